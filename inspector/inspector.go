@@ -7,9 +7,14 @@ type Inspector interface {
     Views(dbName string) ([]string, error)
     Triggers(dbName string) ([]string, error)
     Procedures(dbName string) ([]string, error)
+    Functions(dbName string) ([]string, error)
+    Events(dbName string) ([]string, error)
+    Databases() ([]string, error)
+    DatabaseCharset(dbName string) (charset, collation string, err error)
     ShowCreateTable(tableName string) (string, error)
     MakeCreateTableQuery(tableName string, columnInfo map[string]*Column) string
     DropTableQuery(tableName string) string
+    TruncateTableQuery(tableName string) string
 
     ShowCreateTrigger(triggerName string) (string, error)
     DropTriggerQuery(triggerName string) string
@@ -20,11 +25,24 @@ type Inspector interface {
     ShowCreateProcedure(procName string) (string, error)
     DropProcedureQuery(procName string) string
 
+    ShowCreateFunction(funcName string) (string, error)
+    DropFunctionQuery(funcName string) string
+
+    ShowCreateEvent(eventName string) (string, error)
+    DropEventQuery(eventName string) string
+
     ColumnTypes(tableName string) (map[string]*Column, error)
 
+    ChecksumQuery(tableName string, columnInfo map[string]*Column, condition, algorithm string) (string, error)
+
     FindPrimaryColumn(tableName string, useAnyIndex bool) (string, error)
-    GetMinMaxValues(tableName, column string) (min, max string, err error)
-    EstimateCount(tableName, column string) (int64, error)
+    KeyColumns(tableName string) ([]string, error)
+    UniqueColumns(tableName string) ([]string, error)
+    ChunkColumns(tableName string) ([]*Column, error)
+    KeyBoundary(tableName string, columns []*Column, where string, after []string, offset int64) ([]string, error)
+    GetMinMaxValues(tableName, column, where string) (min, max string, err error)
+    EstimateCount(tableName, column, where string) (int64, error)
+    LimitCondition(tableName, where string, limit int64) (string, error)
 }
 
 type RowCallback func(tableName string, rowValues []interface{}) error
@@ -38,6 +56,12 @@ type Column struct {
     SqlType    string
     Length     int
     Attributes string
+    Collation  string // collation of text column
+    Nullable   bool
+}
+
+func (c *Column)IsBlob() bool {
+    return c.isBlob
 }
 
 type ByIndex []*Column
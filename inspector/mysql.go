@@ -81,7 +81,7 @@ func (i *mysqlInspector)Views(dbName string) ([]string, error) {
     return views, nil
 }
 func (i *mysqlInspector)Triggers(dbName string) ([]string, error) {
-    query := "SHOW TRIGGERS FROM " + dbName
+    query := fmt.Sprintf("SHOW TRIGGERS FROM `%s`", dbName)
     rows, err := i.db.Query(query)
 
     if err != nil {
@@ -138,6 +138,105 @@ func (i *mysqlInspector)Procedures(dbName string) ([]string, error) {
 
     return procedures, nil
 }
+func (i *mysqlInspector)Functions(dbName string) ([]string, error) {
+    query := `
+        SELECT
+            SPECIFIC_NAME AS function_name
+        FROM
+            INFORMATION_SCHEMA.ROUTINES
+        WHERE
+            ROUTINE_TYPE='FUNCTION'
+            AND ROUTINE_SCHEMA=?
+    `
+
+    rows, err := i.db.Query(query, dbName)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var functions []string
+
+    for rows.Next() {
+        var routineName string
+        if err := rows.Scan(&routineName); err != nil {
+            return nil, err
+        }
+
+        log.Debugf("Found function: %v", routineName)
+        functions = append(functions, routineName)
+    }
+
+    return functions, rows.Err()
+}
+func (i *mysqlInspector)Events(dbName string) ([]string, error) {
+    query := `
+        SELECT
+            EVENT_NAME
+        FROM
+            INFORMATION_SCHEMA.EVENTS
+        WHERE
+            EVENT_SCHEMA=?
+    `
+
+    rows, err := i.db.Query(query, dbName)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var events []string
+
+    for rows.Next() {
+        var eventName string
+        if err := rows.Scan(&eventName); err != nil {
+            return nil, err
+        }
+
+        log.Debugf("Found event: %v", eventName)
+        events = append(events, eventName)
+    }
+
+    return events, rows.Err()
+}
+func (i *mysqlInspector)Databases() ([]string, error) {
+    rows, err := i.db.Query("SHOW DATABASES")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var databases []string
+
+    for rows.Next() {
+        var dbName string
+        if err := rows.Scan(&dbName); err != nil {
+            return nil, err
+        }
+
+        databases = append(databases, dbName)
+    }
+
+    return databases, rows.Err()
+}
+// Default character set and collation of database
+func (i *mysqlInspector)DatabaseCharset(dbName string) (string, string, error) {
+    query := `
+        SELECT
+            DEFAULT_CHARACTER_SET_NAME, DEFAULT_COLLATION_NAME
+        FROM
+            INFORMATION_SCHEMA.SCHEMATA
+        WHERE
+            SCHEMA_NAME=?
+    `
+
+    var charset, collation string
+    if err := i.db.QueryRow(query, dbName).Scan(&charset, &collation); err != nil {
+        return "", "", err
+    }
+
+    return charset, collation, nil
+}
 func (i *mysqlInspector)ShowCreateTable(tableName string) (string, error) {
     query := fmt.Sprintf("SHOW CREATE TABLE `%v`", tableName)
     row := i.db.QueryRow(query)
@@ -203,7 +302,7 @@ func (i *mysqlInspector)ShowCreateView(viewName string) (string, error) {
     return createViewSql, nil
 }
 func (i *mysqlInspector)ColumnTypes(tableName string) (map[string]*Column, error) {
-    query := fmt.Sprintf("SHOW COLUMNS FROM `%v`", tableName)
+    query := fmt.Sprintf("SHOW FULL COLUMNS FROM `%v`", tableName)
 
     rows, err := i.db.Query(query)
 
@@ -214,18 +313,18 @@ func (i *mysqlInspector)ColumnTypes(tableName string) (map[string]*Column, error
     columnTypes := make(map[string]*Column)
     rowIndex := 0
     for rows.Next() {
-        var field, colType, isNull, key, extra string
-        var defaultValue sql.NullString
+        var field, colType, isNull, key, extra, privileges, comment string
+        var collation, defaultValue sql.NullString
 
-        err := rows.Scan(&field, &colType, &isNull, &key, &defaultValue, &extra)
+        err := rows.Scan(&field, &colType, &collation, &isNull, &key, &defaultValue, &extra, &privileges, &comment)
 
         if err != nil {
-            panic(err)
             return nil, err
         }
 
         col := makeColumn(field, rowIndex, colType)
         col.parseColumnType(isNull, key, extra, defaultValue)
+        col.Collation = collation.String
         columnTypes[field] = col
         rowIndex += 1
     }
@@ -241,6 +340,16 @@ func makeColumn(field string, index int, sqlType string) *Column {
     }
 }
 
+// MakeColumn makes column of sql type like "varbinary(16)" or "int(11) unsigned", as SHOW FULL COLUMNS describes it
+func MakeColumn(name string, index int, sqlType string, nullable bool) *Column {
+    isNull := "NO"
+    if nullable {
+        isNull = "YES"
+    }
+
+    return makeColumn(name, index, sqlType).parseColumnType(isNull, "", "", sql.NullString{})
+}
+
 func (col *Column)parseColumnType(isNull, key, extra string, defaultValue sql.NullString) *Column {
     colTypeParts := strings.Split(col.SqlType, " ")
 
@@ -270,17 +379,28 @@ func (col *Column)parseColumnType(isNull, key, extra string, defaultValue sql.Nu
         col.isBlob = true
     }
 
+    col.Nullable = isNull == "YES"
+
     return col
 }
 func (i *mysqlInspector)DropTableQuery(tableName string) string {
     return fmt.Sprintf("DROP TABLE IF EXISTS `%s`;\n", tableName)
 }
+func (i *mysqlInspector)TruncateTableQuery(tableName string) string {
+    return fmt.Sprintf("TRUNCATE TABLE `%s`", tableName)
+}
 func (i *mysqlInspector)DropViewQuery(viewName string) string {
     return fmt.Sprintf("DROP VIEW IF EXISTS `%s`", viewName)
 }
 func (i *mysqlInspector)DropProcedureQuery(procName string) string {
     return fmt.Sprintf("DROP PROCEDURE IF EXISTS `%s`", procName)
 }
+func (i *mysqlInspector)DropFunctionQuery(funcName string) string {
+    return fmt.Sprintf("DROP FUNCTION IF EXISTS `%s`", funcName)
+}
+func (i *mysqlInspector)DropEventQuery(eventName string) string {
+    return fmt.Sprintf("DROP EVENT IF EXISTS `%s`", eventName)
+}
 func (i *mysqlInspector)MakeCreateTableQuery(tableName string, columnInfo map[string]*Column) string {
     var sqlBuffer bytes.Buffer
 
@@ -311,6 +431,67 @@ func (i *mysqlInspector)ShowCreateProcedure(procName string) (string, error) {
 
     return createProcedureSql, nil
 }
+func (i *mysqlInspector)ShowCreateFunction(funcName string) (string, error) {
+    query := fmt.Sprintf("SHOW CREATE FUNCTION `%s`", funcName)
+    row := i.db.QueryRow(query)
+
+    var _1, _2, createFunctionSql, _4, _5, _6 string
+
+    err := row.Scan(&_1, &_2, &createFunctionSql, &_4, &_5, &_6)
+    if err != nil {
+        return "", err
+    }
+
+    return createFunctionSql, nil
+}
+func (i *mysqlInspector)ShowCreateEvent(eventName string) (string, error) {
+    query := fmt.Sprintf("SHOW CREATE EVENT `%s`", eventName)
+    row := i.db.QueryRow(query)
+
+    // Event, sql_mode, time_zone, Create Event, character_set_client, collation_connection, Database Collation
+    var _1, _2, _3, createEventSql, _5, _6, _7 string
+
+    err := row.Scan(&_1, &_2, &_3, &createEventSql, &_5, &_6, &_7)
+    if err != nil {
+        return "", err
+    }
+
+    return createEventSql, nil
+}
+// Query returns count of rows and aggregated checksum of all rows matched by condition.
+// Checksum doesn't depend on rows order, so it may be compared between servers
+func (i *mysqlInspector)ChecksumQuery(tableName string, columnInfo map[string]*Column, condition, algorithm string) (string, error) {
+    sortedColumns := SortColumnsByIndex(columnInfo)
+
+    colNames := make([]string, len(sortedColumns))
+    nullFlags := make([]string, len(sortedColumns))
+    for j, col := range sortedColumns {
+        colNames[j] = fmt.Sprintf("`%s`", col.Name)
+        nullFlags[j] = fmt.Sprintf("ISNULL(`%s`)", col.Name)
+    }
+
+    // CONCAT_WS skips NULL values, so NULL and empty string are distinguished by null flags
+    rowExpr := fmt.Sprintf("CONCAT_WS('#', %s, CONCAT(%s))", strings.Join(colNames, ", "), strings.Join(nullFlags, ", "))
+
+    var checksumExpr string
+    switch algorithm {
+    case "", "crc32":
+        checksumExpr = fmt.Sprintf("LOWER(CONV(COALESCE(BIT_XOR(CRC32(%s)), 0), 10, 16))", rowExpr)
+    case "md5":
+        // BIT_XOR works with 64-bit integers, so md5 is aggregated by halves
+        halfExpr := "LPAD(LOWER(CONV(COALESCE(BIT_XOR(CAST(CONV(SUBSTRING(MD5(%s), %d, 16), 16, 10) AS UNSIGNED)), 0), 10, 16)), 16, '0')"
+        checksumExpr = fmt.Sprintf("CONCAT(%s, %s)", fmt.Sprintf(halfExpr, rowExpr, 1), fmt.Sprintf(halfExpr, rowExpr, 17))
+    default:
+        return "", fmt.Errorf("Unknown checksum algorithm '%s'", algorithm)
+    }
+
+    var whereCond string
+    if condition != "" {
+        whereCond = fmt.Sprintf(" WHERE %s", condition)
+    }
+
+    return fmt.Sprintf("SELECT /*!40001 SQL_NO_CACHE */ COUNT(*), %s FROM `%s`%s", checksumExpr, tableName, whereCond), nil
+}
 // Тут весьма унылый код (спасибо go-database-sql!), который ищет в таблице колонку с наилучшим индексом
 func (i *mysqlInspector)FindPrimaryColumn(tableName string, useAnyIndex bool) (string, error) {
     query := fmt.Sprintf("SHOW INDEX FROM `%s`", tableName)
@@ -364,8 +545,79 @@ func (i *mysqlInspector)FindPrimaryColumn(tableName string, useAnyIndex bool) (s
 
     return field, nil
 }
-func (i *mysqlInspector)GetMinMaxValues(tableName, column string) (min, max string, err error) {
-    query := fmt.Sprintf("SELECT /*!40001 SQL_NO_CACHE */ IFNULL(MIN(`%s`), 0), IFNULL(MAX(`%s`), 0) FROM `%s`", column, column, tableName)
+// KeyColumns returns columns of primary key or of first unique key without nullable columns.
+// Rows of table are identified by these columns. Nil is returned if table has no such key
+func (i *mysqlInspector)KeyColumns(tableName string) ([]string, error) {
+    query := fmt.Sprintf("SHOW INDEX FROM `%s`", tableName)
+
+    dataSet, _, err := i.querySimple(query)
+    if err != nil {
+        return nil, err
+    }
+
+    keys := make(map[string][]string)
+    nullableKeys := make(map[string]bool)
+    keyNames := make([]string, 0)
+
+    // rows are ordered by key and position in key
+    for _, row := range dataSet {
+        if row[1] != "0" {
+            continue
+        }
+
+        keyName := row[2]
+        if _, ok := keys[keyName]; !ok {
+            keyNames = append(keyNames, keyName)
+        }
+
+        keys[keyName] = append(keys[keyName], row[4])
+
+        if len(row) > 9 && row[9] == "YES" {
+            nullableKeys[keyName] = true
+        }
+    }
+
+    if columns, ok := keys["PRIMARY"]; ok {
+        return columns, nil
+    }
+
+    for _, keyName := range keyNames {
+        if !nullableKeys[keyName] {
+            return keys[keyName], nil
+        }
+    }
+
+    return nil, nil
+}
+// Columns of primary and all unique keys of table
+func (i *mysqlInspector)UniqueColumns(tableName string) ([]string, error) {
+    query := fmt.Sprintf("SHOW INDEX FROM `%s`", tableName)
+
+    dataSet, _, err := i.querySimple(query)
+    if err != nil {
+        return nil, err
+    }
+
+    columns := make([]string, 0)
+    for _, row := range dataSet {
+        if row[1] != "0" {
+            continue
+        }
+
+        found := false
+        for _, column := range columns {
+            found = found || column == row[4]
+        }
+
+        if !found {
+            columns = append(columns, row[4])
+        }
+    }
+
+    return columns, nil
+}
+func (i *mysqlInspector)GetMinMaxValues(tableName, column, where string) (min, max string, err error) {
+    query := fmt.Sprintf("SELECT /*!40001 SQL_NO_CACHE */ IFNULL(MIN(`%s`), 0), IFNULL(MAX(`%s`), 0) FROM `%s`%s", column, column, tableName, whereClause(where))
 
     row := i.db.QueryRow(query)
     err = row.Scan(&min, &max)
@@ -376,12 +628,13 @@ func (i *mysqlInspector)GetMinMaxValues(tableName, column string) (min, max stri
 
     return
 }
-func (i *mysqlInspector)EstimateCount(tableName, column string) (int64, error) {
-    if column == "" {
-        column = "*"
+func (i *mysqlInspector)EstimateCount(tableName, column, where string) (int64, error) {
+    selectExpr := "*"
+    if column != "" {
+        selectExpr = fmt.Sprintf("`%s`", column)
     }
 
-    query := fmt.Sprintf("EXPLAIN SELECT `%s` FROM `%s`", column, tableName)
+    query := fmt.Sprintf("EXPLAIN SELECT %s FROM `%s`%s", selectExpr, tableName, whereClause(where))
 
     dataSet, columnNames, err := i.querySimple(query)
     if err != nil {
@@ -396,6 +649,11 @@ func (i *mysqlInspector)EstimateCount(tableName, column string) (int64, error) {
         }
     }
 
+    // EXPLAIN of joined or impossible where may have NULL rows
+    if dataSet[0][index] == "" {
+        return 0, nil
+    }
+
     count, err := strconv.ParseInt(dataSet[0][index], 10, 64)
     if err != nil {
         return 0, err
@@ -404,6 +662,247 @@ func (i *mysqlInspector)EstimateCount(tableName, column string) (int64, error) {
     return count, nil
 
 }
+// LimitCondition returns condition, which selects last limit rows of table (matching where) by key columns.
+// Empty condition is returned if table has not more rows
+func (i *mysqlInspector)LimitCondition(tableName, where string, limit int64) (string, error) {
+    keyColumns, err := i.KeyColumns(tableName)
+    if err != nil {
+        return "", err
+    }
+
+    if len(keyColumns) == 0 {
+        return "", fmt.Errorf("[inspector] Table %s has no primary or unique key, so its rows cannot be limited", tableName)
+    }
+
+    columns, err := i.ColumnTypes(tableName)
+    if err != nil {
+        return "", err
+    }
+
+    names := make([]string, len(keyColumns))
+    order := make([]string, len(keyColumns))
+    for j, name := range keyColumns {
+        names[j] = fmt.Sprintf("`%s`", name)
+        order[j] = fmt.Sprintf("`%s` DESC", name)
+    }
+
+    query := fmt.Sprintf("SELECT /*!40001 SQL_NO_CACHE */ %s FROM `%s`%s ORDER BY %s LIMIT 1 OFFSET %d",
+        strings.Join(names, ", "), tableName, whereClause(where), strings.Join(order, ", "), limit - 1)
+
+    dataSet, _, err := i.querySimple(query)
+    if err != nil {
+        return "", err
+    }
+
+    if len(dataSet) == 0 {
+        return "", nil
+    }
+
+    keys := make([]*Column, len(keyColumns))
+    for j, name := range keyColumns {
+        if keys[j] = columns[name]; keys[j] == nil {
+            keys[j] = &Column{Name: name}
+        }
+    }
+
+    return KeyCondition(keys, dataSet[0], ">="), nil
+}
+// ChunkColumns returns columns of index, by which rows of table are split into chunks: primary key,
+// unique key without nullable columns or index with the highest cardinality. Indexes on prefixes of columns
+// and on columns, which are compared differently than ordered (enum, set, bit), are not used.
+// Nil is returned if table has no suitable index
+func (i *mysqlInspector)ChunkColumns(tableName string) ([]*Column, error) {
+    query := fmt.Sprintf("SHOW INDEX FROM `%s`", tableName)
+
+    dataSet, _, err := i.querySimple(query)
+    if err != nil {
+        return nil, err
+    }
+
+    columns, err := i.ColumnTypes(tableName)
+    if err != nil {
+        return nil, err
+    }
+
+    type index struct {
+        unique      bool
+        suitable    bool
+        nullable    bool
+        columns     []*Column
+        cardinality int64
+    }
+
+    indexes := make(map[string]*index)
+    indexNames := make([]string, 0)
+
+    // rows are ordered by index and position in index
+    for _, row := range dataSet {
+        indexName := row[2]
+
+        idx, ok := indexes[indexName]
+        if !ok {
+            idx = &index{unique: row[1] == "0", suitable: true}
+            indexes[indexName] = idx
+            indexNames = append(indexNames, indexName)
+        }
+
+        column := columns[row[4]]
+        if column == nil || row[7] != "" || chunkUnsuitableTypes[column.ColType] || column.IsBlob() && column.ColType != "binary" && column.ColType != "varbinary" {
+            idx.suitable = false
+            continue
+        }
+
+        if len(row) > 10 && (row[10] == "FULLTEXT" || row[10] == "SPATIAL") {
+            idx.suitable = false
+        }
+
+        idx.nullable = idx.nullable || column.Nullable
+        idx.columns = append(idx.columns, column)
+
+        // cardinality of last column is count of distinct values of whole index
+        if cardinality, err := strconv.ParseInt(row[6], 10, 64); err == nil {
+            idx.cardinality = cardinality
+        }
+    }
+
+    if idx, ok := indexes["PRIMARY"]; ok && idx.suitable {
+        return idx.columns, nil
+    }
+
+    for _, indexName := range indexNames {
+        if idx := indexes[indexName]; idx.suitable && idx.unique && !idx.nullable {
+            return idx.columns, nil
+        }
+    }
+
+    var best *index
+    for _, indexName := range indexNames {
+        if idx := indexes[indexName]; idx.suitable && (best == nil || idx.cardinality > best.cardinality) {
+            best = idx
+        }
+    }
+
+    if best == nil {
+        return nil, nil
+    }
+
+    return best.columns, nil
+}
+// KeyBoundary returns values of columns of row at offset in order of columns. Rows match where, have no NULL
+// in columns and follow after given values (all rows if after is nil). Nil is returned if there is no such row
+func (i *mysqlInspector)KeyBoundary(tableName string, columns []*Column, where string, after []string, offset int64) ([]string, error) {
+    names := make([]string, len(columns))
+    for j, column := range columns {
+        names[j] = fmt.Sprintf("`%s`", column.Name)
+    }
+
+    conditions := make([]string, 0, 3)
+    if where != "" {
+        conditions = append(conditions, fmt.Sprintf("(%s)", where))
+    }
+    if nullCondition := KeyNullCondition(columns); nullCondition != "" {
+        conditions = append(conditions, fmt.Sprintf("NOT (%s)", nullCondition))
+    }
+    if after != nil {
+        conditions = append(conditions, KeyCondition(columns, after, ">"))
+    }
+
+    query := fmt.Sprintf("SELECT /*!40001 SQL_NO_CACHE */ %s FROM `%s`%s ORDER BY %s LIMIT 1 OFFSET %d",
+        strings.Join(names, ", "), tableName, whereClause(strings.Join(conditions, " AND ")), strings.Join(names, ", "), offset)
+
+    dataSet, _, err := i.querySimple(query)
+    if err != nil {
+        return nil, err
+    }
+
+    if len(dataSet) == 0 {
+        return nil, nil
+    }
+
+    return dataSet[0], nil
+}
+// KeyCondition compares columns with values in order of columns: (`a` > 'x' OR (`a` = 'x' AND `b` >= 1)).
+// Row constructor (`a`, `b`) >= ('x', 1) is not used, mysql before 5.7.3 can't use index for it and scans whole table
+func KeyCondition(columns []*Column, values []string, operator string) string {
+    names := make([]string, len(columns))
+    literals := make([]string, len(columns))
+    for j, column := range columns {
+        names[j] = fmt.Sprintf("`%s`", column.Name)
+        literals[j] = QuoteColumnValue(column, values[j])
+    }
+
+    if len(columns) == 1 {
+        return fmt.Sprintf("%s %s %s", names[0], operator, literals[0])
+    }
+
+    // previous columns are equal, column is strictly compared, the last one by operator
+    strict := strings.TrimSuffix(operator, "=")
+    alternatives := make([]string, len(columns))
+    for j := range columns {
+        parts := make([]string, 0, j + 1)
+        for k := 0; k < j; k++ {
+            parts = append(parts, fmt.Sprintf("%s = %s", names[k], literals[k]))
+        }
+
+        if j == len(columns) - 1 {
+            parts = append(parts, fmt.Sprintf("%s %s %s", names[j], operator, literals[j]))
+        } else {
+            parts = append(parts, fmt.Sprintf("%s %s %s", names[j], strict, literals[j]))
+        }
+
+        alternatives[j] = strings.Join(parts, " AND ")
+        if j > 0 {
+            alternatives[j] = "(" + alternatives[j] + ")"
+        }
+    }
+
+    return "(" + strings.Join(alternatives, " OR ") + ")"
+}
+// KeyNullCondition matches rows with NULL in any of columns, empty if columns are not nullable
+func KeyNullCondition(columns []*Column) string {
+    conditions := make([]string, 0)
+    for _, column := range columns {
+        if column.Nullable {
+            conditions = append(conditions, fmt.Sprintf("`%s` IS NULL", column.Name))
+        }
+    }
+
+    return strings.Join(conditions, " OR ")
+}
+// QuoteColumnValue returns sql literal of column value. Text is compared by collation of column,
+// as connection may use other character set
+func QuoteColumnValue(column *Column, value string) string {
+    if column.IsNumeric && column.ColType != "bit" {
+        return QuoteValue(value, true)
+    }
+
+    if column.Collation != "" && !column.IsBlob() {
+        charset := strings.SplitN(column.Collation, "_", 2)[0]
+
+        return fmt.Sprintf("_%s%s COLLATE %s", charset, QuoteValue(value, false), column.Collation)
+    }
+
+    return QuoteValue(value, false)
+}
+// QuoteValue returns sql literal of value. Strings are quoted and escaped
+func QuoteValue(value string, numeric bool) string {
+    if numeric {
+        if _, err := strconv.ParseFloat(value, 64); err == nil {
+            return value
+        }
+    }
+
+    replacer := strings.NewReplacer("\\", "\\\\", "'", "\\'", "\x00", "\\0", "\n", "\\n", "\r", "\\r", "\x1a", "\\Z")
+
+    return "'" + replacer.Replace(value) + "'"
+}
+func whereClause(where string) string {
+    if where == "" {
+        return ""
+    }
+
+    return fmt.Sprintf(" WHERE %s", where)
+}
 
 func (i *mysqlInspector)querySimple(query string) ([][]string, []string, error) {
     rows, err := i.db.Query(query)
@@ -471,6 +970,15 @@ var numericalTypes = map[string]bool{
     "numeric": true,
 }
 
+// Values of these types are compared not in order of index, so rows cannot be split by them
+var chunkUnsuitableTypes = map[string]bool{
+    "enum": true,
+    "set": true,
+    "bit": true,
+    "json": true,
+    "geometry": true,
+}
+
 var blobTypes = map[string]bool{
     "tinyblob": true,
     "blob": true,
@@ -0,0 +1,140 @@
+package inspector
+
+import (
+    "database/sql/driver"
+    "github.com/LTD-Beget/besync/internal/fakesql"
+    "reflect"
+    "testing"
+)
+
+var (
+    intColumn      = &Column{Name: "id", IsNumeric: true, ColType: "int"}
+    nullableColumn = &Column{Name: "parent", IsNumeric: true, ColType: "int", Nullable: true}
+    textColumn     = &Column{Name: "name", ColType: "varchar", Collation: "utf8mb4_general_ci"}
+    binaryColumn   = &Column{Name: "hash", ColType: "varbinary", isBlob: true, Collation: "binary"}
+    bitColumn      = &Column{Name: "flags", IsNumeric: true, ColType: "bit"}
+)
+
+func TestQuoteColumnValue(t *testing.T) {
+    tests := []struct {
+        column   *Column
+        value    string
+        expected string
+    }{
+        {intColumn, "42", "42"},
+        {intColumn, "-1.5e3", "-1.5e3"},
+        {intColumn, "1 OR 1=1", "'1 OR 1=1'"},
+        {bitColumn, "\x01", "'\x01'"},
+        {textColumn, "abc", "_utf8mb4'abc' COLLATE utf8mb4_general_ci"},
+        {textColumn, "it's", "_utf8mb4'it\\'s' COLLATE utf8mb4_general_ci"},
+        {textColumn, "a\\b", "_utf8mb4'a\\\\b' COLLATE utf8mb4_general_ci"},
+        {textColumn, "\x00\n\r\x1a", "_utf8mb4'\\0\\n\\r\\Z' COLLATE utf8mb4_general_ci"},
+        {binaryColumn, "\xff'", "'\xff\\''"},
+        {&Column{Name: "code", ColType: "char"}, "x", "'x'"},
+    }
+
+    for _, test := range tests {
+        if result := QuoteColumnValue(test.column, test.value); result != test.expected {
+            t.Errorf("QuoteColumnValue(%s, %q) = %s, expected %s", test.column.ColType, test.value, result, test.expected)
+        }
+    }
+}
+
+func TestKeyCondition(t *testing.T) {
+    tests := []struct {
+        columns  []*Column
+        values   []string
+        operator string
+        expected string
+    }{
+        {[]*Column{intColumn}, []string{"10"}, ">=", "`id` >= 10"},
+        {[]*Column{textColumn}, []string{"O'Brien"}, "<", "`name` < _utf8mb4'O\\'Brien' COLLATE utf8mb4_general_ci"},
+        {[]*Column{intColumn, textColumn}, []string{"1", "b"}, ">",
+            "(`id` > 1 OR (`id` = 1 AND `name` > _utf8mb4'b' COLLATE utf8mb4_general_ci))"},
+        {[]*Column{intColumn, textColumn}, []string{"1", "b"}, ">=",
+            "(`id` > 1 OR (`id` = 1 AND `name` >= _utf8mb4'b' COLLATE utf8mb4_general_ci))"},
+        {[]*Column{textColumn, binaryColumn, intColumn}, []string{"", "\x00", "7"}, "<",
+            "(`name` < _utf8mb4'' COLLATE utf8mb4_general_ci OR (`name` = _utf8mb4'' COLLATE utf8mb4_general_ci AND `hash` < '\\0') OR " +
+                "(`name` = _utf8mb4'' COLLATE utf8mb4_general_ci AND `hash` = '\\0' AND `id` < 7))"},
+    }
+
+    for _, test := range tests {
+        if result := KeyCondition(test.columns, test.values, test.operator); result != test.expected {
+            t.Errorf("KeyCondition(%v) = %s, expected %s", test.values, result, test.expected)
+        }
+    }
+}
+
+func TestKeyNullCondition(t *testing.T) {
+    tests := []struct {
+        columns  []*Column
+        expected string
+    }{
+        {[]*Column{intColumn}, ""},
+        {[]*Column{nullableColumn}, "`parent` IS NULL"},
+        {[]*Column{intColumn, nullableColumn, &Column{Name: "b", Nullable: true}}, "`parent` IS NULL OR `b` IS NULL"},
+    }
+
+    for _, test := range tests {
+        if result := KeyNullCondition(test.columns); result != test.expected {
+            t.Errorf("KeyNullCondition(%d columns) = %s, expected %s", len(test.columns), result, test.expected)
+        }
+    }
+}
+
+func TestKeyBoundary(t *testing.T) {
+    columns := []*Column{intColumn, &Column{Name: "name", ColType: "varchar", Collation: "utf8_bin", Nullable: true}}
+
+    tests := []struct {
+        where    string
+        after    []string
+        offset   int64
+        result   [][]driver.Value
+        query    string
+        boundary []string
+    }{
+        {
+            offset: 999,
+            result: [][]driver.Value{{[]byte("1000"), []byte("x")}},
+            query: "SELECT /*!40001 SQL_NO_CACHE */ `id`, `name` FROM `t` WHERE NOT (`name` IS NULL) ORDER BY `id`, `name` LIMIT 1 OFFSET 999",
+            boundary: []string{"1000", "x"},
+        },
+        {
+            where: "`id` < 5000",
+            after: []string{"1000", "it's"},
+            offset: 998,
+            result: [][]driver.Value{{[]byte("2000"), []byte("")}},
+            query: "SELECT /*!40001 SQL_NO_CACHE */ `id`, `name` FROM `t` WHERE (`id` < 5000) AND NOT (`name` IS NULL) AND " +
+                "(`id` > 1000 OR (`id` = 1000 AND `name` > _utf8'it\\'s' COLLATE utf8_bin)) ORDER BY `id`, `name` LIMIT 1 OFFSET 998",
+            boundary: []string{"2000", ""},
+        },
+        {
+            after: []string{"2000", ""},
+            offset: 998,
+            query: "SELECT /*!40001 SQL_NO_CACHE */ `id`, `name` FROM `t` WHERE NOT (`name` IS NULL) AND " +
+                "(`id` > 2000 OR (`id` = 2000 AND `name` > _utf8'' COLLATE utf8_bin)) ORDER BY `id`, `name` LIMIT 1 OFFSET 998",
+        },
+    }
+
+    for _, test := range tests {
+        var queries []string
+        db, err := fakesql.Open(fakesql.Recorder(&queries, []string{"id", "name"}, test.result))
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        boundary, err := MakeMysqlInspector(db, nil).KeyBoundary("t", columns, test.where, test.after, test.offset)
+        db.Close()
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if len(queries) != 1 || queries[0] != test.query {
+            t.Errorf("KeyBoundary queries %v, expected [%s]", queries, test.query)
+        }
+
+        if !reflect.DeepEqual(boundary, test.boundary) {
+            t.Errorf("KeyBoundary = %#v, expected %#v", boundary, test.boundary)
+        }
+    }
+}
@@ -0,0 +1,117 @@
+// Package fakesql is database/sql driver for tests. Queries of every opened db are answered by its handler
+package fakesql
+
+import (
+    "database/sql"
+    "database/sql/driver"
+    "errors"
+    "io"
+    "strconv"
+    "sync"
+)
+
+const DRIVER_NAME = "fakesql"
+
+// Handler answers query with columns and rows of result. Result of Exec is ignored
+type Handler func(query string, args []driver.Value) ([]string, [][]driver.Value, error)
+
+var (
+    mutex    = &sync.Mutex{}
+    handlers = make(map[string]Handler)
+    opened   int
+)
+
+func init() {
+    sql.Register(DRIVER_NAME, fakeDriver{})
+}
+
+// Open returns db, which queries are passed to handler
+func Open(handler Handler) (*sql.DB, error) {
+    mutex.Lock()
+    opened++
+    name := strconv.Itoa(opened)
+    handlers[name] = handler
+    mutex.Unlock()
+
+    return sql.Open(DRIVER_NAME, name)
+}
+
+// Recorder returns handler, which records queries and answers them with the same result
+func Recorder(queries *[]string, columns []string, rows [][]driver.Value) Handler {
+    return func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+        *queries = append(*queries, query)
+
+        return columns, rows, nil
+    }
+}
+
+type fakeDriver struct{}
+type fakeConn struct {
+    handler Handler
+}
+type fakeStmt struct {
+    handler Handler
+    query   string
+}
+type fakeRows struct {
+    columns []string
+    rows    [][]driver.Value
+}
+
+func (fakeDriver)Open(name string) (driver.Conn, error) {
+    mutex.Lock()
+    defer mutex.Unlock()
+
+    handler, ok := handlers[name]
+    if !ok {
+        return nil, errors.New("Unknown fake db " + name)
+    }
+
+    return &fakeConn{handler: handler}, nil
+}
+func (c *fakeConn)Prepare(query string) (driver.Stmt, error) {
+    return &fakeStmt{handler: c.handler, query: query}, nil
+}
+func (c *fakeConn)Close() error {
+    return nil
+}
+func (c *fakeConn)Begin() (driver.Tx, error) {
+    return nil, errors.New("Transactions are not supported")
+}
+func (s *fakeStmt)Close() error {
+    return nil
+}
+func (s *fakeStmt)NumInput() int {
+    return -1
+}
+func (s *fakeStmt)Exec(args []driver.Value) (driver.Result, error) {
+    if _, _, err := s.handler(s.query, args); err != nil {
+        return nil, err
+    }
+
+    return driver.RowsAffected(0), nil
+}
+func (s *fakeStmt)Query(args []driver.Value) (driver.Rows, error) {
+    columns, rows, err := s.handler(s.query, args)
+    if err != nil {
+        return nil, err
+    }
+
+    return &fakeRows{columns: columns, rows: rows}, nil
+}
+func (r *fakeRows)Columns() []string {
+    return r.columns
+}
+func (r *fakeRows)Close() error {
+    return nil
+}
+func (r *fakeRows)Next(dest []driver.Value) error {
+    if len(r.rows) == 0 {
+        return io.EOF
+    }
+
+    copy(dest, r.rows[0])
+    r.rows = r.rows[1:]
+
+    return nil
+}
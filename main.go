@@ -8,6 +8,10 @@ import (
     "encoding/json"
     "flag"
     "fmt"
+    "time"
+    "os/signal"
+    "text/tabwriter"
+    "syscall"
 )
 
 var version string
@@ -17,21 +21,52 @@ type Config struct {
     Mode                 string `envconfig:"MODE" default:"http"`
     ModeServerListenHost string `envconfig:"SERVER_LISTEN_HOST" default:"localhost"`
     ModeServerListenPort int    `envconfig:"SERVER_LISTEN_PORT" default:"8080"`
+    ModeServerTLSCert    string
+    ModeServerTLSKey     string
+    ModeServerClientCA   string
+    ModeProxyTLSCert     string
+    ModeProxyTLSKey      string
+    ModeServerAuthConfig string
     ModeExportConfigFile string `envconfig:"EXPORT_CONFIG_FILE"`
+    ModeExportResumeId   int64
+    ModeListStatus       string
+    ModeListType         string
+    ModeListFrom         string
+    ModeListTo           string
+    ModeListLimit        int
+    ModeListOffset       int
     Debug                bool
 }
 
 var config Config
 
+// Time which cli waits for delivery of task notifications before exit
+const NOTIFY_WAIT_TIMEOUT = 30 * time.Second
+
 func init() {
-    flag.StringVar(&config.Mode, "mode", "http", "Running mode. May be cli|http")
+    flag.StringVar(&config.Mode, "mode", "http", "Running mode. May be cli|verify|import|list|http")
 
     // http
     flag.StringVar(&config.ModeServerListenHost, "http-host", "localhost", "[http mode] Listen host")
     flag.IntVar(&config.ModeServerListenPort, "http-port", 8080, "[http mode] Listen port")
+    flag.StringVar(&config.ModeServerTLSCert, "http-tls-cert", "", "[http mode] Certificate of https api")
+    flag.StringVar(&config.ModeServerTLSKey, "http-tls-key", "", "[http mode] Key of https api certificate")
+    flag.StringVar(&config.ModeServerClientCA, "http-tls-client-ca", "", "[http mode] CA of required client certificates")
+    flag.StringVar(&config.ModeProxyTLSCert, "proxy-tls-cert", "", "[http mode] Certificate of proxy mysql listeners")
+    flag.StringVar(&config.ModeProxyTLSKey, "proxy-tls-key", "", "[http mode] Key of proxy listeners certificate")
+    flag.StringVar(&config.ModeServerAuthConfig, "http-auth-config", "", "[http mode] Json file with api tokens and HMAC keys")
 
     // export
     flag.StringVar(&config.ModeExportConfigFile, "cli-config", "", "[export mode] Json config path")
+    flag.Int64Var(&config.ModeExportResumeId, "resume", 0, "[export mode] Resume interrupted sync with given id using saved settings")
+
+    // list
+    flag.StringVar(&config.ModeListStatus, "status", "", "[list mode] Comma separated statuses of tasks")
+    flag.StringVar(&config.ModeListType, "type", "", "[list mode] Type of tasks: sync|verify|import")
+    flag.StringVar(&config.ModeListFrom, "from", "", "[list mode] Tasks created at or after this time (2006-01-02 15:04:05)")
+    flag.StringVar(&config.ModeListTo, "to", "", "[list mode] Tasks created before this time (2006-01-02 15:04:05)")
+    flag.IntVar(&config.ModeListLimit, "limit", proxy.TASK_LIST_DEFAULT_LIMIT, "[list mode] Max count of tasks")
+    flag.IntVar(&config.ModeListOffset, "offset", 0, "[list mode] Count of skipped tasks")
 
     flag.BoolVar(&config.Debug, "debug", false, "Enable debug mode")
 
@@ -61,57 +96,214 @@ func init() {
 }
 
 func main() {
+    var settings *proxy.Settings
+
+    // resumed sync takes passwords from config, because they are not saved
+    resumeWithConfig := config.ModeExportResumeId != 0 && config.ModeExportConfigFile != ""
+
+    if (config.Mode == "cli" && (config.ModeExportResumeId == 0 || resumeWithConfig)) || config.Mode == "verify" || config.Mode == "import" {
+        settings = readCliSettings()
+
+        // stdout is used by dump
+        if settings.Output != nil && settings.Output.Path == "-" {
+            log.SetOutput(os.Stderr)
+        }
+    }
+
+    // stdout is used by task list
+    if config.Mode == "list" {
+        log.SetOutput(os.Stderr)
+    }
+
     log.Infof("Beget MySQL dumper starting...")
     log.Infof("Mode is '%s'", config.Mode)
 
-    if config.Mode == "cli" {
-        var file []byte
+    if config.Mode == "cli" || config.Mode == "verify" || config.Mode == "import" {
+        resultCh := make(chan *proxy.ExportStatus, 3)
+
+        var id int64
         var err error
 
-        if config.ModeExportConfigFile == "" {
-            if file, err = ioutil.ReadAll(os.Stdin); err != nil {
-                log.Panicf("Stdin read error: %v\n", err)
+        if config.ModeExportResumeId != 0 {
+            id = config.ModeExportResumeId
+            err = proxy.Manager.ResumeDump(id, settings, resultCh)
+        } else if config.Mode == "verify" {
+            id, err = proxy.Manager.StartVerify(settings, resultCh)
+        } else if config.Mode == "import" {
+            id, err = proxy.Manager.StartImport(settings, resultCh)
+        } else {
+            id, err = proxy.Manager.StartDump(settings, resultCh)
+        }
+
+        if err != nil {
+            log.Panicf("Exporter error: %v", err)
+        }
+
+        log.Infof("Started dump %v", id)
+
+        progressTicker := time.NewTicker(10 * time.Second)
+        defer progressTicker.Stop()
+
+        // cutover of sync which follows source binlog
+        cutoverCh := make(chan os.Signal, 1)
+        signal.Notify(cutoverCh, syscall.SIGUSR1)
+
+        L:
+        for {
+            select {
+            case result := <-resultCh:
+                log.Infof("GOT EXPORT RESULT %+v", result)
+                logVerifyResult(result.Verify)
+
+                switch result.Status {
+                case "started":
+                    log.Infof("Started")
+                case "following":
+                    log.Infof("Following source binlog. Send SIGUSR1 to process %v for cutover", os.Getpid())
+                case "success":
+                    log.Infof("Success!")
+                    break L
+                case "error":
+                    log.Infof("ERROR: %+v", result.Error)
+                    break L
+                case "cancelled":
+                    log.Infof("Cancelled")
+                    break L
+                }
+            case <-cutoverCh:
+                if err := proxy.Manager.Cutover(id); err != nil {
+                    log.Errorf("Cutover error: %v", err)
+                }
+            case <-progressTicker.C:
+                logProgress(proxy.Manager.GetProgress(id))
             }
+        }
 
-            if len(file) == 0 {
-                log.Panicf("Stdin is empty")
+        proxy.Manager.WaitNotifications(id, NOTIFY_WAIT_TIMEOUT)
+    } else if config.Mode == "list" {
+        listTasks()
+    } else if config.Mode == "http" {
+        options := &proxy.ServeOptions{}
+
+        if config.ModeServerTLSCert != "" {
+            options.ApiTLS = &proxy.ServerTLSSettings{
+                CertFile: config.ModeServerTLSCert,
+                KeyFile: config.ModeServerTLSKey,
+                ClientCAFile: config.ModeServerClientCA,
             }
-        } else {
-            if file, err = ioutil.ReadFile(config.ModeExportConfigFile); err != nil {
-                log.Panicf("File error: %v\n", err)
+        }
+
+        if config.ModeProxyTLSCert != "" {
+            options.ProxyTLS = &proxy.ServerTLSSettings{
+                CertFile: config.ModeProxyTLSCert,
+                KeyFile: config.ModeProxyTLSKey,
             }
         }
 
-        settings := &proxy.Settings{}
-        if err := json.Unmarshal(file, settings); err != nil {
-            log.Panicf("Invalid json: %v\n", err)
+        if config.ModeServerAuthConfig != "" {
+            auth, err := proxy.LoadApiAuth(config.ModeServerAuthConfig)
+            if err != nil {
+                log.Panicf("Auth config error: %v", err)
+            }
+
+            options.Auth = auth
         }
 
-        resultCh := make(chan *proxy.ExportStatus, 3)
+        if err := proxy.Serve(config.ModeServerListenHost, config.ModeServerListenPort, options); err != nil {
+            log.Panicf("Server error: %v", err)
+        }
+    }
+}
 
-        id, err := proxy.Manager.StartDump(settings, resultCh)
-        if err != nil {
-            log.Panicf("Exporter error: %v", err)
+func readCliSettings() *proxy.Settings {
+    var file []byte
+    var err error
+
+    if config.ModeExportConfigFile == "" {
+        if file, err = ioutil.ReadAll(os.Stdin); err != nil {
+            log.Panicf("Stdin read error: %v\n", err)
         }
 
-        L:
-        for result := range resultCh {
-            log.Infof("GOT EXPORT RESULT %+v", result)
-
-            switch result.Status {
-            case "starterd":
-                log.Infof("Started")
-            case "success":
-                log.Infof("Success!")
-                break L
-            case "error":
-                log.Infof("ERROR: %+v", result.Error)
-                break L
-            }
+        if len(file) == 0 {
+            log.Panicf("Stdin is empty")
+        }
+    } else {
+        if file, err = ioutil.ReadFile(config.ModeExportConfigFile); err != nil {
+            log.Panicf("File error: %v\n", err)
         }
+    }
 
-        log.Infof("Started dump %v", id)
-    } else if config.Mode == "http" {
-        proxy.Serve(config.ModeServerListenHost, config.ModeServerListenPort)
+    settings := &proxy.Settings{}
+    if err := json.Unmarshal(file, settings); err != nil {
+        log.Panicf("Invalid json: %v\n", err)
+    }
+
+    return settings
+}
+
+func listTasks() {
+    filter, err := proxy.MakeTaskFilter(config.ModeListStatus, config.ModeListType, config.ModeListFrom, config.ModeListTo,
+        config.ModeListLimit, config.ModeListOffset)
+    if err != nil {
+        log.Panicf("Invalid filter: %v", err)
+    }
+
+    list, err := proxy.Manager.ListTasks(filter)
+    if err != nil {
+        log.Panicf("Task list error: %v", err)
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "ID\tTYPE\tSTATUS\tSOURCE\tTARGET\tCREATED\tUPDATED\tDURATION\tERROR")
+
+    for _, task := range list.Tasks {
+        fmt.Fprintf(w, "%v\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+            task.Id, task.Type, task.Status, task.SourceDb, task.TargetDb,
+            task.CreatedAt.Format(proxy.TASK_TIME_FORMAT), task.UpdatedAt.Format(proxy.TASK_TIME_FORMAT),
+            time.Duration(task.DurationSeconds) * time.Second, task.Error)
+    }
+
+    w.Flush()
+
+    fmt.Printf("Shown %v of %v tasks (offset %v)\n", len(list.Tasks), list.Total, list.Offset)
+}
+
+func logVerifyResult(result *proxy.VerifyResult) {
+    if result == nil {
+        return
+    }
+
+    log.Infof("Verify: %v tables; %v chunks; %v chunks differ", result.Tables, result.Chunks, result.ChunksDiffer)
+
+    for _, mismatch := range result.Mismatches {
+        log.Warnf("Verify [%s][%s]: source %v rows (%s); target %v rows (%s)",
+            mismatch.Table, mismatch.Chunk, mismatch.SourceRows, mismatch.SourceChecksum, mismatch.TargetRows, mismatch.TargetChecksum)
+    }
+}
+
+func logProgress(progress *proxy.ExportProgress) {
+    if progress == nil {
+        return
+    }
+
+    eta := "unknown"
+    if progress.EtaSeconds >= 0 {
+        eta = (time.Duration(progress.EtaSeconds) * time.Second).String()
+    }
+
+    log.Infof("Progress: phase %s; rows %v of ~%v; bytes %v; chunks %v/%v; ETA %s",
+        progress.Phase, progress.Rows, progress.EstimatedRows, progress.Bytes, progress.ChunksDone, progress.ChunksTotal, eta)
+
+    if progress.Binlog != nil {
+        log.Infof("Progress: binlog position %s:%v; delay %v sec", progress.Binlog.File, progress.Binlog.Position, progress.DelaySeconds)
+    }
+
+    for tableName, table := range progress.Tables {
+        if table.ChunksDone == table.ChunksTotal {
+            continue
+        }
+
+        log.Infof("Progress [%s]: rows %v of ~%v; bytes %v; chunks %v/%v",
+            tableName, table.Rows, table.EstimatedRows, table.Bytes, table.ChunksDone, table.ChunksTotal)
     }
 }
@@ -0,0 +1,273 @@
+package proxy
+
+import (
+    log "github.com/Sirupsen/logrus"
+    "bytes"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    PERMISSION_SYNC  = "sync"  // start, cancel, resume and cutover of sync, verify and import tasks
+    PERMISSION_PROXY = "proxy" // start and stop of proxies
+    PERMISSION_READ  = "read"  // statuses and lists
+)
+
+const (
+    AUTH_SCHEME_BEARER = "Bearer"
+    AUTH_SCHEME_HMAC   = "HMAC-SHA256"
+)
+
+const (
+    AUTH_HMAC_MAX_SKEW  = 5 * time.Minute // max difference between timestamp of signed request and time of daemon
+    AUTH_HMAC_MAX_NONCE = 64              // max length of nonce of signed request
+)
+
+// Credentials of daemon api clients
+type ApiAuth struct {
+    Tokens   []*ApiToken
+    HmacKeys []*ApiHmacKey
+
+    mutex  sync.Mutex
+    nonces map[string]time.Time // "key id:nonce" of accepted signed requests -> expiration of their timestamp
+}
+
+type ApiToken struct {
+    Name        string
+    Token       string
+    Permissions []string
+}
+
+type ApiHmacKey struct {
+    Name        string
+    KeyId       string
+    Secret      string
+    Permissions []string
+}
+
+// Credentials which are sent by exporter to proxy daemon. Token or HMAC key may be set
+type ApiCredentials struct {
+    Token      string
+    HmacKeyId  string
+    HmacSecret string
+}
+
+// LoadApiAuth reads json file with tokens and HMAC keys
+func LoadApiAuth(path string) (*ApiAuth, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    auth := &ApiAuth{}
+    if err := json.Unmarshal(data, auth); err != nil {
+        return nil, fmt.Errorf("[auth] Invalid auth config: %v", err)
+    }
+
+    for _, token := range auth.Tokens {
+        if token.Token == "" {
+            return nil, fmt.Errorf("[auth] Token '%s' is blank", token.Name)
+        }
+    }
+
+    for _, key := range auth.HmacKeys {
+        if key.KeyId == "" || key.Secret == "" {
+            return nil, fmt.Errorf("[auth] KeyId and Secret of HMAC key '%s' are required", key.Name)
+        }
+    }
+
+    return auth, nil
+}
+
+// Returns name and permissions of client or error if request is not authenticated
+func (a *ApiAuth)authenticate(r *http.Request, body []byte) (string, []string, error) {
+    header := r.Header.Get("Authorization")
+    if header == "" {
+        return "", nil, fmt.Errorf("Authorization is required")
+    }
+
+    parts := strings.SplitN(header, " ", 2)
+    if len(parts) != 2 {
+        return "", nil, fmt.Errorf("Invalid authorization header")
+    }
+
+    switch parts[0] {
+    case AUTH_SCHEME_BEARER:
+        for _, token := range a.Tokens {
+            if subtle.ConstantTimeCompare([]byte(token.Token), []byte(parts[1])) == 1 {
+                return token.Name, token.Permissions, nil
+            }
+        }
+
+        return "", nil, fmt.Errorf("Invalid token")
+    case AUTH_SCHEME_HMAC:
+        return a.authenticateHmac(r, body, parts[1])
+    }
+
+    return "", nil, fmt.Errorf("Unknown authorization scheme '%s'", parts[0])
+}
+func (a *ApiAuth)authenticateHmac(r *http.Request, body []byte, params string) (string, []string, error) {
+    values := make(map[string]string)
+    for _, param := range strings.Split(params, ",") {
+        if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 {
+            values[kv[0]] = kv[1]
+        }
+    }
+
+    timestamp, err := strconv.ParseInt(values["Timestamp"], 10, 64)
+    if err != nil {
+        return "", nil, fmt.Errorf("Invalid timestamp of signature")
+    }
+
+    skew := time.Since(time.Unix(timestamp, 0))
+    if skew > AUTH_HMAC_MAX_SKEW || skew < -AUTH_HMAC_MAX_SKEW {
+        return "", nil, fmt.Errorf("Signature is expired")
+    }
+
+    nonce := values["Nonce"]
+    if nonce == "" || len(nonce) > AUTH_HMAC_MAX_NONCE {
+        return "", nil, fmt.Errorf("Invalid nonce of signature")
+    }
+
+    for _, key := range a.HmacKeys {
+        if key.KeyId != values["KeyId"] {
+            continue
+        }
+
+        expected := signRequest(key.Secret, r.Method, r.URL.RequestURI(), values["Timestamp"], nonce, body)
+        if !hmac.Equal([]byte(expected), []byte(values["Signature"])) {
+            return "", nil, fmt.Errorf("Invalid signature")
+        }
+
+        if !a.useNonce(key.KeyId + ":" + nonce, time.Unix(timestamp, 0).Add(AUTH_HMAC_MAX_SKEW)) {
+            return "", nil, fmt.Errorf("Signature is already used")
+        }
+
+        return key.Name, key.Permissions, nil
+    }
+
+    return "", nil, fmt.Errorf("Unknown key id")
+}
+// Remembers nonce until timestamp of request expires. Returns false, if nonce was used by other request
+func (a *ApiAuth)useNonce(nonce string, expires time.Time) bool {
+    a.mutex.Lock()
+    defer a.mutex.Unlock()
+
+    now := time.Now()
+    if a.nonces == nil {
+        a.nonces = make(map[string]time.Time)
+    }
+
+    for used, usedExpires := range a.nonces {
+        if now.After(usedExpires) {
+            delete(a.nonces, used)
+        }
+    }
+
+    if _, ok := a.nonces[nonce]; ok {
+        return false
+    }
+
+    a.nonces[nonce] = expires
+
+    return true
+}
+
+// Signature of request: hex of HMAC-SHA256 of method, uri, timestamp, nonce and sha256 of body, joined with "\n"
+func signRequest(secret, method, uri, timestamp, nonce string, body []byte) string {
+    bodyHash := sha256.Sum256(body)
+
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(strings.Join([]string{method, uri, timestamp, nonce, hex.EncodeToString(bodyHash[:])}, "\n")))
+
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Adds credentials to request of proxy daemon api
+func (c *ApiCredentials)apply(req *http.Request, body []byte) {
+    switch {
+    case c.Token != "":
+        req.Header.Set("Authorization", AUTH_SCHEME_BEARER + " " + c.Token)
+    case c.HmacKeyId != "":
+        timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+        nonce := makeNonce()
+        signature := signRequest(c.HmacSecret, req.Method, req.URL.RequestURI(), timestamp, nonce, body)
+
+        req.Header.Set("Authorization", fmt.Sprintf("%s KeyId=%s,Timestamp=%s,Nonce=%s,Signature=%s",
+            AUTH_SCHEME_HMAC, c.HmacKeyId, timestamp, nonce, signature))
+    }
+}
+// Random nonce, so signed request cannot be replayed
+func makeNonce() string {
+    nonce := make([]byte, 16)
+    if _, err := rand.Read(nonce); err != nil {
+        log.Errorf("[auth] Failed to make nonce: %v", err)
+        return strconv.FormatInt(time.Now().UnixNano(), 16)
+    }
+
+    return hex.EncodeToString(nonce)
+}
+func (c *ApiCredentials)redact() {
+    if c.Token != "" {
+        c.Token = MASKED_PASSWORD
+    }
+
+    if c.HmacSecret != "" {
+        c.HmacSecret = MASKED_PASSWORD
+    }
+}
+func (c *ApiCredentials)masked() bool {
+    return c.Token == MASKED_PASSWORD || c.HmacSecret == MASKED_PASSWORD
+}
+
+// Checks credentials and permission before action. Api is open, if auth is not configured
+func authAction(auth *ApiAuth, permission string, f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+    if auth == nil {
+        return f
+    }
+
+    return func(w http.ResponseWriter, r *http.Request) {
+        body, err := ioutil.ReadAll(r.Body)
+        if err != nil {
+            authError(w, http.StatusBadRequest, err)
+            return
+        }
+
+        // body is read again by action
+        r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+        name, permissions, err := auth.authenticate(r, body)
+        if err != nil {
+            log.Warnf("[http] Unauthorized request %s %v from %s: %v", r.Method, r.URL, r.RemoteAddr, err)
+            authError(w, http.StatusUnauthorized, err)
+            return
+        }
+
+        if !inSlice(permissions, permission) {
+            log.Warnf("[http] Client '%s' has no permission '%s' for %s %v", name, permission, r.Method, r.URL)
+            authError(w, http.StatusForbidden, fmt.Errorf("Permission '%s' is required", permission))
+            return
+        }
+
+        log.Debugf("[http] Request %s %v by client '%s'", r.Method, r.URL, name)
+        f(w, r)
+    }
+}
+func authError(w http.ResponseWriter, status int, err error) {
+    data, _ := json.Marshal(resultError{Error: err.Error()})
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    w.Write(data)
+}
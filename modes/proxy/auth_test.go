@@ -0,0 +1,188 @@
+package proxy
+
+import (
+    "bytes"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestSignRequest(t *testing.T) {
+    // hex of HMAC-SHA256("secret", "POST\n/sync/start\n1465390580\nabc\n" + hex of sha256 of "{}")
+    expected := "dd2762c4f4f5b5782d64af70a001017c7bf5b541092369ba95bddb6764424dcf"
+    if signature := signRequest("secret", "POST", "/sync/start", "1465390580", "abc", []byte("{}")); signature != expected {
+        t.Errorf("signRequest = %s, expected %s", signature, expected)
+    }
+
+    // every part of request changes signature
+    base := signRequest("secret", "POST", "/sync/start", "1465390580", "abc", []byte("{}"))
+    others := map[string]string{
+        "secret": signRequest("other", "POST", "/sync/start", "1465390580", "abc", []byte("{}")),
+        "method": signRequest("secret", "GET", "/sync/start", "1465390580", "abc", []byte("{}")),
+        "uri": signRequest("secret", "POST", "/sync/start?id=1", "1465390580", "abc", []byte("{}")),
+        "timestamp": signRequest("secret", "POST", "/sync/start", "1465390581", "abc", []byte("{}")),
+        "nonce": signRequest("secret", "POST", "/sync/start", "1465390580", "abd", []byte("{}")),
+        "body": signRequest("secret", "POST", "/sync/start", "1465390580", "abc", []byte("{ }")),
+    }
+    for name, signature := range others {
+        if signature == base {
+            t.Errorf("Signature doesn't depend on %s", name)
+        }
+    }
+}
+
+func makeTestAuth() *ApiAuth {
+    return &ApiAuth{
+        Tokens: []*ApiToken{{Name: "monitoring", Token: "read-token", Permissions: []string{PERMISSION_READ}}},
+        HmacKeys: []*ApiHmacKey{
+            {Name: "control", KeyId: "control-1", Secret: "secret-1", Permissions: []string{PERMISSION_SYNC, PERMISSION_READ}},
+            {Name: "backup", KeyId: "control-2", Secret: "secret-2", Permissions: []string{PERMISSION_READ}},
+        },
+    }
+}
+
+// Request signed by key at time with nonce
+func signedTestRequest(keyId, secret, uri string, timestamp time.Time, nonce string, body []byte) *http.Request {
+    r := httptest.NewRequest("POST", uri, bytes.NewReader(body))
+
+    unix := strconv.FormatInt(timestamp.Unix(), 10)
+    signature := signRequest(secret, "POST", uri, unix, nonce, body)
+    r.Header.Set("Authorization", fmt.Sprintf("%s KeyId=%s,Timestamp=%s,Nonce=%s,Signature=%s", AUTH_SCHEME_HMAC, keyId, unix, nonce, signature))
+
+    return r
+}
+
+func TestAuthenticateHmac(t *testing.T) {
+    body := []byte(`{"SourceDb": {}}`)
+    now := time.Now()
+
+    tests := []struct {
+        name    string
+        request *http.Request
+        body    []byte
+        client  string
+    }{
+        {"valid", signedTestRequest("control-1", "secret-1", "/sync/start", now, "n1", body), body, "control"},
+        {"second key", signedTestRequest("control-2", "secret-2", "/sync/start", now, "n1", body), body, "backup"},
+        {"wrong secret", signedTestRequest("control-1", "secret-2", "/sync/start", now, "n2", body), body, ""},
+        {"unknown key", signedTestRequest("control-3", "secret-1", "/sync/start", now, "n3", body), body, ""},
+        {"changed body", signedTestRequest("control-1", "secret-1", "/sync/start", now, "n4", body), []byte(`{}`), ""},
+        {"old timestamp", signedTestRequest("control-1", "secret-1", "/sync/start", now.Add(-AUTH_HMAC_MAX_SKEW - time.Minute), "n5", body), body, ""},
+        {"future timestamp", signedTestRequest("control-1", "secret-1", "/sync/start", now.Add(AUTH_HMAC_MAX_SKEW + time.Minute), "n6", body), body, ""},
+        {"allowed skew", signedTestRequest("control-1", "secret-1", "/sync/start", now.Add(-AUTH_HMAC_MAX_SKEW + time.Minute), "n7", body), body, "control"},
+        {"without nonce", signedTestRequest("control-1", "secret-1", "/sync/start", now, "", body), body, ""},
+        {"long nonce", signedTestRequest("control-1", "secret-1", "/sync/start", now, strings.Repeat("a", AUTH_HMAC_MAX_NONCE + 1), body), body, ""},
+    }
+
+    auth := makeTestAuth()
+    for _, test := range tests {
+        name, _, err := auth.authenticate(test.request, test.body)
+
+        if test.client != "" && (err != nil || name != test.client) {
+            t.Errorf("%s: authenticated as '%s', error %v, expected '%s'", test.name, name, err, test.client)
+        }
+        if test.client == "" && err == nil {
+            t.Errorf("%s: request must not be authenticated", test.name)
+        }
+    }
+
+    // nonce of request with invalid signature is not remembered
+    if _, _, err := auth.authenticate(signedTestRequest("control-1", "secret-1", "/sync/start", now, "n2", body), body); err != nil {
+        t.Errorf("Nonce of rejected request is not available: %v", err)
+    }
+}
+
+func TestAuthenticateHmacReplay(t *testing.T) {
+    auth := makeTestAuth()
+    body := []byte(`{}`)
+
+    request := signedTestRequest("control-1", "secret-1", "/sync/cancel?id=1", time.Now(), "replayed", body)
+    if _, _, err := auth.authenticate(request, body); err != nil {
+        t.Fatal(err)
+    }
+
+    if _, _, err := auth.authenticate(request, body); err == nil {
+        t.Errorf("Replayed request is authenticated")
+    }
+
+    // nonce is checked together with key
+    other := signedTestRequest("control-2", "secret-2", "/sync/cancel?id=1", time.Now(), "replayed", body)
+    if _, _, err := auth.authenticate(other, body); err != nil {
+        t.Errorf("Request of other key is not authenticated: %v", err)
+    }
+
+    // credentials of exporter make new nonce for every request
+    credentials := &ApiCredentials{HmacKeyId: "control-1", HmacSecret: "secret-1"}
+    for j := 0; j < 3; j++ {
+        r := httptest.NewRequest("POST", "/proxy/start", bytes.NewReader(body))
+        credentials.apply(r, body)
+
+        if name, _, err := auth.authenticate(r, body); err != nil || name != "control" {
+            t.Errorf("Request %d of credentials: '%s', %v", j, name, err)
+        }
+    }
+}
+
+func TestUseNonceExpires(t *testing.T) {
+    auth := makeTestAuth()
+
+    if !auth.useNonce("k:a", time.Now().Add(-time.Second)) {
+        t.Fatal("New nonce is not accepted")
+    }
+
+    // expired nonce is forgotten, its timestamp is rejected anyway
+    if !auth.useNonce("k:a", time.Now().Add(time.Minute)) || len(auth.nonces) != 1 {
+        t.Errorf("Expired nonce is not removed: %v", auth.nonces)
+    }
+
+    if auth.useNonce("k:a", time.Now().Add(time.Minute)) {
+        t.Errorf("Used nonce is accepted")
+    }
+}
+
+func TestAuthAction(t *testing.T) {
+    auth := makeTestAuth()
+    ok := func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusOK)
+    }
+
+    tests := []struct {
+        name          string
+        authorization string
+        permission    string
+        status        int
+    }{
+        {"no header", "", PERMISSION_READ, http.StatusUnauthorized},
+        {"token", "Bearer read-token", PERMISSION_READ, http.StatusOK},
+        {"wrong token", "Bearer other", PERMISSION_READ, http.StatusUnauthorized},
+        {"token without permission", "Bearer read-token", PERMISSION_SYNC, http.StatusForbidden},
+        {"unknown scheme", "Basic read-token", PERMISSION_READ, http.StatusUnauthorized},
+    }
+
+    for _, test := range tests {
+        r := httptest.NewRequest("GET", "/sync", nil)
+        if test.authorization != "" {
+            r.Header.Set("Authorization", test.authorization)
+        }
+
+        w := httptest.NewRecorder()
+        authAction(auth, test.permission, ok)(w, r)
+
+        if w.Code != test.status {
+            t.Errorf("%s: status %d, expected %d", test.name, w.Code, test.status)
+        }
+    }
+
+    // signed request without permission
+    r := signedTestRequest("control-2", "secret-2", "/sync/start", time.Now(), "action", []byte(`{}`))
+    w := httptest.NewRecorder()
+    authAction(auth, PERMISSION_SYNC, ok)(w, r)
+
+    if w.Code != http.StatusForbidden {
+        t.Errorf("Signed request without permission: status %d, expected %d", w.Code, http.StatusForbidden)
+    }
+}
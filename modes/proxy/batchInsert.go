@@ -8,21 +8,28 @@ import (
     "strings"
     "database/sql"
     "math"
+    "time"
     log "github.com/Sirupsen/logrus"
 )
 
 type batchInsert struct {
-    cap          int // максимальное количество строк, которые могут быть вставлены за раз
-    table        string
-    columnInfo   map[string]*inspector.Column
-    statement    *sql.Stmt
-    statementLen int // количество строк в текущем стейтменте
-    dataChunkLen int // количество колонок в строке
-    db           *sql.DB
-    data         []interface{}
-    curDataLen   int
-    maxPacketLen int64
-    curDataSize  int64
+    cap           int // максимальное количество строк, которые могут быть вставлены за раз
+    table         string
+    columnInfo    map[string]*inspector.Column
+    statement     *sql.Stmt
+    statementLen  int // количество строк в текущем стейтменте
+    dataChunkLen  int // количество колонок в строке
+    db            *sql.DB
+    file          *dumpFile // if set, statements are written to file instead of db
+    data          []interface{}
+    curDataLen    int
+    maxPacketLen  int64
+    curDataSize   int64
+    onFlush       func(rows int, size int64)
+    throttle      *workerThrottle // rate limits of flushed rows, nil if they are not limited
+    onConflict    string   // handling of existing rows, plain INSERT by default
+    updateColumns []string // columns updated by ON DUPLICATE KEY UPDATE
+    noopColumn    string   // column assigned to itself, if all columns are in keys
 }
 
 const MAX_PLACEHOLDERS = 60000
@@ -48,6 +55,13 @@ func MakeBatchInsert(cap int, table string, columnInfo map[string]*inspector.Col
         maxPacketLen: maxPacketLen,
     }
 }
+// MakeFileBatchInsert makes batch insert, which writes INSERT statements with values to dump file
+func MakeFileBatchInsert(cap int, table string, columnInfo map[string]*inspector.Column, file *dumpFile, maxPacketLen int64) *batchInsert {
+    b := MakeBatchInsert(cap, table, columnInfo, nil, maxPacketLen)
+    b.file = file
+
+    return b
+}
 func (b *batchInsert)Insert(rowValues []interface{}, size int64) error {
     valuesLen := len(rowValues)
 
@@ -82,6 +96,40 @@ func (b *batchInsert)Insert(rowValues []interface{}, size int64) error {
     return nil
 }
 
+// OnFlush sets callback which is called after every successfully flushed statement
+func (b *batchInsert)OnFlush(f func(rows int, size int64)) {
+    b.onFlush = f
+}
+
+// Throttle sets rate limits, which are waited before every flush
+func (b *batchInsert)Throttle(t *workerThrottle) {
+    b.throttle = t
+}
+
+// OnConflict sets handling of rows, which conflict with existing rows by unique key.
+// Columns of keyColumns are not updated by ON_CONFLICT_UPDATE
+func (b *batchInsert)OnConflict(mode string, keyColumns []string) {
+    b.onConflict = mode
+    b.updateColumns = nil
+    b.noopColumn = ""
+
+    if mode != ON_CONFLICT_UPDATE {
+        return
+    }
+
+    sortedColumns := inspector.SortColumnsByIndex(b.columnInfo)
+    for _, col := range sortedColumns {
+        if !inSlice(keyColumns, col.Name) {
+            b.updateColumns = append(b.updateColumns, col.Name)
+        }
+    }
+
+    // all columns are in keys, so conflicting row is kept by assignment of column to itself
+    if len(b.updateColumns) == 0 && len(sortedColumns) > 0 {
+        b.noopColumn = sortedColumns[0].Name
+    }
+}
+
 func (b *batchInsert)Close() error {
     if b.statement != nil {
         if err := b.statement.Close(); err != nil {
@@ -97,6 +145,14 @@ func (b *batchInsert)Flush() error {
         return nil
     }
 
+    if err := b.throttle.waitRate(b.curDataLen, b.curDataSize); err != nil {
+        return err
+    }
+
+    if b.file != nil {
+        return b.flushToFile()
+    }
+
     if b.statementLen != b.curDataLen {
         // close prev statement
         if err := b.Close(); err != nil {
@@ -113,16 +169,65 @@ func (b *batchInsert)Flush() error {
     }
 
     params := b.data[0:b.statementLen * b.dataChunkLen]
+    startedAt := time.Now()
 
     if _, err := b.statement.Exec(params...); err != nil {
         return err
     }
 
+    b.flushed(b.statementLen, time.Since(startedAt))
+
+    return nil
+}
+func (b *batchInsert)flushToFile() error {
+    sortedColumns := inspector.SortColumnsByIndex(b.columnInfo)
+
+    columnNames := make([]string, len(sortedColumns))
+    for j, col := range sortedColumns {
+        columnNames[j] = fmt.Sprintf("`%s`", col.Name)
+    }
+
+    startedAt := time.Now()
+
+    buf := bytes.Buffer{}
+    buf.WriteString(fmt.Sprintf("%s `%v` (%v) VALUES ", b.insertKeyword(), b.table, strings.Join(columnNames, ",")))
+
+    for i := 0; i < b.curDataLen; i++ {
+        if i > 0 {
+            buf.WriteString(",")
+        }
+
+        buf.WriteString("(")
+        for j, col := range sortedColumns {
+            if j > 0 {
+                buf.WriteString(",")
+            }
+
+            writeSqlValue(&buf, col, b.data[i * b.dataChunkLen + j])
+        }
+        buf.WriteString(")")
+    }
+
+    buf.WriteString(b.updateClause())
+
+    if err := b.file.WriteStatement(buf.String()); err != nil {
+        return err
+    }
+
+    b.flushed(b.curDataLen, time.Since(startedAt))
+
+    return nil
+}
+func (b *batchInsert)flushed(rows int, duration time.Duration) {
+    metrics.batchFlushed(duration, rows, b.curDataSize)
+
+    if b.onFlush != nil {
+        b.onFlush(rows, b.curDataSize)
+    }
+
     // rewind data index
     b.curDataLen = 0
     b.curDataSize = 0
-
-    return nil
 }
 func (b *batchInsert)makeStatement() (*sql.Stmt, error) {
     insertQuery, err := b.makeInsertQuery()
@@ -185,5 +290,35 @@ func (b *batchInsert)makeInsertQuery() (string, error) {
         paramsBuf.WriteString(fmt.Sprintf(",%v", paramsStr))
     }
 
-    return fmt.Sprintf("INSERT INTO `%v` (%v) VALUES %v", b.table, strings.Join(insertParts, ","), paramsBuf.String()), nil
+    return fmt.Sprintf("%s `%v` (%v) VALUES %v%s", b.insertKeyword(), b.table, strings.Join(insertParts, ","), paramsBuf.String(), b.updateClause()), nil
+}
+func (b *batchInsert)insertKeyword() string {
+    switch b.onConflict {
+    case ON_CONFLICT_IGNORE:
+        return "INSERT IGNORE INTO"
+    case ON_CONFLICT_REPLACE:
+        return "REPLACE INTO"
+    }
+
+    return "INSERT INTO"
+}
+func (b *batchInsert)updateClause() string {
+    if b.onConflict != ON_CONFLICT_UPDATE {
+        return ""
+    }
+
+    assignments := make([]string, len(b.updateColumns))
+    for i, name := range b.updateColumns {
+        assignments[i] = fmt.Sprintf("`%s`=VALUES(`%s`)", name, name)
+    }
+
+    if len(assignments) == 0 {
+        if b.noopColumn == "" {
+            return ""
+        }
+
+        assignments = []string{fmt.Sprintf("`%s`=`%s`", b.noopColumn, b.noopColumn)}
+    }
+
+    return " ON DUPLICATE KEY UPDATE " + strings.Join(assignments, ",")
 }
\ No newline at end of file
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+    "github.com/LTD-Beget/besync/inspector"
+    "github.com/LTD-Beget/besync/internal/fakesql"
+    "reflect"
+    "testing"
+)
+
+func makeTestColumnInfo() map[string]*inspector.Column {
+    return map[string]*inspector.Column{
+        "name": {Name: "name", Index: 2},
+        "id": {Name: "id", Index: 0, IsNumeric: true},
+        "email": {Name: "email", Index: 1},
+    }
+}
+
+func TestMakeInsertQuery(t *testing.T) {
+    values := " `users` (`id`,`email`,`name`) VALUES (?,?,?),(?,?,?)"
+
+    tests := []struct {
+        onConflict string
+        keyColumns []string
+        expected   string
+    }{
+        {ON_CONFLICT_ERROR, []string{"id"}, "INSERT INTO" + values},
+        {ON_CONFLICT_IGNORE, []string{"id"}, "INSERT IGNORE INTO" + values},
+        {ON_CONFLICT_REPLACE, []string{"id"}, "REPLACE INTO" + values},
+        {ON_CONFLICT_UPDATE, []string{"id"}, "INSERT INTO" + values + " ON DUPLICATE KEY UPDATE `email`=VALUES(`email`),`name`=VALUES(`name`)"},
+        {ON_CONFLICT_UPDATE, []string{"id", "email"}, "INSERT INTO" + values + " ON DUPLICATE KEY UPDATE `name`=VALUES(`name`)"},
+        // existing row is kept unchanged, when all columns are in keys
+        {ON_CONFLICT_UPDATE, []string{"name", "id", "email"}, "INSERT INTO" + values + " ON DUPLICATE KEY UPDATE `id`=`id`"},
+    }
+
+    b := MakeBatchInsert(10, "users", makeTestColumnInfo(), nil, 1024 * 1024)
+    b.curDataLen = 2
+
+    for _, test := range tests {
+        // mode of previous test must not be kept
+        b.OnConflict(test.onConflict, test.keyColumns)
+
+        query, err := b.makeInsertQuery()
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if query != test.expected {
+            t.Errorf("%s %v: query %s, expected %s", test.onConflict, test.keyColumns, query, test.expected)
+        }
+    }
+
+    if _, err := MakeBatchInsert(10, "users", nil, nil, 1024 * 1024).makeInsertQuery(); err == nil {
+        t.Errorf("Query is made without columns")
+    }
+}
+
+// Full batch is flushed by Insert, the rest by Flush with statement of its size
+func TestBatchInsertFlush(t *testing.T) {
+    var queries []string
+    db, err := fakesql.Open(fakesql.Recorder(&queries, nil, nil))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+
+    b := MakeBatchInsert(2, "users", makeTestColumnInfo(), db, 1024 * 1024)
+    b.OnConflict(ON_CONFLICT_IGNORE, []string{"id"})
+
+    var flushed []int
+    b.OnFlush(func(rows int, size int64) {
+        flushed = append(flushed, rows)
+    })
+
+    for j := 0; j < 3; j++ {
+        if err := b.Insert([]interface{}{[]byte("1"), []byte("a@b.c"), nil}, 10); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    if err := b.Insert([]interface{}{[]byte("1")}, 1); err == nil {
+        t.Errorf("Row with wrong count of values is inserted")
+    }
+
+    if err := b.Flush(); err != nil {
+        t.Fatal(err)
+    }
+    if err := b.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    expected := []string{
+        "INSERT IGNORE INTO `users` (`id`,`email`,`name`) VALUES (?,?,?),(?,?,?)",
+        "INSERT IGNORE INTO `users` (`id`,`email`,`name`) VALUES (?,?,?)",
+    }
+    if !reflect.DeepEqual(queries, expected) {
+        t.Errorf("Executed queries %q, expected %q", queries, expected)
+    }
+
+    if !reflect.DeepEqual(flushed, []int{2, 1}) {
+        t.Errorf("Flushed rows %v, expected [2 1]", flushed)
+    }
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+    "database/sql"
+    "encoding/json"
+    "github.com/LTD-Beget/besync/modes/proxy/tableChunk"
+)
+
+const (
+    OBJECT_TABLE     = "table"
+    OBJECT_VIEW      = "view"
+    OBJECT_TRIGGER   = "trigger"
+    OBJECT_PROCEDURE = "procedure"
+    OBJECT_FUNCTION  = "function"
+    OBJECT_EVENT     = "event"
+
+    CHUNK_PENDING = "pending"
+    CHUNK_STARTED = "started"
+    CHUNK_DONE    = "done"
+)
+
+var checkpointSchema = `
+CREATE TABLE IF NOT EXISTS sync_object
+(
+ task_id INT NOT NULL,
+ object_type VARCHAR(50) NOT NULL,
+ object_name TEXT NOT NULL,
+ date_create DATETIME NOT NULL,
+ UNIQUE (task_id, object_type, object_name)
+);
+CREATE TABLE IF NOT EXISTS sync_chunk
+(
+ task_id INT NOT NULL,
+ table_name TEXT NOT NULL,
+ chunk_idx INT NOT NULL,
+ chunk_condition TEXT NOT NULL,
+ status VARCHAR(50) NOT NULL,
+ date_update DATETIME NOT NULL,
+ UNIQUE (task_id, table_name, chunk_idx)
+);
+`
+
+// Saves state of sync task in local sqlite db, so interrupted task may be resumed
+type checkpoints struct {
+    db     *sql.DB
+    taskId int64
+}
+
+type savedChunk struct {
+    chunk  *tableChunk.Chunk
+    status string
+}
+
+func makeCheckpoints(db *sql.DB, taskId int64) *checkpoints {
+    return &checkpoints{
+        db: db,
+        taskId: taskId,
+    }
+}
+func (c *checkpoints)objectCreated(objectType, name string) error {
+    insertSql := `INSERT OR IGNORE INTO sync_object (task_id, object_type, object_name, date_create)
+     VALUES (?, ?, ?, datetime('now','localtime'))`
+
+    _, err := c.db.Exec(insertSql, c.taskId, objectType, name)
+    return err
+}
+func (c *checkpoints)createdObjects(objectType string) (map[string]bool, error) {
+    rows, err := c.db.Query("SELECT object_name FROM sync_object WHERE task_id = ? AND object_type = ?", c.taskId, objectType)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    result := make(map[string]bool)
+    for rows.Next() {
+        var name string
+        if err := rows.Scan(&name); err != nil {
+            return nil, err
+        }
+
+        result[name] = true
+    }
+
+    return result, rows.Err()
+}
+func (c *checkpoints)saveChunks(chunks []*tableChunk.Chunk) error {
+    tx, err := c.db.Begin()
+    if err != nil {
+        return err
+    }
+
+    insertSql := `INSERT OR REPLACE INTO sync_chunk (task_id, table_name, chunk_idx, chunk_condition, chunk_range, status, date_update)
+     VALUES (?, ?, ?, ?, ?, ?, datetime('now','localtime'))`
+
+    for _, chunk := range chunks {
+        // bounds of not split range, NULL for cut chunk
+        var keyRange []byte
+        if chunk.Range != nil {
+            if keyRange, err = json.Marshal(chunk.Range); err != nil {
+                tx.Rollback()
+                return err
+            }
+        }
+
+        if _, err := tx.Exec(insertSql, c.taskId, chunk.Key(), chunk.Index, chunk.Condition, keyRange, CHUNK_PENDING); err != nil {
+            tx.Rollback()
+            return err
+        }
+    }
+
+    return tx.Commit()
+}
+// Returns nil if chunks for table was not saved yet
+func (c *checkpoints)loadChunks(database, tableName string) ([]*savedChunk, error) {
+    query := `SELECT chunk_idx, chunk_condition, chunk_range, status FROM sync_chunk
+     WHERE task_id = ? AND table_name = ? ORDER BY chunk_idx`
+
+    rows, err := c.db.Query(query, c.taskId, tableChunk.TableKey(database, tableName))
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var result []*savedChunk
+    for rows.Next() {
+        chunk := &tableChunk.Chunk{Database: database, TableName: tableName}
+        saved := &savedChunk{chunk: chunk}
+
+        var keyRange []byte
+        if err := rows.Scan(&chunk.Index, &chunk.Condition, &keyRange, &saved.status); err != nil {
+            return nil, err
+        }
+
+        if len(keyRange) > 0 {
+            chunk.Range = &tableChunk.KeyRange{}
+            if err := json.Unmarshal(keyRange, chunk.Range); err != nil {
+                return nil, err
+            }
+        }
+
+        result = append(result, saved)
+    }
+
+    return result, rows.Err()
+}
+func (c *checkpoints)setChunkStatus(chunk *tableChunk.Chunk, status string) error {
+    updateSql := `UPDATE sync_chunk SET status = ?, date_update = datetime('now','localtime')
+     WHERE task_id = ? AND table_name = ? AND chunk_idx = ?`
+
+    _, err := c.db.Exec(updateSql, status, c.taskId, chunk.Key(), chunk.Index)
+    return err
+}
+// Binlog position is stored in sync_task, because it belongs to whole task
+func (c *checkpoints)saveBinlogPosition(position *BinlogPosition) error {
+    dumped, err := json.Marshal(position)
+    if err != nil {
+        return err
+    }
+
+    _, err = c.db.Exec("UPDATE sync_task SET binlog_position = ? WHERE id = ?", string(dumped), c.taskId)
+    return err
+}
+// Returns nil if position was not saved yet
+func (c *checkpoints)loadBinlogPosition() (*BinlogPosition, error) {
+    var dumped []byte
+
+    if err := c.db.QueryRow("SELECT binlog_position FROM sync_task WHERE id = ?", c.taskId).Scan(&dumped); err != nil {
+        return nil, err
+    }
+
+    if len(dumped) == 0 {
+        return nil, nil
+    }
+
+    position := &BinlogPosition{}
+    if err := json.Unmarshal(dumped, position); err != nil {
+        return nil, err
+    }
+
+    return position, nil
+}
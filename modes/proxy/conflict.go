@@ -0,0 +1,67 @@
+package proxy
+
+import (
+    "fmt"
+)
+
+// Handling of copied rows, which conflict with existing rows of target by primary or unique key
+const (
+    ON_CONFLICT_ERROR   = "error"
+    ON_CONFLICT_IGNORE  = "ignore"  // INSERT IGNORE, existing rows are kept
+    ON_CONFLICT_REPLACE = "replace" // REPLACE INTO, existing rows are deleted and inserted again
+    ON_CONFLICT_UPDATE  = "update"  // INSERT ... ON DUPLICATE KEY UPDATE of columns, which are not in unique keys
+)
+
+func checkOnConflictMode(mode string) error {
+    switch mode {
+    case "", ON_CONFLICT_ERROR, ON_CONFLICT_IGNORE, ON_CONFLICT_REPLACE, ON_CONFLICT_UPDATE:
+        return nil
+    }
+
+    return fmt.Errorf("unknown mode '%s', mode must be one of: error, ignore, replace, update", mode)
+}
+func (e *ExportSettings)checkOnConflict() error {
+    if e == nil {
+        return nil
+    }
+
+    if err := checkOnConflictMode(e.OnConflict); err != nil {
+        return fmt.Errorf("OnConflict: %v", err)
+    }
+
+    for tableName, mode := range e.TableOnConflict {
+        if err := checkOnConflictMode(mode); err != nil {
+            return fmt.Errorf("TableOnConflict: table '%s': %v", tableName, err)
+        }
+    }
+
+    return nil
+}
+
+func (s *exporter)checkTableOnConflict() error {
+    for tableName := range s.settings.Export.TableOnConflict {
+        if !inSlice(s.schema.Tables, tableName) {
+            return fmt.Errorf("TableOnConflict: table '%s' is not dumped", tableName)
+        }
+    }
+
+    return nil
+}
+// Conflict mode of table, mode of task is used if table has no own mode
+func (s *exporter)tableOnConflict(tableName string) string {
+    mode := s.settings.Export.OnConflict
+    if tableMode, ok := s.settings.Export.TableOnConflict[tableName]; ok && tableMode != "" {
+        mode = tableMode
+    }
+
+    if mode == "" {
+        return ON_CONFLICT_ERROR
+    }
+
+    return mode
+}
+// Existing target table is kept, if rows are inserted into it or it's truncated.
+// Such table is created only if it doesn't exist and is never dropped
+func (s *exporter)keepTargetTable(tableName string) bool {
+    return s.settings.Export.TruncateBeforeInsert || s.tableOnConflict(tableName) != ON_CONFLICT_ERROR
+}
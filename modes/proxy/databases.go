@@ -0,0 +1,416 @@
+package proxy
+
+import (
+    log "github.com/Sirupsen/logrus"
+    "github.com/LTD-Beget/besync/inspector"
+    "github.com/LTD-Beget/besync/modes/proxy/tableChunk"
+    "fmt"
+    "regexp"
+    "strings"
+)
+
+// Source databases of multi-database task. One of Names, Pattern and All must be set
+type DatabasesSettings struct {
+    Names   []string // list of databases
+    Pattern string   // regexp of names of databases
+    All     bool     // all databases except system schemas
+    Exclude []string // databases excluded from Pattern and All
+}
+
+var systemDatabases = []string{"mysql", "information_schema", "performance_schema", "sys"}
+
+// Several databases are copied by one task
+func (s *Settings)multiDatabase() bool {
+    return s.Databases != nil
+}
+func (s *Settings)checkDatabases() error {
+    if !s.multiDatabase() {
+        return nil
+    }
+
+    databases := s.Databases
+
+    selectors := 0
+    for _, set := range []bool{len(databases.Names) > 0, databases.Pattern != "", databases.All} {
+        if set {
+            selectors++
+        }
+    }
+
+    if selectors != 1 {
+        return fmt.Errorf("Databases: one of Names, Pattern and All must be set")
+    }
+
+    if databases.Pattern != "" {
+        if _, err := regexp.Compile(databases.Pattern); err != nil {
+            return fmt.Errorf("Databases: bad pattern '%s': %v", databases.Pattern, err)
+        }
+    }
+
+    if (s.SourceDb != nil && s.SourceDb.Name != "") || (s.TargetDb != nil && s.TargetDb.Name != "") {
+        return fmt.Errorf("Databases: Name of SourceDb and TargetDb must be empty, target databases are named by Rename.Databases")
+    }
+
+    if s.follow() {
+        return fmt.Errorf("Databases cannot be used with binlog follow")
+    }
+
+    if s.toFile() {
+        return fmt.Errorf("Databases cannot be used with file output")
+    }
+
+    return nil
+}
+// Name of target database of source database
+func (s *Settings)targetDatabaseName(sourceName string) string {
+    if s.Rename == nil {
+        return sourceName
+    }
+
+    rules, err := compileRenameRules(s.Rename.Databases)
+    if err != nil {
+        return sourceName
+    }
+
+    return rules.rename(sourceName)
+}
+
+// Loads schema of copied database or makes exporters of all databases of multi-database task
+func (s *exporter)loadDatabases() error {
+    if !s.settings.multiDatabase() {
+        return s.prepareDatabase()
+    }
+
+    names, err := s.sourceDatabases()
+    if err != nil {
+        return wrapExportError(PHASE_PREPARE, "", "", err)
+    }
+
+    if err := s.checkDatabaseKeys(names); err != nil {
+        return wrapExportError(PHASE_PREPARE, "", "", err)
+    }
+
+    log.Infof("[export] Copied databases: %+v", names)
+
+    for _, name := range names {
+        database, err := s.makeDatabaseExporter(name)
+        if err != nil {
+            return wrapExportError(PHASE_PREPARE, name, "", err)
+        }
+
+        s.databases = append(s.databases, database)
+
+        if err := database.prepareDatabase(); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+// Loads schema of database and checks options of its tables
+func (s *exporter)prepareDatabase() error {
+    if err := s.loadSchema(); err != nil {
+        return wrapExportError(PHASE_SCHEMA, s.database, "", err)
+    }
+
+    if err := s.checkTableFilters(); err != nil {
+        return wrapExportError(PHASE_PREPARE, s.database, "", err)
+    }
+
+    if err := s.checkMasking(); err != nil {
+        return wrapExportError(PHASE_PREPARE, s.database, "", err)
+    }
+
+    if err := s.checkTableOnConflict(); err != nil {
+        return wrapExportError(PHASE_PREPARE, s.database, "", err)
+    }
+
+    if err := s.checkFollowKeys(); err != nil {
+        return wrapExportError(PHASE_PREPARE, s.database, "", err)
+    }
+
+    if err := s.prepareRename(); err != nil {
+        return wrapExportError(PHASE_PREPARE, s.database, "", err)
+    }
+
+    return nil
+}
+func (s *exporter)sourceDatabases() ([]string, error) {
+    settings := s.settings.Databases
+
+    existing, err := s.inspector.Databases()
+    if err != nil {
+        return nil, err
+    }
+
+    if len(settings.Names) > 0 {
+        for _, name := range settings.Names {
+            if inSlice(systemDatabases, strings.ToLower(name)) {
+                return nil, fmt.Errorf("Databases: system database '%s' cannot be copied", name)
+            }
+
+            if !inSlice(existing, name) {
+                return nil, fmt.Errorf("Databases: database '%s' not found", name)
+            }
+        }
+
+        return settings.Names, nil
+    }
+
+    var pattern *regexp.Regexp
+    if settings.Pattern != "" {
+        if pattern, err = regexp.Compile(settings.Pattern); err != nil {
+            return nil, err
+        }
+    }
+
+    names := make([]string, 0)
+    for _, name := range existing {
+        if inSlice(systemDatabases, strings.ToLower(name)) || inSlice(settings.Exclude, name) {
+            continue
+        }
+
+        if pattern != nil && !pattern.MatchString(name) {
+            continue
+        }
+
+        names = append(names, name)
+    }
+
+    if len(names) == 0 {
+        return nil, fmt.Errorf("Databases: no databases to copy")
+    }
+
+    return names, nil
+}
+
+// Table options of multi-database task refer to tables as "database.table"
+func (s *exporter)checkDatabaseKeys(names []string) error {
+    export := s.settings.Export
+
+    keys := append(append(append([]string{}, export.IncludeTables...), export.ExcludeTables...), export.ExcludeTriggers...)
+    for key := range export.TableFilters {
+        keys = append(keys, key)
+    }
+    for key := range export.TableLimits {
+        keys = append(keys, key)
+    }
+    for key := range export.Masking {
+        keys = append(keys, key)
+    }
+    for key := range export.TableOnConflict {
+        keys = append(keys, key)
+    }
+    if rename := s.settings.Rename; rename != nil {
+        for key := range rename.Tables.names() {
+            keys = append(keys, key)
+        }
+        for key := range rename.Columns.names() {
+            keys = append(keys, key)
+        }
+    }
+
+    for _, key := range keys {
+        found := false
+        for _, name := range names {
+            found = found || strings.HasPrefix(key, name + ".")
+        }
+
+        if !found {
+            return fmt.Errorf("'%s' doesn't refer to copied database, tables of multi-database task are named as 'database.table'", key)
+        }
+    }
+
+    return nil
+}
+
+// Exporter of one database of multi-database task. It has own schema and source connection,
+// but workers, progress and checkpoints belong to task
+func (s *exporter)makeDatabaseExporter(name string) (*exporter, error) {
+    settings := *s.settings
+
+    sourceDb := *settings.SourceDb
+    sourceDb.Name = name
+    settings.SourceDb = &sourceDb
+
+    if settings.TargetDb != nil {
+        targetDb := *settings.TargetDb
+        targetDb.Name = settings.targetDatabaseName(name)
+        settings.TargetDb = &targetDb
+    }
+
+    settings.Export = settings.Export.forDatabase(name)
+    settings.Rename = settings.Rename.forDatabase(name)
+
+    database := &exporter{
+        settings: &settings,
+        dumpId: s.dumpId,
+        tableColumns: make(map[string]map[string]*inspector.Column),
+        schema: &Schema{
+            TableColumns: make(map[string]map[string]*inspector.Column),
+            TableConditions: make(map[string]string),
+        },
+        sourceMysqlVersion: s.sourceMysqlVersion,
+        ctx: s.ctx,
+        cancel: s.cancel,
+        errMutex: s.errMutex,
+        progress: s.progress,
+        checkpoints: s.checkpoints,
+        resume: s.resume,
+        verifyOnly: s.verifyOnly,
+        parent: s,
+        database: name,
+    }
+
+    db, err := database.newSourceDbConnection()
+    if err != nil {
+        return nil, err
+    }
+
+    database.sourceDb = db
+    database.inspector = inspector.MakeMysqlInspector(db, s.sourceMysqlVersion)
+
+    return database, nil
+}
+// Exporters of copied databases. Exporter of single database task copies its database itself
+func (s *exporter)databaseExporters() []*exporter {
+    if s.settings.multiDatabase() {
+        return s.databases
+    }
+
+    return []*exporter{s}
+}
+// Exporter of database of chunk
+func (s *exporter)chunkDatabase(chunk *tableChunk.Chunk) *exporter {
+    for _, database := range s.databases {
+        if database.database == chunk.Database {
+            return database
+        }
+    }
+
+    return s
+}
+// Exporter of whole task
+func (s *exporter)task() *exporter {
+    if s.parent != nil {
+        return s.parent
+    }
+
+    return s
+}
+// Key of object in progress and checkpoints
+func (s *exporter)objectKey(name string) string {
+    return tableChunk.TableKey(s.database, name)
+}
+func (s *exporter)jobDatabase() jobDatabase {
+    database := jobDatabase{
+        rename: s.rename,
+    }
+
+    if s.database != "" {
+        database.sourceDb = s.settings.SourceDb.Name
+        database.targetDb = s.settings.TargetDb.Name
+    }
+
+    // connections of single database task select shadow database by USE too, and target after swap
+    if s.settings.shadowDatabase() && !s.verifyOnly {
+        database.targetDb = s.settings.TargetDb.Name
+
+        if shadow := s.shadowName(); shadow != "" {
+            database.targetDb = shadow
+        }
+    }
+
+    return database
+}
+
+// Target databases of multi-database task are created with default character set and collation of source databases
+func (s *exporter)createDatabases() error {
+    for _, database := range s.databases {
+        charset, collation, err := database.inspector.DatabaseCharset(database.database)
+        if err != nil {
+            return err
+        }
+
+        err = s.runJob(&jobCreateDatabase{
+            name: database.settings.TargetDb.Name,
+            charset: charset,
+            collation: collation,
+        })
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Options of tables of database, names of tables are given without database
+func (e *ExportSettings)forDatabase(name string) *ExportSettings {
+    export := *e
+    prefix := name + "."
+
+    export.IncludeTables = databaseList(e.IncludeTables, prefix)
+    export.ExcludeTables = databaseList(e.ExcludeTables, prefix)
+    export.ExcludeTriggers = databaseList(e.ExcludeTriggers, prefix)
+    export.TableFilters = databaseMap(e.TableFilters, prefix)
+    export.TableOnConflict = databaseMap(e.TableOnConflict, prefix)
+
+    export.TableLimits = make(map[string]int64)
+    for key, limit := range e.TableLimits {
+        if strings.HasPrefix(key, prefix) {
+            export.TableLimits[strings.TrimPrefix(key, prefix)] = limit
+        }
+    }
+
+    export.Masking = make(map[string]*MaskRule)
+    for key, rule := range e.Masking {
+        if strings.HasPrefix(key, prefix) {
+            export.Masking[strings.TrimPrefix(key, prefix)] = rule
+        }
+    }
+
+    return &export
+}
+func (s *RenameSettings)forDatabase(name string) *RenameSettings {
+    if s == nil {
+        return nil
+    }
+
+    rename := *s
+    prefix := name + "."
+
+    if s.Tables != nil {
+        tables := *s.Tables
+        tables.Names = databaseMap(s.Tables.Names, prefix)
+        rename.Tables = &tables
+    }
+
+    if s.Columns != nil {
+        columns := *s.Columns
+        columns.Names = databaseMap(s.Columns.Names, prefix)
+        rename.Columns = &columns
+    }
+
+    return &rename
+}
+func databaseList(names []string, prefix string) []string {
+    var result []string
+    for _, name := range names {
+        if strings.HasPrefix(name, prefix) {
+            result = append(result, strings.TrimPrefix(name, prefix))
+        }
+    }
+
+    return result
+}
+func databaseMap(values map[string]string, prefix string) map[string]string {
+    result := make(map[string]string)
+    for key, value := range values {
+        if strings.HasPrefix(key, prefix) {
+            result[strings.TrimPrefix(key, prefix)] = value
+        }
+    }
+
+    return result
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+    "bufio"
+    "bytes"
+    "compress/gzip"
+    "encoding/hex"
+    "fmt"
+    "github.com/DataDog/zstd"
+    "github.com/LTD-Beget/besync/inspector"
+    "io"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    OUTPUT_MYSQL = "mysql"
+    OUTPUT_FILE  = "file"
+
+    COMPRESSION_GZIP = "gzip"
+    COMPRESSION_ZSTD = "zstd"
+)
+
+// Raw size of data in one INSERT of dump file. Hex encoded blobs are twice as large,
+// so statement fits default max_allowed_packet of mysql client (16M)
+const FILE_MAX_STATEMENT_SIZE int64 = 8 * 1024 * 1024
+
+// SQL script which is written by all workers. Every statement is written at once,
+// so statements of different workers are never mixed
+type dumpFile struct {
+    mutex      *sync.Mutex
+    file       *os.File // nil for stdout
+    buffer     *bufio.Writer
+    compressor io.WriteCloser
+    writer     io.Writer
+}
+
+// Opens file for writing, "-" means stdout. Compressed file opened in append mode gets new gzip member or zstd frame,
+// so file is still readable as one stream
+func openDumpFile(path, compression string, appendMode bool) (*dumpFile, error) {
+    if path == "" {
+        return nil, fmt.Errorf("[dump file] Output path cannot be blank")
+    }
+
+    f := &dumpFile{
+        mutex: &sync.Mutex{},
+    }
+
+    var out io.Writer = os.Stdout
+    if path != "-" {
+        flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+        if appendMode {
+            flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+        }
+
+        file, err := os.OpenFile(path, flags, 0644)
+        if err != nil {
+            return nil, err
+        }
+
+        f.file = file
+        out = file
+    }
+
+    f.buffer = bufio.NewWriterSize(out, 1024 * 1024)
+    f.writer = f.buffer
+
+    switch compression {
+    case "":
+    case COMPRESSION_GZIP:
+        f.compressor = gzip.NewWriter(f.buffer)
+    case COMPRESSION_ZSTD:
+        f.compressor = zstd.NewWriter(f.buffer)
+    default:
+        f.closeFile()
+        return nil, fmt.Errorf("[dump file] Unknown compression '%s'", compression)
+    }
+
+    if f.compressor != nil {
+        f.writer = f.compressor
+    }
+
+    return f, nil
+}
+func (f *dumpFile)write(data []byte) error {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+
+    _, err := f.writer.Write(data)
+    return err
+}
+// WriteStatement writes query terminated by semicolon
+func (f *dumpFile)WriteStatement(query string) error {
+    query = strings.TrimRight(query, "; \t\r\n")
+
+    return f.write([]byte(query + ";\n"))
+}
+// WriteRoutine writes trigger or procedure body, which contains semicolons itself
+func (f *dumpFile)WriteRoutine(query string) error {
+    query = strings.TrimRight(query, "; \t\r\n")
+
+    return f.write([]byte(fmt.Sprintf("DELIMITER ;;\n%s ;;\nDELIMITER ;\n", query)))
+}
+func (f *dumpFile)WriteHeader(host, dbName, serverVersion string) error {
+    header := bytes.Buffer{}
+
+    header.WriteString("-- BeSync dump\n--\n")
+    header.WriteString(fmt.Sprintf("-- Host: %s    Database: %s\n", host, dbName))
+    header.WriteString("-- ------------------------------------------------------\n")
+    header.WriteString(fmt.Sprintf("-- Server version\t%s\n\n", serverVersion))
+
+    header.WriteString("/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */;\n")
+    header.WriteString("/*!40101 SET @OLD_CHARACTER_SET_RESULTS=@@CHARACTER_SET_RESULTS */;\n")
+    header.WriteString("/*!40101 SET @OLD_COLLATION_CONNECTION=@@COLLATION_CONNECTION */;\n")
+    // data is selected with binary charset, so it's written as is
+    header.WriteString("/*!40101 SET NAMES binary */;\n")
+    header.WriteString("/*!40014 SET @OLD_UNIQUE_CHECKS=@@UNIQUE_CHECKS, UNIQUE_CHECKS=0 */;\n")
+    header.WriteString("/*!40014 SET @OLD_FOREIGN_KEY_CHECKS=@@FOREIGN_KEY_CHECKS, FOREIGN_KEY_CHECKS=0 */;\n")
+    header.WriteString("/*!40101 SET @OLD_SQL_MODE=@@SQL_MODE, SQL_MODE='ALLOW_INVALID_DATES,NO_AUTO_VALUE_ON_ZERO' */;\n\n")
+
+    return f.write(header.Bytes())
+}
+// Footer is written only after successful dump, so incomplete dump may be recognized by its absence
+func (f *dumpFile)WriteFooter() error {
+    footer := bytes.Buffer{}
+
+    footer.WriteString("\n/*!40101 SET SQL_MODE=@OLD_SQL_MODE */;\n")
+    footer.WriteString("/*!40014 SET FOREIGN_KEY_CHECKS=@OLD_FOREIGN_KEY_CHECKS */;\n")
+    footer.WriteString("/*!40014 SET UNIQUE_CHECKS=@OLD_UNIQUE_CHECKS */;\n")
+    footer.WriteString("/*!40101 SET CHARACTER_SET_CLIENT=@OLD_CHARACTER_SET_CLIENT */;\n")
+    footer.WriteString("/*!40101 SET CHARACTER_SET_RESULTS=@OLD_CHARACTER_SET_RESULTS */;\n")
+    footer.WriteString("/*!40101 SET COLLATION_CONNECTION=@OLD_COLLATION_CONNECTION */;\n\n")
+    footer.WriteString(fmt.Sprintf("-- Dump completed on %s\n", time.Now().Format("2006-01-02 15:04:05")))
+
+    return f.write(footer.Bytes())
+}
+func (f *dumpFile)Close() error {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+
+    if f.compressor != nil {
+        if err := f.compressor.Close(); err != nil {
+            f.closeFile()
+            return err
+        }
+    }
+
+    if err := f.buffer.Flush(); err != nil {
+        f.closeFile()
+        return err
+    }
+
+    return f.closeFile()
+}
+func (f *dumpFile)closeFile() error {
+    if f.file == nil {
+        return nil
+    }
+
+    return f.file.Close()
+}
+
+var sqlEscaper = strings.NewReplacer(
+    "\\", "\\\\",
+    "'", "\\'",
+    "\x00", "\\0",
+    "\n", "\\n",
+    "\r", "\\r",
+    "\x1a", "\\Z",
+)
+
+// Writes value as sql literal. Binary values are written in hex, so dump doesn't depend on its charset
+func writeSqlValue(buf *bytes.Buffer, col *inspector.Column, value interface{}) {
+    if value == nil {
+        buf.WriteString("NULL")
+        return
+    }
+
+    data := value.([]byte)
+
+    switch {
+    case col.IsBlob():
+        if len(data) == 0 {
+            buf.WriteString("''")
+            return
+        }
+
+        buf.WriteString("0x")
+        buf.WriteString(hex.EncodeToString(data))
+    case col.IsNumeric:
+        buf.Write(data)
+    default:
+        buf.WriteString("'")
+        buf.WriteString(sqlEscaper.Replace(string(data)))
+        buf.WriteString("'")
+    }
+}
@@ -0,0 +1,214 @@
+package proxy
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "sync"
+)
+
+const (
+    LAYOUT_SINGLE = "single" // everything in one file
+    LAYOUT_TABLE  = "table"  // schema.sql, objects.sql and data file per table
+    LAYOUT_CHUNK  = "chunk"  // schema.sql, objects.sql and data file per table chunk
+)
+
+const (
+    SECTION_SCHEMA  = "schema"  // tables
+    SECTION_OBJECTS = "objects" // views, triggers and procedures. Written after data, so triggers don't fire on import
+)
+
+const DUMP_DATA_DIR = "data"
+
+// Set of dump files. Directory layouts are restored by import mode in parallel
+type dumpOutput struct {
+    settings      *OutputSettings
+    host          string
+    dbName        string
+    serverVersion string
+
+    mutex         *sync.Mutex
+    sections      map[string]*dumpFile
+    tableFiles    map[string]*sharedDumpFile
+}
+
+// Data file of table, which is used by several chunks at the same time
+type sharedDumpFile struct {
+    file *dumpFile
+    refs int
+}
+
+func openDumpOutput(settings *OutputSettings, host, dbName, serverVersion string) (*dumpOutput, error) {
+    o := &dumpOutput{
+        settings: settings,
+        host: host,
+        dbName: dbName,
+        serverVersion: serverVersion,
+        mutex: &sync.Mutex{},
+        sections: make(map[string]*dumpFile),
+        tableFiles: make(map[string]*sharedDumpFile),
+    }
+
+    switch o.layout() {
+    case LAYOUT_SINGLE:
+        file, err := o.openFile(settings.Path, false)
+        if err != nil {
+            return nil, err
+        }
+
+        o.sections[SECTION_SCHEMA] = file
+        o.sections[SECTION_OBJECTS] = file
+    case LAYOUT_TABLE, LAYOUT_CHUNK:
+        if settings.Path == "-" {
+            return nil, fmt.Errorf("[dump output] Layout '%s' cannot be written to stdout", o.layout())
+        }
+
+        // table files are opened in append mode, so old dump would be mixed with new one
+        if _, err := os.Stat(o.sectionPath(SECTION_SCHEMA)); err == nil {
+            return nil, fmt.Errorf("[dump output] Directory %s already contains dump", settings.Path)
+        }
+
+        if err := os.MkdirAll(filepath.Join(settings.Path, DUMP_DATA_DIR), 0755); err != nil {
+            return nil, err
+        }
+
+        for _, section := range []string{SECTION_SCHEMA, SECTION_OBJECTS} {
+            file, err := o.openFile(o.sectionPath(section), false)
+            if err != nil {
+                o.Close()
+                return nil, err
+            }
+
+            o.sections[section] = file
+        }
+    default:
+        return nil, fmt.Errorf("[dump output] Unknown layout '%s'", settings.Layout)
+    }
+
+    return o, nil
+}
+func (o *dumpOutput)layout() string {
+    if o.settings.Layout == "" {
+        return LAYOUT_SINGLE
+    }
+
+    return o.settings.Layout
+}
+func (o *dumpOutput)openFile(path string, appendMode bool) (*dumpFile, error) {
+    file, err := openDumpFile(path, o.settings.Compression, appendMode)
+    if err != nil {
+        return nil, err
+    }
+
+    if err := file.WriteHeader(o.host, o.dbName, o.serverVersion); err != nil {
+        file.Close()
+        return nil, err
+    }
+
+    return file, nil
+}
+func (o *dumpOutput)sectionPath(section string) string {
+    return filepath.Join(o.settings.Path, section + ".sql" + compressionExt(o.settings.Compression))
+}
+func (o *dumpOutput)dataPath(name string) string {
+    return filepath.Join(o.settings.Path, DUMP_DATA_DIR, name + ".sql" + compressionExt(o.settings.Compression))
+}
+// Section returns file for schema or objects statements
+func (o *dumpOutput)Section(section string) *dumpFile {
+    return o.sections[section]
+}
+// DataFile returns file for rows of table chunk. File must be released after chunk is written
+func (o *dumpOutput)DataFile(tableName string, chunkIndex int) (*dumpFile, error) {
+    switch o.layout() {
+    case LAYOUT_CHUNK:
+        return o.openFile(o.dataPath(fmt.Sprintf("%s.%d", tableName, chunkIndex)), false)
+    case LAYOUT_TABLE:
+        o.mutex.Lock()
+        defer o.mutex.Unlock()
+
+        shared, ok := o.tableFiles[tableName]
+        if !ok {
+            file, err := o.openFile(o.dataPath(tableName), true)
+            if err != nil {
+                return nil, err
+            }
+
+            shared = &sharedDumpFile{file: file}
+            o.tableFiles[tableName] = shared
+        }
+
+        shared.refs++
+
+        return shared.file, nil
+    }
+
+    return o.sections[SECTION_SCHEMA], nil
+}
+// ReleaseDataFile closes data file, when no more chunks write to it
+func (o *dumpOutput)ReleaseDataFile(tableName string, file *dumpFile) error {
+    switch o.layout() {
+    case LAYOUT_CHUNK:
+        return file.Close()
+    case LAYOUT_TABLE:
+        o.mutex.Lock()
+        defer o.mutex.Unlock()
+
+        shared, ok := o.tableFiles[tableName]
+        if !ok {
+            return nil
+        }
+
+        shared.refs--
+        if shared.refs > 0 {
+            return nil
+        }
+
+        delete(o.tableFiles, tableName)
+
+        return shared.file.Close()
+    }
+
+    return nil
+}
+// Footer is written to objects section, which is written last
+func (o *dumpOutput)WriteFooter() error {
+    return o.sections[SECTION_OBJECTS].WriteFooter()
+}
+func (o *dumpOutput)Close() error {
+    o.mutex.Lock()
+    defer o.mutex.Unlock()
+
+    var firstErr error
+    closed := make(map[*dumpFile]bool)
+
+    for _, file := range o.sections {
+        if closed[file] {
+            continue
+        }
+
+        if err := file.Close(); err != nil && firstErr == nil {
+            firstErr = err
+        }
+
+        closed[file] = true
+    }
+
+    for _, shared := range o.tableFiles {
+        if err := shared.file.Close(); err != nil && firstErr == nil {
+            firstErr = err
+        }
+    }
+
+    return firstErr
+}
+
+func compressionExt(compression string) string {
+    switch compression {
+    case COMPRESSION_GZIP:
+        return ".gz"
+    case COMPRESSION_ZSTD:
+        return ".zst"
+    }
+
+    return ""
+}
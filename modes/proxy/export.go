@@ -14,6 +14,8 @@ import (
     "github.com/jeffail/tunny"
     "github.com/hashicorp/go-version"
     "strings"
+    "errors"
+    "context"
 )
 
 type exporter struct {
@@ -28,20 +30,50 @@ type exporter struct {
     proxyInfo          *ProxyStartResponse
     workPool           *tunny.WorkPool
     sourceMysqlVersion *version.Version
+
+    ctx                context.Context
+    cancel             context.CancelFunc
+    errMutex           *sync.Mutex
+    err                error // first error of dump
+    progress           *progress
+    checkpoints        *checkpoints
+    resume             bool // skip objects and chunks saved in checkpoints
+    verifyOnly         bool // compare source and target without dump
+    importOnly         bool // restore dump file into target
+    verifyResult       *VerifyResult
+    output             *dumpOutput // output files if dump is written to file
+    binlogPosition     *BinlogPosition // source binlog position of dump snapshot, then of applied events
+    cutoverCh          chan struct{}
+    onFollow           func() // called when follower starts tailing binlog
+    rename             *renamer // target names of objects, nil if they are not renamed
+    parent             *exporter   // exporter of task, if exporter copies one database of multi-database task
+    database           string      // source database of multi-database task, empty for single database
+    databases          []*exporter // exporters of databases of multi-database task
+    throttle           *throttle   // rate limits and load check of workers, nil if they are not throttled
+    swapped            bool        // tables of shadow databases are swapped into target
+    shadowCheck        bool        // views and routines are created in shadow databases to check them before swap
 }
 
+var ErrDumpCancelled = errors.New("Dump was cancelled")
+
 type DbSettings struct {
-    Name     string
-    Host     string
-    Port     int
-    User     string
-    Password string
+    Name         string
+    Host         string
+    Port         int
+    User         string
+    Password     string
+    PasswordEnv  string // environment variable with password
+    PasswordFile string // file with password
+    TLS          *TLSSettings
 }
 
 type ProxySettings struct {
-    Host       string
-    Port       int
-    ListenAddr string
+    Host        string
+    Port        int
+    ListenAddr  string
+    TLS         *TLSSettings    // https for api and TLS for mysql connections to proxy listeners
+    Auth        *ApiCredentials // credentials of proxy daemon api
+    IdleTimeout int             // seconds without commands, after which proxy daemon stops listeners. 3600 by default
 }
 
 type ExportSettings struct {
@@ -49,21 +81,79 @@ type ExportSettings struct {
     WorkersCount          int             // Максимальное количество воркеров, выполняющих экспорт
     WithoutProxy          bool            // Не использовать прокси. В этом случае сразу подключаемся к targetDb
     MaxWorkersOnLastTable int             // Максимальное количество воркеров на последней таблице
-    TableChunkSize        int64
+    TableChunkSize        int64           // rows of the first chunks of table, 350000 by default
+    ChunkTargetSeconds    int             // next chunks are sized by throughput, so their copy takes about this time. 30 by default
+    MaxChunkSize          int64           // max rows of chunk, 10 * TableChunkSize by default
 
     AddDropTrigger        bool            // Add DROP TRIGGER IF EXISTS before CREATE ANY TRIGGER
     AddDropTable          bool            // Add DROP TABLE statement before each CREATE TABLE statement
     AddDropProcedure      bool            // add DROP PROCEDURE statement before dump each procedure
+    AddDropFunction       bool            // add DROP FUNCTION statement before dump each function
+    AddDropEvent          bool            // add DROP EVENT statement before dump each event
     NoCreateTable         bool            //? Do not write CREATE TABLE statements that re-create each dumped table
 
     NoData                bool            // Do not dump table contents
     IncludeTables         []string        // list of tables/views to dump. If empty, all tables was processed
     ExcludeTables         []string        // list of tables/views to exclude from dump. If empty, no tables was excluded
     ExcludeTriggers       []string        // list of triggers to exclude from dump. If empty, no triggers was excluded
-    NoViews               bool            // Do not dump views structure (n/u)
-    NoProcedures          bool            // Do not dump any procedures (n/u)
+    NoViews               bool            // Do not dump views structure
+    NoProcedures          bool            // Do not dump any procedures
+    NoFunctions           bool            // Do not dump any stored functions
+    NoEvents              bool            // Do not dump any scheduled events
     NoLockTables          bool
     NoTransaction         bool
+    TableFilters          map[string]string // table -> WHERE condition of copied rows
+    TableLimits           map[string]int64  // table -> count of copied rows, last rows by primary (or unique) key are copied
+    Masking               map[string]*MaskRule // "table.column" -> transform of copied values
+    MaskingSalt           string          // salt of hash based transforms, so masked values are the same for every sync
+    MaskingSaltEnv        string          // environment variable with MaskingSalt
+    MaskingSaltFile       string          // file with MaskingSalt
+    OnConflict            string          // handling of rows, which already exist in target: error (default), ignore, replace, update
+    TableOnConflict       map[string]string // table -> OnConflict of table
+    TruncateBeforeInsert  bool            // delete all rows of existing target tables before copy
+    ShadowDatabase        bool            // copy tables into shadow database and swap them into target after successful sync
+    AutoResume            bool            // resume task automatically, if it was interrupted by restart of daemon
+    MaxRowsPerSecond        int64         // rows copied by all workers per second, 0 - unlimited
+    MaxBytesPerSecond       int64         // bytes copied by all workers per second, 0 - unlimited
+    MaxWorkerRowsPerSecond  int64         // rows copied by one worker per second, 0 - unlimited
+    MaxWorkerBytesPerSecond int64         // bytes copied by one worker per second, 0 - unlimited
+    LoadCheck             *LoadCheckSettings // pause of workers while servers are overloaded
+}
+
+func (e *ExportSettings)chunkSizing() *tableChunk.Sizing {
+    sizing := &tableChunk.Sizing{
+        InitialRows: e.TableChunkSize,
+        MaxRows: e.MaxChunkSize,
+        TargetDuration: time.Duration(e.ChunkTargetSeconds) * time.Second,
+    }
+
+    if sizing.InitialRows <= 0 {
+        sizing.InitialRows = tableChunk.DEFAULT_CHUNK_SIZE
+    }
+    if sizing.MaxRows <= 0 {
+        sizing.MaxRows = sizing.InitialRows * 10
+    }
+    if sizing.TargetDuration <= 0 {
+        sizing.TargetDuration = 30 * time.Second
+    }
+
+    return sizing
+}
+
+type OutputSettings struct {
+    Type        string // mysql (default) - copy to TargetDb, file - write sql script to Path
+    Path        string // path of sql script, "-" - stdout
+    Compression string // gzip, zstd or empty
+    Layout      string // single (default) - one file, table or chunk - directory with data file per table or chunk
+}
+
+type InputSettings struct {
+    Path string // dump file or directory, which is restored by import
+}
+
+type VerifySettings struct {
+    Enabled   bool   // Verify target after successful dump
+    Algorithm string // Checksum of rows: crc32 (default) or md5
 }
 
 // Exporter settings
@@ -72,100 +162,359 @@ type Settings struct {
     TargetDb *DbSettings
     Proxy    *ProxySettings
     Export   *ExportSettings
+    Verify   *VerifySettings
+    Output   *OutputSettings
+    Input    *InputSettings
+    Follow   *FollowSettings
+    Notify   *NotifySettings
+    Rename   *RenameSettings
+    Databases *DatabasesSettings
+}
+
+// Dump is written to sql file instead of TargetDb
+func (s *Settings)toFile() bool {
+    return s.Output != nil && s.Output.Type == OUTPUT_FILE
+}
+// Source binlog is applied to target after dump
+func (s *Settings)follow() bool {
+    return s.Follow != nil && s.Follow.Enabled
 }
 
 type Schema struct {
-    Tables       []string
-    Views        []string
-    Triggers     []string
-    Procedures   []string
-    TableColumns map[string]map[string]*inspector.Column
+    Tables          []string
+    Views           []string
+    Triggers        []string
+    Procedures      []string
+    Functions       []string
+    Events          []string
+    TableColumns    map[string]map[string]*inspector.Column
+    TableConditions map[string]string // filter and limit of copied rows of table
 }
 
-func MakeExporter(exportSettings *Settings) *exporter {
+func MakeExporter(ctx context.Context, exportSettings *Settings) *exporter {
+    ctx, cancel := context.WithCancel(ctx)
+
     server := &exporter{
         settings: exportSettings,
         dumpId: time.Now().UnixNano(),
         tableColumns: make(map[string]map[string]*inspector.Column),
         schema: &Schema{
             TableColumns: make(map[string]map[string]*inspector.Column),
+            TableConditions: make(map[string]string),
         },
+        ctx: ctx,
+        cancel: cancel,
+        errMutex: &sync.Mutex{},
+        progress: makeProgress(),
+        cutoverCh: make(chan struct{}, 1),
     }
 
     return server
 }
 func (s *exporter)Start() error {
     defer s.endDump() // for graceful shutdown
-    s.startDump()
+
+    var err error
+    if s.importOnly {
+        err = s.startImport()
+    } else if err = s.startDump(); err == nil && !s.isCancelled() {
+        // workers are already stopped, so source snapshots are released while binlog is followed
+        err = s.follow()
+    }
+
+    if err != nil {
+        s.fail(err)
+    }
+
+    if err := s.firstError(); err != nil {
+        return err
+    }
+
+    if s.isCancelled() {
+        return ErrDumpCancelled
+    }
 
     return nil
 }
-func (s *exporter)startDump() {
-    db, err := s.newSourceDbConnection()
+// Cancel asks running dump to stop. Chunks which are already in work are interrupted by workers,
+// all other jobs are skipped
+func (s *exporter)Cancel() {
+    log.Infof("[export] Cancelling dump")
+    s.cancel()
+}
+// Progress returns snapshot of dump progress. Safe to call from any goroutine
+func (s *exporter)Progress() *ExportProgress {
+    return s.progress.Snapshot()
+}
+func (s *exporter)isCancelled() bool {
+    return s.ctx.Err() != nil
+}
+// Saves first error and stops all other jobs
+func (s *exporter)fail(err error) {
+    if s.parent != nil {
+        s.parent.fail(err)
+        return
+    }
+
+    if err == ErrDumpCancelled {
+        return
+    }
+
+    s.errMutex.Lock()
+    if s.err == nil {
+        log.Errorf("[export] %v", err)
+        s.err = err
+    }
+    s.errMutex.Unlock()
+
+    s.cancel()
+}
+func (s *exporter)firstError() error {
+    if s.parent != nil {
+        return s.parent.firstError()
+    }
 
+    s.errMutex.Lock()
+    defer s.errMutex.Unlock()
+
+    return s.err
+}
+func (s *exporter)startDump() error {
+    if err := s.checkOutput(); err != nil {
+        return wrapExportError(PHASE_PREPARE, "", "", err)
+    }
+
+    db, err := s.newSourceDbConnection()
     if err != nil {
-        log.Panic(err)
+        return wrapExportError(PHASE_PREPARE, "", "", err)
     }
 
     s.sourceDb = db
 
     if err := s.determineSourceMysqlVersion(); err != nil {
-        log.Panic(err)
+        return wrapExportError(PHASE_PREPARE, "", "", err)
     }
 
     s.inspector = inspector.MakeMysqlInspector(db, s.sourceMysqlVersion)
 
-    if err := s.loadSchema(); err != nil {
-        log.Panic(err)
+    if err := s.checkFollow(); err != nil {
+        return wrapExportError(PHASE_PREPARE, "", "", err)
+    }
+
+    if err := s.loadDatabases(); err != nil {
+        return err
+    }
+
+    if s.isCancelled() {
+        return nil
     }
 
     if err := s.prepareProxy(); err != nil {
-        log.Panic(err)
+        return wrapExportError(PHASE_PREPARE, "", "", err)
+    }
+
+    if err := s.openDumpOutput(); err != nil {
+        return wrapExportError(PHASE_PREPARE, "", "", err)
     }
 
     if err := s.lockAllTables(); err != nil {
-        log.Panic(err)
+        return wrapExportError(PHASE_PREPARE, "", "", err)
     }
 
+    s.throttle = makeThrottle(s.settings.Export, s.progress)
+
     s.workPool, err = s.createWorkerPool()
     if err != nil {
-        log.Panic(err)
+        s.unlockAllTables()
+        return wrapExportError(PHASE_PREPARE, "", "", err)
     }
     defer s.workPool.Close()
 
+    stopLoadCheck, err := s.startLoadCheck()
+    if err != nil {
+        s.unlockAllTables()
+        return wrapExportError(PHASE_PREPARE, "", "", err)
+    }
+    defer stopLoadCheck()
+
+    if err := s.recordBinlogPosition(); err != nil {
+        s.unlockAllTables()
+        return wrapExportError(PHASE_PREPARE, "", "", err)
+    }
+
+    for _, database := range s.databaseExporters() {
+        if err := database.loadTableConditions(); err != nil {
+            s.unlockAllTables()
+            return wrapExportError(PHASE_PREPARE, "", "", err)
+        }
+    }
+
     if err := s.unlockAllTables(); err != nil {
-        log.Panic(err)
+        return wrapExportError(PHASE_PREPARE, "", "", err)
+    }
+
+    if s.verifyOnly {
+        if err := s.verifyTables(); err != nil {
+            return err
+        }
+
+        s.progress.setPhase(PHASE_FINISHED)
+
+        return nil
+    }
+
+    s.progress.setPhase(PHASE_SCHEMA)
+    if err := s.createDatabases(); err != nil {
+        return wrapExportError(PHASE_SCHEMA, "", "", err)
+    }
+
+    if err := s.createShadowDatabases(); err != nil {
+        return wrapExportError(PHASE_SCHEMA, "", "", err)
     }
 
     if err := s.exportTables(); err != nil {
-        log.Panic(err)
+        return err
+    }
+
+    if s.isCancelled() {
+        return nil
     }
 
+    // target stays untouched until tables of shadow databases are copied and verified
+    if s.settings.shadowDatabase() {
+        if s.settings.Verify != nil && s.settings.Verify.Enabled && !s.swapped {
+            if err := s.verifyTables(); err != nil {
+                return err
+            }
+
+            if s.isCancelled() {
+                return nil
+            }
+        }
+
+        s.progress.setPhase(PHASE_VIEWS)
+        if err := s.checkShadowObjects(); err != nil {
+            return err
+        }
+
+        if s.isCancelled() {
+            return nil
+        }
+
+        s.progress.setPhase(PHASE_SWAP)
+        if err := s.swapShadowDatabases(); err != nil {
+            return wrapExportError(PHASE_SWAP, "", "", err)
+        }
+    }
+
+    s.progress.setPhase(PHASE_VIEWS)
     if err := s.exportViews(); err != nil {
-        log.Panic(err)
+        return err
     }
 
-    if err := s.exportRoutines(); err != nil {
-        log.Panic(err)
+    if s.isCancelled() {
+        return nil
     }
+
+    s.progress.setPhase(PHASE_ROUTINES)
+    for _, database := range s.databaseExporters() {
+        if err := database.exportRoutines(); err != nil {
+            return err
+        }
+
+        if s.isCancelled() {
+            return nil
+        }
+    }
+
+    if s.isCancelled() {
+        return nil
+    }
+
+    if s.output != nil {
+        if err := s.output.WriteFooter(); err != nil {
+            return wrapExportError(PHASE_ROUTINES, "", "", err)
+        }
+    }
+
+    // workers still keep snapshot of dump, so target is compared with exactly dumped data
+    if s.settings.Verify != nil && s.settings.Verify.Enabled && !s.settings.shadowDatabase() {
+        if err := s.verifyTables(); err != nil {
+            return err
+        }
+    }
+
+    s.progress.setPhase(PHASE_FINISHED)
+
+    return nil
+}
+func (s *exporter)checkOutput() error {
+    if s.settings.Output == nil {
+        return nil
+    }
+
+    switch s.settings.Output.Type {
+    case "", OUTPUT_MYSQL:
+        return nil
+    case OUTPUT_FILE:
+    default:
+        return fmt.Errorf("Unknown output type '%s'", s.settings.Output.Type)
+    }
+
+    if s.verifyOnly || (s.settings.Verify != nil && s.settings.Verify.Enabled) {
+        return fmt.Errorf("Verification is not supported for file output")
+    }
+
+    return nil
+}
+func (s *exporter)openDumpOutput() error {
+    if !s.settings.toFile() {
+        return nil
+    }
+
+    output, err := openDumpOutput(s.settings.Output, s.settings.SourceDb.Host, s.settings.SourceDb.Name, s.sourceMysqlVersion.String())
+    if err != nil {
+        return err
+    }
+
+    s.output = output
+    log.Infof("[export] Writing dump to %s", s.settings.Output.Path)
+
+    return nil
+}
+// Runs job on any free worker and waits for result
+func (s *exporter)runJob(job interface{}) error {
+    return jobError(s.task().workPool.SendWork(job))
 }
 func (s *exporter)newSourceDbConnection() (*sql.DB, error) {
+    return openDbConnection(s.settings.SourceDb)
+}
+// Single connection to server of settings
+func openDbConnection(settings *DbSettings) (*sql.DB, error) {
     mysqlConfig := &mysql.Config{
-        User: s.settings.SourceDb.User,
-        Passwd: s.settings.SourceDb.Password,
-        Addr: fmt.Sprintf("%s:%v", s.settings.SourceDb.Host, s.settings.SourceDb.Port),
+        User: settings.User,
+        Passwd: settings.Password,
+        Addr: fmt.Sprintf("%s:%v", settings.Host, settings.Port),
         Net: "tcp",
-        DBName: s.settings.SourceDb.Name,
+        DBName: settings.Name,
         Params: map[string]string{
             "charset": "binary",
         },
     }
 
+    if err := setMysqlTLS(mysqlConfig, settings.TLS, settings.Host); err != nil {
+        return nil, err
+    }
+
     db, err := sql.Open("mysql", mysqlConfig.FormatDSN())
+    if err != nil {
+        return nil, err
+    }
+
     db.SetMaxIdleConns(1)
     db.SetMaxOpenConns(1)
 
-    return db, err
+    return db, nil
 }
 func (s *exporter)determineSourceMysqlVersion() error {
     row := s.sourceDb.QueryRow("SELECT VERSION()")
@@ -184,53 +533,29 @@ func (s *exporter)determineSourceMysqlVersion() error {
     return nil
 }
 func (s *exporter)exportTables() error {
-    var wgSchema sync.WaitGroup = sync.WaitGroup{}
-
     maxOnLast := s.settings.Export.MaxWorkersOnLastTable
     if maxOnLast < 1 {
         maxOnLast = 1
     }
 
     cm := tableChunk.MakeManager(s.settings.Export.WorkersCount, maxOnLast)
+    cm.SetSizing(s.settings.Export.chunkSizing())
+    cm.OnDone(metrics.chunkDone)
+    cm.OnCut(s.checkpoints.saveChunks)
+    s.progress.setChunkManager(cm)
 
-    // create tables first
-    tablesToDump := make([]string, 0)
-    for _, tableName := range s.schema.Tables {
-        columns, err := s.inspector.ColumnTypes(tableName)
-        if err != nil {
+    // chunks which may be partially copied by interrupted dump
+    dirtyChunks := make(map[*tableChunk.Chunk]bool)
+
+    // create tables of all databases first, chunks of all tables are copied by the same workers
+    for _, database := range s.databaseExporters() {
+        if err := database.createTables(cm, dirtyChunks); err != nil {
             return err
         }
 
-        s.schema.TableColumns[tableName] = columns
-        log.Debugf("[export] Inspected %v columns: %+v", tableName, columns)
-
-        tablesToDump = append(tablesToDump, tableName)
-
-        if !s.settings.Export.NoData {
-            chunks, err := tableChunk.CalculateChunksForTable(tableName, s.settings.Export.TableChunkSize, s.inspector)
-            if err != nil {
-                return err
-            }
-
-            for _, chunk := range chunks {
-                cm.AddChunk(chunk)
-            }
+        if s.isCancelled() {
+            return nil
         }
-
-        wgSchema.Add(1)
-
-        s.workPool.SendWorkAsync(&jobCreateTable{
-            tableName: tableName,
-            withDropTable: s.settings.Export.AddDropTable,
-        }, func(result interface{}, err error) {
-            if resultErr, ok := result.(error); ok || err != nil {
-                panic(fmt.Sprintf("[export] create table worker error: %v%v", resultErr, err))
-            }
-
-            wgSchema.Done()
-        })
-
-        wgSchema.Wait()
     }
 
     if s.settings.Export.NoData {
@@ -238,10 +563,17 @@ func (s *exporter)exportTables() error {
         return nil
     }
 
+    s.progress.setPhase(PHASE_TABLES)
+
     var wgData sync.WaitGroup = sync.WaitGroup{}
 
     for {
-        chunk := cm.GetNext()
+        if s.isCancelled() {
+            log.Infof("[export] Dump stopped, waiting for chunks in progress")
+            break
+        }
+
+        chunk := cm.GetNext(s.ctx)
         if chunk == nil {
             break
         }
@@ -249,182 +581,539 @@ func (s *exporter)exportTables() error {
         contextLogger := log.WithField("processing now", cm.GetProcessing())
         contextLogger.Debugf("[export] got chunk: %+v", chunk)
 
+        if err := s.checkpoints.setChunkStatus(chunk, CHUNK_STARTED); err != nil {
+            s.fail(wrapExportError(PHASE_TABLES, chunk.Key(), chunk.Condition, err))
+            break
+        }
+
         wgData.Add(1)
 
-        log.Debugf("[export] TABLE [%v] CHUNK IS %+v", chunk.TableName, chunk)
+        database := s.chunkDatabase(chunk)
+        onConflict := database.tableOnConflict(chunk.TableName)
+
+        log.Debugf("[export] TABLE [%v] CHUNK IS %+v", chunk.Key(), chunk)
         s.workPool.SendWorkAsync(&jobExportTable{
+            jobDatabase: database.jobDatabase(),
             tableName: chunk.TableName,
             condition: chunk.Condition,
-            columnInfo: s.schema.TableColumns[chunk.TableName],
+            filter: database.tableCondition(chunk.TableName),
+            masking: database.tableMasking(chunk.TableName),
+            columnInfo: database.schema.TableColumns[chunk.TableName],
             rowsPerStmt: s.settings.Export.MaxRowsPerStatement,
-        }, func(tableName string) func(result interface{}, err error) {
+            chunkIndex: chunk.Index,
+            progress: s.progress,
+            onConflict: onConflict,
+            // rows of interrupted chunk are overwritten or skipped by other modes
+            cleanup: dirtyChunks[chunk] && onConflict == ON_CONFLICT_ERROR,
+        }, func(chunk *tableChunk.Chunk) func(result interface{}, err error) {
             return func(result interface{}, err error) {
-                if resultErr, ok := result.(error); ok || err != nil {
-                    panic(fmt.Sprintf("[export][%s] export table worker error: %v%v", chunk.TableName, resultErr, err))
+                defer wgData.Done()
+
+                if copied, ok := result.(*chunkCopied); ok {
+                    defer cm.Done(chunk, copied.rows, copied.bytes)
+                } else {
+                    defer cm.Done(chunk, 0, 0)
                 }
 
-                cm.Done(tableName)
-                wgData.Done()
+                if err := jobError(result, err); err == ErrDumpCancelled {
+                    log.Infof("[export][%s] Chunk export interrupted", chunk.Key())
+                } else if err != nil {
+                    s.fail(wrapExportError(PHASE_TABLES, chunk.Key(), chunk.Condition, err))
+                } else if err := s.checkpoints.setChunkStatus(chunk, CHUNK_DONE); err != nil {
+                    log.Errorf("[export][%s] Failed to save chunk checkpoint: %v", chunk.Key(), err)
+                }
             }
-        }(chunk.TableName))
+        }(chunk))
+    }
+
+    if err := cm.Err(); err != nil {
+        s.fail(wrapExportError(PHASE_TABLES, "", "", err))
     }
 
     log.Debugf("[export] Waiting for table data export")
     wgData.Wait()
-    log.Infof("[export] All tables was exported")
+
+    if !s.isCancelled() {
+        log.Infof("[export] All tables was exported")
+    }
 
     return nil
 }
+// Creates tables of database and adds chunks of their rows to chunk manager
+func (s *exporter)createTables(cm *tableChunk.Manager, dirtyChunks map[*tableChunk.Chunk]bool) error {
+    createdTables, err := s.createdObjects(OBJECT_TABLE)
+    if err != nil {
+        return wrapExportError(PHASE_SCHEMA, "", "", err)
+    }
+
+    for _, tableName := range s.schema.Tables {
+        if s.isCancelled() {
+            return nil
+        }
+
+        tableKey := s.objectKey(tableName)
+
+        columns, err := s.inspector.ColumnTypes(tableName)
+        if err != nil {
+            return wrapExportError(PHASE_SCHEMA, tableKey, "", err)
+        }
+
+        s.schema.TableColumns[tableName] = columns
+        log.Debugf("[export] Inspected %v columns: %+v", tableKey, columns)
+
+        if !s.settings.Export.NoData {
+            estimatedRows, err := s.inspector.EstimateCount(tableName, "", s.tableCondition(tableName))
+            if err != nil {
+                return wrapExportError(PHASE_SCHEMA, tableKey, "", err)
+            }
+
+            s.progress.setEstimate(tableKey, estimatedRows)
+
+            chunks, err := s.tableChunks(tableName, dirtyChunks)
+            if err != nil {
+                return wrapExportError(PHASE_SCHEMA, tableKey, "", err)
+            }
+
+            for _, chunk := range chunks {
+                cm.AddChunk(chunk)
+            }
+        }
+
+        if createdTables[tableKey] {
+            log.Infof("[export] Table %v was created by previous run. Skipping...", tableKey)
+            continue
+        }
+
+        keepTable := s.keepTargetTable(tableName)
+
+        err = s.runJob(&jobCreateTable{
+            jobDatabase: s.jobDatabase(),
+            tableName: tableName,
+            withDropTable: s.settings.Export.AddDropTable && !keepTable,
+            ifNotExists: keepTable,
+            truncate: s.settings.Export.TruncateBeforeInsert,
+        })
+        if err != nil {
+            return wrapExportError(PHASE_SCHEMA, tableKey, "", err)
+        }
+
+        if err := s.checkpoints.objectCreated(OBJECT_TABLE, tableKey); err != nil {
+            return wrapExportError(PHASE_SCHEMA, tableKey, "", err)
+        }
+    }
+
+    return nil
+}
+// Table is added as one key range, chunks are cut from it while table is copied. Cut chunks and rest of range
+// are saved in checkpoints, so resumed dump copies the same chunks and cuts the rest of range
+func (s *exporter)tableChunks(tableName string, dirtyChunks map[*tableChunk.Chunk]bool) ([]*tableChunk.Chunk, error) {
+    if s.resume {
+        saved, err := s.checkpoints.loadChunks(s.database, tableName)
+        if err != nil {
+            return nil, err
+        }
+
+        if saved != nil {
+            chunks := make([]*tableChunk.Chunk, 0, len(saved))
+            for _, savedChunk := range saved {
+                switch savedChunk.status {
+                case CHUNK_DONE:
+                    continue
+                case CHUNK_STARTED:
+                    dirtyChunks[savedChunk.chunk] = true
+                }
+
+                if err := tableChunk.RestoreRange(savedChunk.chunk, s.tableCondition(tableName), s.inspector); err != nil {
+                    return nil, err
+                }
+
+                chunks = append(chunks, savedChunk.chunk)
+            }
+
+            log.Infof("[export] Table %v: %v of %v chunks left from previous run", s.objectKey(tableName), len(chunks), len(saved))
+
+            return chunks, nil
+        }
+    }
+
+    chunk, err := tableChunk.TableRange(tableName, s.tableCondition(tableName), s.inspector)
+    if err != nil {
+        return nil, err
+    }
+
+    chunk.Database = s.database
+    chunks := []*tableChunk.Chunk{chunk}
+
+    if err := s.checkpoints.saveChunks(chunks); err != nil {
+        return nil, err
+    }
+
+    return chunks, nil
+}
+// Views may depend on other views, so tables are created instead of all views first and then replaced by views.
+// Functions used by views must exist when view is created, so they are created before views
 func (s *exporter)exportViews() error {
-    var wgTableViews sync.WaitGroup = sync.WaitGroup{}
+    viewsToCreate := make(map[*exporter][]string)
+
+    for _, database := range s.databaseExporters() {
+        views, err := database.createViewTables()
+        if err != nil {
+            return err
+        }
+
+        if s.isCancelled() {
+            return nil
+        }
+
+        viewsToCreate[database] = views
+    }
+
+    for _, database := range s.databaseExporters() {
+        if err := database.createFunctions(); err != nil {
+            return err
+        }
+
+        if s.isCancelled() {
+            return nil
+        }
+    }
+
+    for _, database := range s.databaseExporters() {
+        if err := database.createViews(viewsToCreate[database]); err != nil {
+            return err
+        }
+
+        if s.isCancelled() {
+            return nil
+        }
+    }
+
+    return nil
+}
+// Returns views of database, which must be created
+func (s *exporter)createViewTables() ([]string, error) {
+    createdViews, err := s.createdObjects(OBJECT_VIEW)
+    if err != nil {
+        return nil, wrapExportError(PHASE_VIEWS, "", "", err)
+    }
 
     viewsToCreate := make([]string, 0)
     for _, viewName := range s.schema.Views {
+        if s.isCancelled() {
+            return nil, nil
+        }
+
+        viewKey := s.objectKey(viewName)
+
+        if createdViews[viewKey] {
+            log.Infof("[export] View %v was created by previous run. Skipping...", viewKey)
+            continue
+        }
+
         columns, err := s.inspector.ColumnTypes(viewName)
         if err != nil {
-            return err
+            return nil, wrapExportError(PHASE_VIEWS, viewKey, "", err)
         }
 
         s.schema.TableColumns[viewName] = columns
         viewsToCreate = append(viewsToCreate, viewName)
 
-        wgTableViews.Add(1)
-
-        s.workPool.SendWorkAsync(&jobCreateViewTable{
+        err = s.runJob(&jobCreateViewTable{
+            jobDatabase: s.jobDatabase(),
             viewName: viewName,
             withDropView: s.settings.Export.AddDropTable,
             columnInfo: columns,
-        }, func(result interface{}, err error) {
-            if resultErr, ok := result.(error); ok || err != nil {
-                panic(fmt.Sprintf("[export] create view worker error: %v%v", resultErr, err))
-            }
-
-            wgTableViews.Done()
         })
-
-        wgTableViews.Wait()
+        if err != nil {
+            return nil, wrapExportError(PHASE_VIEWS, viewKey, "", err)
+        }
     }
 
-    //log.Debugf("[export] Waiting for view table create")
-    //wgTableViews.Wait()
-    //log.Infof("[export] All view tables was exported")
-
-    var wgViews sync.WaitGroup = sync.WaitGroup{}
-    for _, viewName := range viewsToCreate {
-        wgViews.Add(1)
+    return viewsToCreate, nil
+}
+func (s *exporter)createViews(views []string) error {
+    for _, viewName := range views {
+        if s.isCancelled() {
+            return nil
+        }
 
-        s.workPool.SendWorkAsync(&jobCreateView{
-            viewName: viewName,
-        }, func(result interface{}, err error) {
-            if resultErr, ok := result.(error); ok || err != nil {
-                panic(fmt.Sprintf("[export] create view worker error: %v%v", resultErr, err))
-            }
+        viewKey := s.objectKey(viewName)
 
-            wgViews.Done()
-        })
+        if err := s.runJob(&jobCreateView{jobDatabase: s.jobDatabase(), viewName: viewName}); err != nil {
+            return wrapExportError(PHASE_VIEWS, viewKey, "", err)
+        }
 
-        wgViews.Wait()
+        if err := s.objectCreated(OBJECT_VIEW, viewKey); err != nil {
+            return wrapExportError(PHASE_VIEWS, viewKey, "", err)
+        }
     }
 
     return nil
 }
 func (s *exporter)exportRoutines() error {
-    var wgTriggers sync.WaitGroup = sync.WaitGroup{}
+    createdTriggers, err := s.createdObjects(OBJECT_TRIGGER)
+    if err != nil {
+        return wrapExportError(PHASE_ROUTINES, "", "", err)
+    }
 
     for _, triggerName := range s.schema.Triggers {
-        wgTriggers.Add(1)
+        if s.isCancelled() {
+            return nil
+        }
+
+        triggerKey := s.objectKey(triggerName)
+
+        if createdTriggers[triggerKey] {
+            log.Infof("[export] Trigger %v was created by previous run. Skipping...", triggerKey)
+            continue
+        }
 
-        s.workPool.SendWorkAsync(&jobCreateTrigger{
+        err := s.runJob(&jobCreateTrigger{
+            jobDatabase: s.jobDatabase(),
             triggerName: triggerName,
             withDropTrigger: s.settings.Export.AddDropTrigger,
-        }, func(result interface{}, err error) {
-            if result != nil {
-                log.Errorf("[export][create trigger] Error: %v", result)
-            }
-            wgTriggers.Done()
         })
 
-        wgTriggers.Wait()
+        // broken trigger doesn't fail whole dump
+        if err != nil {
+            log.Errorf("[export][create trigger] Error: %v", err)
+        } else if err := s.objectCreated(OBJECT_TRIGGER, triggerKey); err != nil {
+            return wrapExportError(PHASE_ROUTINES, triggerKey, "", err)
+        }
     }
 
-    var wgProcedures sync.WaitGroup = sync.WaitGroup{}
+    createdProcedures, err := s.createdObjects(OBJECT_PROCEDURE)
+    if err != nil {
+        return wrapExportError(PHASE_ROUTINES, "", "", err)
+    }
 
     for _, procName := range s.schema.Procedures {
-        wgProcedures.Add(1)
-        s.workPool.SendWorkAsync(&jobCreateProcedure{
+        if s.isCancelled() {
+            return nil
+        }
+
+        procKey := s.objectKey(procName)
+
+        if createdProcedures[procKey] {
+            log.Infof("[export] Procedure %v was created by previous run. Skipping...", procKey)
+            continue
+        }
+
+        err := s.runJob(&jobCreateProcedure{
+            jobDatabase: s.jobDatabase(),
             procName: procName,
             withDropProcedure: s.settings.Export.AddDropProcedure,
-        }, func(result interface{}, err error) {
-            if resultErr, ok := result.(error); ok || err != nil {
-                panic(fmt.Sprintf("[export] create routine worker error: %v%v", resultErr, err))
-            }
+        })
+        if err != nil {
+            return wrapExportError(PHASE_ROUTINES, procKey, "", err)
+        }
+
+        if err := s.objectCreated(OBJECT_PROCEDURE, procKey); err != nil {
+            return wrapExportError(PHASE_ROUTINES, procKey, "", err)
+        }
+    }
+
+    // scheduler would run events on tables of shadow database, so they are created only in target
+    if s.task().shadowCheck {
+        return nil
+    }
+
+    createdEvents, err := s.createdObjects(OBJECT_EVENT)
+    if err != nil {
+        return wrapExportError(PHASE_ROUTINES, "", "", err)
+    }
+
+    for _, eventName := range s.schema.Events {
+        if s.isCancelled() {
+            return nil
+        }
 
-            wgProcedures.Done()
+        eventKey := s.objectKey(eventName)
+
+        if createdEvents[eventKey] {
+            log.Infof("[export] Event %v was created by previous run. Skipping...", eventKey)
+            continue
+        }
+
+        err := s.runJob(&jobCreateEvent{
+            jobDatabase: s.jobDatabase(),
+            eventName: eventName,
+            withDropEvent: s.settings.Export.AddDropEvent,
         })
+        if err != nil {
+            return wrapExportError(PHASE_ROUTINES, eventKey, "", err)
+        }
 
-        wgProcedures.Wait()
+        if err := s.objectCreated(OBJECT_EVENT, eventKey); err != nil {
+            return wrapExportError(PHASE_ROUTINES, eventKey, "", err)
+        }
     }
 
     return nil
 }
+func (s *exporter)createFunctions() error {
+    createdFunctions, err := s.createdObjects(OBJECT_FUNCTION)
+    if err != nil {
+        return wrapExportError(PHASE_VIEWS, "", "", err)
+    }
+
+    for _, funcName := range s.schema.Functions {
+        if s.isCancelled() {
+            return nil
+        }
+
+        funcKey := s.objectKey(funcName)
+
+        if createdFunctions[funcKey] {
+            log.Infof("[export] Function %v was created by previous run. Skipping...", funcKey)
+            continue
+        }
+
+        err := s.runJob(&jobCreateFunction{
+            jobDatabase: s.jobDatabase(),
+            funcName: funcName,
+            withDropFunction: s.settings.Export.AddDropFunction,
+        })
+        if err != nil {
+            return wrapExportError(PHASE_VIEWS, funcKey, "", err)
+        }
+
+        if err := s.objectCreated(OBJECT_FUNCTION, funcKey); err != nil {
+            return wrapExportError(PHASE_VIEWS, funcKey, "", err)
+        }
+    }
+
+    return nil
+}
+// Returns objects created by previous run of resumed dump. Objects of shadow check are created again in target
+func (s *exporter)createdObjects(objectType string) (map[string]bool, error) {
+    if !s.resume || s.task().shadowCheck {
+        return make(map[string]bool), nil
+    }
+
+    return s.checkpoints.createdObjects(objectType)
+}
+func (s *exporter)objectCreated(objectType, name string) error {
+    if s.task().shadowCheck {
+        return nil
+    }
+
+    return s.checkpoints.objectCreated(objectType, name)
+}
 func (s *exporter)createWorkerPool() (*tunny.WorkPool, error) {
     var host string
     var ports []int
 
-    if s.settings.Export.WithoutProxy {
-        host = s.settings.TargetDb.Host
+    // workers of file dump don't connect to target
+    if s.output == nil {
+        if s.settings.Export.WithoutProxy {
+            host = s.settings.TargetDb.Host
 
-        ports = make([]int, s.settings.Export.WorkersCount)
-        for i, _ := range ports {
-            ports[i] = s.settings.TargetDb.Port
+            ports = make([]int, s.settings.Export.WorkersCount)
+            for i, _ := range ports {
+                ports[i] = s.settings.TargetDb.Port
+            }
+        } else {
+            host = s.settings.Proxy.ListenAddr
+            ports = s.proxyInfo.Ports
         }
-    } else {
-        host = s.settings.Proxy.ListenAddr
-        ports = s.proxyInfo.Ports
     }
 
     log.Debugf("[export] Creating worker pool with %v workers", s.settings.Export.WorkersCount)
 
     workers := make([]tunny.TunnyWorker, s.settings.Export.WorkersCount)
+
+    // close connections of already created workers if pool cannot be created
+    closeWorkers := func() {
+        for _, w := range workers {
+            if w != nil {
+                w.(*worker).closeConnections()
+            }
+        }
+    }
+
     for i, _ := range workers {
+        // import workers don't read source
+        if s.importOnly {
+            worker, err := MakeWorker(s.ctx, nil, nil, false, s.workerTargetDbSettings(host, ports[i]))
+            if err != nil {
+                closeWorkers()
+                return nil, err
+            }
+
+            worker.throttle = s.throttle.forWorker(s.ctx)
+            workers[i] = worker
+            continue
+        }
+
         workerSourceDb, err := s.newSourceDbConnection()
         if err != nil {
+            closeWorkers()
             return nil, err
         }
 
-        worker, err := MakeWorker(workerSourceDb, s.sourceMysqlVersion, !s.settings.Export.NoTransaction,
-            &DbSettings{
-                Name: s.settings.TargetDb.Name,
-                Host: host,
-                Port: ports[i],
-                User: s.settings.TargetDb.User,
-                Password: s.settings.TargetDb.Password,
-            },
-        )
+        if s.output != nil {
+            worker, err := MakeFileWorker(s.ctx, workerSourceDb, s.sourceMysqlVersion, !s.settings.Export.NoTransaction, s.output)
+            if err != nil {
+                workerSourceDb.Close()
+                closeWorkers()
+                return nil, err
+            }
+
+            worker.throttle = s.throttle.forWorker(s.ctx)
+            workers[i] = worker
+            continue
+        }
+
+        worker, err := MakeWorker(s.ctx, workerSourceDb, s.sourceMysqlVersion, !s.settings.Export.NoTransaction,
+            s.workerTargetDbSettings(host, ports[i]))
 
         if err != nil {
+            workerSourceDb.Close()
+            closeWorkers()
             return nil, err
         }
 
+        worker.throttle = s.throttle.forWorker(s.ctx)
         workers[i] = worker
     }
 
     pool, err := tunny.CreateCustomPool(workers).Open()
     if err != nil {
+        closeWorkers()
         return nil, err
     }
 
     return pool, nil
 }
+// Target connection of worker goes to proxy or directly to target database.
+// Proxy accepts its own one-time password
+func (s *exporter)workerTargetDbSettings(host string, port int) *DbSettings {
+    password := s.settings.TargetDb.Password
+    tlsSettings := s.settings.TargetDb.TLS
+    if s.proxyInfo != nil {
+        password = s.proxyInfo.Password
+        tlsSettings = s.settings.Proxy.TLS
+    }
+
+    return &DbSettings{
+        Name: s.settings.TargetDb.Name,
+        Host: host,
+        Port: port,
+        User: s.settings.TargetDb.User,
+        Password: password,
+        TLS: tlsSettings,
+    }
+}
 func (s *exporter)lockAllTables() error {
     if s.settings.Export.NoLockTables {
         log.Debugf("[export] No lock tables because settings")
         return nil
     }
 
-    tableNames := make([]string, len(s.schema.Tables))
-    for i, tableName := range s.schema.Tables {
-        tableNames[i] = fmt.Sprintf("`%s` READ LOCAL", tableName)
+    tableNames := s.lockedTables()
+    if len(tableNames) == 0 {
+        return nil
     }
 
     log.Infof("[export] Locking all tables")
@@ -437,12 +1126,32 @@ func (s *exporter)lockAllTables() error {
 
     return nil
 }
+// Tables of all databases are locked by one statement, so workers get consistent snapshot of all of them
+func (s *exporter)lockedTables() []string {
+    tableNames := make([]string, 0)
+
+    for _, database := range s.databaseExporters() {
+        for _, tableName := range database.schema.Tables {
+            if database.database != "" {
+                tableNames = append(tableNames, fmt.Sprintf("%s.%s READ LOCAL", quoteIdentifier(database.database), quoteIdentifier(tableName)))
+            } else {
+                tableNames = append(tableNames, fmt.Sprintf("`%s` READ LOCAL", tableName))
+            }
+        }
+    }
+
+    return tableNames
+}
 func (s *exporter)unlockAllTables() error {
     if s.settings.Export.NoLockTables {
         log.Debugf("[export] No unlock table needed because settings")
         return nil
     }
 
+    if len(s.lockedTables()) == 0 {
+        return nil
+    }
+
     if _, err := s.sourceDb.Exec("UNLOCK TABLES"); err != nil {
         return err
     }
@@ -474,9 +1183,11 @@ func (s *exporter)loadSchema() error {
 
 
     // VIEWS
-    views, err := s.inspector.Views(s.settings.SourceDb.Name)
-    if err != nil {
-        return err
+    var views []string
+    if !s.settings.Export.NoViews {
+        if views, err = s.inspector.Views(s.settings.SourceDb.Name); err != nil {
+            return err
+        }
     }
     for _, viewName := range views {
         if inSlice(s.settings.Export.ExcludeTables, viewName) {
@@ -513,18 +1224,42 @@ func (s *exporter)loadSchema() error {
 
 
     // PROCEDURES
-    procedures, err := s.inspector.Procedures(s.settings.SourceDb.Name)
-    if err != nil {
-        return err
+    if !s.settings.Export.NoProcedures {
+        procedures, err := s.inspector.Procedures(s.settings.SourceDb.Name)
+        if err != nil {
+            return err
+        }
+        s.schema.Procedures = procedures
+        log.Infof("[export] Inspected database procedures: %+v", s.schema.Procedures)
+    }
+
+
+    // FUNCTIONS
+    if !s.settings.Export.NoFunctions {
+        functions, err := s.inspector.Functions(s.settings.SourceDb.Name)
+        if err != nil {
+            return err
+        }
+        s.schema.Functions = functions
+        log.Infof("[export] Inspected database functions: %+v", s.schema.Functions)
+    }
+
+
+    // EVENTS
+    if !s.settings.Export.NoEvents {
+        events, err := s.inspector.Events(s.settings.SourceDb.Name)
+        if err != nil {
+            return err
+        }
+        s.schema.Events = events
+        log.Infof("[export] Inspected database events: %+v", s.schema.Events)
     }
-    s.schema.Procedures = procedures
-    log.Infof("[export] Inspected database procedures: %+v", s.schema.Procedures)
 
     return nil
 }
 
 func (s *exporter)prepareProxy() error {
-    if s.settings.Export.WithoutProxy {
+    if s.settings.Export.WithoutProxy || s.settings.toFile() {
         log.Infof("[export] We don't start proxy because settings")
         return nil
     }
@@ -534,7 +1269,7 @@ func (s *exporter)prepareProxy() error {
         return err
     }
 
-    log.Infof("[export] Got proxy info: %+v", proxyInfo)
+    log.Infof("[export] Got proxy %v with ports %v", proxyInfo.Id, proxyInfo.Ports)
     s.proxyInfo = proxyInfo
 
     return nil
@@ -543,11 +1278,31 @@ func (s *exporter)endDump() {
     if s.proxyInfo != nil && s.proxyInfo.Id != 0 {
         log.Infof("[export] Stopping proxy importer %v", s.proxyInfo.Id)
 
-        host := fmt.Sprintf("http://%s:%v", s.settings.Proxy.Host, s.settings.Proxy.Port)
+        host, client, err := proxyHttpClient(s.settings.Proxy)
+        if err == nil {
+            _, err = httpRequest(client, s.settings.Proxy.Auth, "DELETE", host, fmt.Sprintf("/proxy/%v/stop", s.proxyInfo.Id), nil)
+        }
 
-        _, err := httpRequest("DELETE", host, fmt.Sprintf("/proxy/%v/stop", s.proxyInfo.Id), nil)
         if err != nil {
-            log.Errorf("[export] ", err.Error())
+            log.Errorf("[export] %v", err)
+        }
+    }
+
+    if s.output != nil {
+        if err := s.output.Close(); err != nil {
+            log.Errorf("[export] Failed to close dump files: %v", err)
+        }
+    }
+
+    if s.sourceDb != nil {
+        if err := s.sourceDb.Close(); err != nil {
+            log.Errorf("[export] Failed to close source connection: %v", err)
+        }
+    }
+
+    for _, database := range s.databases {
+        if err := database.sourceDb.Close(); err != nil {
+            log.Errorf("[export] Failed to close source connection of database %v: %v", database.database, err)
         }
     }
 }
@@ -558,12 +1313,18 @@ func (s *exporter)startProxy() (*ProxyStartResponse, error) {
         DbPassword: s.settings.TargetDb.Password,
         DbUser: s.settings.TargetDb.User,
         DbName: s.settings.TargetDb.Name,
+        DbTLS: s.settings.TargetDb.TLS,
         MysqlListenAddr: s.settings.Proxy.ListenAddr,
-        Count: s.settings.Export.WorkersCount,
+        Count: s.proxyPortsCount(),
+        IdleTimeout: s.settings.Proxy.IdleTimeout,
+    }
+
+    host, client, err := proxyHttpClient(s.settings.Proxy)
+    if err != nil {
+        return nil, err
     }
 
-    host := fmt.Sprintf("http://%s:%v", s.settings.Proxy.Host, s.settings.Proxy.Port)
-    body, err := httpRequest("POST", host, "/proxy/start", request)
+    body, err := httpRequest(client, s.settings.Proxy.Auth, "POST", host, "/proxy/start", request)
     if err != nil {
         return nil, err
     }
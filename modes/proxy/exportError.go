@@ -0,0 +1,76 @@
+package proxy
+
+import (
+    "fmt"
+    "github.com/go-sql-driver/mysql"
+)
+
+// ExportError describes where dump was failed
+type ExportError struct {
+    Phase   string
+    Table   string // name of table, view, trigger or procedure
+    Chunk   string // condition of table chunk
+    File    string // dump file, if error happened on import
+    Code    uint16 // mysql error code, 0 if error is not mysql error
+    Message string
+}
+
+func (e *ExportError)Error() string {
+    msg := fmt.Sprintf("[%s]", e.Phase)
+
+    if e.Table != "" {
+        msg += fmt.Sprintf("[%s]", e.Table)
+    }
+
+    if e.Chunk != "" {
+        msg += fmt.Sprintf("[chunk %s]", e.Chunk)
+    }
+
+    if e.File != "" {
+        msg += fmt.Sprintf("[file %s]", e.File)
+    }
+
+    if e.Code != 0 {
+        msg += fmt.Sprintf(" Error %d:", e.Code)
+    }
+
+    return fmt.Sprintf("%s %s", msg, e.Message)
+}
+
+// Adds place of error to err. Errors which are already wrapped are returned as is
+func wrapExportError(phase, table, chunk string, err error) error {
+    if err == nil || err == ErrDumpCancelled {
+        return err
+    }
+
+    if _, ok := err.(*ExportError); ok {
+        return err
+    }
+
+    exportErr := &ExportError{
+        Phase: phase,
+        Table: table,
+        Chunk: chunk,
+        Message: err.Error(),
+    }
+
+    if mysqlErr, ok := err.(*mysql.MySQLError); ok {
+        exportErr.Code = mysqlErr.Number
+        exportErr.Message = mysqlErr.Message
+    }
+
+    return exportErr
+}
+
+// Converts result of tunny job to error
+func jobError(result interface{}, err error) error {
+    if err != nil {
+        return err
+    }
+
+    if resultErr, ok := result.(error); ok {
+        return resultErr
+    }
+
+    return nil
+}
@@ -9,17 +9,27 @@ import (
     "sync"
     "encoding/json"
     "errors"
+    "fmt"
+    "strings"
+    "sort"
+    "context"
 )
 
 type exportManager struct {
     db *sql.DB
     mutex *sync.Mutex
+    running map[int64]*exporter
+    unsaved map[int64]*ExportStatus // statuses of tasks, which failed to be saved in local db
+    notifier *notifier
 }
 
 type ExportStatus struct {
     Id int64
     Status string
     Error error
+    ErrorDetails *ExportError
+    Progress *ExportProgress
+    Verify *VerifyResult
 }
 
 var tableSchema = `
@@ -34,6 +44,24 @@ CREATE TABLE IF NOT EXISTS sync_task
 );
 `
 
+// Columns added after first release. "duplicate column" errors are ignored, so migrations may be applied many times
+var tableMigrations = []string{
+    "ALTER TABLE sync_task ADD COLUMN progress TEXT",
+    "ALTER TABLE sync_task ADD COLUMN error_details TEXT",
+    "ALTER TABLE sync_task ADD COLUMN task_type VARCHAR(50) NOT NULL DEFAULT 'sync'",
+    "ALTER TABLE sync_task ADD COLUMN verify_result TEXT",
+    "ALTER TABLE sync_task ADD COLUMN binlog_position TEXT",
+    "ALTER TABLE sync_task ADD COLUMN pid INT",
+    "ALTER TABLE sync_task ADD COLUMN auto_resumes INT NOT NULL DEFAULT 0",
+    "ALTER TABLE sync_chunk ADD COLUMN chunk_range TEXT",
+}
+
+const (
+    TASK_SYNC   = "sync"
+    TASK_VERIFY = "verify"
+    TASK_IMPORT = "import"
+)
+
 var Manager exportManager
 
 func init() {
@@ -46,11 +74,14 @@ func init() {
 
     db, err := sql.Open("sqlite3", dbName)
 
-    if _, err := db.Exec("PRAGMA busy_timeout = 5000"); err != nil {
+    if err != nil {
         log.Panicf("exportManager init error: %v", err)
     }
 
-    if err != nil {
+    // checkpoints are written from many goroutines, so all queries go through one connection with busy_timeout
+    db.SetMaxOpenConns(1)
+
+    if _, err := db.Exec("PRAGMA busy_timeout = 5000"); err != nil {
         log.Panicf("exportManager init error: %v", err)
     }
 
@@ -58,28 +89,259 @@ func init() {
         log.Panicf("exportManager init error: %v", err)
     }
 
+    if _, err := db.Exec(checkpointSchema); err != nil {
+        log.Panicf("exportManager init error: %v", err)
+    }
+
+    if _, err := db.Exec(notificationSchema); err != nil {
+        log.Panicf("exportManager init error: %v", err)
+    }
+
+    if _, err := db.Exec(proxySessionSchema); err != nil {
+        log.Panicf("exportManager init error: %v", err)
+    }
+
+    for _, migration := range tableMigrations {
+        if _, err := db.Exec(migration); err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+            log.Panicf("exportManager init error: %v", err)
+        }
+    }
+
+    if err := redactSavedSettings(db); err != nil {
+        log.Panicf("exportManager init error: %v", err)
+    }
+
+    if err := markOrphanedTasks(db); err != nil {
+        log.Panicf("exportManager init error: %v", err)
+    }
+
     Manager = exportManager{
         db: db,
         mutex: &sync.Mutex{},
+        running: make(map[int64]*exporter),
+        unsaved: make(map[int64]*ExportStatus),
+        notifier: makeNotifier(db),
     }
 }
 
+// Settings of tasks which were saved by previous versions contain passwords and masking salt
+func redactSavedSettings(db *sql.DB) error {
+    rows, err := db.Query(`SELECT id, settings FROM sync_task WHERE settings LIKE '%"Password":"%' OR settings LIKE '%"MaskingSalt":"%'`)
+    if err != nil {
+        return err
+    }
+
+    saved := make(map[int64]string)
+    for rows.Next() {
+        var id int64
+        var dumpedSettings string
+
+        if err := rows.Scan(&id, &dumpedSettings); err != nil {
+            rows.Close()
+            return err
+        }
+
+        saved[id] = dumpedSettings
+    }
+
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    for id, dumpedSettings := range saved {
+        settings := &Settings{}
+        if err := json.Unmarshal([]byte(dumpedSettings), settings); err != nil {
+            log.Errorf("[export manager] Failed to parse settings of task %v: %v", id, err)
+            continue
+        }
+
+        redacted, err := dumpSettings(settings)
+        if err != nil {
+            return err
+        }
+
+        if redacted == dumpedSettings {
+            continue
+        }
+
+        if _, err := db.Exec("UPDATE sync_task SET settings = ? WHERE id = ?", redacted, id); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
 func (m *exportManager)StartDump(settings *Settings, resultCh chan *ExportStatus) (int64, error) {
+    return m.startTask(TASK_SYNC, settings, resultCh)
+}
+
+// StartVerify compares tables of source and target databases without dump
+func (m *exportManager)StartVerify(settings *Settings, resultCh chan *ExportStatus) (int64, error) {
+    return m.startTask(TASK_VERIFY, settings, resultCh)
+}
+
+// StartImport restores dump file or directory into target database
+func (m *exportManager)StartImport(settings *Settings, resultCh chan *ExportStatus) (int64, error) {
+    return m.startTask(TASK_IMPORT, settings, resultCh)
+}
+
+func (m *exportManager)startTask(taskType string, settings *Settings, resultCh chan *ExportStatus) (int64, error) {
     m.mutex.Lock()
     defer m.mutex.Unlock()
 
     id := time.Now().UnixNano()
 
-    exporter := MakeExporter(settings)
+    if err := settings.resolveSecrets(); err != nil {
+        return 0, err
+    }
+
+    if err := settings.Notify.check(); err != nil {
+        return 0, err
+    }
+
+    if err := settings.Rename.check(); err != nil {
+        return 0, err
+    }
 
-    dumpedSettings, err := json.Marshal(exporter.settings)
+    if err := settings.checkDatabases(); err != nil {
+        return 0, err
+    }
+
+    if err := settings.Export.checkRateLimits(); err != nil {
+        return 0, err
+    }
+
+    if err := settings.Export.checkOnConflict(); err != nil {
+        return 0, err
+    }
+
+    if err := settings.checkShadow(); err != nil {
+        return 0, err
+    }
+    settings.renameTargetDatabase()
+
+    exporter := MakeExporter(context.Background(), settings)
+    exporter.verifyOnly = taskType == TASK_VERIFY
+    exporter.importOnly = taskType == TASK_IMPORT
+
+    dumpedSettings, err := dumpSettings(settings)
     if err != nil {
         return 0, err
     }
 
+    insertSql := `INSERT INTO sync_task (id, status, task_type, settings, pid, date_create, date_update)
+     VALUES (?, ?, ?, ?, ?, datetime('now','localtime'), datetime('now','localtime'))`
+
+    if _, err := m.db.Exec(insertSql, id, "started", taskType, dumpedSettings, os.Getpid()); err != nil {
+        return 0, err
+    }
+
+    m.run(id, exporter, resultCh)
+
+    return id, nil
+}
+
+// ResumeDump restarts interrupted dump with saved settings.
+// Objects and chunks which was copied by previous run are skipped.
+// Inline passwords are not saved, so they are taken from credentials
+func (m *exportManager)ResumeDump(id int64, credentials *Settings, resultCh chan *ExportStatus) error {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    if _, ok := m.running[id]; ok {
+        return fmt.Errorf("Sync with id %v is already running", id)
+    }
+
+    var status, taskType, dumpedSettings string
+
+    row := m.db.QueryRow("SELECT status, task_type, settings FROM sync_task WHERE id = ?", id)
+    if err := row.Scan(&status, &taskType, &dumpedSettings); err == sql.ErrNoRows {
+        return fmt.Errorf("Sync with id %v not found", id)
+    } else if err != nil {
+        return err
+    }
+
+    if status == "success" {
+        return fmt.Errorf("Sync with id %v is already finished", id)
+    }
+
+    settings := &Settings{}
+    if err := json.Unmarshal([]byte(dumpedSettings), settings); err != nil {
+        return err
+    }
+
+    // rows of interrupted import are not known
+    if taskType == TASK_IMPORT {
+        return fmt.Errorf("Import with id %v cannot be resumed", id)
+    }
+
+    // file is rewritten from the beginning, so dump to file cannot be continued
+    if settings.toFile() {
+        return fmt.Errorf("Sync with id %v writes to file and cannot be resumed", id)
+    }
+
+    settings.restoreSecrets(credentials)
+    if err := settings.resolveSecrets(); err != nil {
+        return fmt.Errorf("Sync with id %v cannot be resumed: %v", id, err)
+    }
+
+    exporter := MakeExporter(context.Background(), settings)
+    exporter.resume = true
+    exporter.verifyOnly = taskType == TASK_VERIFY
+
+    updateSql := "UPDATE sync_task SET status = 'started', error_text = NULL, error_details = NULL, verify_result = NULL, pid = ?, date_update = datetime('now','localtime') WHERE id = ?"
+
+    if _, err := m.db.Exec(updateSql, os.Getpid(), id); err != nil {
+        return err
+    }
+
+    log.Infof("[export manager] Resuming sync %v", id)
+    m.run(id, exporter, resultCh)
+
+    return nil
+}
+
+func dumpSettings(settings *Settings) (string, error) {
+    redacted, err := settings.redacted()
+    if err != nil {
+        return "", err
+    }
+
+    dumped, err := json.Marshal(redacted)
+    if err != nil {
+        return "", err
+    }
+
+    return string(dumped), nil
+}
+
+// Must be called with locked mutex
+func (m *exportManager)run(id int64, exporter *exporter, resultCh chan *ExportStatus) {
+    exporter.dumpId = id
+    exporter.checkpoints = makeCheckpoints(m.db, id)
+    exporter.onFollow = func() {
+        m.handleFollow(id, exporter, resultCh)
+    }
+
+    m.running[id] = exporter
+
+    resultCh <- &ExportStatus{
+        Id: id,
+        Status: "started",
+    }
+
+    progressDone := make(chan struct{})
+    go m.notifyProgress(id, exporter.settings.Notify, progressDone)
+
     go func() {
+        defer m.unregister(id)
+        defer close(progressDone)
         defer func() {
             if r := recover(); r != nil {
+                var err error
+
                 switch x := r.(type) {
                 case string:
                     err = errors.New(x)
@@ -89,89 +351,239 @@ func (m *exportManager)StartDump(settings *Settings, resultCh chan *ExportStatus
                     err = errors.New("Unknown panic")
                 }
 
-                if handleErr := m.handleError(id, err, resultCh); handleErr != nil {
-                    panic(handleErr)
-                }
+                m.handleError(id, exporter, err, resultCh)
             }
         }()
 
-        if err := exporter.Start(); err != nil {
-            if handleErr := m.handleError(id, err, resultCh); handleErr != nil {
-                panic(handleErr)
-            }
+        if err := exporter.Start(); err == ErrDumpCancelled {
+            m.handleCancel(id, exporter, resultCh)
+            return
+        } else if err != nil {
+            m.handleError(id, exporter, err, resultCh)
+            return
         }
 
-        if err := m.handleSuccess(id, resultCh); err != nil {
-            panic(err)
-        }
+        m.handleSuccess(id, exporter, resultCh)
     }()
+}
 
-    insertSql := `INSERT INTO sync_task (id, status, settings, date_create, date_update)
-     VALUES (?, ?, ?, datetime('now','localtime'), datetime('now','localtime'))`
+// CancelDump stops running dump. Dump status becomes 'cancelling' until exporter stops all its workers
+func (m *exportManager)CancelDump(id int64) error {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
 
-    if _, err := m.db.Exec(insertSql, id, "started", string(dumpedSettings)); err != nil {
-        return 0, err
+    exporter, ok := m.running[id]
+    if !ok {
+        return fmt.Errorf("Sync with id %v is not running", id)
     }
 
-    resultCh <- &ExportStatus{
-        Id: id,
-        Status: "started",
+    updateSql := "UPDATE sync_task SET status = 'cancelling', date_update = datetime('now','localtime') WHERE id = ?"
+
+    if _, err := m.db.Exec(updateSql, id); err != nil {
+        return err
     }
 
-    return id, nil
+    exporter.Cancel()
+
+    return nil
 }
 
-func (m *exportManager)handleError(id int64, err error, resultCh chan *ExportStatus) error {
+// Cutover finishes sync which follows source binlog. Status becomes 'cutover' until binlog is applied
+// up to current position of source, after that - 'success'
+func (m *exportManager)Cutover(id int64) error {
     m.mutex.Lock()
     defer m.mutex.Unlock()
 
-    updateSql := "UPDATE sync_task SET status = 'error', error_text = ?, date_update = datetime('now','localtime') WHERE id = ?"
+    exporter, ok := m.running[id]
+    if !ok {
+        return fmt.Errorf("Sync with id %v is not running", id)
+    }
 
-    if _, err := m.db.Exec(updateSql, err.Error(), id); err != nil {
+    if err := exporter.Cutover(); err != nil {
         return err
     }
 
-    resultCh <- &ExportStatus{
+    updateSql := "UPDATE sync_task SET status = 'cutover', date_update = datetime('now','localtime') WHERE id = ?"
+
+    _, err := m.db.Exec(updateSql, id)
+    return err
+}
+
+func (m *exportManager)unregister(id int64) {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    delete(m.running, id)
+}
+
+// Progress, verify result and event of task are taken before lock of manager,
+// snapshot of progress reads counters of workers and chunks
+func (m *exportManager)handleCancel(id int64, exporter *exporter, resultCh chan *ExportStatus) {
+    progress := exporter.Progress()
+    event := notifyEvent(id, exporter.taskType(), progress, "cancelled", nil, nil)
+
+    status := &ExportStatus{
         Id: id,
-        Status: "error",
-        Error: err,
+        Status: "cancelled",
     }
 
-    return nil
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    updateSql := "UPDATE sync_task SET status = 'cancelled', progress = ?, date_update = datetime('now','localtime') WHERE id = ?"
+    m.saveStatus(status, progress, updateSql, dumpProgress(progress), id)
+
+    metrics.taskFinished(exporter.taskType(), "cancelled")
+
+    m.notify(exporter, event)
+
+    resultCh <- status
 }
 
-func (m *exportManager)handleSuccess(id int64, resultCh chan *ExportStatus) error {
+func (m *exportManager)handleFollow(id int64, exporter *exporter, resultCh chan *ExportStatus) {
+    progress := exporter.Progress()
+    event := notifyEvent(id, exporter.taskType(), progress, "following", nil, nil)
+
+    status := &ExportStatus{
+        Id: id,
+        Status: "following",
+        Verify: exporter.VerifyResult(),
+    }
+
     m.mutex.Lock()
     defer m.mutex.Unlock()
 
-    updateSql := "UPDATE sync_task SET status = 'success', date_update = datetime('now','localtime') WHERE id = ?"
+    updateSql := "UPDATE sync_task SET status = 'following', date_update = datetime('now','localtime') WHERE id = ?"
+    m.saveStatus(status, progress, updateSql, id)
 
-    if _, err := m.db.Exec(updateSql, id); err != nil {
-        return err
+    m.notify(exporter, event)
+
+    resultCh <- status
+}
+
+func (m *exportManager)handleError(id int64, exporter *exporter, err error, resultCh chan *ExportStatus) {
+    progress := exporter.Progress()
+
+    status := &ExportStatus{
+        Id: id,
+        Status: "error",
+        Error: err,
+        Verify: exporter.VerifyResult(),
     }
 
-    resultCh <- &ExportStatus{
+    var dumpedDetails interface{}
+    if exportErr, ok := err.(*ExportError); ok {
+        status.ErrorDetails = exportErr
+
+        if dumped, jsonErr := json.Marshal(exportErr); jsonErr != nil {
+            log.Errorf("[export manager] Failed to dump error details of task %v: %v", id, jsonErr)
+        } else {
+            dumpedDetails = string(dumped)
+        }
+    }
+
+    event := notifyEvent(id, exporter.taskType(), progress, "error", err, status.ErrorDetails)
+
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    updateSql := "UPDATE sync_task SET status = 'error', error_text = ?, error_details = ?, progress = ?, verify_result = ?, date_update = datetime('now','localtime') WHERE id = ?"
+    m.saveStatus(status, progress, updateSql, err.Error(), dumpedDetails, dumpProgress(progress), dumpVerifyResult(status.Verify), id)
+
+    metrics.taskFinished(exporter.taskType(), "error")
+
+    m.notify(exporter, event)
+
+    resultCh <- status
+}
+
+func (m *exportManager)handleSuccess(id int64, exporter *exporter, resultCh chan *ExportStatus) {
+    progress := exporter.Progress()
+    event := notifyEvent(id, exporter.taskType(), progress, "success", nil, nil)
+
+    status := &ExportStatus{
         Id: id,
         Status: "success",
+        Verify: exporter.VerifyResult(),
     }
 
-    return nil
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    updateSql := "UPDATE sync_task SET status = 'success', progress = ?, verify_result = ?, date_update = datetime('now','localtime') WHERE id = ?"
+    m.saveStatus(status, progress, updateSql, dumpProgress(progress), dumpVerifyResult(status.Verify), id)
+
+    metrics.taskFinished(exporter.taskType(), "success")
+
+    m.notify(exporter, event)
+
+    resultCh <- status
+}
+
+// Status which isn't saved because of error of local db is kept in memory, so failure of local db
+// doesn't stop daemon with other tasks, and the task still reports its status. Must be called with locked manager
+func (m *exportManager)saveStatus(status *ExportStatus, progress *ExportProgress, updateSql string, args ...interface{}) {
+    if _, err := m.db.Exec(updateSql, args...); err != nil {
+        log.Errorf("[export manager] Failed to save status '%s' of task %v: %v", status.Status, status.Id, err)
+
+        status.Progress = progress
+        m.unsaved[status.Id] = status
+
+        return
+    }
+
+    delete(m.unsaved, status.Id)
+}
+
+// Progress of finished tasks is stored in sqlite, so it's available after exporter stops
+func dumpProgress(progress *ExportProgress) interface{} {
+    dumped, err := json.Marshal(progress)
+    if err != nil {
+        log.Errorf("[export manager] Failed to dump progress: %v", err)
+        return nil
+    }
+
+    return string(dumped)
+}
+
+func dumpVerifyResult(result *VerifyResult) interface{} {
+    if result == nil {
+        return nil
+    }
+
+    dumped, err := json.Marshal(result)
+    if err != nil {
+        log.Errorf("[export manager] Failed to dump verify result: %v", err)
+        return nil
+    }
+
+    return string(dumped)
 }
 
 func (m *exportManager)GetStatus(id int64) (*ExportStatus, error) {
     m.mutex.Lock()
     defer m.mutex.Unlock()
 
+    if status, ok := m.unsaved[id]; ok {
+        result := *status
+        if exporter, ok := m.running[id]; ok {
+            result.Progress = exporter.Progress()
+        }
+
+        return &result, nil
+    }
+
     var status string
-    var error_byte []byte
+    var error_byte, details_byte, progress_byte, verify_byte []byte
 
-    rows, err := m.db.Query("SELECT status, error_text FROM sync_task WHERE id = ?", id)
+    rows, err := m.db.Query("SELECT status, error_text, error_details, progress, verify_result FROM sync_task WHERE id = ?", id)
     if err != nil {
         return nil, err
     }
+    defer rows.Close()
 
     for rows.Next() {
-        if err := rows.Scan(&status, &error_byte); err != nil {
+        if err := rows.Scan(&status, &error_byte, &details_byte, &progress_byte, &verify_byte); err != nil {
             return nil, err
         }
 
@@ -182,12 +594,112 @@ func (m *exportManager)GetStatus(id int64) (*ExportStatus, error) {
             err = errors.New(error_text)
         }
 
+        var errorDetails *ExportError
+        if len(details_byte) > 0 {
+            errorDetails = &ExportError{}
+            if jsonErr := json.Unmarshal(details_byte, errorDetails); jsonErr != nil {
+                return nil, jsonErr
+            }
+        }
+
+        var progress *ExportProgress
+        if exporter, ok := m.running[id]; ok {
+            progress = exporter.Progress()
+        } else if len(progress_byte) > 0 {
+            progress = &ExportProgress{}
+            if jsonErr := json.Unmarshal(progress_byte, progress); jsonErr != nil {
+                return nil, jsonErr
+            }
+        }
+
+        var verifyResult *VerifyResult
+        if len(verify_byte) > 0 {
+            verifyResult = &VerifyResult{}
+            if jsonErr := json.Unmarshal(verify_byte, verifyResult); jsonErr != nil {
+                return nil, jsonErr
+            }
+        }
+
         return &ExportStatus{
             Id: id,
             Status: status,
             Error: err,
+            ErrorDetails: errorDetails,
+            Progress: progress,
+            Verify: verifyResult,
         }, nil
     }
 
     return nil, nil
+}
+
+// Type of running task
+func (m *exportManager)taskType(id int64) string {
+    exporter, ok := m.running[id]
+    if !ok {
+        return ""
+    }
+
+    return exporter.taskType()
+}
+
+func (s *exporter)taskType() string {
+    switch {
+    case s.verifyOnly:
+        return TASK_VERIFY
+    case s.importOnly:
+        return TASK_IMPORT
+    }
+
+    return TASK_SYNC
+}
+
+type runningTask struct {
+    id       int64
+    taskType string
+    progress *ExportProgress
+}
+
+// Progress of running tasks ordered by id, for metrics
+func (m *exportManager)runningTasks() []*runningTask {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    var tasks []*runningTask
+    for id, exporter := range m.running {
+        tasks = append(tasks, &runningTask{
+            id: id,
+            taskType: m.taskType(id),
+            progress: exporter.Progress(),
+        })
+    }
+
+    sort.Sort(byId(tasks))
+
+    return tasks
+}
+
+type byId []*runningTask
+
+func (a byId) Len() int {
+    return len(a)
+}
+func (a byId) Swap(i, j int) {
+    a[i], a[j] = a[j], a[i]
+}
+func (a byId) Less(i, j int) bool {
+    return a[i].id < a[j].id
+}
+
+// GetProgress returns progress of running task or nil if task is not running now
+func (m *exportManager)GetProgress(id int64) *ExportProgress {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    exporter, ok := m.running[id]
+    if !ok {
+        return nil
+    }
+
+    return exporter.Progress()
 }
\ No newline at end of file
@@ -0,0 +1,716 @@
+package proxy
+
+import (
+    log "github.com/Sirupsen/logrus"
+    "github.com/LTD-Beget/besync/inspector"
+    "github.com/siddontang/go-mysql/mysql"
+    "github.com/siddontang/go-mysql/replication"
+    "context"
+    "database/sql"
+    "fmt"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Rows of one REPLACE statement, if MaxRowsPerStatement is not set
+const FOLLOW_ROWS_PER_STATEMENT = 100
+
+// Applied position is saved not more often than this interval
+const FOLLOW_SAVE_INTERVAL = time.Second
+
+// Idle target connection is pinged with this interval, so proxy listener isn't reaped while source has no writes
+const FOLLOW_KEEPALIVE_INTERVAL = time.Minute
+
+type FollowSettings struct {
+    Enabled  bool   // Apply source binlog to target after dump until cutover
+    ServerId uint32 // Server id of binlog client. Must differ from ids of source and its replicas
+}
+
+// Position of source binlog. GtidSet is recorded only for information
+type BinlogPosition struct {
+    File     string
+    Position uint32
+    GtidSet  string `json:",omitempty"`
+}
+
+func (p *BinlogPosition)String() string {
+    return fmt.Sprintf("%s:%v", p.File, p.Position)
+}
+// Binlog files have increasing numeric extensions, which get wider after mysql-bin.999999
+func (p *BinlogPosition)reached(target *BinlogPosition) bool {
+    if p.File != target.File {
+        return binlogFileNumber(p.File) > binlogFileNumber(target.File)
+    }
+
+    return p.Position >= target.Position
+}
+func binlogFileNumber(file string) uint64 {
+    number, err := strconv.ParseUint(file[strings.LastIndex(file, ".") + 1:], 10, 64)
+    if err != nil {
+        return 0
+    }
+
+    return number
+}
+
+// Follower applies row events of source binlog to target database
+type follower struct {
+    exporter   *exporter
+    targetDb   *sql.DB
+    tx         *sql.Tx
+
+    current    BinlogPosition // position of last read event
+    applied    BinlogPosition // position of last committed transaction
+    savedAt    time.Time
+    activeAt   time.Time // time of last commit or ping of target
+    cutoverPos *BinlogPosition
+
+    keys       map[string][]string
+    sourceRe   *regexp.Regexp // names of source database in statements
+}
+
+// Source must write full row images in row format, otherwise rows cannot be applied
+func (s *exporter)checkBinlogFormat() error {
+    rows, err := s.sourceDb.Query("SHOW GLOBAL VARIABLES WHERE Variable_name IN ('log_bin', 'binlog_format', 'binlog_row_image')")
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    variables := make(map[string]string)
+    for rows.Next() {
+        var name, value string
+        if err := rows.Scan(&name, &value); err != nil {
+            return err
+        }
+
+        variables[strings.ToLower(name)] = strings.ToUpper(value)
+    }
+
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    if variables["log_bin"] != "ON" && variables["log_bin"] != "1" {
+        return fmt.Errorf("[follow] Binary log is disabled on source")
+    }
+
+    if variables["binlog_format"] != "ROW" {
+        return fmt.Errorf("[follow] binlog_format of source must be ROW, got %s", variables["binlog_format"])
+    }
+
+    // binlog_row_image appeared in 5.6, older versions always write full rows
+    if image, ok := variables["binlog_row_image"]; ok && image != "FULL" {
+        return fmt.Errorf("[follow] binlog_row_image of source must be FULL, got %s", image)
+    }
+
+    return nil
+}
+// Reads position of source binlog. Position read while all tables are locked matches snapshots of workers
+func readBinlogPosition(db *sql.DB) (*BinlogPosition, error) {
+    rows, err := db.Query("SHOW MASTER STATUS")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    columns, err := rows.Columns()
+    if err != nil {
+        return nil, err
+    }
+
+    if !rows.Next() {
+        if err := rows.Err(); err != nil {
+            return nil, err
+        }
+
+        return nil, fmt.Errorf("[follow] Binary log is disabled on source")
+    }
+
+    // count of columns depends on mysql version
+    values := make([][]byte, len(columns))
+    scanArgs := make([]interface{}, len(values))
+    for i := range values {
+        scanArgs[i] = &values[i]
+    }
+
+    if err := rows.Scan(scanArgs...); err != nil {
+        return nil, err
+    }
+
+    position := &BinlogPosition{}
+    for i, column := range columns {
+        switch column {
+        case "File":
+            position.File = string(values[i])
+        case "Position":
+            pos, err := strconv.ParseUint(string(values[i]), 10, 32)
+            if err != nil {
+                return nil, err
+            }
+
+            position.Position = uint32(pos)
+        case "Executed_Gtid_Set":
+            position.GtidSet = strings.Replace(string(values[i]), "\n", "", -1)
+        }
+    }
+
+    return position, nil
+}
+// Must be called while tables are locked. Resumed sync keeps position of first run,
+// because chunks copied by first run don't contain changes made after it
+func (s *exporter)recordBinlogPosition() error {
+    if !s.settings.follow() {
+        return nil
+    }
+
+    if s.resume {
+        saved, err := s.checkpoints.loadBinlogPosition()
+        if err != nil {
+            return err
+        }
+
+        if saved != nil {
+            s.binlogPosition = saved
+            log.Infof("[follow] Using binlog position %s of previous run", saved)
+            return nil
+        }
+    }
+
+    position, err := readBinlogPosition(s.sourceDb)
+    if err != nil {
+        return err
+    }
+
+    if err := s.checkpoints.saveBinlogPosition(position); err != nil {
+        return err
+    }
+
+    s.binlogPosition = position
+    s.progress.setBinlogPosition(position, 0)
+    log.Infof("[follow] Source binlog position is %s", position)
+
+    return nil
+}
+func (s *exporter)checkFollow() error {
+    if !s.settings.follow() {
+        return nil
+    }
+
+    if s.verifyOnly || s.settings.toFile() {
+        return fmt.Errorf("Binlog follow is available only for sync to mysql")
+    }
+
+    if s.settings.Export.NoLockTables {
+        return fmt.Errorf("Binlog follow requires table locks to record consistent binlog position")
+    }
+
+    if s.settings.Follow.ServerId == 0 {
+        return fmt.Errorf("Follow.ServerId is required")
+    }
+
+    return s.checkBinlogFormat()
+}
+// Events after saved position are applied again by resumed sync. REPLACE and DELETE are idempotent only for rows
+// identified by key, so every followed table needs primary key or unique key without nullable columns
+func (s *exporter)checkFollowKeys() error {
+    if !s.settings.follow() {
+        return nil
+    }
+
+    for _, tableName := range s.schema.Tables {
+        keys, err := s.inspector.KeyColumns(tableName)
+        if err != nil {
+            return err
+        }
+
+        if len(keys) == 0 {
+            return fmt.Errorf("Binlog follow requires primary key or unique key without nullable columns, table '%s' has none", tableName)
+        }
+    }
+
+    return nil
+}
+// Count of proxy ports: workers and follower
+func (s *exporter)proxyPortsCount() int {
+    if s.settings.follow() {
+        return s.settings.Export.WorkersCount + 1
+    }
+
+    return s.settings.Export.WorkersCount
+}
+// Cutover asks follower to apply source binlog up to its current position and finish sync.
+// Writes to source should be stopped before cutover
+func (s *exporter)Cutover() error {
+    if s.progress.currentPhase() != PHASE_FOLLOW {
+        return fmt.Errorf("Sync is not following source binlog")
+    }
+
+    select {
+    case s.cutoverCh <- struct{}{}:
+    default:
+    }
+
+    return nil
+}
+// Tails source binlog from recorded position and applies row events to target until cutover
+func (s *exporter)follow() error {
+    if !s.settings.follow() || s.binlogPosition == nil {
+        return nil
+    }
+
+    s.progress.setPhase(PHASE_FOLLOW)
+
+    host := s.settings.TargetDb.Host
+    port := s.settings.TargetDb.Port
+    if !s.settings.Export.WithoutProxy {
+        host = s.settings.Proxy.ListenAddr
+        port = s.proxyInfo.Ports[s.settings.Export.WorkersCount]
+    }
+
+    targetWorker, err := MakeWorker(s.ctx, nil, nil, false, s.workerTargetDbSettings(host, port))
+    if err != nil {
+        return wrapExportError(PHASE_FOLLOW, "", "", err)
+    }
+    defer targetWorker.closeConnections()
+
+    // TIMESTAMP values of binlog are rendered in UTC, so target session must read them in UTC too
+    if _, err := targetWorker.targetDb.Exec("SET time_zone = '+00:00'"); err != nil {
+        return wrapExportError(PHASE_FOLLOW, "", "", err)
+    }
+
+    syncerConfig := &replication.BinlogSyncerConfig{
+        ServerID: s.settings.Follow.ServerId,
+        Flavor: mysql.MySQLFlavor,
+        Host: s.settings.SourceDb.Host,
+        Port: uint16(s.settings.SourceDb.Port),
+        User: s.settings.SourceDb.User,
+        Password: s.settings.SourceDb.Password,
+        UseDecimal: true,
+        TimestampStringLocation: time.UTC,
+    }
+
+    if s.settings.SourceDb.TLS != nil {
+        if syncerConfig.TLSConfig, err = s.settings.SourceDb.TLS.clientConfig(s.settings.SourceDb.Host); err != nil {
+            return wrapExportError(PHASE_FOLLOW, "", "", err)
+        }
+    }
+
+    syncer := replication.NewBinlogSyncer(syncerConfig)
+    defer syncer.Close()
+
+    streamer, err := syncer.StartSync(mysql.Position{Name: s.binlogPosition.File, Pos: s.binlogPosition.Position})
+    if err != nil {
+        return wrapExportError(PHASE_FOLLOW, "", "", err)
+    }
+
+    f := &follower{
+        exporter: s,
+        targetDb: targetWorker.targetDb,
+        current: *s.binlogPosition,
+        applied: *s.binlogPosition,
+        savedAt: time.Now(),
+        activeAt: time.Now(),
+        keys: make(map[string][]string),
+        sourceRe: sourceDatabasePattern(s.settings.SourceDb.Name),
+    }
+
+    log.Infof("[follow] Following source binlog from %s", s.binlogPosition)
+
+    if s.onFollow != nil {
+        s.onFollow()
+    }
+
+    if err := f.run(streamer); err != nil {
+        f.rollback()
+        return wrapExportError(PHASE_FOLLOW, "", "", err)
+    }
+
+    if !s.isCancelled() {
+        s.progress.setPhase(PHASE_FINISHED)
+    }
+
+    return nil
+}
+func (f *follower)run(streamer *replication.BinlogStreamer) error {
+    s := f.exporter
+
+    for {
+        if s.isCancelled() {
+            f.rollback()
+            return f.save()
+        }
+
+        select {
+        case <-s.cutoverCh:
+            target, err := readBinlogPosition(s.sourceDb)
+            if err != nil {
+                return err
+            }
+
+            f.cutoverPos = target
+            log.Infof("[follow] Cutover requested, applying binlog up to %s", target)
+        default:
+        }
+
+        if f.cutoverPos != nil && f.tx == nil && f.applied.reached(f.cutoverPos) {
+            log.Infof("[follow] Binlog is applied up to %s, cutover is done", f.applied.String())
+            return f.save()
+        }
+
+        ctx, cancel := context.WithTimeout(s.ctx, time.Second)
+        event, err := streamer.GetEvent(ctx)
+        cancel()
+
+        if err == context.DeadlineExceeded {
+            // no new events, so target is not behind source
+            if f.tx == nil {
+                s.progress.setBinlogPosition(&f.applied, 0)
+
+                if err := f.keepalive(); err != nil {
+                    return err
+                }
+            }
+            continue
+        } else if err != nil {
+            if s.isCancelled() {
+                continue
+            }
+            return err
+        }
+
+        if err := f.handleEvent(event); err != nil {
+            return err
+        }
+    }
+}
+func (f *follower)handleEvent(event *replication.BinlogEvent) error {
+    switch e := event.Event.(type) {
+    case *replication.RotateEvent:
+        f.current.File = string(e.NextLogName)
+        f.current.Position = uint32(e.Position)
+    default:
+        if event.Header.LogPos > 0 {
+            f.current.Position = event.Header.LogPos
+        }
+    }
+
+    switch e := event.Event.(type) {
+    case *replication.RowsEvent:
+        if err := f.applyRows(event.Header.EventType, e); err != nil {
+            return err
+        }
+    case *replication.XIDEvent:
+        return f.commit(event.Header.Timestamp)
+    case *replication.QueryEvent:
+        keywords := statementKeywords(string(e.Query), 2)
+
+        switch {
+        case keywords[0] == "BEGIN":
+        case keywords[0] == "COMMIT", keywords[0] == "ROLLBACK" && keywords[1] == "":
+            // transaction of non-transactional tables, their changes are kept by ROLLBACK too
+            return f.commit(event.Header.Timestamp)
+        case keywords[0] == "SAVEPOINT", keywords[0] == "RELEASE", keywords[0] == "ROLLBACK":
+            // savepoints of application transactions, rows of rolled back part are not logged
+        case f.changesSource(string(e.Schema), string(e.Query), keywords):
+            return fmt.Errorf("[follow] Statement on source database cannot be followed: %s", string(e.Query))
+        }
+    }
+
+    if f.tx == nil {
+        f.applied = f.current
+    }
+
+    return nil
+}
+// Statements, which change objects of default database, if they don't name other one
+var followChangeStatements = map[string]bool{
+    "CREATE": true,
+    "ALTER": true,
+    "DROP": true,
+    "RENAME": true,
+    "TRUNCATE": true,
+    "INSERT": true,
+    "UPDATE": true,
+    "DELETE": true,
+    "REPLACE": true,
+    "LOAD": true,
+}
+
+// DDL or DML of source objects. Rows of DML are followed by row events, so its statement means statement format
+// of session. Statements of users and other databases are logged in default database of session, they are skipped
+func (f *follower)changesSource(schema, query string, keywords []string) bool {
+    if f.sourceRe.MatchString(withoutLiterals(query)) {
+        return true
+    }
+
+    if schema != f.exporter.settings.SourceDb.Name || !followChangeStatements[keywords[0]] {
+        return false
+    }
+
+    switch keywords[1] {
+    case "USER", "ROLE", "SERVER", "DATABASE", "SCHEMA":
+        return false
+    }
+
+    return true
+}
+// First words of statement in upper case, comments are skipped. Missing words are empty
+func statementKeywords(query string, count int) []string {
+    keywords := make([]string, 0, count)
+
+    for _, token := range tokenizeSql(query) {
+        if len(keywords) == count {
+            break
+        }
+
+        text := strings.TrimSpace(token.text)
+        if text == "" || isCommentStart(text, 0) {
+            continue
+        }
+
+        keywords = append(keywords, strings.ToUpper(text))
+    }
+
+    for len(keywords) < count {
+        keywords = append(keywords, "")
+    }
+
+    return keywords
+}
+// Statement without string literals and comments, so names in them are not matched
+func withoutLiterals(query string) string {
+    tokens := tokenizeSql(query)
+    for _, token := range tokens {
+        if c := token.text[0]; !token.quoted && (c == '\'' || c == '"' || isCommentStart(token.text, 0)) {
+            token.text = " "
+        }
+    }
+
+    return joinTokens(tokens)
+}
+// Statements of other default database may name source database: "ALTER TABLE src.t", "DROP DATABASE src"
+func sourceDatabasePattern(database string) *regexp.Regexp {
+    name := "(`" + regexp.QuoteMeta(strings.Replace(database, "`", "``", -1)) + "`|" + regexp.QuoteMeta(database) + `\b)`
+
+    return regexp.MustCompile(`(?i)(^|[^\w$.` + "`" + `])` + name + `\s*\.|\b(DATABASE|SCHEMA)\s+(IF\s+(NOT\s+)?EXISTS\s+)?` + name)
+}
+func (f *follower)applyRows(eventType replication.EventType, e *replication.RowsEvent) error {
+    s := f.exporter
+
+    if string(e.Table.Schema) != s.settings.SourceDb.Name {
+        return nil
+    }
+
+    tableName := string(e.Table.Table)
+    columns, ok := s.schema.TableColumns[tableName]
+    if !ok || !inSlice(s.schema.Tables, tableName) {
+        return nil
+    }
+
+    keyColumns, err := f.keyColumns(tableName)
+    if err != nil {
+        return err
+    }
+
+    sortedColumns := inspector.SortColumnsByIndex(columns)
+
+    if f.tx == nil {
+        if f.tx, err = f.targetDb.Begin(); err != nil {
+            return err
+        }
+    }
+
+    switch eventType {
+    case replication.WRITE_ROWS_EVENTv0, replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
+        return f.replaceRows(tableName, sortedColumns, e.Rows)
+    case replication.DELETE_ROWS_EVENTv0, replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
+        for _, row := range e.Rows {
+            if err := f.deleteRow(tableName, sortedColumns, keyColumns, row); err != nil {
+                return err
+            }
+        }
+    case replication.UPDATE_ROWS_EVENTv0, replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2:
+        // rows are pairs of before and after images. Key may be changed by update, so old row is deleted
+        for i := 0; i + 1 < len(e.Rows); i += 2 {
+            if err := f.deleteRow(tableName, sortedColumns, keyColumns, e.Rows[i]); err != nil {
+                return err
+            }
+
+            if err := f.replaceRows(tableName, sortedColumns, e.Rows[i + 1:i + 2]); err != nil {
+                return err
+            }
+        }
+    }
+
+    return nil
+}
+// Rows are identified by primary or unique key, which is checked before dump
+func (f *follower)keyColumns(tableName string) ([]string, error) {
+    if keys, ok := f.keys[tableName]; ok {
+        return keys, nil
+    }
+
+    keys, err := f.exporter.inspector.KeyColumns(tableName)
+    if err != nil {
+        return nil, err
+    }
+
+    f.keys[tableName] = keys
+
+    return keys, nil
+}
+func (f *follower)replaceRows(tableName string, columns []*inspector.Column, rows [][]interface{}) error {
+    rowsPerStmt := f.exporter.settings.Export.MaxRowsPerStatement
+    if rowsPerStmt <= 0 {
+        rowsPerStmt = FOLLOW_ROWS_PER_STATEMENT
+    }
+
+    rename := f.exporter.rename
+
+    names := make([]string, len(columns))
+    for i, col := range columns {
+        names[i] = fmt.Sprintf("`%s`", rename.column(tableName, col.Name))
+    }
+
+    rowPlaceholders := "(" + strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",") + ")"
+
+    for start := 0; start < len(rows); start += rowsPerStmt {
+        end := start + rowsPerStmt
+        if end > len(rows) {
+            end = len(rows)
+        }
+
+        placeholders := make([]string, 0, end - start)
+        args := make([]interface{}, 0, (end - start) * len(columns))
+
+        for _, row := range rows[start:end] {
+            placeholders = append(placeholders, rowPlaceholders)
+
+            for _, col := range columns {
+                args = append(args, binlogValue(col, row))
+            }
+        }
+
+        query := fmt.Sprintf("REPLACE INTO `%s` (%s) VALUES %s", rename.table(tableName), strings.Join(names, ","), strings.Join(placeholders, ","))
+        if _, err := f.tx.Exec(query, args...); err != nil {
+            return err
+        }
+
+        f.exporter.progress.addRows(tableName, end - start, 0)
+    }
+
+    return nil
+}
+func (f *follower)deleteRow(tableName string, columns []*inspector.Column, keyColumns []string, row []interface{}) error {
+    rename := f.exporter.rename
+
+    conditions := make([]string, 0, len(columns))
+    args := make([]interface{}, 0, len(columns))
+
+    for _, col := range columns {
+        if len(keyColumns) > 0 && !inSlice(keyColumns, col.Name) {
+            continue
+        }
+
+        conditions = append(conditions, fmt.Sprintf("`%s` <=> ?", rename.column(tableName, col.Name)))
+        args = append(args, binlogValue(col, row))
+    }
+
+    query := fmt.Sprintf("DELETE FROM `%s` WHERE %s LIMIT 1", rename.table(tableName), strings.Join(conditions, " AND "))
+    _, err := f.tx.Exec(query, args...)
+
+    return err
+}
+func (f *follower)keepalive() error {
+    if time.Since(f.activeAt) < FOLLOW_KEEPALIVE_INTERVAL {
+        return nil
+    }
+
+    f.activeAt = time.Now()
+
+    return f.targetDb.Ping()
+}
+func (f *follower)commit(timestamp uint32) error {
+    if f.tx != nil {
+        if err := f.tx.Commit(); err != nil {
+            f.tx = nil
+            return err
+        }
+
+        f.tx = nil
+        f.activeAt = time.Now()
+    }
+
+    f.applied = f.current
+
+    var delay int64
+    if timestamp > 0 {
+        if delay = time.Now().Unix() - int64(timestamp); delay < 0 {
+            delay = 0
+        }
+    }
+
+    f.exporter.progress.setBinlogPosition(&f.applied, delay)
+
+    if time.Since(f.savedAt) < FOLLOW_SAVE_INTERVAL {
+        return nil
+    }
+
+    return f.save()
+}
+func (f *follower)rollback() {
+    if f.tx == nil {
+        return
+    }
+
+    if err := f.tx.Rollback(); err != nil {
+        log.Errorf("[follow] Failed to rollback target transaction: %v", err)
+    }
+
+    f.tx = nil
+}
+// Saved position is used by resumed sync. Events after it are applied again, which is safe for REPLACE and DELETE
+// of rows identified by key (see checkFollowKeys)
+func (f *follower)save() error {
+    f.savedAt = time.Now()
+
+    position := f.applied
+    f.exporter.binlogPosition = &position
+
+    return f.exporter.checkpoints.saveBinlogPosition(&position)
+}
+
+// Converts value of binlog row to query argument. Unsigned columns are decoded as signed integers
+func binlogValue(col *inspector.Column, row []interface{}) interface{} {
+    if col.Index >= len(row) {
+        return nil
+    }
+
+    value := row[col.Index]
+    if !strings.Contains(col.SqlType, "unsigned") {
+        return value
+    }
+
+    switch v := value.(type) {
+    case int8:
+        return int64(uint8(v))
+    case int16:
+        return int64(uint16(v))
+    case int32:
+        if v < 0 && col.ColType == "mediumint" {
+            return int64(v) + (1 << 24)
+        }
+
+        return int64(uint32(v))
+    case int64:
+        // driver doesn't support uint64 values with high bit set
+        if v < 0 {
+            return strconv.FormatUint(uint64(v), 10)
+        }
+    }
+
+    return value
+}
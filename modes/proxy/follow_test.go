@@ -0,0 +1,63 @@
+package proxy
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestStatementKeywords(t *testing.T) {
+    tests := []struct {
+        query    string
+        expected string
+    }{
+        {"BEGIN", "BEGIN,"},
+        {"  savepoint `sp_1`", "SAVEPOINT,`SP_1`"},
+        {"/* app=orders */ ROLLBACK TO SAVEPOINT sp", "ROLLBACK,TO"},
+        {"-- comment\nRELEASE SAVEPOINT sp", "RELEASE,SAVEPOINT"},
+        {"/*!40000 ALTER TABLE t DISABLE KEYS */", "ALTER,TABLE"},
+        {"", ","},
+    }
+
+    for _, test := range tests {
+        if result := strings.Join(statementKeywords(test.query, 2), ","); result != test.expected {
+            t.Errorf("statementKeywords(%q) = %s, expected %s", test.query, result, test.expected)
+        }
+    }
+}
+
+func TestFollowChangesSource(t *testing.T) {
+    f := &follower{
+        exporter: &exporter{settings: &Settings{SourceDb: &DbSettings{Name: "src"}}},
+        sourceRe: sourceDatabasePattern("src"),
+    }
+
+    tests := []struct {
+        schema  string
+        query   string
+        changes bool
+    }{
+        {"src", "ALTER TABLE users ADD COLUMN age INT", true},
+        {"src", "DROP TABLE `orders`", true},
+        {"src", "CREATE DEFINER=`root`@`%` TRIGGER trg BEFORE INSERT ON users FOR EACH ROW SET NEW.a = 1", true},
+        {"src", "INSERT INTO users VALUES (1)", true},
+        {"src", "/* app */ TRUNCATE users", true},
+        {"other", "ALTER TABLE src.users ADD COLUMN age INT", true},
+        {"other", "DROP DATABASE IF EXISTS `src`", true},
+        {"src", "CREATE USER 'app'@'%' IDENTIFIED BY 'x'", false},
+        {"src", "DROP DATABASE other", false},
+        {"src", "FLUSH PRIVILEGES", false},
+        {"src", "ANALYZE TABLE users", false},
+        {"other", "ALTER TABLE users ADD COLUMN age INT", false},
+        {"other", "INSERT INTO log VALUES ('src.users')", false},
+        {"other", "/* src.users */ DELETE FROM log", false},
+        {"other", "/*!40000 ALTER TABLE src.users DISABLE KEYS */", true},
+    }
+
+    for _, test := range tests {
+        keywords := statementKeywords(test.query, 2)
+
+        if result := f.changesSource(test.schema, test.query, keywords); result != test.changes {
+            t.Errorf("changesSource(%s, %s) = %v, expected %v", test.schema, test.query, result, test.changes)
+        }
+    }
+}
@@ -0,0 +1,230 @@
+package proxy
+
+import (
+    log "github.com/Sirupsen/logrus"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+)
+
+// Restores dump, which was written by file output. Directory layouts are restored in parallel:
+// schema.sql first, then data files by all workers, objects.sql at the end
+func (s *exporter)startImport() error {
+    if s.settings.Input == nil || s.settings.Input.Path == "" {
+        return wrapExportError(PHASE_PREPARE, "", "", fmt.Errorf("Input path is required for import"))
+    }
+
+    path := s.settings.Input.Path
+
+    info, err := os.Stat(path)
+    if err != nil {
+        return wrapExportError(PHASE_PREPARE, "", "", err)
+    }
+
+    if err := s.prepareProxy(); err != nil {
+        return wrapExportError(PHASE_PREPARE, "", "", err)
+    }
+
+    s.workPool, err = s.createWorkerPool()
+    if err != nil {
+        return wrapExportError(PHASE_PREPARE, "", "", err)
+    }
+    defer s.workPool.Close()
+
+    if info.IsDir() {
+        err = s.importDirectory(path)
+    } else {
+        err = s.importSingleFile(path)
+    }
+
+    if err != nil {
+        return err
+    }
+
+    if !s.isCancelled() {
+        s.progress.setPhase(PHASE_FINISHED)
+        log.Infof("[import] Dump %s was imported", path)
+    }
+
+    return nil
+}
+func (s *exporter)importDirectory(path string) error {
+    s.progress.setPhase(PHASE_SCHEMA)
+
+    schemaPath, err := findScript(path, SECTION_SCHEMA)
+    if err != nil {
+        return wrapExportError(PHASE_SCHEMA, "", "", err)
+    }
+
+    if err := s.runJob(s.importFileJob(schemaPath)); err != nil {
+        return wrapImportError(PHASE_SCHEMA, schemaPath, err)
+    }
+
+    if s.isCancelled() {
+        return nil
+    }
+
+    s.progress.setPhase(PHASE_TABLES)
+
+    dataFiles, err := ioutil.ReadDir(filepath.Join(path, DUMP_DATA_DIR))
+    if err != nil && !os.IsNotExist(err) {
+        return wrapExportError(PHASE_TABLES, "", "", err)
+    }
+
+    var wg sync.WaitGroup = sync.WaitGroup{}
+
+    for _, dataFile := range dataFiles {
+        if s.isCancelled() {
+            break
+        }
+
+        if dataFile.IsDir() || !isScriptName(dataFile.Name()) {
+            continue
+        }
+
+        dataPath := filepath.Join(path, DUMP_DATA_DIR, dataFile.Name())
+
+        wg.Add(1)
+        s.workPool.SendWorkAsync(s.importFileJob(dataPath), func(result interface{}, err error) {
+            defer wg.Done()
+
+            if err := jobError(result, err); err == ErrDumpCancelled {
+                log.Infof("[import] Import of %s interrupted", dataPath)
+            } else if err != nil {
+                s.fail(wrapImportError(PHASE_TABLES, dataPath, err))
+            } else {
+                log.Infof("[import] Imported %s", dataPath)
+            }
+        })
+    }
+
+    wg.Wait()
+
+    if s.isCancelled() {
+        return nil
+    }
+
+    s.progress.setPhase(PHASE_ROUTINES)
+
+    objectsPath, err := findScript(path, SECTION_OBJECTS)
+    if err != nil {
+        return wrapExportError(PHASE_ROUTINES, "", "", err)
+    }
+
+    if err := s.runJob(s.importFileJob(objectsPath)); err != nil {
+        return wrapImportError(PHASE_ROUTINES, objectsPath, err)
+    }
+
+    return nil
+}
+// Single file is read by exporter. INSERT statements are sent to all workers,
+// other statements are executed after all previous INSERTs are finished
+func (s *exporter)importSingleFile(path string) error {
+    s.progress.setPhase(PHASE_TABLES)
+
+    script, err := openSqlScript(path)
+    if err != nil {
+        return wrapImportError(PHASE_TABLES, path, err)
+    }
+    defer script.Close()
+
+    scanner := makeSqlScanner(script)
+
+    var wg sync.WaitGroup = sync.WaitGroup{}
+    // limits count of statements read ahead
+    slots := make(chan struct{}, s.settings.Export.WorkersCount * 2)
+
+    defer wg.Wait()
+
+    for {
+        if s.isCancelled() {
+            return nil
+        }
+
+        query, err := scanner.Next()
+        if err == io.EOF {
+            return nil
+        } else if err != nil {
+            return wrapImportError(PHASE_TABLES, path, err)
+        }
+
+        job := &jobImportStatements{
+            statements: singleStatement(query),
+            rowsPerStmt: s.settings.Export.MaxRowsPerStatement,
+            progress: s.progress,
+        }
+
+        if !isInsertStatement(query) {
+            wg.Wait()
+
+            if err := s.runJob(job); err != nil {
+                return wrapImportError(PHASE_TABLES, path, err)
+            }
+
+            continue
+        }
+
+        slots <- struct{}{}
+        wg.Add(1)
+
+        s.workPool.SendWorkAsync(job, func(result interface{}, err error) {
+            defer wg.Done()
+            defer func() { <-slots }()
+
+            if err := jobError(result, err); err != nil {
+                s.fail(wrapImportError(PHASE_TABLES, path, err))
+            }
+        })
+    }
+}
+func (s *exporter)importFileJob(path string) *jobImportStatements {
+    return &jobImportStatements{
+        path: path,
+        rowsPerStmt: s.settings.Export.MaxRowsPerStatement,
+        progress: s.progress,
+    }
+}
+
+// Same as wrapExportError, but with dump file which was imported
+func wrapImportError(phase, path string, err error) error {
+    err = wrapExportError(phase, "", "", err)
+
+    if exportErr, ok := err.(*ExportError); ok && exportErr.File == "" {
+        exportErr.File = path
+    }
+
+    return err
+}
+// Returns path of section script with any compression
+func findScript(dir, section string) (string, error) {
+    for _, ext := range []string{"", ".gz", ".zst"} {
+        path := filepath.Join(dir, section + ".sql" + ext)
+
+        if _, err := os.Stat(path); err == nil {
+            return path, nil
+        }
+    }
+
+    return "", fmt.Errorf("[import] %s.sql not found in %s", section, dir)
+}
+func isScriptName(name string) bool {
+    return strings.HasSuffix(name, ".sql") || strings.HasSuffix(name, ".sql.gz") || strings.HasSuffix(name, ".sql.zst")
+}
+// Statement source, which returns one statement
+func singleStatement(query string) func() (string, error) {
+    done := false
+
+    return func() (string, error) {
+        if done {
+            return "", io.EOF
+        }
+
+        done = true
+
+        return query, nil
+    }
+}
@@ -0,0 +1,353 @@
+package proxy
+
+import (
+    "github.com/LTD-Beget/besync/inspector"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "fmt"
+    "math/big"
+    "strconv"
+    "strings"
+)
+
+const (
+    MASK_NULL     = "null"     // NULL instead of value
+    MASK_FIXED    = "fixed"    // Value of rule instead of value
+    MASK_HASH     = "hash"     // hex of HMAC-SHA256 of value with salt, number for numeric columns
+    MASK_EMAIL    = "email"    // fake email
+    MASK_PHONE    = "phone"    // fake phone
+    MASK_NAME     = "name"     // fake first and last name
+    MASK_DIGITS   = "digits"   // digits of value are replaced, other characters are kept
+    MASK_TRUNCATE = "truncate" // first Length characters of value
+)
+
+// Transform of masked column
+type MaskRule struct {
+    Transform string
+    Value     string // value of fixed transform
+    Length    int    // length of truncate transform
+}
+
+var maskFirstNames = []string{"James", "Mary", "John", "Linda", "Robert", "Anna", "Michael", "Elena", "David", "Maria",
+    "Ivan", "Olga", "Peter", "Sofia", "Alex", "Irina"}
+var maskLastNames = []string{"Smith", "Johnson", "Brown", "Taylor", "Miller", "Wilson", "Moore", "Anderson", "Ivanov",
+    "Petrov", "Smirnov", "Kuznetsov", "Popov", "Sokolov", "Novak", "Fischer"}
+
+var maskTextTypes = map[string]bool{
+    "char": true,
+    "varchar": true,
+    "tinytext": true,
+    "text": true,
+    "mediumtext": true,
+    "longtext": true,
+}
+
+// Masks of columns of one table by index of column in selected row
+type tableMasking struct {
+    columns map[int]*columnMask
+}
+
+type columnMask struct {
+    rule   *MaskRule
+    column *inspector.Column
+    salt   []byte
+}
+
+// Rules must refer to columns of dumped tables and suit types of columns
+func (s *exporter)checkMasking() error {
+    export := s.settings.Export
+
+    if len(export.Masking) == 0 {
+        return nil
+    }
+
+    if s.settings.follow() {
+        return fmt.Errorf("Masking cannot be used with binlog follow")
+    }
+
+    for key, rule := range export.Masking {
+        tableName, columnName, err := splitMaskKey(key)
+        if err != nil {
+            return err
+        }
+
+        if !inSlice(s.schema.Tables, tableName) {
+            return fmt.Errorf("Masking: table '%s' is not dumped", tableName)
+        }
+
+        columns, ok := s.schema.TableColumns[tableName]
+        if !ok {
+            if columns, err = s.inspector.ColumnTypes(tableName); err != nil {
+                return err
+            }
+
+            s.schema.TableColumns[tableName] = columns
+        }
+
+        column, ok := columns[columnName]
+        if !ok {
+            return fmt.Errorf("Masking: table '%s' has no column '%s'", tableName, columnName)
+        }
+
+        if err := rule.check(column, export.MaskingSalt); err != nil {
+            return fmt.Errorf("Masking: %s: %v", key, err)
+        }
+    }
+
+    return nil
+}
+func splitMaskKey(key string) (string, string, error) {
+    tableName, columnName, err := splitColumnKey(key)
+    if err != nil {
+        return "", "", fmt.Errorf("Masking: %v", err)
+    }
+
+    return tableName, columnName, nil
+}
+
+func (r *MaskRule)check(column *inspector.Column, salt string) error {
+    text := maskTextTypes[column.ColType] || column.IsBlob()
+    numeric := column.IsNumeric && !column.IsBlob()
+
+    switch r.Transform {
+    case MASK_NULL:
+        if !column.Nullable {
+            return fmt.Errorf("transform '%s' cannot be used for NOT NULL column", r.Transform)
+        }
+
+        return nil
+    case MASK_FIXED:
+        if numeric {
+            return checkNumericMaskValue(column, r.Value)
+        }
+
+        return nil
+    case MASK_HASH, MASK_DIGITS:
+        if !text && !numeric {
+            return fmt.Errorf("transform '%s' cannot be used for %s column", r.Transform, column.ColType)
+        }
+    case MASK_EMAIL, MASK_PHONE, MASK_NAME:
+        if !text {
+            return fmt.Errorf("transform '%s' can be used only for text columns", r.Transform)
+        }
+    case MASK_TRUNCATE:
+        if !text {
+            return fmt.Errorf("transform '%s' can be used only for text columns", r.Transform)
+        }
+
+        if r.Length <= 0 {
+            return fmt.Errorf("Length of truncate must be positive")
+        }
+
+        return nil
+    default:
+        return fmt.Errorf("unknown transform '%s'", r.Transform)
+    }
+
+    // without salt hashes of known values may be found
+    if salt == "" {
+        return fmt.Errorf("MaskingSalt is required for transform '%s'", r.Transform)
+    }
+
+    return nil
+}
+
+// Fixed value of numeric column must be number of column type
+func checkNumericMaskValue(column *inspector.Column, value string) error {
+    var err error
+    if strings.HasSuffix(column.ColType, "int") {
+        _, err = strconv.ParseInt(value, 10, 64)
+    } else {
+        _, err = strconv.ParseFloat(value, 64)
+    }
+
+    if err != nil {
+        return fmt.Errorf("Value '%s' of fixed transform is not valid for %s column", value, column.ColType)
+    }
+
+    return nil
+}
+
+// Masking of table rows, nil if table has no masked columns
+func (s *exporter)tableMasking(tableName string) *tableMasking {
+    var masking *tableMasking
+
+    for key, rule := range s.settings.Export.Masking {
+        maskTable, columnName, err := splitMaskKey(key)
+        if err != nil || maskTable != tableName {
+            continue
+        }
+
+        column, ok := s.schema.TableColumns[tableName][columnName]
+        if !ok {
+            continue
+        }
+
+        if masking == nil {
+            masking = &tableMasking{
+                columns: make(map[int]*columnMask),
+            }
+        }
+
+        masking.columns[column.Index] = &columnMask{
+            rule: rule,
+            column: column,
+            salt: []byte(s.settings.Export.MaskingSalt),
+        }
+    }
+
+    return masking
+}
+// Masked columns differ on source and target, so they are not verified
+func (s *exporter)verifiedColumns(tableName string, columns map[string]*inspector.Column) map[string]*inspector.Column {
+    masking := s.tableMasking(tableName)
+    if masking == nil {
+        return columns
+    }
+
+    result := make(map[string]*inspector.Column, len(columns))
+    for name, column := range columns {
+        if _, masked := masking.columns[column.Index]; !masked {
+            result[name] = column
+        }
+    }
+
+    // checksum needs at least one column
+    if len(result) == 0 {
+        return columns
+    }
+
+    return result
+}
+
+// Replaces values of masked columns in row. Values are []byte or nil
+func (t *tableMasking)apply(rowValues []interface{}) {
+    for index, mask := range t.columns {
+        if value, ok := rowValues[index].([]byte); ok {
+            rowValues[index] = mask.apply(value)
+        }
+    }
+}
+func (m *columnMask)apply(value []byte) interface{} {
+    var result []byte
+
+    switch m.rule.Transform {
+    case MASK_NULL:
+        return nil
+    case MASK_FIXED:
+        return []byte(m.rule.Value)
+    case MASK_HASH:
+        if m.column.IsNumeric && !m.column.IsBlob() {
+            result = m.number(value)
+        } else {
+            result = []byte(hex.EncodeToString(m.hash(value, 0)))
+        }
+    case MASK_DIGITS:
+        if m.column.IsNumeric && !m.column.IsBlob() {
+            result = m.number(value)
+        } else {
+            result = m.digits(value)
+        }
+    case MASK_EMAIL:
+        result = []byte(fmt.Sprintf("user.%s@example.com", hex.EncodeToString(m.hash(value, 0)[:6])))
+    case MASK_PHONE:
+        n := binary.BigEndian.Uint64(m.hash(value, 0))
+        result = []byte(fmt.Sprintf("+1-555-%03d-%04d", n % 1000, (n / 1000) % 10000))
+    case MASK_NAME:
+        sum := m.hash(value, 0)
+        result = []byte(maskFirstNames[int(sum[0]) % len(maskFirstNames)] + " " + maskLastNames[int(sum[1]) % len(maskLastNames)])
+    case MASK_TRUNCATE:
+        return m.truncate(value, m.rule.Length)
+    default:
+        return value
+    }
+
+    // generated value must fit into char column, length of other types is display width
+    if maskTextTypes[m.column.ColType] || m.column.ColType == "binary" || m.column.ColType == "varbinary" {
+        return m.truncate(result, m.column.Length)
+    }
+
+    return result
+}
+// HMAC of value with salt. Counter gives next blocks of hash stream
+func (m *columnMask)hash(value []byte, counter uint32) []byte {
+    mac := hmac.New(sha256.New, m.salt)
+
+    block := make([]byte, 4)
+    binary.BigEndian.PutUint32(block, counter)
+
+    mac.Write(block)
+    mac.Write(value)
+
+    return mac.Sum(nil)
+}
+// Every digit is replaced with digit of hash stream, so format of value is kept
+func (m *columnMask)digits(value []byte) []byte {
+    result := make([]byte, len(value))
+
+    var stream []byte
+    var counter uint32
+    for i, c := range value {
+        if c < '0' || c > '9' {
+            result[i] = c
+            continue
+        }
+
+        if len(stream) == 0 {
+            stream = m.hash(value, counter)
+            counter++
+        }
+
+        result[i] = '0' + stream[0] % 10
+        stream = stream[1:]
+    }
+
+    return result
+}
+// Digits of number are replaced. Integer doesn't exceed absolute value of original, so it fits into column type
+func (m *columnMask)number(value []byte) []byte {
+    result := m.digits(value)
+
+    if strings.ContainsAny(string(value), ".eE") {
+        return result
+    }
+
+    original, ok := new(big.Int).SetString(string(value), 10)
+    if !ok {
+        return result
+    }
+
+    masked, ok := new(big.Int).SetString(string(result), 10)
+    if !ok {
+        return result
+    }
+
+    limit := new(big.Int).Abs(original)
+    if new(big.Int).Abs(masked).Cmp(limit) > 0 {
+        masked.Rem(masked, limit.Add(limit, big.NewInt(1)))
+    }
+
+    return []byte(masked.String())
+}
+// Text is cut by characters, blob by bytes. Zero length keeps value
+func (m *columnMask)truncate(value []byte, length int) []byte {
+    if length <= 0 || len(value) <= length {
+        return value
+    }
+
+    if m.column.IsBlob() {
+        return value[:length]
+    }
+
+    count := 0
+    for i := range string(value) {
+        if count == length {
+            return value[:i]
+        }
+        count++
+    }
+
+    return value
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+    "github.com/LTD-Beget/besync/inspector"
+    "math/big"
+    "regexp"
+    "strings"
+    "testing"
+)
+
+var (
+    maskIntColumn      = &inspector.Column{Name: "id", IsNumeric: true, ColType: "int"}
+    maskDecimalColumn  = &inspector.Column{Name: "amount", IsNumeric: true, ColType: "decimal"}
+    maskTextColumn     = &inspector.Column{Name: "name", ColType: "varchar", Length: 255}
+    maskShortColumn    = &inspector.Column{Name: "code", ColType: "char", Length: 10}
+    maskDateColumn     = &inspector.Column{Name: "created", ColType: "datetime"}
+    maskNullableColumn = &inspector.Column{Name: "comment", ColType: "text", Nullable: true}
+)
+
+func makeTestMask(transform string, column *inspector.Column, salt string) *columnMask {
+    return &columnMask{rule: &MaskRule{Transform: transform}, column: column, salt: []byte(salt)}
+}
+
+// Masked value depends only on value and salt, so masked keys still join
+func TestMaskDeterministic(t *testing.T) {
+    for _, transform := range []string{MASK_HASH, MASK_EMAIL, MASK_PHONE, MASK_NAME, MASK_DIGITS} {
+        value := []byte("john.doe+421596@mail.example")
+
+        first := makeTestMask(transform, maskTextColumn, "salt-1").apply(value).([]byte)
+        again := makeTestMask(transform, maskTextColumn, "salt-1").apply(value).([]byte)
+        if string(first) != string(again) {
+            t.Errorf("%s: %s and %s for the same value and salt", transform, first, again)
+        }
+
+        if transform == MASK_NAME {
+            // fake names are few, they may repeat for other salts
+            continue
+        }
+
+        if other := makeTestMask(transform, maskTextColumn, "salt-2").apply(value).([]byte); string(other) == string(first) {
+            t.Errorf("%s: %s doesn't depend on salt", transform, first)
+        }
+
+        if other := makeTestMask(transform, maskTextColumn, "salt-1").apply([]byte("jane.doe+438870@mail.example")).([]byte); string(other) == string(first) {
+            t.Errorf("%s: %s doesn't depend on value", transform, first)
+        }
+    }
+}
+
+func TestMaskFormats(t *testing.T) {
+    tests := []struct {
+        transform string
+        column    *inspector.Column
+        value     string
+        pattern   string
+    }{
+        {MASK_HASH, maskTextColumn, "secret", "^[0-9a-f]{64}$"},
+        {MASK_HASH, maskShortColumn, "secret", "^[0-9a-f]{10}$"},
+        {MASK_EMAIL, maskTextColumn, "a@b.c", "^user\\.[0-9a-f]{12}@example\\.com$"},
+        {MASK_PHONE, maskTextColumn, "+7 900 000-00-00", "^\\+1-555-\\d{3}-\\d{4}$"},
+        {MASK_NAME, maskTextColumn, "Ivan Petrov", "^[A-Z][a-z]+ [A-Z][a-z]+$"},
+        {MASK_DIGITS, maskTextColumn, "+7 (900) 123-45-67", "^\\+\\d \\(\\d{3}\\) \\d{3}-\\d{2}-\\d{2}$"},
+        {MASK_DIGITS, maskTextColumn, "card 4111 1111", "^card \\d{4} \\d{4}$"},
+        {MASK_DIGITS, maskTextColumn, "no digits", "^no digits$"},
+        {MASK_DIGITS, maskDecimalColumn, "-123.45", "^-\\d{3}\\.\\d{2}$"},
+    }
+
+    for _, test := range tests {
+        result := makeTestMask(test.transform, test.column, "salt").apply([]byte(test.value)).([]byte)
+
+        if !regexp.MustCompile(test.pattern).Match(result) {
+            t.Errorf("%s of %q for %s: %q doesn't match %s", test.transform, test.value, test.column.ColType, result, test.pattern)
+        }
+    }
+}
+
+// Masked integer doesn't exceed absolute value of original, so it fits into type of column
+func TestMaskNumberClamp(t *testing.T) {
+    values := []string{"0", "7", "-7", "10", "99", "100", "-100", "12345", "2147483647", "-2147483648", "18446744073709551615"}
+    for j := 1; j < 300; j++ {
+        values = append(values, big.NewInt(int64(j * 37)).String())
+    }
+
+    for _, transform := range []string{MASK_HASH, MASK_DIGITS} {
+        mask := makeTestMask(transform, maskIntColumn, "salt")
+
+        for _, value := range values {
+            result := string(mask.apply([]byte(value)).([]byte))
+
+            original, _ := new(big.Int).SetString(value, 10)
+            masked, ok := new(big.Int).SetString(result, 10)
+            if !ok {
+                t.Errorf("%s of %s: %s is not integer", transform, value, result)
+                continue
+            }
+
+            if new(big.Int).Abs(masked).Cmp(new(big.Int).Abs(original)) > 0 {
+                t.Errorf("%s of %s: %s exceeds original", transform, value, result)
+            }
+
+            if strings.HasPrefix(value, "-") != strings.HasPrefix(result, "-") && masked.Sign() != 0 {
+                t.Errorf("%s of %s: %s has other sign", transform, value, result)
+            }
+        }
+    }
+}
+
+// Text is cut by characters, so multibyte characters are not broken
+func TestMaskTruncate(t *testing.T) {
+    tests := []struct {
+        value    string
+        length   int
+        expected string
+    }{
+        {"abcdef", 3, "abc"},
+        {"abc", 3, "abc"},
+        {"ab", 5, "ab"},
+        {"Привет, мир", 6, "Привет"},
+        {"日本語テキスト", 2, "日本"},
+        {"", 3, ""},
+    }
+
+    for _, test := range tests {
+        mask := &columnMask{rule: &MaskRule{Transform: MASK_TRUNCATE, Length: test.length}, column: maskTextColumn}
+
+        if result := string(mask.apply([]byte(test.value)).([]byte)); result != test.expected {
+            t.Errorf("truncate(%q, %d) = %q, expected %q", test.value, test.length, result, test.expected)
+        }
+    }
+
+    // generated value is cut to length of char column
+    mask := &columnMask{column: &inspector.Column{Name: "c", ColType: "varchar", Length: 4}}
+    if result := string(mask.truncate([]byte("ёжик-ёж"), 4)); result != "ёжик" {
+        t.Errorf("truncate to column length = %q, expected ёжик", result)
+    }
+}
+
+func TestMaskNullAndFixed(t *testing.T) {
+    if result := makeTestMask(MASK_NULL, maskTextColumn, "").apply([]byte("x")); result != nil {
+        t.Errorf("null transform = %v, expected nil", result)
+    }
+
+    mask := &columnMask{rule: &MaskRule{Transform: MASK_FIXED, Value: "hidden"}, column: maskTextColumn}
+    if result := mask.apply([]byte("x")).([]byte); string(result) != "hidden" {
+        t.Errorf("fixed transform = %s, expected hidden", result)
+    }
+
+    // NULL values stay NULL
+    masking := &tableMasking{columns: map[int]*columnMask{1: makeTestMask(MASK_HASH, maskTextColumn, "salt")}}
+    row := []interface{}{[]byte("1"), nil, []byte("keep")}
+    masking.apply(row)
+
+    if row[1] != nil || string(row[0].([]byte)) != "1" || string(row[2].([]byte)) != "keep" {
+        t.Errorf("Masked row %q", row)
+    }
+}
+
+func TestMaskRuleCheck(t *testing.T) {
+    tests := []struct {
+        name    string
+        rule    *MaskRule
+        column  *inspector.Column
+        salt    string
+        success bool
+    }{
+        {"hash of text", &MaskRule{Transform: MASK_HASH}, maskTextColumn, "salt", true},
+        {"hash of integer", &MaskRule{Transform: MASK_HASH}, maskIntColumn, "salt", true},
+        {"hash without salt", &MaskRule{Transform: MASK_HASH}, maskTextColumn, "", false},
+        {"email without salt", &MaskRule{Transform: MASK_EMAIL}, maskTextColumn, "", false},
+        {"hash of date", &MaskRule{Transform: MASK_HASH}, maskDateColumn, "salt", false},
+        {"digits of decimal", &MaskRule{Transform: MASK_DIGITS}, maskDecimalColumn, "salt", true},
+        {"email of integer", &MaskRule{Transform: MASK_EMAIL}, maskIntColumn, "salt", false},
+        {"phone of date", &MaskRule{Transform: MASK_PHONE}, maskDateColumn, "salt", false},
+        {"name of text", &MaskRule{Transform: MASK_NAME}, maskTextColumn, "salt", true},
+        {"truncate", &MaskRule{Transform: MASK_TRUNCATE, Length: 3}, maskTextColumn, "", true},
+        {"truncate without length", &MaskRule{Transform: MASK_TRUNCATE}, maskTextColumn, "", false},
+        {"truncate of integer", &MaskRule{Transform: MASK_TRUNCATE, Length: 3}, maskIntColumn, "", false},
+        {"fixed of text", &MaskRule{Transform: MASK_FIXED, Value: "x"}, maskTextColumn, "", true},
+        {"fixed number of integer", &MaskRule{Transform: MASK_FIXED, Value: "-5"}, maskIntColumn, "", true},
+        {"fixed text of integer", &MaskRule{Transform: MASK_FIXED, Value: "x"}, maskIntColumn, "", false},
+        {"fixed fraction of integer", &MaskRule{Transform: MASK_FIXED, Value: "1.5"}, maskIntColumn, "", false},
+        {"fixed fraction of decimal", &MaskRule{Transform: MASK_FIXED, Value: "1.5"}, maskDecimalColumn, "", true},
+        {"null of nullable", &MaskRule{Transform: MASK_NULL}, maskNullableColumn, "", true},
+        {"null of NOT NULL", &MaskRule{Transform: MASK_NULL}, maskTextColumn, "", false},
+        {"unknown transform", &MaskRule{Transform: "shuffle"}, maskTextColumn, "salt", false},
+    }
+
+    for _, test := range tests {
+        err := test.rule.check(test.column, test.salt)
+
+        if test.success && err != nil {
+            t.Errorf("%s: %v", test.name, err)
+        }
+        if !test.success && err == nil {
+            t.Errorf("%s: check must fail", test.name)
+        }
+    }
+}
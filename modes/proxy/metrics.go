@@ -0,0 +1,210 @@
+package proxy
+
+import (
+    "github.com/LTD-Beget/besync/modes/proxy/tableChunk"
+    "bytes"
+    "fmt"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Metrics of daemon in prometheus text format. Counters are kept since start of process
+type daemonMetrics struct {
+    mutex          *sync.Mutex
+    tasksFinished  map[string]map[string]int64 // type -> status -> count
+
+    rows           int64 // atomic
+    bytes          int64 // atomic
+    workers        int64 // atomic
+    workersBusy    int64 // atomic
+
+    chunkDuration  *histogram
+    flushDuration  *histogram
+    flushRows      *histogram
+    flushBytes     *histogram
+}
+
+type histogram struct {
+    mutex   *sync.Mutex
+    buckets []float64
+    counts  []uint64 // not cumulative, last one is +Inf
+    sum     float64
+    count   uint64
+}
+
+var metrics = &daemonMetrics{
+    mutex: &sync.Mutex{},
+    tasksFinished: make(map[string]map[string]int64),
+    chunkDuration: makeHistogram([]float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600}),
+    flushDuration: makeHistogram([]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}),
+    flushRows: makeHistogram([]float64{1, 10, 100, 500, 1000, 2500, 5000}),
+    flushBytes: makeHistogram([]float64{1024, 16384, 131072, 1048576, 4194304, 16777216, 67108864}),
+}
+
+func makeHistogram(buckets []float64) *histogram {
+    return &histogram{
+        mutex: &sync.Mutex{},
+        buckets: buckets,
+        counts: make([]uint64, len(buckets) + 1),
+    }
+}
+func (h *histogram)observe(value float64) {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    i := sort.SearchFloat64s(h.buckets, value)
+    h.counts[i]++
+    h.sum += value
+    h.count++
+}
+func (h *histogram)write(buf *bytes.Buffer, name, help string) {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    writeMetricHeader(buf, name, help, "histogram")
+
+    var cumulative uint64
+    for i, bound := range h.buckets {
+        cumulative += h.counts[i]
+        fmt.Fprintf(buf, "%s_bucket{le=\"%s\"} %v\n", name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+    }
+
+    fmt.Fprintf(buf, "%s_bucket{le=\"+Inf\"} %v\n", name, h.count)
+    fmt.Fprintf(buf, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+    fmt.Fprintf(buf, "%s_count %v\n", name, h.count)
+}
+
+func (m *daemonMetrics)taskFinished(taskType, status string) {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    if _, ok := m.tasksFinished[taskType]; !ok {
+        m.tasksFinished[taskType] = make(map[string]int64)
+    }
+
+    m.tasksFinished[taskType][status]++
+}
+func (m *daemonMetrics)rowsCopied(rows int, size int64) {
+    atomic.AddInt64(&m.rows, int64(rows))
+    atomic.AddInt64(&m.bytes, size)
+}
+func (m *daemonMetrics)chunkDone(chunk *tableChunk.Chunk, duration time.Duration) {
+    m.chunkDuration.observe(duration.Seconds())
+}
+func (m *daemonMetrics)batchFlushed(duration time.Duration, rows int, size int64) {
+    m.flushDuration.observe(duration.Seconds())
+    m.flushRows.observe(float64(rows))
+    m.flushBytes.observe(float64(size))
+}
+func (m *daemonMetrics)workerStarted() {
+    atomic.AddInt64(&m.workers, 1)
+}
+func (m *daemonMetrics)workerStopped() {
+    atomic.AddInt64(&m.workers, -1)
+}
+func (m *daemonMetrics)jobStarted() {
+    atomic.AddInt64(&m.workersBusy, 1)
+}
+func (m *daemonMetrics)jobFinished() {
+    atomic.AddInt64(&m.workersBusy, -1)
+}
+
+func (m *daemonMetrics)write(buf *bytes.Buffer) {
+    running := Manager.runningTasks()
+
+    writeMetricHeader(buf, "besync_tasks_running", "Count of running tasks", "gauge")
+    runningByType := make(map[string]int)
+    for _, task := range running {
+        runningByType[task.taskType]++
+    }
+    for _, taskType := range []string{TASK_SYNC, TASK_VERIFY, TASK_IMPORT} {
+        fmt.Fprintf(buf, "besync_tasks_running{type=\"%s\"} %v\n", taskType, runningByType[taskType])
+    }
+
+    m.mutex.Lock()
+    writeMetricHeader(buf, "besync_tasks_finished_total", "Count of finished tasks by status", "counter")
+    for _, taskType := range []string{TASK_SYNC, TASK_VERIFY, TASK_IMPORT} {
+        statuses := make([]string, 0, len(m.tasksFinished[taskType]))
+        for status := range m.tasksFinished[taskType] {
+            statuses = append(statuses, status)
+        }
+        sort.Strings(statuses)
+
+        for _, status := range statuses {
+            fmt.Fprintf(buf, "besync_tasks_finished_total{type=\"%s\",status=\"%s\"} %v\n", taskType, status, m.tasksFinished[taskType][status])
+        }
+    }
+    m.mutex.Unlock()
+
+    writeMetricHeader(buf, "besync_task_rows", "Rows copied by running task", "gauge")
+    for _, task := range running {
+        fmt.Fprintf(buf, "besync_task_rows{id=\"%v\",type=\"%s\"} %v\n", task.id, task.taskType, task.progress.Rows)
+    }
+
+    writeMetricHeader(buf, "besync_task_bytes", "Bytes copied by running task", "gauge")
+    for _, task := range running {
+        fmt.Fprintf(buf, "besync_task_bytes{id=\"%v\",type=\"%s\"} %v\n", task.id, task.taskType, task.progress.Bytes)
+    }
+
+    writeMetricHeader(buf, "besync_task_chunks_done", "Chunks copied by running task", "gauge")
+    for _, task := range running {
+        fmt.Fprintf(buf, "besync_task_chunks_done{id=\"%v\",type=\"%s\"} %v\n", task.id, task.taskType, task.progress.ChunksDone)
+    }
+
+    writeMetricHeader(buf, "besync_task_chunks_total", "Chunks of running task", "gauge")
+    for _, task := range running {
+        fmt.Fprintf(buf, "besync_task_chunks_total{id=\"%v\",type=\"%s\"} %v\n", task.id, task.taskType, task.progress.ChunksTotal)
+    }
+
+    writeMetricHeader(buf, "besync_rows_total", "Rows copied by all tasks", "counter")
+    fmt.Fprintf(buf, "besync_rows_total %v\n", atomic.LoadInt64(&m.rows))
+
+    writeMetricHeader(buf, "besync_bytes_total", "Bytes copied by all tasks", "counter")
+    fmt.Fprintf(buf, "besync_bytes_total %v\n", atomic.LoadInt64(&m.bytes))
+
+    m.chunkDuration.write(buf, "besync_chunk_duration_seconds", "Duration of table chunk copy")
+    m.flushDuration.write(buf, "besync_batch_flush_duration_seconds", "Duration of batch insert flush")
+    m.flushRows.write(buf, "besync_batch_flush_rows", "Rows of batch insert flush")
+    m.flushBytes.write(buf, "besync_batch_flush_bytes", "Bytes of batch insert flush")
+
+    proxies, importers := proxyCounts()
+
+    writeMetricHeader(buf, "besync_proxies", "Count of started proxies", "gauge")
+    fmt.Fprintf(buf, "besync_proxies %v\n", proxies)
+
+    writeMetricHeader(buf, "besync_proxy_importers", "Count of open proxy importers (listeners)", "gauge")
+    fmt.Fprintf(buf, "besync_proxy_importers %v\n", importers)
+
+    writeMetricHeader(buf, "besync_workers", "Count of workers of running tasks", "gauge")
+    fmt.Fprintf(buf, "besync_workers %v\n", atomic.LoadInt64(&m.workers))
+
+    writeMetricHeader(buf, "besync_workers_busy", "Count of workers which are running job", "gauge")
+    fmt.Fprintf(buf, "besync_workers_busy %v\n", atomic.LoadInt64(&m.workersBusy))
+}
+
+func writeMetricHeader(buf *bytes.Buffer, name, help, metricType string) {
+    fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+func proxyCounts() (int, int) {
+    proxyMapMutex.Lock()
+    defer proxyMapMutex.Unlock()
+
+    importers := 0
+    for _, session := range proxyMap {
+        importers += len(session.importers)
+    }
+
+    return len(proxyMap), importers
+}
+
+func metricsAction(w http.ResponseWriter, r *http.Request) {
+    buf := &bytes.Buffer{}
+    metrics.write(buf)
+
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    w.Write(buf.Bytes())
+}
@@ -3,11 +3,15 @@ package proxy
 import (
     "github.com/siddontang/go-mysql/mysql"
     "net"
+    "crypto/tls"
     "github.com/siddontang/go-mysql/server"
     "github.com/siddontang/go-mysql/client"
     log "github.com/Sirupsen/logrus"
     "time"
     "fmt"
+    "context"
+    "sync"
+    "sync/atomic"
 )
 
 type TargetDbSettings struct {
@@ -16,14 +20,19 @@ type TargetDbSettings struct {
     DbHost string
     DbName string
     DbPort int
+    DbTLS *TLSSettings
 }
 type MysqlProxyImporter struct {
     conn *client.Conn
     proxyListener net.Listener
     proxyMysqlConn *server.Conn
     statements map[int64] *client.Stmt
-    commandCh chan Command
     targetDbSettings *TargetDbSettings
+    listenPassword string // password of proxy listener, differs from password of target
+    ctx context.Context
+    cancel context.CancelFunc
+    mutex *sync.Mutex
+    activeAt *int64 // unix nano time of start or last command, updated atomically
 
     proxyHost string
     proxyPort int
@@ -31,100 +40,153 @@ type MysqlProxyImporter struct {
     state string
 }
 
-type Command uint16
-const COMMAND_STOP Command = 1
+func MakeProxyImporter(ctx context.Context, host string, port int, settings *TargetDbSettings, listenPassword string) (*MysqlProxyImporter, error) {
+    var options []func(*client.Conn)
+    if settings.DbTLS != nil {
+        tlsConfig, err := settings.DbTLS.clientConfig(settings.DbHost)
+        if err != nil {
+            return nil, err
+        }
 
-func MakeProxyImporter(host string, port int, settings *TargetDbSettings) (*MysqlProxyImporter, error) {
-    targetConn, err := client.Connect(fmt.Sprintf("%v:%v", settings.DbHost, settings.DbPort), settings.DbUser, settings.DbPassword, settings.DbName)
+        options = append(options, func(c *client.Conn) {
+            c.SetTLSConfig(tlsConfig)
+        })
+    }
 
+    targetConn, err := client.Connect(fmt.Sprintf("%v:%v", settings.DbHost, settings.DbPort), settings.DbUser, settings.DbPassword, settings.DbName, options...)
     if err != nil {
-        panic(err)
+        return nil, err
     }
 
+    ctx, cancel := context.WithCancel(ctx)
+    activeAt := time.Now().UnixNano()
+
     handler := &MysqlProxyImporter{
         conn: targetConn,
         statements: make(map[int64]*client.Stmt),
         targetDbSettings: settings,
-        commandCh: make(chan Command),
+        listenPassword: listenPassword,
+        ctx: ctx,
+        cancel: cancel,
+        mutex: &sync.Mutex{},
+        activeAt: &activeAt,
         proxyHost: host,
         proxyPort: port,
     }
 
     return handler, nil
 }
+// Start listens proxy port. Importer works until Stop is called or its context is done
 func (h *MysqlProxyImporter)Start() error {
     l, err := net.Listen("tcp4", fmt.Sprintf("%v:%v", h.proxyHost, h.proxyPort))
     if err != nil {
+        h.cancel()
+        h.conn.Close()
         return err
     }
 
     h.proxyListener = l
 
     go func() {
-        for {
-            select {
-            case command := <-h.commandCh:
-                switch(command) {
-                case COMMAND_STOP:
-                    log.Debugf("[mysql-proxy] Stopping importer")
-                    err := h.stop()
-
-                    if err != nil {
-                        log.Errorf("Failed to stop: %v", err)
-                    }
-                default:
-                    log.Errorf("Unknown command %v", command)
-                }
-            }
+        <-h.ctx.Done()
+
+        log.Debugf("[mysql-proxy] Stopping importer")
+        if err := h.stop(); err != nil {
+            log.Errorf("[mysql-proxy] Failed to stop: %v", err)
         }
     }()
 
-    go func() {
-        c, err := l.Accept()
-        if err != nil {
-            panic(err) // todo handle this
-            //return nil, err
-        }
+    go h.serve()
 
-        log.Infof("ACCEPT: user: %v; password: %v", h.targetDbSettings.DbUser, h.targetDbSettings.DbPassword)
-        proxyConn, err := server.NewConn(c, h.targetDbSettings.DbUser, h.targetDbSettings.DbPassword, h)
-        if err != nil {
-            panic(err) // todo handle this
+    return nil
+}
+func (h *MysqlProxyImporter)Stop() {
+    h.cancel()
+}
+func (h *MysqlProxyImporter)serve() {
+    defer h.proxyListener.Close()
+
+    c, err := h.proxyListener.Accept()
+    if err != nil {
+        if h.ctx.Err() == nil {
+            log.Errorf("[mysql-proxy] Accept error: %v", err)
         }
+        return
+    }
 
-        h.proxyMysqlConn = proxyConn
+    log.Infof("[mysql-proxy] Accepted connection from %v for user %v", c.RemoteAddr(), h.targetDbSettings.DbUser)
+    proxyConn, err := h.newServerConn(c)
+    if err != nil {
+        log.Errorf("[mysql-proxy] Handshake error: %v", err)
+        c.Close()
+        return
+    }
 
-        for {
-            err := proxyConn.HandleCommand()
+    h.mutex.Lock()
+    h.proxyMysqlConn = proxyConn
+    h.mutex.Unlock()
 
-            if err != nil {
-                if h.state == "stopped" || h.state == "stopping" {
-                    log.Infof("[mysql-proxy] Stopping handle mysql command")
-                } else {
-                    log.Warnf("[mysql-proxy] Handle command err: %v", err)
-                }
+    h.touch()
+
+    for {
+        err := proxyConn.HandleCommand()
+        h.touch()
 
-                break
+        if err != nil {
+            if h.ctx.Err() != nil {
+                log.Infof("[mysql-proxy] Stopping handle mysql command")
+            } else {
+                log.Warnf("[mysql-proxy] Handle command err: %v", err)
             }
+
+            break
         }
+    }
+}
+// Connection of proxy listener. If daemon has proxy certificate, client must upgrade connection to TLS
+func (h *MysqlProxyImporter)newServerConn(c net.Conn) (*server.Conn, error) {
+    if proxyServerTLS == nil {
+        return server.NewConn(c, h.targetDbSettings.DbUser, h.listenPassword, h)
+    }
 
-        l.Close()
-    }()
+    serverConf := server.NewServer("5.7.0", mysql.DEFAULT_COLLATION_ID, mysql.AUTH_NATIVE_PASSWORD, nil, proxyServerTLS)
 
-    return nil
+    credentials := server.NewInMemoryProvider()
+    credentials.AddUser(h.targetDbSettings.DbUser, h.listenPassword)
+
+    proxyConn, err := server.NewCustomizedConn(c, serverConf, credentials, h)
+    if err != nil {
+        return nil, err
+    }
+
+    // upgrade is optional for mysql clients, so plain connection is refused before any command
+    if _, ok := proxyConn.Conn.Conn.(*tls.Conn); !ok {
+        proxyConn.Close()
+        return nil, fmt.Errorf("[mysql-proxy] Connection from %v without TLS is refused", c.RemoteAddr())
+    }
+
+    return proxyConn, nil
 }
-func (h *MysqlProxyImporter)SendCommand(command Command) {
-    h.commandCh <- command
+func (h *MysqlProxyImporter)touch() {
+    atomic.StoreInt64(h.activeAt, time.Now().UnixNano())
+}
+// Time since last command of client
+func (h *MysqlProxyImporter)idle() time.Duration {
+    return time.Since(time.Unix(0, atomic.LoadInt64(h.activeAt)))
 }
 func (h *MysqlProxyImporter)stop() error {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
     h.state = "stopping"
     defer func() { h.state = "stopped"}()
 
-    if err := h.proxyListener.Close(); err != nil {
-        return err
-    }
+    // listener may be already closed if client was disconnected
+    h.proxyListener.Close()
 
-    h.proxyMysqlConn.Close()
+    if h.proxyMysqlConn != nil {
+        h.proxyMysqlConn.Close()
+    }
 
     if err := h.conn.Close(); err != nil {
         return err
@@ -185,6 +247,10 @@ func (h MysqlProxyImporter)HandleStmtExecute(context interface{}, query string,
         return nil, fmt.Errorf("Invalid context")
     }
 }
+// Other commands (COM_PING etc.) are not used by workers
+func (h MysqlProxyImporter)HandleOtherCommand(cmd byte, data []byte) error {
+    return mysql.NewError(mysql.ER_UNKNOWN_ERROR, fmt.Sprintf("command %d is not supported now", cmd))
+}
 func (h MysqlProxyImporter)HandleStmtClose(context interface{}) error {
     intContext, ok := context.(int64)
     if !ok {
@@ -0,0 +1,369 @@
+package proxy
+
+import (
+    log "github.com/Sirupsen/logrus"
+    "bytes"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "sync"
+    "time"
+)
+
+var notificationSchema = `
+CREATE TABLE IF NOT EXISTS sync_notification
+(
+ id INTEGER PRIMARY KEY AUTOINCREMENT,
+ task_id INT NOT NULL,
+ url TEXT NOT NULL,
+ payload TEXT NOT NULL,
+ status VARCHAR(50) NOT NULL,
+ attempts INT NOT NULL DEFAULT 0,
+ max_attempts INT NOT NULL,
+ next_attempt INT NOT NULL,
+ last_error TEXT,
+ date_create DATETIME NOT NULL,
+ date_update DATETIME NOT NULL
+);
+`
+
+const (
+    NOTIFICATION_PENDING = "pending"
+    NOTIFICATION_SENT    = "sent"
+    NOTIFICATION_FAILED  = "failed"
+)
+
+const (
+    NOTIFY_DEFAULT_MAX_ATTEMPTS = 10
+    NOTIFY_BACKOFF              = 5 * time.Second // delay before first retry, doubled by every next one
+    NOTIFY_MAX_BACKOFF          = time.Hour
+    NOTIFY_TIMEOUT              = 10 * time.Second
+    NOTIFY_POLL_INTERVAL        = 5 * time.Second
+    NOTIFY_KEEP_DAYS            = 7 // delivered and failed notifications are removed after this
+)
+
+type NotifySettings struct {
+    Urls             []string // every event is posted to all urls
+    ProgressInterval int      // seconds between progress events of running task, 0 - only status changes are sent
+    MaxAttempts      int      // attempts of delivery of status event, 10 by default. Progress events are not retried
+}
+
+// Body of notification request
+type NotifyEvent struct {
+    Id              int64
+    Type            string
+    Status          string // following, success, error, cancelled or progress
+    Error           string       `json:",omitempty"`
+    ErrorDetails    *ExportError `json:",omitempty"`
+    StartedAt       time.Time
+    Time            time.Time
+    DurationSeconds int64
+    Rows            int64
+    Bytes           int64
+    Progress        *ExportProgress
+}
+
+// Delivers notifications saved in local db. Undelivered ones are retried after restart of daemon
+type notifier struct {
+    db     *sql.DB
+    client *http.Client
+    wakeCh chan struct{}
+    once   *sync.Once
+}
+
+type notification struct {
+    id          int64
+    url         string
+    payload     string
+    attempts    int
+    maxAttempts int
+}
+
+func makeNotifier(db *sql.DB) *notifier {
+    return &notifier{
+        db: db,
+        client: &http.Client{Timeout: NOTIFY_TIMEOUT},
+        wakeCh: make(chan struct{}, 1),
+        once: &sync.Once{},
+    }
+}
+
+func (n *NotifySettings)check() error {
+    if n == nil {
+        return nil
+    }
+
+    for _, rawUrl := range n.Urls {
+        parsed, err := url.Parse(rawUrl)
+        if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+            return fmt.Errorf("Notify: invalid url '%s'", rawUrl)
+        }
+    }
+
+    if n.ProgressInterval < 0 || n.MaxAttempts < 0 {
+        return fmt.Errorf("Notify: ProgressInterval and MaxAttempts cannot be negative")
+    }
+
+    return nil
+}
+func (n *NotifySettings)maxAttempts() int {
+    if n.MaxAttempts == 0 {
+        return NOTIFY_DEFAULT_MAX_ATTEMPTS
+    }
+
+    return n.MaxAttempts
+}
+
+// Starts delivery in background. It may be called many times
+func (n *notifier)start() {
+    n.once.Do(func() {
+        go n.run()
+    })
+}
+func (n *notifier)run() {
+    cleanupSql := `DELETE FROM sync_notification WHERE status != ? AND date_update < datetime('now','localtime',?)`
+    if _, err := n.db.Exec(cleanupSql, NOTIFICATION_PENDING, fmt.Sprintf("-%d days", NOTIFY_KEEP_DAYS)); err != nil {
+        log.Errorf("[notify] Failed to remove old notifications: %v", err)
+    }
+
+    ticker := time.NewTicker(NOTIFY_POLL_INTERVAL)
+    defer ticker.Stop()
+
+    for {
+        if err := n.deliverPending(); err != nil {
+            log.Errorf("[notify] Failed to deliver notifications: %v", err)
+        }
+
+        select {
+        case <-ticker.C:
+        case <-n.wakeCh:
+        }
+    }
+}
+
+// Saves event for every url of settings and wakes up delivery
+func (n *notifier)enqueue(settings *NotifySettings, event *NotifyEvent, maxAttempts int) error {
+    payload, err := json.Marshal(event)
+    if err != nil {
+        return err
+    }
+
+    insertSql := `INSERT INTO sync_notification (task_id, url, payload, status, max_attempts, next_attempt, date_create, date_update)
+     VALUES (?, ?, ?, ?, ?, ?, datetime('now','localtime'), datetime('now','localtime'))`
+
+    for _, rawUrl := range settings.Urls {
+        if _, err := n.db.Exec(insertSql, event.Id, rawUrl, string(payload), NOTIFICATION_PENDING, maxAttempts, time.Now().Unix()); err != nil {
+            return err
+        }
+    }
+
+    n.start()
+
+    select {
+    case n.wakeCh <- struct{}{}:
+    default:
+    }
+
+    return nil
+}
+
+func (n *notifier)deliverPending() error {
+    selectSql := `SELECT id, url, payload, attempts, max_attempts FROM sync_notification
+     WHERE status = ? AND next_attempt <= ? ORDER BY id`
+
+    rows, err := n.db.Query(selectSql, NOTIFICATION_PENDING, time.Now().Unix())
+    if err != nil {
+        return err
+    }
+
+    // db has one connection, so rows are read before updates
+    var pending []*notification
+    for rows.Next() {
+        item := &notification{}
+        if err := rows.Scan(&item.id, &item.url, &item.payload, &item.attempts, &item.maxAttempts); err != nil {
+            rows.Close()
+            return err
+        }
+
+        pending = append(pending, item)
+    }
+
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    for _, item := range pending {
+        if err := n.delivered(item, n.send(item)); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+func (n *notifier)send(item *notification) error {
+    resp, err := n.client.Post(item.url, "application/json", bytes.NewBufferString(item.payload))
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    io.Copy(ioutil.Discard, resp.Body)
+
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("Unexpected response status %v", resp.Status)
+    }
+
+    return nil
+}
+// Saves result of delivery attempt and schedules next one with exponential backoff
+func (n *notifier)delivered(item *notification, sendErr error) error {
+    item.attempts++
+
+    if sendErr == nil {
+        updateSql := "UPDATE sync_notification SET status = ?, attempts = ?, last_error = NULL, date_update = datetime('now','localtime') WHERE id = ?"
+        _, err := n.db.Exec(updateSql, NOTIFICATION_SENT, item.attempts, item.id)
+
+        return err
+    }
+
+    status := NOTIFICATION_PENDING
+    if item.attempts >= item.maxAttempts {
+        status = NOTIFICATION_FAILED
+        log.Errorf("[notify] Notification %v to %s failed after %v attempts: %v", item.id, item.url, item.attempts, sendErr)
+    } else {
+        log.Warnf("[notify] Notification %v to %s failed (attempt %v of %v): %v", item.id, item.url, item.attempts, item.maxAttempts, sendErr)
+    }
+
+    backoff := NOTIFY_BACKOFF << uint(item.attempts - 1)
+    if backoff > NOTIFY_MAX_BACKOFF || backoff <= 0 {
+        backoff = NOTIFY_MAX_BACKOFF
+    }
+
+    updateSql := "UPDATE sync_notification SET status = ?, attempts = ?, next_attempt = ?, last_error = ?, date_update = datetime('now','localtime') WHERE id = ?"
+    _, err := n.db.Exec(updateSql, status, item.attempts, time.Now().Add(backoff).Unix(), sendErr.Error(), item.id)
+
+    return err
+}
+
+// Count of notifications of task, which are not delivered yet
+func (n *notifier)pendingCount(taskId int64) (int, error) {
+    var count int
+
+    row := n.db.QueryRow("SELECT COUNT(*) FROM sync_notification WHERE task_id = ? AND status = ?", taskId, NOTIFICATION_PENDING)
+    if err := row.Scan(&count); err != nil {
+        return 0, err
+    }
+
+    return count, nil
+}
+
+// Saves status event of task, if task has notifications. Must be called with locked manager
+func (m *exportManager)notify(exporter *exporter, event *NotifyEvent) {
+    if exporter.settings.Notify == nil {
+        return
+    }
+
+    m.enqueueEvent(exporter, event)
+}
+// Must be called with locked manager, so events of task are saved in order of their statuses
+func (m *exportManager)enqueueEvent(exporter *exporter, event *NotifyEvent) {
+    maxAttempts := exporter.settings.Notify.maxAttempts()
+    if event.Status == "progress" {
+        maxAttempts = 1
+    }
+
+    if err := m.notifier.enqueue(exporter.settings.Notify, event, maxAttempts); err != nil {
+        log.Errorf("[notify] Failed to save notification of task %v: %v", event.Id, err)
+    }
+}
+func notifyEvent(id int64, taskType string, progress *ExportProgress, status string, err error, errorDetails *ExportError) *NotifyEvent {
+    now := time.Now()
+
+    event := &NotifyEvent{
+        Id: id,
+        Type: taskType,
+        Status: status,
+        ErrorDetails: errorDetails,
+        StartedAt: progress.StartedAt,
+        Time: now,
+        DurationSeconds: int64(now.Sub(progress.StartedAt).Seconds()),
+        Rows: progress.Rows,
+        Bytes: progress.Bytes,
+        Progress: progress,
+    }
+
+    if err != nil {
+        event.Error = err.Error()
+    }
+
+    return event
+}
+// Sends progress events of running task until done is closed
+func (m *exportManager)notifyProgress(id int64, settings *NotifySettings, done chan struct{}) {
+    if settings == nil || settings.ProgressInterval == 0 {
+        return
+    }
+
+    ticker := time.NewTicker(time.Duration(settings.ProgressInterval) * time.Second)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ticker.C:
+            m.mutex.Lock()
+            exporter, ok := m.running[id]
+            taskType := m.taskType(id)
+            m.mutex.Unlock()
+
+            if !ok {
+                continue
+            }
+
+            // snapshot of progress reads counters of workers and chunks, so it's built without lock of manager
+            event := notifyEvent(id, taskType, exporter.Progress(), "progress", nil, nil)
+
+            m.mutex.Lock()
+            // progress of finished task must not follow its status event
+            if m.running[id] == exporter {
+                m.enqueueEvent(exporter, event)
+            }
+            m.mutex.Unlock()
+        case <-done:
+            return
+        }
+    }
+}
+
+// StartNotifications starts delivery of notifications, which were not delivered before restart
+func (m *exportManager)StartNotifications() {
+    m.notifier.start()
+}
+// WaitNotifications waits until notifications of task are delivered or timeout expires.
+// Undelivered notifications stay in local db and are retried by next start of besync
+func (m *exportManager)WaitNotifications(id int64, timeout time.Duration) {
+    deadline := time.Now().Add(timeout)
+
+    for {
+        count, err := m.notifier.pendingCount(id)
+        if err != nil {
+            log.Errorf("[notify] Failed to read notifications: %v", err)
+            return
+        }
+
+        if count == 0 {
+            return
+        }
+
+        if time.Now().After(deadline) {
+            log.Warnf("[notify] %v notifications of task %v are not delivered yet, they will be retried by next start", count, id)
+            return
+        }
+
+        time.Sleep(500 * time.Millisecond)
+    }
+}
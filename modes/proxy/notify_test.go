@@ -0,0 +1,227 @@
+package proxy
+
+import (
+    "database/sql"
+    "encoding/json"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "sync"
+    "testing"
+    "time"
+)
+
+// Receiver, which answers with statuses in order and records payloads
+type testReceiver struct {
+    mutex    sync.Mutex
+    statuses []int
+    events   []*NotifyEvent
+}
+
+func (r *testReceiver)ServeHTTP(w http.ResponseWriter, req *http.Request) {
+    event := &NotifyEvent{}
+    if err := json.NewDecoder(req.Body).Decode(event); err != nil {
+        w.WriteHeader(http.StatusBadRequest)
+        return
+    }
+
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    r.events = append(r.events, event)
+
+    status := http.StatusOK
+    if len(r.statuses) > 0 {
+        status, r.statuses = r.statuses[0], r.statuses[1:]
+    }
+    w.WriteHeader(status)
+}
+func (r *testReceiver)received() int {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    return len(r.events)
+}
+
+// Notifier on temporary local db without background delivery
+func makeTestNotifier(t *testing.T) (*notifier, func()) {
+    dir, err := ioutil.TempDir("", "besync-notify")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    db, err := sql.Open("sqlite3", filepath.Join(dir, "notify.db"))
+    if err != nil {
+        os.RemoveAll(dir)
+        t.Fatal(err)
+    }
+    db.SetMaxOpenConns(1)
+
+    if _, err := db.Exec(notificationSchema); err != nil {
+        db.Close()
+        os.RemoveAll(dir)
+        t.Fatal(err)
+    }
+
+    n := makeNotifier(db)
+    n.once.Do(func() {})
+
+    return n, func() {
+        db.Close()
+        os.RemoveAll(dir)
+    }
+}
+
+type testNotification struct {
+    status      string
+    attempts    int
+    nextAttempt int64
+    lastError   sql.NullString
+}
+
+func readTestNotification(t *testing.T, n *notifier) *testNotification {
+    item := &testNotification{}
+
+    row := n.db.QueryRow("SELECT status, attempts, next_attempt, last_error FROM sync_notification ORDER BY id LIMIT 1")
+    if err := row.Scan(&item.status, &item.attempts, &item.nextAttempt, &item.lastError); err != nil {
+        t.Fatal(err)
+    }
+
+    return item
+}
+
+func TestNotifierDelivery(t *testing.T) {
+    n, cleanup := makeTestNotifier(t)
+    defer cleanup()
+
+    receiver := &testReceiver{}
+    server := httptest.NewServer(receiver)
+    defer server.Close()
+
+    settings := &NotifySettings{Urls: []string{server.URL}}
+    if err := n.enqueue(settings, &NotifyEvent{Id: 7, Type: "dump", Status: "success", Rows: 42}, settings.maxAttempts()); err != nil {
+        t.Fatal(err)
+    }
+
+    if count, err := n.pendingCount(7); err != nil || count != 1 {
+        t.Fatalf("Pending notifications before delivery: %v, %v", count, err)
+    }
+
+    if err := n.deliverPending(); err != nil {
+        t.Fatal(err)
+    }
+
+    if receiver.received() != 1 {
+        t.Fatalf("Receiver got %d requests, expected 1", receiver.received())
+    }
+
+    event := receiver.events[0]
+    if event.Id != 7 || event.Type != "dump" || event.Status != "success" || event.Rows != 42 {
+        t.Errorf("Unexpected event %+v", event)
+    }
+
+    if item := readTestNotification(t, n); item.status != NOTIFICATION_SENT || item.attempts != 1 || item.lastError.Valid {
+        t.Errorf("Notification after delivery: %+v", item)
+    }
+
+    if count, err := n.pendingCount(7); err != nil || count != 0 {
+        t.Errorf("Pending notifications after delivery: %v, %v", count, err)
+    }
+
+    // delivered notification is not sent again
+    if err := n.deliverPending(); err != nil {
+        t.Fatal(err)
+    }
+    if receiver.received() != 1 {
+        t.Errorf("Delivered notification is sent again")
+    }
+}
+
+// Failed delivery is retried with doubled delay until max attempts
+func TestNotifierRetryBackoff(t *testing.T) {
+    n, cleanup := makeTestNotifier(t)
+    defer cleanup()
+
+    receiver := &testReceiver{statuses: []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable}}
+    server := httptest.NewServer(receiver)
+    defer server.Close()
+
+    settings := &NotifySettings{Urls: []string{server.URL}, MaxAttempts: 3}
+    if err := n.enqueue(settings, &NotifyEvent{Id: 1, Status: "error"}, settings.maxAttempts()); err != nil {
+        t.Fatal(err)
+    }
+
+    backoffs := []time.Duration{NOTIFY_BACKOFF, 2 * NOTIFY_BACKOFF}
+
+    for j, backoff := range backoffs {
+        started := time.Now()
+        if err := n.deliverPending(); err != nil {
+            t.Fatal(err)
+        }
+
+        item := readTestNotification(t, n)
+        if item.status != NOTIFICATION_PENDING || item.attempts != j + 1 || !item.lastError.Valid {
+            t.Fatalf("Attempt %d: %+v", j + 1, item)
+        }
+
+        delay := time.Duration(item.nextAttempt - started.Unix()) * time.Second
+        if delay < backoff || delay > backoff + time.Second {
+            t.Errorf("Attempt %d: next attempt after %v, expected %v", j + 1, delay, backoff)
+        }
+
+        // notification waits for its next attempt
+        if err := n.deliverPending(); err != nil {
+            t.Fatal(err)
+        }
+        if receiver.received() != j + 1 {
+            t.Fatalf("Attempt %d: notification is sent before backoff expired", j + 1)
+        }
+
+        if _, err := n.db.Exec("UPDATE sync_notification SET next_attempt = 0"); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    if err := n.deliverPending(); err != nil {
+        t.Fatal(err)
+    }
+
+    item := readTestNotification(t, n)
+    if item.status != NOTIFICATION_FAILED || item.attempts != 3 || item.lastError.String == "" {
+        t.Errorf("Notification after last attempt: %+v", item)
+    }
+
+    if count, err := n.pendingCount(1); err != nil || count != 0 {
+        t.Errorf("Pending notifications after last attempt: %v, %v", count, err)
+    }
+
+    if err := n.deliverPending(); err != nil {
+        t.Fatal(err)
+    }
+    if receiver.received() != 3 {
+        t.Errorf("Receiver got %d requests, expected 3", receiver.received())
+    }
+}
+
+func TestNotifierBackoffLimit(t *testing.T) {
+    n, cleanup := makeTestNotifier(t)
+    defer cleanup()
+
+    if _, err := n.db.Exec(`INSERT INTO sync_notification (task_id, url, payload, status, max_attempts, next_attempt, date_create, date_update)
+     VALUES (1, 'http://127.0.0.1', '{}', ?, 100, 0, datetime('now'), datetime('now'))`, NOTIFICATION_PENDING); err != nil {
+        t.Fatal(err)
+    }
+
+    started := time.Now()
+    if err := n.delivered(&notification{id: 1, attempts: 40, maxAttempts: 100}, http.ErrHandlerTimeout); err != nil {
+        t.Fatal(err)
+    }
+
+    item := readTestNotification(t, n)
+    delay := time.Duration(item.nextAttempt - started.Unix()) * time.Second
+    if delay < NOTIFY_MAX_BACKOFF || delay > NOTIFY_MAX_BACKOFF + time.Second {
+        t.Errorf("Next attempt after %v, expected %v", delay, NOTIFY_MAX_BACKOFF)
+    }
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+    "sync"
+    "time"
+    "github.com/LTD-Beget/besync/modes/proxy/tableChunk"
+)
+
+const (
+    PHASE_PREPARE  = "prepare"
+    PHASE_SCHEMA   = "schema"
+    PHASE_TABLES   = "tables"
+    PHASE_VIEWS    = "views"
+    PHASE_ROUTINES = "routines"
+    PHASE_VERIFY   = "verify"
+    PHASE_SWAP     = "swap"
+    PHASE_FOLLOW   = "follow"
+    PHASE_FINISHED = "finished"
+)
+
+type TableProgress struct {
+    Rows           int64
+    Bytes          int64
+    EstimatedRows  int64
+    ChunksDone     int
+    ChunksTotal    int     // chunks cut so far, it grows while key ranges are cut
+    ChunksUncut    int     `json:",omitempty"` // key ranges, which are not cut into chunks yet
+    RowsPerSecond  float64 `json:",omitempty"` // copy speed of one worker, next chunks are sized by it
+    BytesPerSecond float64 `json:",omitempty"`
+}
+
+type ExportProgress struct {
+    Phase         string
+    StartedAt     time.Time
+    Rows          int64
+    Bytes         int64
+    EstimatedRows int64
+    ChunksDone    int
+    ChunksTotal   int
+    ChunksUncut   int    `json:",omitempty"`
+    EtaSeconds    int64 // -1 if eta cannot be calculated yet
+    Tables        map[string]*TableProgress
+    Binlog        *BinlogPosition // applied position of source binlog, if binlog is followed
+    DelaySeconds  int64 // delay of target from source while binlog is followed
+    Throttled     string `json:",omitempty"` // reason of pause of workers by load check
+}
+
+// Collects counters from workers. All methods are safe for concurrent use
+type progress struct {
+    mutex         *sync.Mutex
+    phase         string
+    startedAt     time.Time
+    dataStartedAt time.Time
+    tables        map[string]*TableProgress
+    chunkManager  *tableChunk.Manager
+    binlog        *BinlogPosition
+    delaySeconds  int64
+    throttled     string
+}
+
+func makeProgress() *progress {
+    return &progress{
+        mutex: &sync.Mutex{},
+        phase: PHASE_PREPARE,
+        startedAt: time.Now(),
+        tables: make(map[string]*TableProgress),
+    }
+}
+func (p *progress)setPhase(phase string) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    if phase == PHASE_TABLES {
+        p.dataStartedAt = time.Now()
+    }
+
+    p.phase = phase
+}
+func (p *progress)currentPhase() string {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    return p.phase
+}
+func (p *progress)setBinlogPosition(position *BinlogPosition, delaySeconds int64) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    positionCopy := *position
+    p.binlog = &positionCopy
+    p.delaySeconds = delaySeconds
+}
+func (p *progress)setThrottled(reason string) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    p.throttled = reason
+}
+func (p *progress)setChunkManager(cm *tableChunk.Manager) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    p.chunkManager = cm
+}
+func (p *progress)setEstimate(tableName string, rows int64) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    p.table(tableName).EstimatedRows = rows
+}
+func (p *progress)addRows(tableName string, rows int, size int64) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    t := p.table(tableName)
+    t.Rows += int64(rows)
+    t.Bytes += size
+
+    metrics.rowsCopied(rows, size)
+}
+func (p *progress)table(tableName string) *TableProgress {
+    t, ok := p.tables[tableName]
+    if !ok {
+        t = &TableProgress{}
+        p.tables[tableName] = t
+    }
+
+    return t
+}
+func (p *progress)Snapshot() *ExportProgress {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    result := &ExportProgress{
+        Phase: p.phase,
+        StartedAt: p.startedAt,
+        EtaSeconds: -1,
+        Tables: make(map[string]*TableProgress, len(p.tables)),
+        Binlog: p.binlog,
+        DelaySeconds: p.delaySeconds,
+        Throttled: p.throttled,
+    }
+
+    var chunkStats map[string]tableChunk.TableStats
+    if p.chunkManager != nil {
+        chunkStats = p.chunkManager.Stats()
+    }
+
+    for tableName, t := range p.tables {
+        tableCopy := *t
+
+        if stats, ok := chunkStats[tableName]; ok {
+            tableCopy.ChunksDone = stats.Done
+            tableCopy.ChunksTotal = stats.Total
+            tableCopy.ChunksUncut = stats.Uncut
+            tableCopy.RowsPerSecond = stats.RowsPerSecond
+            tableCopy.BytesPerSecond = stats.BytesPerSecond
+        }
+
+        result.Rows += tableCopy.Rows
+        result.Bytes += tableCopy.Bytes
+        result.EstimatedRows += tableCopy.EstimatedRows
+        result.ChunksDone += tableCopy.ChunksDone
+        result.ChunksTotal += tableCopy.ChunksTotal
+        result.ChunksUncut += tableCopy.ChunksUncut
+
+        result.Tables[tableName] = &tableCopy
+    }
+
+    switch p.phase {
+    case PHASE_TABLES:
+        // EstimateCount is based on EXPLAIN, so copied rows may be greater than estimated
+        if result.Rows > 0 && result.EstimatedRows > 0 {
+            elapsed := time.Since(p.dataStartedAt)
+            left := result.EstimatedRows - result.Rows
+            if left < 0 {
+                left = 0
+            }
+
+            result.EtaSeconds = int64(elapsed.Seconds() * float64(left) / float64(result.Rows))
+        }
+    case PHASE_SWAP, PHASE_VIEWS, PHASE_ROUTINES, PHASE_FINISHED:
+        result.EtaSeconds = 0
+    }
+
+    return result
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+    log "github.com/Sirupsen/logrus"
+    "database/sql"
+    "encoding/json"
+    "time"
+)
+
+var proxySessionSchema = `
+CREATE TABLE IF NOT EXISTS proxy_session
+(
+ id INT UNIQUE NOT NULL,
+ ports TEXT NOT NULL,
+ db_name TEXT NOT NULL,
+ status VARCHAR(50) NOT NULL,
+ date_create DATETIME NOT NULL,
+ date_update DATETIME NOT NULL
+);
+`
+
+const (
+    PROXY_ACTIVE  = "active"
+    PROXY_STOPPED = "stopped" // stopped by exporter
+    PROXY_REAPED  = "reaped"  // stopped after idle timeout
+    PROXY_LOST    = "lost"    // listeners were closed by restart of daemon
+)
+
+const (
+    PROXY_DEFAULT_IDLE_TIMEOUT = time.Hour
+    PROXY_REAP_INTERVAL        = time.Minute
+)
+
+// Listeners of one proxy start
+type proxySession struct {
+    importers   []*MysqlProxyImporter
+    idleTimeout time.Duration
+}
+
+var proxyMap = make(map[int64]*proxySession)
+
+func (p *proxySession)ports() []int {
+    ports := make([]int, len(p.importers))
+    for i, importer := range p.importers {
+        ports[i] = importer.proxyPort
+    }
+
+    return ports
+}
+// Time since last command of the most recently active listener
+func (p *proxySession)idle() time.Duration {
+    var idle time.Duration
+
+    for i, importer := range p.importers {
+        if importerIdle := importer.idle(); i == 0 || importerIdle < idle {
+            idle = importerIdle
+        }
+    }
+
+    return idle
+}
+func (p *proxySession)stop() {
+    for _, importer := range p.importers {
+        importer.Stop()
+    }
+}
+
+func saveProxySession(db *sql.DB, id int64, session *proxySession) error {
+    ports, err := json.Marshal(session.ports())
+    if err != nil {
+        return err
+    }
+
+    insertSql := `INSERT INTO proxy_session (id, ports, db_name, status, date_create, date_update)
+     VALUES (?, ?, ?, ?, datetime('now','localtime'), datetime('now','localtime'))`
+
+    _, err = db.Exec(insertSql, id, string(ports), session.importers[0].targetDbSettings.DbName, PROXY_ACTIVE)
+
+    return err
+}
+func setProxySessionStatus(db *sql.DB, id int64, status string) error {
+    updateSql := "UPDATE proxy_session SET status = ?, date_update = datetime('now','localtime') WHERE id = ?"
+    _, err := db.Exec(updateSql, status, id)
+
+    return err
+}
+// Returns empty status, if session is not found
+func proxySessionStatus(db *sql.DB, id int64) (string, error) {
+    var status string
+
+    err := db.QueryRow("SELECT status FROM proxy_session WHERE id = ?", id).Scan(&status)
+    if err == sql.ErrNoRows {
+        return "", nil
+    }
+
+    return status, err
+}
+// Sessions which were active before restart of daemon have no listeners anymore
+func markLostProxySessions(db *sql.DB) error {
+    updateSql := "UPDATE proxy_session SET status = ?, date_update = datetime('now','localtime') WHERE status = ?"
+
+    res, err := db.Exec(updateSql, PROXY_LOST, PROXY_ACTIVE)
+    if err != nil {
+        return err
+    }
+
+    if count, err := res.RowsAffected(); err == nil && count > 0 {
+        log.Warnf("[proxy] %v proxies were lost by restart of daemon", count)
+    }
+
+    return nil
+}
+
+// Stops proxies, which clients were gone without stop request
+func reapIdleProxies(db *sql.DB) {
+    ticker := time.NewTicker(PROXY_REAP_INTERVAL)
+    defer ticker.Stop()
+
+    for range ticker.C {
+        proxyMapMutex.Lock()
+        for id, session := range proxyMap {
+            idle := session.idle()
+            if idle < session.idleTimeout {
+                continue
+            }
+
+            log.Warnf("[proxy] Proxy %v is idle for %v, stopping it", id, idle)
+
+            session.stop()
+            delete(proxyMap, id)
+
+            if err := setProxySessionStatus(db, id, PROXY_REAPED); err != nil {
+                log.Errorf("[proxy] Failed to save status of proxy %v: %v", id, err)
+            }
+        }
+        proxyMapMutex.Unlock()
+    }
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+    log "github.com/Sirupsen/logrus"
+    "database/sql"
+    "encoding/json"
+    "os"
+    "syscall"
+)
+
+// Status of task, which process was stopped while task was running
+const STATUS_INTERRUPTED = "interrupted"
+
+// Times which one task may be resumed automatically, so task which crashes daemon is not resumed forever
+const TASK_MAX_AUTO_RESUMES = 3
+
+// Statuses of task, which is run by some process now
+var activeStatuses = []string{"started", "cancelling", "following", "cutover"}
+
+// Tasks which remain active in local db after their process was stopped are marked as interrupted.
+// Tasks of other running besync processes (cli mode) are not touched
+func markOrphanedTasks(db *sql.DB) error {
+    rows, err := db.Query("SELECT id, pid FROM sync_task WHERE status IN (?, ?, ?, ?)",
+        activeStatuses[0], activeStatuses[1], activeStatuses[2], activeStatuses[3])
+    if err != nil {
+        return err
+    }
+
+    var orphaned []int64
+    for rows.Next() {
+        var id int64
+        var pid sql.NullInt64
+
+        if err := rows.Scan(&id, &pid); err != nil {
+            rows.Close()
+            return err
+        }
+
+        if pid.Valid && int(pid.Int64) != os.Getpid() && processAlive(int(pid.Int64)) {
+            continue
+        }
+
+        orphaned = append(orphaned, id)
+    }
+
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    updateSql := `UPDATE sync_task SET status = ?, error_text = 'Task was interrupted by stop of besync process', date_update = datetime('now','localtime') WHERE id = ?`
+
+    for _, id := range orphaned {
+        log.Warnf("[export manager] Task %v was interrupted by stop of besync process", id)
+
+        if _, err := db.Exec(updateSql, STATUS_INTERRUPTED, id); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+func processAlive(pid int) bool {
+    process, err := os.FindProcess(pid)
+    if err != nil {
+        return false
+    }
+
+    err = process.Signal(syscall.Signal(0))
+
+    return err == nil || err == syscall.EPERM
+}
+
+// ResumeInterrupted resumes interrupted tasks with enabled Export.AutoResume.
+// Inline passwords are not saved, so only tasks with PasswordEnv or PasswordFile may be resumed
+func (m *exportManager)ResumeInterrupted(resultCh chan *ExportStatus) {
+    m.mutex.Lock()
+    rows, err := m.db.Query("SELECT id, settings, auto_resumes FROM sync_task WHERE status = ?", STATUS_INTERRUPTED)
+    if err != nil {
+        m.mutex.Unlock()
+        log.Errorf("[export manager] Failed to read interrupted tasks: %v", err)
+        return
+    }
+
+    resumes := make(map[int64]int)
+    for rows.Next() {
+        var id int64
+        var dumpedSettings string
+        var autoResumes int
+
+        if err := rows.Scan(&id, &dumpedSettings, &autoResumes); err != nil {
+            log.Errorf("[export manager] Failed to read interrupted tasks: %v", err)
+            break
+        }
+
+        settings := &Settings{}
+        if err := json.Unmarshal([]byte(dumpedSettings), settings); err != nil {
+            log.Errorf("[export manager] Failed to parse settings of task %v: %v", id, err)
+            continue
+        }
+
+        if settings.Export == nil || !settings.Export.AutoResume {
+            continue
+        }
+
+        if autoResumes >= TASK_MAX_AUTO_RESUMES {
+            log.Warnf("[export manager] Task %v was resumed %v times already, it's not resumed automatically", id, autoResumes)
+            continue
+        }
+
+        resumes[id] = autoResumes
+    }
+    rows.Close()
+    m.mutex.Unlock()
+
+    for id, autoResumes := range resumes {
+        if _, err := m.db.Exec("UPDATE sync_task SET auto_resumes = ? WHERE id = ?", autoResumes + 1, id); err != nil {
+            log.Errorf("[export manager] Failed to update task %v: %v", id, err)
+            continue
+        }
+
+        if err := m.ResumeDump(id, nil, resultCh); err != nil {
+            log.Errorf("[export manager] Failed to resume interrupted task %v: %v", id, err)
+
+            updateSql := "UPDATE sync_task SET error_text = ?, date_update = datetime('now','localtime') WHERE id = ?"
+            if _, err := m.db.Exec(updateSql, "Automatic resume failed: " + err.Error(), id); err != nil {
+                log.Errorf("[export manager] Failed to update task %v: %v", id, err)
+            }
+        }
+    }
+}
@@ -0,0 +1,620 @@
+package proxy
+
+import (
+    "github.com/LTD-Beget/besync/inspector"
+    "fmt"
+    "regexp"
+    "strings"
+)
+
+// Names of objects on target, which differ from source
+type RenameSettings struct {
+    Databases *RenameRules // databases referenced by definitions, source database is renamed too if TargetDb.Name is empty
+    Tables    *RenameRules // tables and views
+    Columns   *RenameRules // explicit names by "table.column", regexps are applied to name of column
+}
+
+type RenameRules struct {
+    Names   map[string]string // old name -> new name
+    Regexps []*RenameRegexp   // applied to names without explicit rule, the first matched regexp is used
+}
+
+type RenameRegexp struct {
+    Pattern string
+    Replace string // replacement of matched part, $1 is the first group
+}
+
+func (s *RenameSettings)check() error {
+    if s == nil {
+        return nil
+    }
+
+    for key := range s.Columns.names() {
+        if _, _, err := splitColumnKey(key); err != nil {
+            return fmt.Errorf("Rename: %v", err)
+        }
+    }
+
+    for _, rules := range []*RenameRules{s.Databases, s.Tables, s.Columns} {
+        if _, err := compileRenameRules(rules); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+func (r *RenameRules)names() map[string]string {
+    if r == nil {
+        return nil
+    }
+
+    return r.Names
+}
+
+// Target database is named by rules of source database, if its name is not set
+func (s *Settings)renameTargetDatabase() {
+    if s.Rename == nil || s.SourceDb == nil || s.SourceDb.Name == "" || s.TargetDb == nil || s.TargetDb.Name != "" {
+        return
+    }
+
+    s.TargetDb.Name = s.targetDatabaseName(s.SourceDb.Name)
+}
+
+type renameRules struct {
+    names    map[string]string
+    regexps  []*regexp.Regexp
+    replaces []string
+}
+
+func compileRenameRules(rules *RenameRules) (*renameRules, error) {
+    compiled := &renameRules{}
+    if rules == nil {
+        return compiled, nil
+    }
+
+    for name, newName := range rules.Names {
+        if newName == "" {
+            return nil, fmt.Errorf("Rename: new name of '%s' is empty", name)
+        }
+    }
+    compiled.names = rules.Names
+
+    for _, rule := range rules.Regexps {
+        re, err := regexp.Compile(rule.Pattern)
+        if err != nil {
+            return nil, fmt.Errorf("Rename: bad pattern '%s': %v", rule.Pattern, err)
+        }
+
+        compiled.regexps = append(compiled.regexps, re)
+        compiled.replaces = append(compiled.replaces, rule.Replace)
+    }
+
+    return compiled, nil
+}
+func (r *renameRules)rename(name string) string {
+    if newName, ok := r.names[name]; ok {
+        return newName
+    }
+
+    for i, re := range r.regexps {
+        if re.MatchString(name) {
+            if newName := re.ReplaceAllString(name, r.replaces[i]); newName != "" {
+                return newName
+            }
+        }
+    }
+
+    return name
+}
+
+// Maps source names to target names. Nil renamer keeps all names
+type renamer struct {
+    sourceDb  string
+    targetDb  string
+    known     map[string]bool // source tables and views
+    databases *renameRules
+    tables    *renameRules
+    columns   *renameRules
+}
+
+// Rules must refer to dumped tables, and tables must not get the same name
+func (s *exporter)prepareRename() error {
+    rename := s.settings.Rename
+    if rename == nil {
+        return nil
+    }
+
+    r := &renamer{
+        sourceDb: s.settings.SourceDb.Name,
+        targetDb: s.settings.SourceDb.Name,
+        known: make(map[string]bool),
+    }
+
+    if s.settings.TargetDb != nil && s.settings.TargetDb.Name != "" && !s.settings.toFile() {
+        r.targetDb = s.settings.TargetDb.Name
+    }
+
+    var err error
+    if r.databases, err = compileRenameRules(rename.Databases); err != nil {
+        return err
+    }
+    if r.tables, err = compileRenameRules(rename.Tables); err != nil {
+        return err
+    }
+    if r.columns, err = compileRenameRules(rename.Columns); err != nil {
+        return err
+    }
+
+    targets := make(map[string]string)
+    for _, name := range append(append([]string{}, s.schema.Tables...), s.schema.Views...) {
+        r.known[name] = true
+
+        target := strings.ToLower(r.table(name))
+        if other, ok := targets[target]; ok {
+            return fmt.Errorf("Rename: tables '%s' and '%s' get the same name '%s'", other, name, r.table(name))
+        }
+        targets[target] = name
+    }
+
+    for key := range rename.Columns.names() {
+        tableName, _, err := splitColumnKey(key)
+        if err != nil {
+            return fmt.Errorf("Rename: %v", err)
+        }
+
+        if !inSlice(s.schema.Tables, tableName) {
+            return fmt.Errorf("Rename: table '%s' is not dumped", tableName)
+        }
+    }
+
+    s.rename = r
+
+    return nil
+}
+
+func (r *renamer)table(name string) string {
+    if r == nil {
+        return name
+    }
+
+    return r.tables.rename(name)
+}
+func (r *renamer)column(tableName, name string) string {
+    if r == nil {
+        return name
+    }
+
+    if newName, ok := r.columns.names[tableName + "." + name]; ok {
+        return newName
+    }
+
+    for i, re := range r.columns.regexps {
+        if re.MatchString(name) {
+            if newName := re.ReplaceAllString(name, r.columns.replaces[i]); newName != "" {
+                return newName
+            }
+        }
+    }
+
+    return name
+}
+func (r *renamer)database(name string) string {
+    if r == nil {
+        return name
+    }
+
+    if name == r.sourceDb {
+        return r.targetDb
+    }
+
+    return r.databases.rename(name)
+}
+// Copy of columns of table with target names
+func (r *renamer)columnInfo(tableName string, columns map[string]*inspector.Column) map[string]*inspector.Column {
+    if r == nil {
+        return columns
+    }
+
+    result := make(map[string]*inspector.Column, len(columns))
+    for name, column := range columns {
+        renamed := *column
+        renamed.Name = r.column(tableName, column.Name)
+
+        result[name] = &renamed
+    }
+
+    return result
+}
+
+// Renames table, its columns and referenced tables in SHOW CREATE TABLE output, which has one definition per line
+func (r *renamer)createTable(tableName, query string) string {
+    if r == nil {
+        return query
+    }
+
+    lines := strings.Split(query, "\n")
+    for i, line := range lines {
+        lines[i] = r.createTableLine(tableName, line)
+    }
+
+    return strings.Join(lines, "\n")
+}
+func (r *renamer)createTableLine(tableName, line string) string {
+    tokens := tokenizeSql(line)
+    upper := strings.ToUpper(strings.TrimSpace(line))
+
+    // the first identifier of these lines is name of table, index or constraint
+    create := strings.HasPrefix(upper, "CREATE ")
+    named := strings.HasPrefix(upper, "CONSTRAINT ")
+    for _, prefix := range []string{"KEY ", "INDEX ", "UNIQUE ", "FULLTEXT ", "SPATIAL "} {
+        named = named || strings.HasPrefix(upper, prefix)
+    }
+
+    var referenced string
+    var inReferences bool
+    first := true
+
+    for _, token := range tokens {
+        if !token.quoted {
+            if strings.EqualFold(token.text, "REFERENCES") {
+                inReferences = true
+            }
+            continue
+        }
+
+        switch {
+        case first && create:
+            token.rename(r.table(token.ident))
+        case first && named:
+        case inReferences && referenced == "":
+            referenced = token.ident
+            token.rename(r.table(token.ident))
+        case inReferences:
+            token.rename(r.column(referenced, token.ident))
+        default:
+            token.rename(r.column(tableName, token.ident))
+        }
+
+        first = false
+    }
+
+    return joinTokens(tokens)
+}
+
+// Renames tables, columns and databases in definition of view, trigger or procedure.
+// Names of routine bodies are renamed if they are quoted, qualified (`table`.`column`, NEW.column)
+// or known tables after FROM, JOIN, INTO, UPDATE and TABLE
+func (r *renamer)definition(query string) string {
+    if r == nil {
+        return query
+    }
+
+    tokens := tokenizeSql(query)
+    scope := &definitionScope{
+        triggerTable: definitionTriggerTable(tokens),
+        aliases: definitionAliases(tokens),
+    }
+
+    for i := 0; i < len(tokens); {
+        if !tokens[i].isName() {
+            i++
+            continue
+        }
+
+        j := nameChainEnd(tokens, i)
+        chain := make([]*sqlToken, 0)
+        for k := i; k < j; k += 2 {
+            chain = append(chain, tokens[k])
+        }
+
+        // user@host of DEFINER
+        account := (i > 0 && tokens[i - 1].text == "@") || (j < len(tokens) && tokens[j].text == "@")
+        if !account && !afterKeyword(tokens, i, "AS") {
+            r.renameChain(chain, scope, isTableReference(tokens, i))
+        }
+
+        i = j
+    }
+
+    return joinTokens(tokens)
+}
+
+// Names of definition, which qualify columns without being tables of source
+type definitionScope struct {
+    triggerTable string          // columns of NEW and OLD belong to it
+    aliases      map[string]bool // aliases of tables and columns
+}
+
+// Chain is a name or qualified name, reference is true if it follows keyword of table reference
+func (r *renamer)renameChain(chain []*sqlToken, scope *definitionScope, reference bool) {
+    names := make([]string, len(chain))
+    for i, token := range chain {
+        names[i] = token.name()
+    }
+
+    switch len(chain) {
+    case 1:
+        if (chain[0].quoted || reference) && r.known[names[0]] {
+            chain[0].rename(r.table(names[0]))
+        }
+    case 2:
+        switch {
+        case scope.triggerTable != "" && (strings.EqualFold(names[0], "NEW") || strings.EqualFold(names[0], "OLD")):
+            chain[1].rename(r.column(scope.triggerTable, names[1]))
+        case r.known[names[0]]:
+            chain[0].rename(r.table(names[0]))
+            chain[1].rename(r.column(names[0], names[1]))
+        case scope.aliases[names[0]]:
+        case names[0] == r.sourceDb:
+            chain[0].rename(r.targetDb)
+            chain[1].rename(r.table(names[1]))
+        default:
+            // table or routine of other database
+            chain[0].rename(r.database(names[0]))
+        }
+    case 3:
+        chain[0].rename(r.database(names[0]))
+
+        if names[0] == r.sourceDb {
+            chain[1].rename(r.table(names[1]))
+            chain[2].rename(r.column(names[1], names[2]))
+        }
+    }
+}
+// Table of trigger is the name after ON in "TRIGGER `name` BEFORE INSERT ON `table`"
+func definitionTriggerTable(tokens []*sqlToken) string {
+    var trigger bool
+
+    for i, token := range tokens {
+        switch {
+        case strings.EqualFold(token.text, "TRIGGER"):
+            trigger = true
+        case trigger && token.isName() && afterKeyword(tokens, i, "ON"):
+            return token.name()
+        }
+    }
+
+    return ""
+}
+
+// Aliases are names after AS and names right after referenced table ("FROM `users` `u`")
+func definitionAliases(tokens []*sqlToken) map[string]bool {
+    aliases := make(map[string]bool)
+
+    for i := 0; i < len(tokens); {
+        if !tokens[i].isName() {
+            i++
+            continue
+        }
+
+        if afterKeyword(tokens, i, "AS") {
+            aliases[tokens[i].name()] = true
+        }
+
+        j := nameChainEnd(tokens, i)
+        if isTableReference(tokens, i) {
+            k := j
+            for k < len(tokens) && strings.TrimSpace(tokens[k].text) == "" {
+                k++
+            }
+
+            if k > j && k < len(tokens) && tokens[k].isName() {
+                aliases[tokens[k].name()] = true
+            }
+        }
+
+        i = j
+    }
+
+    return aliases
+}
+// End of qualified name "a.b.c", which starts at name token
+func nameChainEnd(tokens []*sqlToken, i int) int {
+    j := i + 1
+    for j + 1 < len(tokens) && tokens[j].text == "." && tokens[j + 1].isName() {
+        j += 2
+    }
+
+    return j
+}
+// Name after FROM, JOIN, INTO, UPDATE or TABLE is table (or view)
+func isTableReference(tokens []*sqlToken, i int) bool {
+    for _, keyword := range []string{"FROM", "JOIN", "INTO", "UPDATE", "TABLE"} {
+        if afterKeyword(tokens, i, keyword) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// Renames columns of table in condition of rows. Unquoted names are renamed if they are columns of table
+func (r *renamer)condition(tableName string, columns map[string]*inspector.Column, condition string) string {
+    if r == nil || condition == "" {
+        return condition
+    }
+
+    tokens := tokenizeSql(condition)
+    for i, token := range tokens {
+        if i > 0 && tokens[i - 1].text == "." {
+            continue
+        }
+
+        if !token.quoted {
+            // function call or name of other table
+            if !token.isName() || i + 1 < len(tokens) && (tokens[i + 1].text == "(" || tokens[i + 1].text == ".") {
+                continue
+            }
+
+            if !hasColumn(columns, token.text) {
+                continue
+            }
+        }
+
+        token.rename(r.column(tableName, token.name()))
+    }
+
+    return joinTokens(tokens)
+}
+func hasColumn(columns map[string]*inspector.Column, name string) bool {
+    for columnName := range columns {
+        if strings.EqualFold(columnName, name) {
+            return true
+        }
+    }
+
+    return false
+}
+
+func splitColumnKey(key string) (string, string, error) {
+    parts := strings.SplitN(key, ".", 2)
+    if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+        return "", "", fmt.Errorf("'%s' must be 'table.column'", key)
+    }
+
+    return parts[0], parts[1], nil
+}
+
+// Token of sql statement: quoted identifier, word, string literal or other character
+type sqlToken struct {
+    text   string
+    ident  string // name of quoted identifier
+    quoted bool
+}
+
+func tokenizeSql(query string) []*sqlToken {
+    tokens := make([]*sqlToken, 0)
+
+    for i := 0; i < len(query); {
+        start := i
+        c := query[i]
+
+        switch {
+        case c == '`':
+            end, closed := quotedEnd(query, i)
+            if closed {
+                tokens = append(tokens, &sqlToken{
+                    text: query[start:end],
+                    ident: strings.Replace(query[start + 1:end - 1], "``", "`", -1),
+                    quoted: true,
+                })
+                i = end
+                continue
+            }
+            i = end
+        case c == '\'' || c == '"':
+            i, _ = quotedEnd(query, i)
+        case isCommentStart(query, i):
+            i = commentEnd(query, i)
+        case isWordChar(c):
+            for i < len(query) && isWordChar(query[i]) {
+                i++
+            }
+        default:
+            i++
+        }
+
+        tokens = append(tokens, &sqlToken{text: query[start:i]})
+    }
+
+    return tokens
+}
+// End of quoted string or identifier. Quotes are escaped by doubling, strings by backslash too
+func quotedEnd(query string, start int) (int, bool) {
+    quote := query[start]
+
+    for i := start + 1; i < len(query); i++ {
+        switch {
+        case query[i] == '\\' && quote != '`':
+            i++
+        case query[i] == quote:
+            if i + 1 < len(query) && query[i + 1] == quote {
+                i++
+                continue
+            }
+            return i + 1, true
+        }
+    }
+
+    return len(query), false
+}
+// Comments are "# ...", "-- ..." and "/* ... */". Names in executable comment /*!50001 ... */ are tokenized
+func isCommentStart(query string, i int) bool {
+    switch {
+    case query[i] == '#':
+        return true
+    case strings.HasPrefix(query[i:], "--"):
+        return i + 2 == len(query) || query[i + 2] == ' ' || query[i + 2] == '\t' || query[i + 2] == '\n' || query[i + 2] == '\r'
+    case strings.HasPrefix(query[i:], "/*"):
+        return true
+    }
+
+    return false
+}
+// End of comment, or end of version prefix of executable comment
+func commentEnd(query string, start int) int {
+    if query[start] != '/' {
+        if end := strings.IndexByte(query[start:], '\n'); end >= 0 {
+            return start + end
+        }
+        return len(query)
+    }
+
+    if strings.HasPrefix(query[start:], "/*!") {
+        i := start + 3
+        for i < len(query) && query[i] >= '0' && query[i] <= '9' {
+            i++
+        }
+        return i
+    }
+
+    if end := strings.Index(query[start + 2:], "*/"); end >= 0 {
+        return start + 2 + end + 2
+    }
+
+    return len(query)
+}
+func isWordChar(c byte) bool {
+    return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+func joinTokens(tokens []*sqlToken) string {
+    parts := make([]string, len(tokens))
+    for i, token := range tokens {
+        parts[i] = token.text
+    }
+
+    return strings.Join(parts, "")
+}
+// Previous token before spaces is keyword
+func afterKeyword(tokens []*sqlToken, i int, keyword string) bool {
+    for i--; i >= 0; i-- {
+        if strings.TrimSpace(tokens[i].text) != "" {
+            return strings.EqualFold(tokens[i].text, keyword)
+        }
+    }
+
+    return false
+}
+
+func (t *sqlToken)isName() bool {
+    return t.quoted || (isWordChar(t.text[0]) && (t.text[0] < '0' || t.text[0] > '9'))
+}
+func (t *sqlToken)name() string {
+    if t.quoted {
+        return t.ident
+    }
+
+    return t.text
+}
+func (t *sqlToken)rename(name string) {
+    if name == t.name() {
+        return
+    }
+
+    t.text = quoteIdentifier(name)
+    t.ident = name
+    t.quoted = true
+}
+func quoteIdentifier(name string) string {
+    return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
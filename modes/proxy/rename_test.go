@@ -0,0 +1,211 @@
+package proxy
+
+import (
+    "strings"
+    "testing"
+)
+
+// Text of tokens, quoted identifiers are marked by their names
+func describeTokens(tokens []*sqlToken) []string {
+    result := make([]string, len(tokens))
+    for i, token := range tokens {
+        result[i] = token.text
+        if token.quoted {
+            result[i] = "ident:" + token.ident
+        }
+    }
+
+    return result
+}
+
+func TestTokenizeSql(t *testing.T) {
+    tests := []struct {
+        query    string
+        expected []string
+    }{
+        {"`users`.name", []string{"ident:users", ".", "name"}},
+        {"`we``ird`", []string{"ident:we`ird"}},
+        {"`a\\b`", []string{"ident:a\\b"}},
+        {"'it''s `t`' `u`", []string{"'it''s `t`'", " ", "ident:u"}},
+        {"'a\\' `t`' `u`", []string{"'a\\' `t`'", " ", "ident:u"}},
+        {"\"x`y\" `u`", []string{"\"x`y\"", " ", "ident:u"}},
+        {"a -- `t`\nb", []string{"a", " ", "-- `t`", "\n", "b"}},
+        {"a--1", []string{"a", "-", "-", "1"}},
+        {"a # `t`\n`u`", []string{"a", " ", "# `t`", "\n", "ident:u"}},
+        {"/* `t` 'x */ `u`", []string{"/* `t` 'x */", " ", "ident:u"}},
+        {"/*!50001 `v` */", []string{"/*!50001", " ", "ident:v", " ", "*", "/"}},
+        {"`abc", []string{"`abc"}},
+        {"'abc", []string{"'abc"}},
+        {"/* abc", []string{"/* abc"}},
+        {"NEW.$x1>=2", []string{"NEW", ".", "$x1", ">", "=", "2"}},
+    }
+
+    for _, test := range tests {
+        tokens := tokenizeSql(test.query)
+
+        if result := describeTokens(tokens); strings.Join(result, "|") != strings.Join(test.expected, "|") {
+            t.Errorf("tokenizeSql(%q) = %q, expected %q", test.query, result, test.expected)
+        }
+
+        if joined := joinTokens(tokens); joined != test.query {
+            t.Errorf("joinTokens(tokenizeSql(%q)) = %q", test.query, joined)
+        }
+    }
+}
+
+// Source database `src` is copied to `dst`, table `users` becomes `people`
+func makeTestRenamer(t *testing.T) *renamer {
+    r := &renamer{
+        sourceDb: "src",
+        targetDb: "dst",
+        known: map[string]bool{"users": true, "orders": true, "we`ird": true},
+    }
+
+    var err error
+    if r.databases, err = compileRenameRules(&RenameRules{Names: map[string]string{"other": "archive"}}); err != nil {
+        t.Fatal(err)
+    }
+    if r.tables, err = compileRenameRules(&RenameRules{Names: map[string]string{"users": "people", "we`ird": "new`name"}}); err != nil {
+        t.Fatal(err)
+    }
+    if r.columns, err = compileRenameRules(&RenameRules{
+        Names: map[string]string{"users.name": "full_name", "orders.user_id": "owner_id", "users.a`b": "ab"},
+        Regexps: []*RenameRegexp{{Pattern: "^old_(.*)$", Replace: "${1}"}},
+    }); err != nil {
+        t.Fatal(err)
+    }
+
+    return r
+}
+
+func TestRenameChain(t *testing.T) {
+    r := makeTestRenamer(t)
+    aliases := map[string]bool{"u": true, "other": false}
+
+    tests := []struct {
+        chain        string
+        triggerTable string
+        reference    bool
+        expected     string
+    }{
+        {"`users`", "", false, "`people`"},
+        {"users", "", false, "users"},
+        {"users", "", true, "`people`"},
+        {"unknown", "", true, "unknown"},
+        {"`unknown`", "", false, "`unknown`"},
+        {"`users`.`name`", "", false, "`people`.`full_name`"},
+        {"users.old_id", "", false, "`people`.`id`"},
+        {"`orders`.`name`", "", false, "`orders`.`name`"},
+        {"`src`.`users`", "", false, "`dst`.`people`"},
+        {"src.orders", "", false, "`dst`.orders"},
+        {"`other`.`users`", "", true, "`archive`.`users`"},
+        {"other.proc", "", false, "`archive`.proc"},
+        {"u.name", "", false, "u.name"},
+        {"`third`.`t`", "", false, "`third`.`t`"},
+        {"NEW.name", "users", false, "NEW.`full_name`"},
+        {"old.`user_id`", "orders", false, "old.`owner_id`"},
+        {"NEW.name", "", false, "NEW.name"},
+        {"`src`.`users`.`name`", "", false, "`dst`.`people`.`full_name`"},
+        {"`other`.`users`.`name`", "", false, "`archive`.`users`.`name`"},
+        {"`third`.`t`.`c`", "", false, "`third`.`t`.`c`"},
+        {"`we``ird`", "", false, "`new``name`"},
+    }
+
+    for _, test := range tests {
+        tokens := tokenizeSql(test.chain)
+
+        chain := make([]*sqlToken, 0)
+        for _, token := range tokens {
+            if token.isName() {
+                chain = append(chain, token)
+            }
+        }
+
+        r.renameChain(chain, &definitionScope{triggerTable: test.triggerTable, aliases: aliases}, test.reference)
+
+        if result := joinTokens(tokens); result != test.expected {
+            t.Errorf("renameChain(%s, %q, %v) = %s, expected %s", test.chain, test.triggerTable, test.reference, result, test.expected)
+        }
+    }
+}
+
+func TestRenameDefinition(t *testing.T) {
+    r := makeTestRenamer(t)
+
+    tests := []struct {
+        name     string
+        query    string
+        expected string
+    }{
+        {"view column alias",
+            "select `users`.`name` AS `name`,`users`.`old_id` AS `id` from `users`",
+            "select `people`.`full_name` AS `name`,`people`.`id` AS `id` from `people`"},
+        {"qualified by source database",
+            "select `src`.`users`.`name` AS `n` from `src`.`users` join `other`.`users`",
+            "select `dst`.`people`.`full_name` AS `n` from `dst`.`people` join `archive`.`users`"},
+        {"string literals",
+            "select 'users.name' AS `s`,\"`users`\" AS `q`,'it\\'s `users`' AS `e` from `users`",
+            "select 'users.name' AS `s`,\"`users`\" AS `q`,'it\\'s `users`' AS `e` from `people`"},
+        {"comments",
+            "SELECT `name` /* `users`.`name` */ FROM `users` -- users.name\n# `users`\nWHERE users.name = 1",
+            "SELECT `name` /* `users`.`name` */ FROM `people` -- users.name\n# `users`\nWHERE `people`.`full_name` = 1"},
+        {"executable comment",
+            "/*!50001 SELECT `users`.`name` FROM `users` */",
+            "/*!50001 SELECT `people`.`full_name` FROM `people` */"},
+        {"unquoted tables",
+            "SELECT COUNT(*) INTO cnt FROM users WHERE users.name = 'x';\nINSERT INTO orders (user_id) SELECT 1;\nUPDATE users SET name = 1;\nTRUNCATE TABLE users",
+            "SELECT COUNT(*) INTO cnt FROM `people` WHERE `people`.`full_name` = 'x';\nINSERT INTO orders (user_id) SELECT 1;\nUPDATE `people` SET name = 1;\nTRUNCATE TABLE `people`"},
+        {"unquoted name of other object",
+            "SELECT users FROM orders JOIN unknown ON 1",
+            "SELECT users FROM orders JOIN unknown ON 1"},
+        {"aliases",
+            "SELECT u.name, o.user_id, x.y FROM users u JOIN other.orders AS o ON 1 JOIN `src`.`orders` `x` ON 1",
+            "SELECT u.name, o.user_id, x.y FROM `people` u JOIN `archive`.orders AS o ON 1 JOIN `dst`.`orders` `x` ON 1"},
+        {"other database",
+            "CALL other.cleanup(); SELECT other.f(1)",
+            "CALL `archive`.cleanup(); SELECT `archive`.f(1)"},
+        {"escaped identifier",
+            "select * from `we``ird`",
+            "select * from `new``name`"},
+        {"trigger",
+            "CREATE DEFINER=`users`@`localhost` TRIGGER `trg` BEFORE INSERT ON `users` FOR EACH ROW SET NEW.name = OLD.`old_x`",
+            "CREATE DEFINER=`users`@`localhost` TRIGGER `trg` BEFORE INSERT ON `people` FOR EACH ROW SET NEW.`full_name` = OLD.`x`"},
+    }
+
+    for _, test := range tests {
+        if result := r.definition(test.query); result != test.expected {
+            t.Errorf("%s: definition = %s, expected %s", test.name, result, test.expected)
+        }
+    }
+}
+
+func TestRenameCreateTableLine(t *testing.T) {
+    r := makeTestRenamer(t)
+
+    tests := []struct {
+        tableName string
+        line      string
+        expected  string
+    }{
+        {"users", "CREATE TABLE `users` (", "CREATE TABLE `people` ("},
+        {"users", "  `name` varchar(10) DEFAULT 'it''s `name`' COMMENT '`name`',",
+            "  `full_name` varchar(10) DEFAULT 'it''s `name`' COMMENT '`name`',"},
+        {"users", "  `a``b` int(11) NOT NULL,", "  `ab` int(11) NOT NULL,"},
+        {"users", "  `old_id` int(11) NOT NULL DEFAULT '0',", "  `id` int(11) NOT NULL DEFAULT '0',"},
+        {"users", "  PRIMARY KEY (`old_id`),", "  PRIMARY KEY (`id`),"},
+        {"users", "  KEY `name` (`name`),", "  KEY `name` (`full_name`),"},
+        {"users", "  UNIQUE KEY `we``ird` (`name`,`old_id`),", "  UNIQUE KEY `we``ird` (`full_name`,`id`),"},
+        {"orders", "  CONSTRAINT `users` FOREIGN KEY (`user_id`) REFERENCES `users` (`name`) ON DELETE CASCADE",
+            "  CONSTRAINT `users` FOREIGN KEY (`owner_id`) REFERENCES `people` (`full_name`) ON DELETE CASCADE"},
+        {"orders", "  CONSTRAINT `fk` FOREIGN KEY (`user_id`, `old_n`) REFERENCES `orders` (`user_id`, `old_n`)",
+            "  CONSTRAINT `fk` FOREIGN KEY (`owner_id`, `n`) REFERENCES `orders` (`owner_id`, `n`)"},
+        {"users", ") ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='`users` and `name`'",
+            ") ENGINE=InnoDB DEFAULT CHARSET=utf8 COMMENT='`users` and `name`'"},
+    }
+
+    for _, test := range tests {
+        if result := r.createTableLine(test.tableName, test.line); result != test.expected {
+            t.Errorf("createTableLine(%s, %s) = %s, expected %s", test.tableName, test.line, result, test.expected)
+        }
+    }
+}
@@ -12,27 +12,90 @@ import (
     "time"
     "strconv"
     "bytes"
+    "context"
 )
 
-func Serve(host string, port int) error {
+// Options of daemon
+type ServeOptions struct {
+    ApiTLS   *ServerTLSSettings // https api, if set
+    ProxyTLS *ServerTLSSettings // TLS of proxy listeners, if set
+    Auth     *ApiAuth           // api is open for everyone, if not set
+}
+
+// Serve starts daemon api. Api and proxy listeners use TLS if their settings are given
+func Serve(host string, port int, options *ServeOptions) error {
+    if options.ProxyTLS != nil {
+        config, err := options.ProxyTLS.serverConfig()
+        if err != nil {
+            return err
+        }
+
+        proxyServerTLS = config
+    }
+
+    if options.Auth == nil {
+        log.Warnf("[http] Api authentication is not configured, api is available for everyone")
+    }
+
     go logExportStatus()
 
+    Manager.StartNotifications()
+
+    if err := markLostProxySessions(Manager.db); err != nil {
+        return err
+    }
+
+    go reapIdleProxies(Manager.db)
+
+    Manager.ResumeInterrupted(exportStatusCh)
+
     r := mux.NewRouter()
+    action := func(permission string, f func(*http.Request) (interface{}, error)) func(http.ResponseWriter, *http.Request) {
+        return authAction(options.Auth, permission, jsonAction(f))
+    }
 
-    r.HandleFunc("/proxy/start", jsonAction(proxyStartAction)).Methods("POST")
-    r.HandleFunc("/proxy/{proxyId}/stop", jsonAction(proxyStopAction)).Methods("DELETE")
-    r.HandleFunc("/proxy", jsonAction(proxyListAction)).Methods("GET")
+    r.HandleFunc("/proxy/start", action(PERMISSION_PROXY, proxyStartAction)).Methods("POST")
+    r.HandleFunc("/proxy/{proxyId}/stop", action(PERMISSION_PROXY, proxyStopAction)).Methods("DELETE")
+    r.HandleFunc("/proxy", action(PERMISSION_READ, proxyListAction)).Methods("GET")
 
-    r.HandleFunc("/sync/start", jsonAction(syncStartAction)).Methods("POST")
-    r.HandleFunc("/sync/{syncId}", jsonAction(syncStatusAction)).Methods("GET")
+    r.HandleFunc("/sync", action(PERMISSION_READ, syncListAction)).Methods("GET")
+    r.HandleFunc("/sync/start", action(PERMISSION_SYNC, syncStartAction)).Methods("POST")
+    r.HandleFunc("/sync/{syncId}", action(PERMISSION_READ, syncStatusAction)).Methods("GET")
+    r.HandleFunc("/sync/{syncId}", action(PERMISSION_SYNC, syncCancelAction)).Methods("DELETE")
+    r.HandleFunc("/sync/{syncId}/resume", action(PERMISSION_SYNC, syncResumeAction)).Methods("POST")
+    r.HandleFunc("/sync/{syncId}/cutover", action(PERMISSION_SYNC, syncCutoverAction)).Methods("POST")
+
+    r.HandleFunc("/verify/start", action(PERMISSION_SYNC, verifyStartAction)).Methods("POST")
+    r.HandleFunc("/verify/{syncId}", action(PERMISSION_READ, syncStatusAction)).Methods("GET")
+    r.HandleFunc("/verify/{syncId}", action(PERMISSION_SYNC, syncCancelAction)).Methods("DELETE")
+
+    r.HandleFunc("/import/start", action(PERMISSION_SYNC, importStartAction)).Methods("POST")
+    r.HandleFunc("/import/{syncId}", action(PERMISSION_READ, syncStatusAction)).Methods("GET")
+    r.HandleFunc("/import/{syncId}", action(PERMISSION_SYNC, syncCancelAction)).Methods("DELETE")
+
+    r.HandleFunc("/metrics", authAction(options.Auth, PERMISSION_READ, metricsAction)).Methods("GET")
 
     http.Handle("/", r)
 
-    if err := http.ListenAndServe(fmt.Sprintf("%v:%v", host, port), r); err != nil {
+    addr := fmt.Sprintf("%v:%v", host, port)
+
+    if options.ApiTLS == nil {
+        return http.ListenAndServe(addr, r)
+    }
+
+    config, err := options.ApiTLS.serverConfig()
+    if err != nil {
         return err
     }
 
-    return nil
+    server := &http.Server{
+        Addr: addr,
+        Handler: r,
+        TLSConfig: config,
+    }
+
+    // certificate is already loaded to TLSConfig
+    return server.ListenAndServeTLS("", "")
 }
 
 type resultError struct {
@@ -85,13 +148,12 @@ func jsonAction(f func(*http.Request) (interface{}, error)) (func(http.ResponseW
             return
         }
 
-        log.Debugf("[http] Return answer: %s", j)
+        log.Debugf("[http] Return answer: %s", redactJson(j))
         w.Write(j)
     }
 }
 
 var proxyMapMutex = &sync.Mutex{}
-var proxyMap = make(map[int64][]*MysqlProxyImporter)
 
 type ProxyStartRequest struct {
     DbHost          string
@@ -99,9 +161,11 @@ type ProxyStartRequest struct {
     DbName          string
     DbUser          string
     DbPassword      string
+    DbTLS           *TLSSettings
 
     Count           int    // Требуемое количество подключений
     MysqlListenAddr string // ip-адрес, на котором будет слушать mysql-proxy
+    IdleTimeout     int    // seconds without commands, after which proxy is stopped. 3600 by default
 }
 func (r *ProxyStartRequest)validate() error {
     if r.DbHost == "" {
@@ -113,9 +177,6 @@ func (r *ProxyStartRequest)validate() error {
     if r.Count == 0 {
         return fmt.Errorf("Count cannot be blank")
     }
-    if r.DbName == "" {
-        return fmt.Errorf("DbName cannot be blank")
-    }
     if r.DbUser == "" {
         return fmt.Errorf("DbUser cannot be blank")
     }
@@ -125,12 +186,16 @@ func (r *ProxyStartRequest)validate() error {
     if r.MysqlListenAddr == "" {
         return fmt.Errorf("MysqlListenAddr cannot be blank")
     }
+    if r.IdleTimeout < 0 {
+        return fmt.Errorf("IdleTimeout cannot be negative")
+    }
 
     return nil
 }
 type ProxyStartResponse struct {
     Id int64
     Ports []int
+    Password string // one-time password of proxy listeners
 }
 
 func proxyStartAction(r *http.Request) (interface{}, error) {
@@ -147,38 +212,72 @@ func proxyStartAction(r *http.Request) (interface{}, error) {
     id := time.Now().UnixNano()
     ports := make([]int, m.Count)
 
+    listenPassword, err := generatePassword()
+    if err != nil {
+        return nil, err
+    }
+
+    proxies := make([]*MysqlProxyImporter, 0, m.Count)
+
+    // stop already started proxies if one of them failed
+    stopStarted := func() {
+        for _, mysqlProxy := range proxies {
+            mysqlProxy.Stop()
+        }
+    }
+
     for i := 0; i < m.Count; i++ {
         port, err := getPort(m.MysqlListenAddr)
         if err != nil {
+            stopStarted()
             return nil, err
         }
 
-        mysqlProxy, err := MakeProxyImporter(m.MysqlListenAddr, port, &TargetDbSettings{
+        mysqlProxy, err := MakeProxyImporter(context.Background(), m.MysqlListenAddr, port, &TargetDbSettings{
             DbUser: m.DbUser,
             DbPassword: m.DbPassword,
             DbHost: m.DbHost,
             DbName: m.DbName,
             DbPort: m.DbPort,
-        })
+            DbTLS: m.DbTLS,
+        }, listenPassword)
 
         if err != nil {
+            stopStarted()
             return nil, err
         }
 
         if err := mysqlProxy.Start(); err != nil {
+            stopStarted()
             return nil, err
         }
 
-        proxyMapMutex.Lock()
-        proxyMap[id] = append(proxyMap[id], mysqlProxy)
-        proxyMapMutex.Unlock()
-
+        proxies = append(proxies, mysqlProxy)
         ports[i] = port
     }
 
+    session := &proxySession{
+        importers: proxies,
+        idleTimeout: PROXY_DEFAULT_IDLE_TIMEOUT,
+    }
+
+    if m.IdleTimeout > 0 {
+        session.idleTimeout = time.Duration(m.IdleTimeout) * time.Second
+    }
+
+    if err := saveProxySession(Manager.db, id, session); err != nil {
+        stopStarted()
+        return nil, err
+    }
+
+    proxyMapMutex.Lock()
+    proxyMap[id] = session
+    proxyMapMutex.Unlock()
+
     return &ProxyStartResponse{
         Id: id,
         Ports: ports,
+        Password: listenPassword,
     }, nil
 }
 
@@ -195,19 +294,32 @@ func proxyStopAction(r *http.Request) (interface{}, error) {
     proxyMapMutex.Lock()
     defer proxyMapMutex.Unlock()
 
-    proxyMysqlList, ok := proxyMap[proxyId]
+    session, ok := proxyMap[proxyId]
     if !ok {
-       return nil, fmt.Errorf("Cannot find proxies with id %v", proxyId)
-    }
+        // proxy may be already reaped or lost by restart, its listeners are closed anyway
+        status, err := proxySessionStatus(Manager.db, proxyId)
+        if err != nil {
+            return nil, err
+        }
 
-    log.Infof("Stopping proxy %v", proxyId)
+        if status == "" || status == PROXY_ACTIVE {
+            return nil, fmt.Errorf("Cannot find proxies with id %v", proxyId)
+        }
 
-    for _, proxyMysql := range proxyMysqlList {
-        proxyMysql.SendCommand(COMMAND_STOP)
+        log.Infof("Proxy %v is already %s", proxyId, status)
+
+        return &StopProxyResponse{Ok: proxyId}, nil
     }
 
+    log.Infof("Stopping proxy %v", proxyId)
+
+    session.stop()
     delete(proxyMap, proxyId)
 
+    if err := setProxySessionStatus(Manager.db, proxyId, PROXY_STOPPED); err != nil {
+        log.Errorf("Failed to save status of proxy %v: %v", proxyId, err)
+    }
+
     return &StopProxyResponse{Ok: proxyId}, nil
 }
 
@@ -215,6 +327,7 @@ type ProxyListItem struct {
     Id int64
     Ports []int
     DbName string
+    IdleSeconds int64
 }
 type ProxyListResponse []ProxyListItem
 func proxyListAction(r *http.Request) (interface{}, error) {
@@ -224,18 +337,12 @@ func proxyListAction(r *http.Request) (interface{}, error) {
     proxyList := make(ProxyListResponse, len(proxyMap))
 
     i := 0
-    for id, mysqlProxyList := range proxyMap {
-        proxyPorts := make([]int, len(mysqlProxyList))
-        for i, mysqlProxy := range mysqlProxyList {
-            proxyPorts[i] = mysqlProxy.proxyPort
-        }
-
-        proxyDbName := mysqlProxyList[0].targetDbSettings.DbName
-
+    for id, session := range proxyMap {
         proxyList[i] = ProxyListItem{
             Id: id,
-            Ports: proxyPorts,
-            DbName: proxyDbName,
+            Ports: session.ports(),
+            DbName: session.importers[0].targetDbSettings.DbName,
+            IdleSeconds: int64(session.idle().Seconds()),
         }
 
         i += 1
@@ -260,6 +367,9 @@ func (s *SyncStartRequest)validate() error {
     if s.Export == nil {
         return fmt.Errorf("'Export' options is required")
     }
+    if s.toFile() && s.Output.Path == "-" {
+        return fmt.Errorf("Output to stdout is available only in cli mode")
+    }
 
     return nil
 }
@@ -293,10 +403,94 @@ func syncStartAction(r *http.Request) (interface{}, error) {
     return &SyncStartResponse{Id: id}, nil
 }
 
+func verifyStartAction(r *http.Request) (interface{}, error) {
+    var s SyncStartRequest
+    b, _ := ioutil.ReadAll(r.Body)
+
+    if err := json.Unmarshal(b, &s); err != nil {
+        return nil, err
+    }
+    if err := s.validate(); err != nil {
+        return nil, err
+    }
+
+    id, err := Manager.StartVerify(&s.Settings, exportStatusCh)
+    if err != nil {
+        return nil, err
+    }
+
+    return &SyncStartResponse{Id: id}, nil
+}
+
+type ImportStartRequest struct {
+    Settings
+}
+func (s *ImportStartRequest)validate() error {
+    if s.TargetDb == nil {
+        return fmt.Errorf("'TargetDb' options is required")
+    }
+    if s.Export == nil {
+        return fmt.Errorf("'Export' options is required")
+    }
+    if s.Proxy == nil && !s.Export.WithoutProxy {
+        return fmt.Errorf("'Proxy' options is required")
+    }
+    if s.Input == nil || s.Input.Path == "" {
+        return fmt.Errorf("'Input' options is required")
+    }
+
+    return nil
+}
+
+func importStartAction(r *http.Request) (interface{}, error) {
+    var s ImportStartRequest
+    b, _ := ioutil.ReadAll(r.Body)
+
+    if err := json.Unmarshal(b, &s); err != nil {
+        return nil, err
+    }
+    if err := s.validate(); err != nil {
+        return nil, err
+    }
+
+    id, err := Manager.StartImport(&s.Settings, exportStatusCh)
+    if err != nil {
+        return nil, err
+    }
+
+    return &SyncStartResponse{Id: id}, nil
+}
+
+func syncResumeAction(r *http.Request) (interface{}, error) {
+    vars := mux.Vars(r)
+    syncId, err := strconv.ParseInt(vars["syncId"], 10, 64)
+    if err != nil {
+        return nil, err
+    }
+
+    // passwords are not saved, so they may be given again in body of request
+    var credentials *Settings
+    if b, _ := ioutil.ReadAll(r.Body); len(bytes.TrimSpace(b)) > 0 {
+        credentials = &Settings{}
+        if err := json.Unmarshal(b, credentials); err != nil {
+            return nil, err
+        }
+    }
+
+    if err := Manager.ResumeDump(syncId, credentials, exportStatusCh); err != nil {
+        return err, nil
+    }
+
+    return &SyncStartResponse{Id: syncId}, nil
+}
+
 type SyncStatusResponse struct {
     Id int64
     Status string
     Error string
+    ErrorDetails *ExportError
+    Progress *ExportProgress
+    Verify *VerifyResult
 }
 func syncStatusAction(r *http.Request) (interface{}, error) {
     vars := mux.Vars(r)
@@ -323,9 +517,72 @@ func syncStatusAction(r *http.Request) (interface{}, error) {
         Id: status.Id,
         Status: status.Status,
         Error: statusErr,
+        ErrorDetails: status.ErrorDetails,
+        Progress: status.Progress,
+        Verify: status.Verify,
     }, nil
 }
 
+// Query parameters: status (comma separated), type, from, to, limit, offset
+func syncListAction(r *http.Request) (interface{}, error) {
+    query := r.URL.Query()
+
+    var limit, offset int
+    var err error
+
+    if value := query.Get("limit"); value != "" {
+        if limit, err = strconv.Atoi(value); err != nil {
+            return nil, err
+        }
+    }
+    if value := query.Get("offset"); value != "" {
+        if offset, err = strconv.Atoi(value); err != nil {
+            return nil, err
+        }
+    }
+
+    filter, err := MakeTaskFilter(query.Get("status"), query.Get("type"), query.Get("from"), query.Get("to"), limit, offset)
+    if err != nil {
+        return nil, err
+    }
+
+    return Manager.ListTasks(filter)
+}
+
+type SyncCancelResponse struct {
+    Ok int64
+}
+func syncCancelAction(r *http.Request) (interface{}, error) {
+    vars := mux.Vars(r)
+    syncId, err := strconv.ParseInt(vars["syncId"], 10, 64)
+    if err != nil {
+        return nil, err
+    }
+
+    if err := Manager.CancelDump(syncId); err != nil {
+        return err, nil
+    }
+
+    return &SyncCancelResponse{Ok: syncId}, nil
+}
+
+type SyncCutoverResponse struct {
+    Ok int64
+}
+func syncCutoverAction(r *http.Request) (interface{}, error) {
+    vars := mux.Vars(r)
+    syncId, err := strconv.ParseInt(vars["syncId"], 10, 64)
+    if err != nil {
+        return nil, err
+    }
+
+    if err := Manager.Cutover(syncId); err != nil {
+        return err, nil
+    }
+
+    return &SyncCutoverResponse{Ok: syncId}, nil
+}
+
 // Ask the kernel for a free open port that is ready to use
 func getPort(ip string) (int, error) {
     addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%v:0", ip))
@@ -343,7 +600,7 @@ func getPort(ip string) (int, error) {
     return l.Addr().(*net.TCPAddr).Port, nil
 }
 
-func httpRequest(method, host, route string, body interface{}) ([]byte, error) {
+func httpRequest(client *http.Client, credentials *ApiCredentials, method, host, route string, body interface{}) ([]byte, error) {
     var j []byte
 
     if body != nil {
@@ -361,7 +618,11 @@ func httpRequest(method, host, route string, body interface{}) ([]byte, error) {
     }
     req.Header.Set("Content-Type", "application/json")
 
-    resp, err := http.DefaultClient.Do(req)
+    if credentials != nil {
+        credentials.apply(req, j)
+    }
+
+    resp, err := client.Do(req)
     if err != nil {
         return nil, err
     }
@@ -372,8 +633,9 @@ func httpRequest(method, host, route string, body interface{}) ([]byte, error) {
         return nil, err
     }
 
-    if resp.StatusCode == http.StatusInternalServerError {
-        return nil, fmt.Errorf("[http] Got error: %v", respBody)
+    // 401 and 403 are returned by auth, 500 - by actions
+    if resp.StatusCode >= http.StatusBadRequest {
+        return nil, fmt.Errorf("[http] Got error %v: %s", resp.StatusCode, respBody)
     }
 
     return respBody, nil
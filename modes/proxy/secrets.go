@@ -0,0 +1,195 @@
+package proxy
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "regexp"
+    "strings"
+)
+
+// Saved instead of inline password
+const MASKED_PASSWORD = "******"
+
+// Secret fields of json (Password, DbPassword, Token, MaskingSalt etc.) with their values
+var jsonPasswordRegexp = regexp.MustCompile(`("\w*(?:Password|Token|Secret|Salt)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+// Secret is taken from env or file, if one of them is set instead of inline value
+func resolveSecret(name, value, env, file string) (string, error) {
+    refs := 0
+    for _, ref := range []string{value, env, file} {
+        if ref != "" {
+            refs++
+        }
+    }
+
+    if refs > 1 {
+        return "", fmt.Errorf("Only one of %s, %sEnv and %sFile may be set", name, name, name)
+    }
+
+    switch {
+    case env != "":
+        secret, ok := os.LookupEnv(env)
+        if !ok {
+            return "", fmt.Errorf("Environment variable %s with %s is not set", env, name)
+        }
+
+        return secret, nil
+    case file != "":
+        data, err := ioutil.ReadFile(file)
+        if err != nil {
+            return "", fmt.Errorf("Failed to read %s file: %v", name, err)
+        }
+
+        return strings.TrimRight(string(data), "\r\n"), nil
+    case value == MASKED_PASSWORD:
+        return "", fmt.Errorf("%s is not saved, it must be given again", name)
+    }
+
+    return value, nil
+}
+
+// Password is taken from PasswordEnv or PasswordFile, if one of them is set instead of Password
+func (d *DbSettings)resolvePassword() error {
+    password, err := resolveSecret("Password", d.Password, d.PasswordEnv, d.PasswordFile)
+    if err != nil {
+        return err
+    }
+
+    d.Password = password
+    return nil
+}
+// Reference to env or file is kept, so password may be resolved again by resumed task
+func (d *DbSettings)redact() {
+    if d.PasswordEnv != "" || d.PasswordFile != "" {
+        d.Password = ""
+    } else if d.Password != "" {
+        d.Password = MASKED_PASSWORD
+    }
+}
+// Masked password is replaced with password from given settings
+func (d *DbSettings)restorePassword(from *DbSettings) {
+    if d.Password != MASKED_PASSWORD || from == nil {
+        return
+    }
+
+    d.Password = from.Password
+    d.PasswordEnv = from.PasswordEnv
+    d.PasswordFile = from.PasswordFile
+}
+// Salt is redacted like password, masked values of known data could be found by it
+func (e *ExportSettings)redactSalt() {
+    if e.MaskingSaltEnv != "" || e.MaskingSaltFile != "" {
+        e.MaskingSalt = ""
+    } else if e.MaskingSalt != "" {
+        e.MaskingSalt = MASKED_PASSWORD
+    }
+}
+func (d DbSettings)String() string {
+    d.redact()
+
+    return fmt.Sprintf("{Name:%s Host:%s Port:%v User:%s Password:%s PasswordEnv:%s PasswordFile:%s}",
+        d.Name, d.Host, d.Port, d.User, d.Password, d.PasswordEnv, d.PasswordFile)
+}
+
+func (s *Settings)resolveSecrets() error {
+    for name, db := range map[string]*DbSettings{"SourceDb": s.SourceDb, "TargetDb": s.TargetDb, "LoadCheck.LagDb": s.lagDb()} {
+        if db == nil {
+            continue
+        }
+
+        if err := db.resolvePassword(); err != nil {
+            return fmt.Errorf("%s: %v", name, err)
+        }
+    }
+
+    if s.Export != nil {
+        salt, err := resolveSecret("MaskingSalt", s.Export.MaskingSalt, s.Export.MaskingSaltEnv, s.Export.MaskingSaltFile)
+        if err != nil {
+            return fmt.Errorf("Export: %v", err)
+        }
+
+        s.Export.MaskingSalt = salt
+    }
+
+    if s.Proxy != nil && s.Proxy.Auth != nil && s.Proxy.Auth.masked() {
+        return fmt.Errorf("Proxy: Api credentials are not saved, they must be given again")
+    }
+
+    return nil
+}
+// Copy of settings without passwords and masking salt, which is saved in local database
+func (s *Settings)redacted() (*Settings, error) {
+    dumped, err := json.Marshal(s)
+    if err != nil {
+        return nil, err
+    }
+
+    result := &Settings{}
+    if err := json.Unmarshal(dumped, result); err != nil {
+        return nil, err
+    }
+
+    for _, db := range []*DbSettings{result.SourceDb, result.TargetDb, result.lagDb()} {
+        if db == nil {
+            continue
+        }
+
+        db.redact()
+    }
+
+    if result.Export != nil {
+        result.Export.redactSalt()
+    }
+
+    if result.Proxy != nil && result.Proxy.Auth != nil {
+        result.Proxy.Auth.redact()
+    }
+
+    return result, nil
+}
+// Passwords and salt which were masked in saved settings are taken from given settings
+func (s *Settings)restoreSecrets(from *Settings) {
+    if from == nil {
+        return
+    }
+
+    if s.SourceDb != nil {
+        s.SourceDb.restorePassword(from.SourceDb)
+    }
+
+    if s.TargetDb != nil {
+        s.TargetDb.restorePassword(from.TargetDb)
+    }
+
+    if s.lagDb() != nil {
+        s.lagDb().restorePassword(from.lagDb())
+    }
+
+    if s.Export != nil && s.Export.MaskingSalt == MASKED_PASSWORD && from.Export != nil {
+        s.Export.MaskingSalt = from.Export.MaskingSalt
+        s.Export.MaskingSaltEnv = from.Export.MaskingSaltEnv
+        s.Export.MaskingSaltFile = from.Export.MaskingSaltFile
+    }
+
+    if s.Proxy != nil && s.Proxy.Auth != nil && s.Proxy.Auth.masked() && from.Proxy != nil {
+        s.Proxy.Auth = from.Proxy.Auth
+    }
+}
+
+// Password of proxy listener. It's generated for every proxy start, so real password of target isn't sent to exporter
+func generatePassword() (string, error) {
+    data := make([]byte, 16)
+    if _, err := rand.Read(data); err != nil {
+        return "", err
+    }
+
+    return hex.EncodeToString(data), nil
+}
+// Masks values of password fields in json, which is written to log
+func redactJson(data []byte) []byte {
+    return jsonPasswordRegexp.ReplaceAll(data, []byte(`$1"` + MASKED_PASSWORD + `"`))
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestResolvePassword(t *testing.T) {
+    dir, err := ioutil.TempDir("", "besync-secrets")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    passwordFile := filepath.Join(dir, "password")
+    if err := ioutil.WriteFile(passwordFile, []byte("from file\r\n"), 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    os.Setenv("BESYNC_TEST_PASSWORD", "from env")
+    defer os.Unsetenv("BESYNC_TEST_PASSWORD")
+
+    tests := []struct {
+        name     string
+        settings *DbSettings
+        password string
+        success  bool
+    }{
+        {"inline", &DbSettings{Password: "inline"}, "inline", true},
+        {"empty", &DbSettings{}, "", true},
+        {"env", &DbSettings{PasswordEnv: "BESYNC_TEST_PASSWORD"}, "from env", true},
+        {"file", &DbSettings{PasswordFile: passwordFile}, "from file", true},
+        {"missing env", &DbSettings{PasswordEnv: "BESYNC_TEST_MISSING_PASSWORD"}, "", false},
+        {"missing file", &DbSettings{PasswordFile: filepath.Join(dir, "missing")}, "", false},
+        {"password and env", &DbSettings{Password: "inline", PasswordEnv: "BESYNC_TEST_PASSWORD"}, "", false},
+        {"env and file", &DbSettings{PasswordEnv: "BESYNC_TEST_PASSWORD", PasswordFile: passwordFile}, "", false},
+        {"masked", &DbSettings{Password: MASKED_PASSWORD}, "", false},
+    }
+
+    for _, test := range tests {
+        err := test.settings.resolvePassword()
+
+        if test.success && (err != nil || test.settings.Password != test.password) {
+            t.Errorf("%s: password %q, error %v, expected %q", test.name, test.settings.Password, err, test.password)
+        }
+        if !test.success && err == nil {
+            t.Errorf("%s: resolvePassword must fail", test.name)
+        }
+    }
+}
+
+// Saved settings have no passwords, references are kept, so resumed task resolves them again
+func TestRedactedSettings(t *testing.T) {
+    settings := &Settings{
+        SourceDb: &DbSettings{Name: "src", User: "root", Password: "source secret"},
+        TargetDb: &DbSettings{Name: "dst", Password: "resolved", PasswordEnv: "TARGET_PASSWORD"},
+    }
+
+    redacted, err := settings.redacted()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if redacted.SourceDb.Password != MASKED_PASSWORD || redacted.SourceDb.User != "root" {
+        t.Errorf("Redacted source %+v", redacted.SourceDb)
+    }
+    if redacted.TargetDb.Password != "" || redacted.TargetDb.PasswordEnv != "TARGET_PASSWORD" {
+        t.Errorf("Redacted target %+v", redacted.TargetDb)
+    }
+
+    if settings.SourceDb.Password != "source secret" || settings.TargetDb.Password != "resolved" {
+        t.Errorf("Original settings are changed: %+v, %+v", settings.SourceDb, settings.TargetDb)
+    }
+
+    // resume request gives inline password again
+    redacted.restoreSecrets(&Settings{SourceDb: &DbSettings{Password: "given again"}})
+    if redacted.SourceDb.Password != "given again" || redacted.TargetDb.Password != "" {
+        t.Errorf("Restored source %+v, target %+v", redacted.SourceDb, redacted.TargetDb)
+    }
+
+    if err := redacted.TargetDb.resolvePassword(); err == nil {
+        t.Errorf("Password of unset env is resolved")
+    }
+
+    // masked password without given settings stays masked and can't be used
+    other, err := (&Settings{SourceDb: &DbSettings{Password: "secret"}}).redacted()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    other.restoreSecrets(nil)
+    if err := other.resolveSecrets(); err == nil {
+        t.Errorf("Masked password is resolved")
+    }
+}
+
+// Masking salt is saved and resolved like password
+func TestMaskingSaltSecret(t *testing.T) {
+    os.Setenv("BESYNC_TEST_SALT", "salt from env")
+    defer os.Unsetenv("BESYNC_TEST_SALT")
+
+    tests := []struct {
+        name   string
+        export *ExportSettings
+        saved  string
+        salt   string
+    }{
+        {"inline", &ExportSettings{MaskingSalt: "inline salt"}, MASKED_PASSWORD, "given again"},
+        {"env", &ExportSettings{MaskingSaltEnv: "BESYNC_TEST_SALT"}, "", "salt from env"},
+        {"empty", &ExportSettings{}, "", ""},
+    }
+
+    for _, test := range tests {
+        settings := &Settings{SourceDb: &DbSettings{}, Export: test.export}
+        if err := settings.resolveSecrets(); err != nil {
+            t.Errorf("%s: %v", test.name, err)
+            continue
+        }
+
+        redacted, err := settings.redacted()
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if redacted.Export.MaskingSalt != test.saved || redacted.Export.MaskingSaltEnv != test.export.MaskingSaltEnv {
+            t.Errorf("%s: saved export %+v", test.name, redacted.Export)
+        }
+        if data, _ := json.Marshal(redacted); test.export.MaskingSalt != "" && strings.Contains(string(data), test.export.MaskingSalt) {
+            t.Errorf("%s: salt is saved: %s", test.name, data)
+        }
+
+        redacted.restoreSecrets(&Settings{Export: &ExportSettings{MaskingSalt: "given again"}})
+        if err := redacted.resolveSecrets(); err != nil || redacted.Export.MaskingSalt != test.salt {
+            t.Errorf("%s: resumed salt %q, error %v, expected %q", test.name, redacted.Export.MaskingSalt, err, test.salt)
+        }
+    }
+
+    // auto-resume has no request body, masked salt can't be used
+    redacted, err := (&Settings{Export: &ExportSettings{MaskingSalt: "secret"}}).redacted()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    redacted.restoreSecrets(nil)
+    if err := redacted.resolveSecrets(); err == nil {
+        t.Errorf("Masked salt is resolved")
+    }
+
+    both := &Settings{Export: &ExportSettings{MaskingSalt: "x", MaskingSaltEnv: "BESYNC_TEST_SALT"}}
+    if err := both.resolveSecrets(); err == nil {
+        t.Errorf("Salt and its env are resolved together")
+    }
+}
+
+func TestDbSettingsString(t *testing.T) {
+    settings := DbSettings{Name: "db", User: "root", Password: "secret"}
+
+    if result := settings.String(); strings.Contains(result, "secret") || !strings.Contains(result, MASKED_PASSWORD) {
+        t.Errorf("String() = %s", result)
+    }
+
+    if settings.Password != "secret" {
+        t.Errorf("String() changed password")
+    }
+}
+
+func TestRedactJson(t *testing.T) {
+    tests := []struct {
+        data     string
+        expected string
+    }{
+        {`{"Password":"secret"}`, `{"Password":"******"}`},
+        {`{"User": "root", "Password" : "a\"b\\"}`, `{"User": "root", "Password" : "******"}`},
+        {`{"DbPassword":"x","DbUser":"y"}`, `{"DbPassword":"******","DbUser":"y"}`},
+        {`{"SourceDb":{"Password":"1"},"TargetDb":{"Password":""}}`, `{"SourceDb":{"Password":"******"},"TargetDb":{"Password":"******"}}`},
+        {`{"MaskingSalt":"s","MaskingSaltEnv":"SALT"}`, `{"MaskingSalt":"******","MaskingSaltEnv":"SALT"}`},
+        {`{"PasswordEnv":"DB_PASSWORD","Name":"Password"}`, `{"PasswordEnv":"DB_PASSWORD","Name":"Password"}`},
+    }
+
+    for _, test := range tests {
+        if result := string(redactJson([]byte(test.data))); result != test.expected {
+            t.Errorf("redactJson(%s) = %s, expected %s", test.data, result, test.expected)
+        }
+    }
+}
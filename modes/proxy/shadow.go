@@ -0,0 +1,448 @@
+package proxy
+
+import (
+    log "github.com/Sirupsen/logrus"
+    "database/sql"
+    "fmt"
+    "strings"
+)
+
+const (
+    SHADOW_DATABASE_SUFFIX = "__besync_tmp" // tables are copied into shadow database before swap
+    OLD_DATABASE_SUFFIX    = "__besync_old" // replaced tables of target are moved here by swap and dropped
+    MAX_DATABASE_NAME      = 64
+
+    OBJECT_SWAP = "swap"
+)
+
+// Tables are copied into shadow database and swapped into target after successful sync
+func (s *Settings)shadowDatabase() bool {
+    return s.Export != nil && s.Export.ShadowDatabase
+}
+func (s *Settings)checkShadow() error {
+    if !s.shadowDatabase() {
+        return nil
+    }
+
+    if s.follow() {
+        return fmt.Errorf("ShadowDatabase cannot be used with binlog follow")
+    }
+
+    if s.toFile() {
+        return fmt.Errorf("ShadowDatabase cannot be used with file output")
+    }
+
+    if s.Export.OnConflict != "" || len(s.Export.TableOnConflict) > 0 || s.Export.TruncateBeforeInsert {
+        return fmt.Errorf("ShadowDatabase cannot be used with OnConflict and TruncateBeforeInsert, tables of target are replaced")
+    }
+
+    // target databases of multi-database task are checked, when they are known
+    if s.multiDatabase() {
+        return nil
+    }
+
+    if s.TargetDb == nil || s.TargetDb.Name == "" {
+        return fmt.Errorf("ShadowDatabase: Name of TargetDb is required")
+    }
+
+    return checkShadowName(s.TargetDb.Name)
+}
+func checkShadowName(target string) error {
+    if len(target) + len(SHADOW_DATABASE_SUFFIX) > MAX_DATABASE_NAME {
+        return fmt.Errorf("ShadowDatabase: name of target database '%s' is too long for shadow database", target)
+    }
+
+    return nil
+}
+
+// Shadow database, which tables of exporter are copied into. Empty if tables are copied into target
+// or they are already swapped
+func (s *exporter)shadowName() string {
+    if !s.settings.shadowDatabase() || s.verifyOnly || s.task().swapped {
+        return ""
+    }
+
+    return s.settings.TargetDb.Name + SHADOW_DATABASE_SUFFIX
+}
+// Shadow databases of task are created empty. Resumed task continues to copy into its shadow databases,
+// unless their tables were already swapped
+func (s *exporter)createShadowDatabases() error {
+    if !s.settings.shadowDatabase() {
+        return nil
+    }
+
+    if s.resume {
+        swapped, err := s.checkpoints.createdObjects(OBJECT_SWAP)
+        if err != nil {
+            return err
+        }
+
+        if swapped[OBJECT_SWAP] {
+            log.Infof("[export] Tables were swapped into target by previous run")
+            s.swapped = true
+            return nil
+        }
+    }
+
+    for _, database := range s.databaseExporters() {
+        shadow := database.shadowName()
+
+        if err := checkShadowName(database.settings.TargetDb.Name); err != nil {
+            return err
+        }
+
+        charset, collation, err := database.inspector.DatabaseCharset(database.settings.SourceDb.Name)
+        if err != nil {
+            return err
+        }
+
+        // shadow database of failed task is left with partially copied tables
+        if !s.resume {
+            if err := s.runJob(&jobDropDatabase{name: shadow}); err != nil {
+                return err
+            }
+        }
+
+        err = s.runJob(&jobCreateDatabase{
+            name: shadow,
+            charset: charset,
+            collation: collation,
+        })
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+// Views and routines are created in shadow databases before swap, so broken object fails task while target is untouched.
+// Then they are dropped, because tables with triggers cannot be moved to another database, and created in target after swap
+func (s *exporter)checkShadowObjects() error {
+    if !s.settings.shadowDatabase() || s.swapped {
+        return nil
+    }
+
+    // objects of failed check are left in shadow database of resumed task
+    if err := s.dropShadowObjects(); err != nil {
+        return err
+    }
+
+    s.shadowCheck = true
+    err := s.exportViews()
+    for _, database := range s.databaseExporters() {
+        if err != nil || s.isCancelled() {
+            break
+        }
+
+        err = database.exportRoutines()
+    }
+    s.shadowCheck = false
+
+    if err != nil {
+        return err
+    }
+
+    if s.isCancelled() {
+        return nil
+    }
+
+    return s.dropShadowObjects()
+}
+func (s *exporter)dropShadowObjects() error {
+    for _, database := range s.databaseExporters() {
+        if err := s.runJob(&jobDropObjects{jobDatabase: database.jobDatabase(), views: database.schema.Views}); err != nil {
+            return wrapExportError(PHASE_VIEWS, database.database, "", err)
+        }
+    }
+
+    return nil
+}
+// Moves tables of all shadow databases into target databases by one RENAME TABLE statement,
+// so applications see either old or new tables. Replaced tables are dropped
+func (s *exporter)swapShadowDatabases() error {
+    if !s.settings.shadowDatabase() || s.swapped {
+        return nil
+    }
+
+    job := &jobSwapTables{}
+    for _, database := range s.databaseExporters() {
+        job.databases = append(job.databases, shadowSwap{
+            shadow: database.shadowName(),
+            target: database.settings.TargetDb.Name,
+        })
+    }
+
+    if err := s.runJob(job); err != nil {
+        return err
+    }
+
+    s.swapped = true
+
+    return s.checkpoints.objectCreated(OBJECT_SWAP, OBJECT_SWAP)
+}
+
+func (w *worker)dropDatabase(job *jobDropDatabase) error {
+    query := fmt.Sprintf("DROP DATABASE IF EXISTS %s", quoteIdentifier(job.name))
+
+    log.Infof("[worker] DROP DATABASE: [%s]", query)
+
+    _, err := w.targetDb.Exec(query)
+    return err
+}
+// Object of target, which was dropped before swap
+type droppedObject struct {
+    database string
+    create   string // statement, which restores object
+}
+
+// Views, which are replaced by tables, and triggers of replaced tables are dropped before RENAME.
+// If swap fails, they are restored, so target is left unchanged
+func (w *worker)swapTables(job *jobSwapTables) error {
+    renames := make([]string, 0)
+    dropped := make([]droppedObject, 0)
+
+    for _, database := range job.databases {
+        tables, err := w.targetTables(database.shadow)
+        if err != nil {
+            return err
+        }
+
+        existing, err := w.targetTables(database.target)
+        if err != nil {
+            return err
+        }
+
+        oldDb := database.target + OLD_DATABASE_SUFFIX
+        if _, err := w.targetDb.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", quoteIdentifier(oldDb))); err != nil {
+            return err
+        }
+        if _, err := w.targetDb.Exec(fmt.Sprintf("CREATE DATABASE %s", quoteIdentifier(oldDb))); err != nil {
+            return err
+        }
+
+        for tableName, shadowType := range tables {
+            if shadowType != "BASE TABLE" {
+                continue
+            }
+
+            tableType, ok := existing[tableName]
+
+            switch {
+            case !ok:
+            case tableType == "VIEW":
+                // views cannot be moved to another database, they are created again after swap
+                view, err := w.dropTargetView(database.target, tableName)
+                if err != nil {
+                    w.restoreTargetObjects(dropped)
+                    return err
+                }
+
+                dropped = append(dropped, view)
+            default:
+                // tables with triggers cannot be moved to another database, triggers are created again after swap
+                triggers, err := w.dropTargetTriggers(database.target, tableName)
+                dropped = append(dropped, triggers...)
+                if err != nil {
+                    w.restoreTargetObjects(dropped)
+                    return err
+                }
+
+                renames = append(renames, fmt.Sprintf("%s.%s TO %s.%s", quoteIdentifier(database.target), quoteIdentifier(tableName),
+                    quoteIdentifier(oldDb), quoteIdentifier(tableName)))
+            }
+
+            renames = append(renames, fmt.Sprintf("%s.%s TO %s.%s", quoteIdentifier(database.shadow), quoteIdentifier(tableName),
+                quoteIdentifier(database.target), quoteIdentifier(tableName)))
+        }
+    }
+
+    if len(renames) > 0 {
+        query := "RENAME TABLE " + strings.Join(renames, ", ")
+        log.Infof("[worker] Swapping tables: [%s]", query)
+
+        if _, err := w.targetDb.Exec(query); err != nil {
+            w.restoreTargetObjects(dropped)
+            return err
+        }
+    }
+
+    for _, database := range job.databases {
+        for _, name := range []string{database.target + OLD_DATABASE_SUFFIX, database.shadow} {
+            if err := w.dropDatabase(&jobDropDatabase{name: name}); err != nil {
+                return err
+            }
+        }
+    }
+
+    return nil
+}
+// Tables and views of target database, name -> TABLE_TYPE
+func (w *worker)targetTables(database string) (map[string]string, error) {
+    rows, err := w.queryTarget("SELECT TABLE_NAME, TABLE_TYPE FROM information_schema.TABLES WHERE TABLE_SCHEMA = ?", database)
+    if err != nil {
+        return nil, err
+    }
+
+    tables := make(map[string]string)
+    for _, row := range rows {
+        tables[row[0]] = row[1]
+    }
+
+    return tables, nil
+}
+func (w *worker)dropTargetView(database, viewName string) (droppedObject, error) {
+    name := quoteIdentifier(database) + "." + quoteIdentifier(viewName)
+
+    create, err := w.showCreateTarget("SHOW CREATE VIEW " + name, 1)
+    if err != nil {
+        return droppedObject{}, err
+    }
+
+    if _, err := w.targetDb.Exec("DROP VIEW IF EXISTS " + name); err != nil {
+        return droppedObject{}, err
+    }
+
+    return droppedObject{database: database, create: create}, nil
+}
+// Triggers are dropped in order of execution, so they are restored in the same order
+func (w *worker)dropTargetTriggers(database, tableName string) ([]droppedObject, error) {
+    rows, err := w.queryTarget("SELECT TRIGGER_NAME FROM information_schema.TRIGGERS WHERE EVENT_OBJECT_SCHEMA = ? AND EVENT_OBJECT_TABLE = ? " +
+        "ORDER BY ACTION_TIMING, EVENT_MANIPULATION, ACTION_ORDER", database, tableName)
+    if err != nil {
+        return nil, err
+    }
+
+    dropped := make([]droppedObject, 0)
+    for _, row := range rows {
+        name := quoteIdentifier(database) + "." + quoteIdentifier(row[0])
+
+        create, err := w.showCreateTarget("SHOW CREATE TRIGGER " + name, 2)
+        if err != nil {
+            return dropped, err
+        }
+
+        if _, err := w.targetDb.Exec("DROP TRIGGER IF EXISTS " + name); err != nil {
+            return dropped, err
+        }
+
+        dropped = append(dropped, droppedObject{database: database, create: create})
+    }
+
+    return dropped, nil
+}
+// Statements of SHOW CREATE don't contain database, so objects are created after USE of their database
+func (w *worker)restoreTargetObjects(dropped []droppedObject) {
+    for _, object := range dropped {
+        if object.database != w.targetDatabase {
+            if _, err := w.targetDb.Exec(fmt.Sprintf("USE %s", quoteIdentifier(object.database))); err != nil {
+                log.Errorf("[worker] Failed to restore object of target database %s: %v", object.database, err)
+                continue
+            }
+
+            w.targetDatabase = object.database
+        }
+
+        if _, err := w.targetDb.Exec(object.create); err != nil {
+            log.Errorf("[worker] Failed to restore object of target database %s: [%s]: %v", object.database, object.create, err)
+        }
+    }
+}
+func (w *worker)dropObjects(job *jobDropObjects) error {
+    database := quoteIdentifier(job.targetDb)
+
+    views := make(map[string]bool)
+    for _, viewName := range job.views {
+        views[w.rename.table(viewName)] = true
+    }
+
+    tables, err := w.targetTables(job.targetDb)
+    if err != nil {
+        return err
+    }
+
+    drops := make([]string, 0)
+    for name, tableType := range tables {
+        switch {
+        case tableType == "VIEW":
+            drops = append(drops, fmt.Sprintf("DROP VIEW IF EXISTS %s.%s", database, quoteIdentifier(name)))
+        case views[name]:
+            drops = append(drops, fmt.Sprintf("DROP TABLE IF EXISTS %s.%s", database, quoteIdentifier(name)))
+        }
+    }
+
+    triggers, err := w.queryTarget("SELECT TRIGGER_NAME FROM information_schema.TRIGGERS WHERE TRIGGER_SCHEMA = ?", job.targetDb)
+    if err != nil {
+        return err
+    }
+
+    for _, row := range triggers {
+        drops = append(drops, fmt.Sprintf("DROP TRIGGER IF EXISTS %s.%s", database, quoteIdentifier(row[0])))
+    }
+
+    routines, err := w.queryTarget("SELECT ROUTINE_NAME, ROUTINE_TYPE FROM information_schema.ROUTINES WHERE ROUTINE_SCHEMA = ?", job.targetDb)
+    if err != nil {
+        return err
+    }
+
+    for _, row := range routines {
+        drops = append(drops, fmt.Sprintf("DROP %s IF EXISTS %s.%s", row[1], database, quoteIdentifier(row[0])))
+    }
+
+    for _, query := range drops {
+        log.Debugf("[worker] Dropping object of shadow database: [%s]", query)
+
+        if _, err := w.targetDb.Exec(query); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+// Rows of query on target as strings
+func (w *worker)queryTarget(query string, args ...interface{}) ([][]string, error) {
+    rows, err := w.targetDb.Query(query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    columns, err := rows.Columns()
+    if err != nil {
+        return nil, err
+    }
+
+    result := make([][]string, 0)
+    for rows.Next() {
+        values := make([]sql.NullString, len(columns))
+        dest := make([]interface{}, len(columns))
+        for i := range values {
+            dest[i] = &values[i]
+        }
+
+        if err := rows.Scan(dest...); err != nil {
+            return nil, err
+        }
+
+        row := make([]string, len(columns))
+        for i, value := range values {
+            row[i] = value.String
+        }
+
+        result = append(result, row)
+    }
+
+    return result, rows.Err()
+}
+// Column of SHOW CREATE statement, which contains create statement
+func (w *worker)showCreateTarget(query string, column int) (string, error) {
+    rows, err := w.queryTarget(query)
+    if err != nil {
+        return "", err
+    }
+
+    if len(rows) == 0 || len(rows[0]) <= column {
+        return "", fmt.Errorf("[worker] Unexpected result of %s", query)
+    }
+
+    return rows[0][column], nil
+}
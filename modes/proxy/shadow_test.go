@@ -0,0 +1,206 @@
+package proxy
+
+import (
+    "database/sql/driver"
+    "errors"
+    "fmt"
+    "github.com/LTD-Beget/besync/internal/fakesql"
+    "reflect"
+    "regexp"
+    "strings"
+    "testing"
+)
+
+// In-memory target server of swap test. Statements of swapTables change its objects
+type fakeTarget struct {
+    current     string
+    tables      map[string]map[string]string // database -> name -> TABLE_TYPE
+    triggers    map[string]map[string]string // database -> trigger -> table
+    views       map[string]map[string]string // database -> view -> create statement
+    renameError error                        // error of RENAME TABLE, tables are moved without it
+}
+
+var (
+    fakeUseRe            = regexp.MustCompile("^USE `([^`]+)`$")
+    fakeDatabaseRe       = regexp.MustCompile("^(DROP|CREATE) DATABASE (IF EXISTS )?`([^`]+)`$")
+    fakeShowViewRe       = regexp.MustCompile("^SHOW CREATE VIEW `([^`]+)`.`([^`]+)`$")
+    fakeShowTriggerRe    = regexp.MustCompile("^SHOW CREATE TRIGGER `([^`]+)`.`([^`]+)`$")
+    fakeDropViewRe       = regexp.MustCompile("^DROP VIEW IF EXISTS `([^`]+)`.`([^`]+)`$")
+    fakeDropTriggerRe    = regexp.MustCompile("^DROP TRIGGER IF EXISTS `([^`]+)`.`([^`]+)`$")
+    fakeCreateViewRe     = regexp.MustCompile("^CREATE VIEW `([^`]+)`")
+    fakeCreateTriggerRe  = regexp.MustCompile("^CREATE TRIGGER `([^`]+)` BEFORE INSERT ON `([^`]+)`")
+    fakeRenameRe         = regexp.MustCompile("`([^`]+)`.`([^`]+)` TO `([^`]+)`.`([^`]+)`")
+)
+
+func (t *fakeTarget)exec(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+    var m []string
+
+    switch {
+    case strings.HasPrefix(query, "SELECT TABLE_NAME, TABLE_TYPE FROM information_schema.TABLES"):
+        rows := make([][]driver.Value, 0)
+        for name, tableType := range t.tables[args[0].(string)] {
+            rows = append(rows, []driver.Value{name, tableType})
+        }
+        for name := range t.views[args[0].(string)] {
+            rows = append(rows, []driver.Value{name, "VIEW"})
+        }
+        return []string{"TABLE_NAME", "TABLE_TYPE"}, rows, nil
+    case strings.HasPrefix(query, "SELECT TRIGGER_NAME FROM information_schema.TRIGGERS WHERE EVENT_OBJECT_SCHEMA"):
+        rows := make([][]driver.Value, 0)
+        for name, table := range t.triggers[args[0].(string)] {
+            if table == args[1].(string) {
+                rows = append(rows, []driver.Value{name})
+            }
+        }
+        return []string{"TRIGGER_NAME"}, rows, nil
+    case strings.HasPrefix(query, "RENAME TABLE"):
+        if t.renameError != nil {
+            return nil, nil, t.renameError
+        }
+
+        for _, m := range fakeRenameRe.FindAllStringSubmatch(query, -1) {
+            tableType, ok := t.tables[m[1]][m[2]]
+            if !ok {
+                return nil, nil, fmt.Errorf("Unknown table %s.%s", m[1], m[2])
+            }
+            if _, ok := t.tables[m[3]][m[4]]; ok {
+                return nil, nil, fmt.Errorf("Table %s.%s already exists", m[3], m[4])
+            }
+
+            delete(t.tables[m[1]], m[2])
+            t.tables[m[3]][m[4]] = tableType
+        }
+        return nil, nil, nil
+    }
+
+    if m = fakeUseRe.FindStringSubmatch(query); m != nil {
+        t.current = m[1]
+    } else if m = fakeDatabaseRe.FindStringSubmatch(query); m != nil {
+        if m[1] == "DROP" {
+            delete(t.tables, m[3])
+        } else {
+            t.tables[m[3]] = make(map[string]string)
+        }
+    } else if m = fakeShowViewRe.FindStringSubmatch(query); m != nil {
+        create, ok := t.views[m[1]][m[2]]
+        if !ok {
+            return nil, nil, fmt.Errorf("Unknown view %s.%s", m[1], m[2])
+        }
+        return []string{"View", "Create View", "character_set_client", "collation_connection"},
+            [][]driver.Value{{m[2], create, "utf8", "utf8_general_ci"}}, nil
+    } else if m = fakeShowTriggerRe.FindStringSubmatch(query); m != nil {
+        table, ok := t.triggers[m[1]][m[2]]
+        if !ok {
+            return nil, nil, fmt.Errorf("Unknown trigger %s.%s", m[1], m[2])
+        }
+        create := fmt.Sprintf("CREATE TRIGGER `%s` BEFORE INSERT ON `%s` FOR EACH ROW SET @x = 1", m[2], table)
+        return []string{"Trigger", "sql_mode", "SQL Original Statement", "character_set_client", "collation_connection", "Database Collation"},
+            [][]driver.Value{{m[2], "", create, "utf8", "utf8_general_ci", "utf8_general_ci"}}, nil
+    } else if m = fakeDropViewRe.FindStringSubmatch(query); m != nil {
+        delete(t.views[m[1]], m[2])
+    } else if m = fakeDropTriggerRe.FindStringSubmatch(query); m != nil {
+        delete(t.triggers[m[1]], m[2])
+    } else if m = fakeCreateViewRe.FindStringSubmatch(query); m != nil {
+        t.views[t.current][m[1]] = query
+    } else if m = fakeCreateTriggerRe.FindStringSubmatch(query); m != nil {
+        t.triggers[t.current][m[1]] = m[2]
+    } else {
+        return nil, nil, fmt.Errorf("Unexpected query: %s", query)
+    }
+
+    return nil, nil, nil
+}
+
+// Target database app with synced shadow copy. View report of target is table of source
+func makeFakeTarget(t *testing.T, renameError error) (*fakeTarget, *worker, func()) {
+    target := &fakeTarget{
+        tables: map[string]map[string]string{
+            "app": {"users": "BASE TABLE", "orders": "BASE TABLE"},
+            "app" + SHADOW_DATABASE_SUFFIX: {"users": "BASE TABLE", "orders": "BASE TABLE", "report": "BASE TABLE"},
+        },
+        triggers: map[string]map[string]string{
+            "app": {"users_bi": "users", "orders_bi": "orders"},
+        },
+        views: map[string]map[string]string{
+            "app": {"report": "CREATE VIEW `report` AS SELECT 1", "active": "CREATE VIEW `active` AS SELECT 2"},
+        },
+        renameError: renameError,
+    }
+
+    db, err := fakesql.Open(target.exec)
+    if err != nil {
+        t.Fatal(err)
+    }
+    db.SetMaxOpenConns(1)
+
+    return target, &worker{targetDb: db}, func() {
+        db.Close()
+    }
+}
+
+func TestSwapTables(t *testing.T) {
+    target, w, cleanup := makeFakeTarget(t, nil)
+    defer cleanup()
+
+    err := w.swapTables(&jobSwapTables{databases: []shadowSwap{{shadow: "app" + SHADOW_DATABASE_SUFFIX, target: "app"}}})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    expected := map[string]string{"users": "BASE TABLE", "orders": "BASE TABLE", "report": "BASE TABLE"}
+    if !reflect.DeepEqual(target.tables["app"], expected) {
+        t.Errorf("Tables of target: %v, expected %v", target.tables["app"], expected)
+    }
+
+    // view, which is replaced by table, and triggers of replaced tables are dropped, other views are kept
+    if len(target.triggers["app"]) != 0 {
+        t.Errorf("Triggers of replaced tables are kept: %v", target.triggers["app"])
+    }
+    if _, ok := target.views["app"]["report"]; ok || len(target.views["app"]) != 1 {
+        t.Errorf("Views of target: %v, expected only active", target.views["app"])
+    }
+
+    for _, database := range []string{"app" + OLD_DATABASE_SUFFIX, "app" + SHADOW_DATABASE_SUFFIX} {
+        if _, ok := target.tables[database]; ok {
+            t.Errorf("Database %s is not dropped", database)
+        }
+    }
+}
+
+func TestSwapTablesRestoresTargetOnFailedRename(t *testing.T) {
+    target, w, cleanup := makeFakeTarget(t, errors.New("Error 1435: Trigger in wrong schema"))
+    defer cleanup()
+
+    tables := copyFakeObjects(target.tables["app"])
+    triggers := copyFakeObjects(target.triggers["app"])
+    views := copyFakeObjects(target.views["app"])
+
+    err := w.swapTables(&jobSwapTables{databases: []shadowSwap{{shadow: "app" + SHADOW_DATABASE_SUFFIX, target: "app"}}})
+    if err == nil {
+        t.Fatal("Swap must fail, when RENAME fails")
+    }
+
+    if !reflect.DeepEqual(target.tables["app"], tables) {
+        t.Errorf("Tables of target are changed: %v, expected %v", target.tables["app"], tables)
+    }
+
+    if !reflect.DeepEqual(target.triggers["app"], triggers) {
+        t.Errorf("Triggers of target are not restored: %v, expected %v", target.triggers["app"], triggers)
+    }
+
+    if !reflect.DeepEqual(target.views["app"], views) {
+        t.Errorf("Views of target are not restored: %v, expected %v", target.views["app"], views)
+    }
+
+    if _, ok := target.tables["app" + SHADOW_DATABASE_SUFFIX]; !ok {
+        t.Errorf("Shadow database must be kept for resumed task")
+    }
+}
+func copyFakeObjects(objects map[string]string) map[string]string {
+    result := make(map[string]string, len(objects))
+    for name, value := range objects {
+        result[name] = value
+    }
+
+    return result
+}
@@ -0,0 +1,555 @@
+package proxy
+
+import (
+    "bufio"
+    "bytes"
+    "compress/gzip"
+    "encoding/hex"
+    "fmt"
+    "github.com/DataDog/zstd"
+    "io"
+    "os"
+    "strings"
+)
+
+// Opens sql script for reading. Compression is detected by extension
+func openSqlScript(path string) (io.ReadCloser, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+
+    switch {
+    case strings.HasSuffix(path, ".gz"):
+        reader, err := gzip.NewReader(file)
+        if err != nil {
+            file.Close()
+            return nil, err
+        }
+
+        return &sqlScriptReader{Reader: reader, closers: []io.Closer{reader, file}}, nil
+    case strings.HasSuffix(path, ".zst"):
+        reader := zstd.NewReader(file)
+
+        return &sqlScriptReader{Reader: reader, closers: []io.Closer{reader, file}}, nil
+    }
+
+    return file, nil
+}
+
+type sqlScriptReader struct {
+    io.Reader
+    closers []io.Closer
+}
+
+func (r *sqlScriptReader)Close() error {
+    var firstErr error
+
+    for _, closer := range r.closers {
+        if err := closer.Close(); err != nil && firstErr == nil {
+            firstErr = err
+        }
+    }
+
+    return firstErr
+}
+
+// Splits sql script into statements like mysql client does: comments are skipped,
+// DELIMITER lines change statement delimiter, delimiters inside quotes are ignored
+type sqlScanner struct {
+    reader    *bufio.Reader
+    delimiter string
+}
+
+func makeSqlScanner(reader io.Reader) *sqlScanner {
+    return &sqlScanner{
+        reader: bufio.NewReaderSize(reader, 1024 * 1024),
+        delimiter: ";",
+    }
+}
+
+// Next returns next statement without delimiter or io.EOF at the end of script
+func (s *sqlScanner)Next() (string, error) {
+    stmt := bytes.Buffer{}
+    lineStart := true
+
+    for {
+        if lineStart && len(bytes.TrimSpace(stmt.Bytes())) == 0 {
+            if ok, err := s.readDelimiterCommand(); err != nil {
+                return "", err
+            } else if ok {
+                continue
+            }
+        }
+
+        c, err := s.reader.ReadByte()
+        if err == io.EOF {
+            query := strings.TrimSpace(stmt.String())
+            if query == "" {
+                return "", io.EOF
+            }
+
+            return query, nil
+        } else if err != nil {
+            return "", err
+        }
+
+        lineStart = c == '\n'
+
+        switch {
+        case c == '#' || (c == '-' && s.isDashComment()):
+            if _, err := s.reader.ReadString('\n'); err != nil && err != io.EOF {
+                return "", err
+            }
+
+            lineStart = true
+            continue
+        case c == '/' && s.peekIs("*") && !s.peekIs("*!"):
+            if err := s.skipBlockComment(); err != nil {
+                return "", err
+            }
+
+            continue
+        case c == '\'' || c == '"' || c == '`':
+            stmt.WriteByte(c)
+            if err := s.readQuoted(c, &stmt); err != nil {
+                return "", err
+            }
+
+            continue
+        case c == s.delimiter[0] && s.peekIs(s.delimiter[1:]):
+            s.reader.Discard(len(s.delimiter) - 1)
+
+            query := strings.TrimSpace(stmt.String())
+            if query == "" {
+                continue
+            }
+
+            return query, nil
+        }
+
+        stmt.WriteByte(c)
+    }
+}
+func (s *sqlScanner)peekIs(expected string) bool {
+    if expected == "" {
+        return true
+    }
+
+    next, _ := s.reader.Peek(len(expected))
+
+    return string(next) == expected
+}
+// "-- " comment needs whitespace after dashes
+func (s *sqlScanner)isDashComment() bool {
+    next, _ := s.reader.Peek(2)
+
+    if len(next) == 0 || next[0] != '-' {
+        return false
+    }
+
+    return len(next) == 1 || next[1] == ' ' || next[1] == '\t' || next[1] == '\n' || next[1] == '\r'
+}
+func (s *sqlScanner)readDelimiterCommand() (bool, error) {
+    // whitespace before command
+    for {
+        next, _ := s.reader.Peek(1)
+        if len(next) == 0 || (next[0] != ' ' && next[0] != '\t' && next[0] != '\r' && next[0] != '\n') {
+            break
+        }
+
+        s.reader.ReadByte()
+    }
+
+    next, _ := s.reader.Peek(10)
+    if !strings.EqualFold(string(next), "DELIMITER ") {
+        return false, nil
+    }
+
+    line, err := s.reader.ReadString('\n')
+    if err != nil && err != io.EOF {
+        return false, err
+    }
+
+    delimiter := strings.TrimSpace(line[10:])
+    if delimiter == "" {
+        return false, fmt.Errorf("[sql script] Empty delimiter")
+    }
+
+    s.delimiter = delimiter
+
+    return true, nil
+}
+func (s *sqlScanner)skipBlockComment() error {
+    s.reader.ReadByte() // '*'
+
+    for {
+        c, err := s.reader.ReadByte()
+        if err != nil {
+            return err
+        }
+
+        if c == '*' && s.peekIs("/") {
+            s.reader.ReadByte()
+            return nil
+        }
+    }
+}
+// Copies quoted string with escape sequences as is
+func (s *sqlScanner)readQuoted(quote byte, stmt *bytes.Buffer) error {
+    for {
+        c, err := s.reader.ReadByte()
+        if err == io.EOF {
+            return fmt.Errorf("[sql script] Unterminated quoted string")
+        } else if err != nil {
+            return err
+        }
+
+        stmt.WriteByte(c)
+
+        if c == '\\' && quote != '`' {
+            escaped, err := s.reader.ReadByte()
+            if err != nil {
+                return fmt.Errorf("[sql script] Unterminated quoted string")
+            }
+
+            stmt.WriteByte(escaped)
+            continue
+        }
+
+        if c == quote {
+            // doubled quote is escaped quote
+            if s.peekIs(string(quote)) {
+                next, _ := s.reader.ReadByte()
+                stmt.WriteByte(next)
+                continue
+            }
+
+            return nil
+        }
+    }
+}
+
+// INSERT statement parsed into rows
+type insertStatement struct {
+    table      string
+    columns    []string
+    rows       [][]interface{}
+    sizes      []int64
+    onConflict string // ON_CONFLICT_IGNORE for INSERT IGNORE
+    update     string // ON DUPLICATE KEY UPDATE clause, statement with it is executed as it is
+}
+
+func isInsertStatement(query string) bool {
+    return len(query) > 6 && strings.EqualFold(query[0:6], "INSERT")
+}
+// LOCK TABLES of mysqldump scripts would block other workers
+func isLockStatement(query string) bool {
+    return (len(query) > 11 && strings.EqualFold(query[0:11], "LOCK TABLES")) ||
+        (len(query) >= 13 && strings.EqualFold(query[0:13], "UNLOCK TABLES"))
+}
+
+// Parses INSERT [IGNORE] INTO `table` (`col`, ...) VALUES (...), (...) [ON DUPLICATE KEY UPDATE ...] statement.
+// Values are returned as []byte like they are selected from source, NULL as nil
+func parseInsert(query string) (*insertStatement, error) {
+    p := &insertParser{query: query}
+
+    if !p.keyword("INSERT") {
+        return nil, p.error("INSERT INTO expected")
+    }
+
+    onConflict := ON_CONFLICT_ERROR
+    if p.keyword("IGNORE") {
+        onConflict = ON_CONFLICT_IGNORE
+    }
+
+    if !p.keyword("INTO") {
+        return nil, p.error("INSERT INTO expected")
+    }
+
+    table, err := p.identifier()
+    if err != nil {
+        return nil, err
+    }
+
+    stmt := &insertStatement{table: table, onConflict: onConflict}
+
+    if !p.char('(') {
+        return nil, p.error("column list is required")
+    }
+
+    for {
+        column, err := p.identifier()
+        if err != nil {
+            return nil, err
+        }
+
+        stmt.columns = append(stmt.columns, column)
+
+        if p.char(')') {
+            break
+        }
+
+        if !p.char(',') {
+            return nil, p.error("',' or ')' expected")
+        }
+    }
+
+    if !p.keyword("VALUES") {
+        return nil, p.error("VALUES expected")
+    }
+
+    for {
+        if !p.char('(') {
+            return nil, p.error("'(' expected")
+        }
+
+        row := make([]interface{}, 0, len(stmt.columns))
+        var size int64
+
+        for {
+            value, err := p.value()
+            if err != nil {
+                return nil, err
+            }
+
+            if value != nil {
+                size += int64(len(value))
+                row = append(row, value)
+            } else {
+                row = append(row, nil)
+            }
+
+            if p.char(')') {
+                break
+            }
+
+            if !p.char(',') {
+                return nil, p.error("',' or ')' expected")
+            }
+        }
+
+        if len(row) != len(stmt.columns) {
+            return nil, p.error(fmt.Sprintf("%v values given for %v columns", len(row), len(stmt.columns)))
+        }
+
+        stmt.rows = append(stmt.rows, row)
+        stmt.sizes = append(stmt.sizes, size)
+
+        if !p.char(',') {
+            break
+        }
+    }
+
+    p.skipSpaces()
+    if p.pos < len(p.query) {
+        start := p.pos
+        if !p.keyword("ON") || !p.keyword("DUPLICATE") || !p.keyword("KEY") || !p.keyword("UPDATE") {
+            return nil, p.error("end of statement expected")
+        }
+
+        stmt.update = p.query[start:]
+    }
+
+    return stmt, nil
+}
+
+type insertParser struct {
+    query string
+    pos   int
+}
+
+func (p *insertParser)error(msg string) error {
+    return fmt.Errorf("[sql script] Failed to parse INSERT at position %v: %s", p.pos, msg)
+}
+func (p *insertParser)skipSpaces() {
+    for p.pos < len(p.query) {
+        switch p.query[p.pos] {
+        case ' ', '\t', '\r', '\n':
+            p.pos++
+        default:
+            return
+        }
+    }
+}
+func (p *insertParser)keyword(keyword string) bool {
+    p.skipSpaces()
+
+    end := p.pos + len(keyword)
+    if end > len(p.query) || !strings.EqualFold(p.query[p.pos:end], keyword) {
+        return false
+    }
+
+    p.pos = end
+
+    return true
+}
+func (p *insertParser)char(c byte) bool {
+    p.skipSpaces()
+
+    if p.pos < len(p.query) && p.query[p.pos] == c {
+        p.pos++
+        return true
+    }
+
+    return false
+}
+func (p *insertParser)identifier() (string, error) {
+    p.skipSpaces()
+
+    if p.pos < len(p.query) && p.query[p.pos] == '`' {
+        name := bytes.Buffer{}
+
+        for p.pos++; p.pos < len(p.query); p.pos++ {
+            c := p.query[p.pos]
+
+            if c == '`' {
+                if p.pos + 1 < len(p.query) && p.query[p.pos + 1] == '`' {
+                    name.WriteByte(c)
+                    p.pos++
+                    continue
+                }
+
+                p.pos++
+                return name.String(), nil
+            }
+
+            name.WriteByte(c)
+        }
+
+        return "", p.error("unterminated identifier")
+    }
+
+    start := p.pos
+    for p.pos < len(p.query) && isIdentifierChar(p.query[p.pos]) {
+        p.pos++
+    }
+
+    if start == p.pos {
+        return "", p.error("identifier expected")
+    }
+
+    return p.query[start:p.pos], nil
+}
+func (p *insertParser)value() ([]byte, error) {
+    p.skipSpaces()
+
+    if p.pos >= len(p.query) {
+        return nil, p.error("value expected")
+    }
+
+    switch c := p.query[p.pos]; {
+    case c == '\'' || c == '"':
+        return p.quoted(c)
+    case p.keyword("NULL"):
+        return nil, nil
+    case (c == '0' || c == 'x' || c == 'X') && p.isHexLiteral():
+        return p.hex()
+    }
+
+    // number or other literal is passed as is
+    start := p.pos
+    for p.pos < len(p.query) {
+        c := p.query[p.pos]
+        if c == ',' || c == ')' || c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+            break
+        }
+
+        p.pos++
+    }
+
+    if start == p.pos {
+        return nil, p.error("value expected")
+    }
+
+    return []byte(p.query[start:p.pos]), nil
+}
+func (p *insertParser)isHexLiteral() bool {
+    rest := p.query[p.pos:]
+
+    return (len(rest) > 2 && rest[0] == '0' && (rest[1] == 'x' || rest[1] == 'X')) ||
+        (len(rest) > 2 && (rest[0] == 'x' || rest[0] == 'X') && rest[1] == '\'')
+}
+func (p *insertParser)hex() ([]byte, error) {
+    var digits string
+
+    if p.query[p.pos] == '0' {
+        // 0xABCD
+        p.pos += 2
+        start := p.pos
+        for p.pos < len(p.query) && isHexChar(p.query[p.pos]) {
+            p.pos++
+        }
+
+        digits = p.query[start:p.pos]
+    } else {
+        // X'ABCD'
+        p.pos += 2
+        end := strings.IndexByte(p.query[p.pos:], '\'')
+        if end < 0 {
+            return nil, p.error("unterminated hex literal")
+        }
+
+        digits = p.query[p.pos:p.pos + end]
+        p.pos += end + 1
+    }
+
+    value, err := hex.DecodeString(digits)
+    if err != nil {
+        return nil, p.error(err.Error())
+    }
+
+    return value, nil
+}
+func (p *insertParser)quoted(quote byte) ([]byte, error) {
+    value := bytes.Buffer{}
+
+    for p.pos++; p.pos < len(p.query); p.pos++ {
+        c := p.query[p.pos]
+
+        switch {
+        case c == '\\' && p.pos + 1 < len(p.query):
+            p.pos++
+            value.WriteString(unescapeChar(p.query[p.pos]))
+        case c == quote && p.pos + 1 < len(p.query) && p.query[p.pos + 1] == quote:
+            value.WriteByte(c)
+            p.pos++
+        case c == quote:
+            p.pos++
+            // empty string is not NULL
+            return []byte(value.String()), nil
+        default:
+            value.WriteByte(c)
+        }
+    }
+
+    return nil, p.error("unterminated string")
+}
+
+// Mysql escape sequences. \% and \_ keep backslash
+func unescapeChar(c byte) string {
+    switch c {
+    case '0':
+        return "\x00"
+    case 'b':
+        return "\b"
+    case 'n':
+        return "\n"
+    case 'r':
+        return "\r"
+    case 't':
+        return "\t"
+    case 'Z':
+        return "\x1a"
+    case '%', '_':
+        return "\\" + string(c)
+    }
+
+    return string(c)
+}
+func isIdentifierChar(c byte) bool {
+    return c == '_' || c == '$' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+func isHexChar(c byte) bool {
+    return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
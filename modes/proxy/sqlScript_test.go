@@ -0,0 +1,172 @@
+package proxy
+
+import (
+    "bytes"
+    "github.com/LTD-Beget/besync/inspector"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// Every resumed write of compressed file appends new gzip member or zstd frame, script is read as one stream
+func TestSqlScriptCompression(t *testing.T) {
+    dir, err := ioutil.TempDir("", "besync-script")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    for _, compression := range []string{"", COMPRESSION_GZIP, COMPRESSION_ZSTD} {
+        path := filepath.Join(dir, "dump.sql" + compressionExt(compression))
+        statements := []string{"CREATE TABLE `t` (`id` int)", "INSERT INTO `t` VALUES (1)"}
+
+        for j, statement := range statements {
+            file, err := openDumpFile(path, compression, j > 0)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            if err := file.WriteStatement(statement); err != nil {
+                t.Fatal(err)
+            }
+            if err := file.Close(); err != nil {
+                t.Fatal(err)
+            }
+        }
+
+        reader, err := openSqlScript(path)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        scanner := makeSqlScanner(reader)
+        for _, expected := range statements {
+            if statement, err := scanner.Next(); err != nil || statement != expected {
+                t.Errorf("%s: statement %q, error %v, expected %q", path, statement, err, expected)
+            }
+        }
+
+        if statement, err := scanner.Next(); err != io.EOF {
+            t.Errorf("%s: statement %q, error %v after the last statement", path, statement, err)
+        }
+
+        if err := reader.Close(); err != nil {
+            t.Errorf("%s: %v", path, err)
+        }
+    }
+}
+
+// Values written to dump are parsed back by import as they were selected from source
+func TestSqlValueRoundTrip(t *testing.T) {
+    columns := []*inspector.Column{
+        inspector.MakeColumn("id", 0, "int(11) unsigned", false),
+        inspector.MakeColumn("amount", 1, "decimal(10,2)", true),
+        inspector.MakeColumn("name", 2, "varchar(255)", true),
+        inspector.MakeColumn("hash", 3, "varbinary(16)", true),
+        inspector.MakeColumn("data", 4, "blob", true),
+    }
+
+    rows := [][]interface{}{
+        {[]byte("1"), []byte("-12.50"), []byte("plain"), []byte{0x00, 0xff, '\''}, []byte("\x00\x1a")},
+        {[]byte("2"), nil, []byte("it's \\ \"q\" \x00 \x1a \n\r\t 100\\% a\\_b"), []byte{}, nil},
+        {[]byte("3"), []byte("0"), []byte(""), []byte("0x12"), []byte("NULL")},
+        {[]byte("4"), nil, nil, nil, []byte{}},
+    }
+
+    buf := bytes.Buffer{}
+    buf.WriteString("INSERT INTO `we``ird` (`id`,`amount`,`name`,`hash`,`data`) VALUES ")
+    for i, row := range rows {
+        if i > 0 {
+            buf.WriteString(",")
+        }
+
+        buf.WriteString("(")
+        for j, column := range columns {
+            if j > 0 {
+                buf.WriteString(",")
+            }
+
+            writeSqlValue(&buf, column, row[j])
+        }
+        buf.WriteString(")")
+    }
+
+    if strings.ContainsAny(buf.String(), "\x00\x1a\n\r") {
+        t.Errorf("Control characters are written as is: %q", buf.String())
+    }
+
+    stmt, err := parseInsert(buf.String())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if stmt.table != "we`ird" || strings.Join(stmt.columns, ",") != "id,amount,name,hash,data" || stmt.onConflict != ON_CONFLICT_ERROR || stmt.update != "" {
+        t.Errorf("Parsed statement %+v", stmt)
+    }
+
+    if len(stmt.rows) != len(rows) {
+        t.Fatalf("%d rows parsed, expected %d", len(stmt.rows), len(rows))
+    }
+
+    for i, row := range rows {
+        for j, value := range row {
+            parsed := stmt.rows[i][j]
+
+            if (value == nil) != (parsed == nil) || value != nil && !bytes.Equal(value.([]byte), parsed.([]byte)) {
+                t.Errorf("Row %d, column %s: parsed %q, written %q", i, columns[j].Name, parsed, value)
+            }
+        }
+    }
+}
+
+func TestParseInsertClauses(t *testing.T) {
+    tests := []struct {
+        query      string
+        onConflict string
+        update     string
+        values     []string
+    }{
+        {"INSERT IGNORE INTO `t` (`a`,`b`) VALUES (1,X'0aFF')", ON_CONFLICT_IGNORE, "", []string{"1", "\x0a\xff"}},
+        {"insert into t (a, b) values ('x' , 0x00)\n", ON_CONFLICT_ERROR, "", []string{"x", "\x00"}},
+        {"INSERT INTO `t` (`a`,`b`) VALUES (1,'it''s') ON DUPLICATE KEY UPDATE `b`=VALUES(`b`)", ON_CONFLICT_ERROR,
+            "ON DUPLICATE KEY UPDATE `b`=VALUES(`b`)", []string{"1", "it's"}},
+        {"INSERT INTO `t` (`a`,`b`) VALUES (1,\"a\\\"b\")\n  on duplicate key update a = a + 1", ON_CONFLICT_ERROR,
+            "on duplicate key update a = a + 1", []string{"1", "a\"b"}},
+    }
+
+    for _, test := range tests {
+        stmt, err := parseInsert(test.query)
+        if err != nil {
+            t.Errorf("%s: %v", test.query, err)
+            continue
+        }
+
+        if stmt.onConflict != test.onConflict || stmt.update != test.update || len(stmt.rows) != 1 {
+            t.Errorf("%s: parsed %+v", test.query, stmt)
+            continue
+        }
+
+        for j, value := range test.values {
+            if parsed, ok := stmt.rows[0][j].([]byte); !ok || string(parsed) != value {
+                t.Errorf("%s: value %d = %q, expected %q", test.query, j, stmt.rows[0][j], value)
+            }
+        }
+    }
+
+    invalid := []string{
+        "INSERT INTO `t` VALUES (1)",
+        "INSERT INTO `t` (`a`) VALUES (1, 2)",
+        "INSERT INTO `t` (`a`) VALUES ('x)",
+        "INSERT INTO `t` (`a`) VALUES (1) RETURNING a",
+        "UPDATE `t` SET a = 1",
+    }
+
+    for _, query := range invalid {
+        if _, err := parseInsert(query); err == nil {
+            t.Errorf("%s: parseInsert must fail", query)
+        }
+    }
+}
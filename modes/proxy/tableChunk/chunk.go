@@ -1,95 +1,109 @@
 package tableChunk
 
 import (
-    "strconv"
-    "fmt"
     "github.com/LTD-Beget/besync/inspector"
     log "github.com/Sirupsen/logrus"
 )
 
+const (
+    DEFAULT_CHUNK_SIZE = 350000
+    MIN_CHUNK_SIZE     = 1000
+)
+
 type Chunk struct {
+    Database  string // source database of multi-database task, empty for single database
     TableName string
     Condition string
+    Index     int       // sequence number of chunk in table
+    Range     *KeyRange // set if rows of chunk are not split yet, chunks are cut from range while table is copied
+    key       *tableKey
 }
 
-func CalculateChunksForTable(tableName string, chunkSize int64, i inspector.Inspector) ([]*Chunk, error){
-    chunks := make([]*Chunk, 0)
-
-    // get suitable indexed column
-    col, err := i.FindPrimaryColumn(tableName, true)
-    if err != nil {
-        return nil, err
-    }
-
-    // if no suitable index found, return only one chunk
-    if col == "" {
-        chunks = append(chunks, &Chunk{
-            TableName: tableName,
-        })
-        return chunks, nil
+// Key of table in progress and checkpoints, tables of multi-database task are qualified by database
+func TableKey(database, tableName string) string {
+    if database == "" {
+        return tableName
     }
 
-    min, max, err := i.GetMinMaxValues(tableName, col)
-    if err != nil {
-        return nil, err
-    }
+    return database + "." + tableName
+}
+func (c *Chunk)Key() string {
+    return TableKey(c.Database, c.TableName)
+}
 
-    rowCount, err := i.EstimateCount(tableName, col)
+// Chunks of rows matching where condition (all rows if it's empty). Rows are split by ranges of index,
+// boundaries of ranges are found by walking index with ORDER BY ... LIMIT, so chunks have about chunkSize rows
+// for any type of key and for composite keys. Chunk conditions don't include where
+func CalculateChunksForTable(tableName, where string, chunkSize int64, i inspector.Inspector) ([]*Chunk, error){
+    columns, err := i.ChunkColumns(tableName)
     if err != nil {
         return nil, err
     }
 
-    if chunkSize == 0 {
-        chunkSize = 350000
+    // if no suitable index found, return only one chunk
+    if len(columns) == 0 {
+        log.Debugf("[chunk] [CHUNK: %v] No suitable index, table is copied by one chunk", tableName)
+        return []*Chunk{{TableName: tableName}}, nil
     }
 
-    est_chunks := int(rowCount / int64(chunkSize))
-    if est_chunks == 0 {
-        est_chunks = 1
+    if chunkSize <= 0 {
+        chunkSize = DEFAULT_CHUNK_SIZE
     }
 
-    // Currently we'r support only integer values
-    nmin, err := strconv.ParseInt(min, 10, 64)
-    log.Debugf("[chunk] [CHUNK: %v] NMIN IS %v", tableName, nmin)
-    if err != nil {
-        chunks = append(chunks, &Chunk{
-            TableName: tableName,
-        })
-        return chunks, nil
-    }
+    var boundaries [][]string
+    var after []string
+    for {
+        // boundary is the first row of the next chunk, rows after previous boundary don't include boundary itself
+        offset := chunkSize
+        if after != nil {
+            offset--
+        }
 
-    nmax, err := strconv.ParseInt(max, 10, 64)
-    log.Debugf("[chunk] [CHUNK: %v] NMAX IS %v", tableName, nmax)
-    if err != nil {
-        chunks = append(chunks, &Chunk{
-            TableName: tableName,
-        })
-        return chunks, nil
-    }
+        boundary, err := i.KeyBoundary(tableName, columns, where, after, offset)
+        if err != nil {
+            return nil, err
+        }
 
-    est_step := (nmax - nmin) / int64(est_chunks) + 1
+        if boundary == nil {
+            break
+        }
 
-    log.Debugf("[chunk] CHUNKS: %v; est_step: %v", est_chunks, est_step)
+        // next chunk starts after the first row of this boundary, so boundaries strictly increase
+        boundaries = append(boundaries, boundary)
+        after = boundary
+    }
 
-    counter := 0
-    showed_nulls := false
-    format := "%s(`%s` >= %d AND `%s` < %d)"
-    for cutoff := nmin; cutoff <= nmax; {
-        var _1 string
+    log.Debugf("[chunk] [CHUNK: %v] %v chunks by %+v", tableName, len(boundaries) + 1, columnNames(columns))
 
-        if !showed_nulls {
-            _1 = fmt.Sprintf("`%s` IS NULL OR ", col)
+    return makeKeyChunks(tableName, columns, boundaries), nil
+}
+// Chunk i has rows from boundary i-1 (inclusive) to boundary i, the first and the last chunk are open.
+// Rows with NULL in key columns are added to the first chunk
+func makeKeyChunks(tableName string, columns []*inspector.Column, boundaries [][]string) []*Chunk {
+    chunks := make([]*Chunk, 0, len(boundaries) + 1)
+    for index := 0; index <= len(boundaries); index++ {
+        keyRange := &KeyRange{NullRows: index == 0}
+        if index > 0 {
+            keyRange.Lower = boundaries[index - 1]
+        }
+        if index < len(boundaries) {
+            keyRange.Upper = boundaries[index]
         }
 
         chunks = append(chunks, &Chunk{
             TableName: tableName,
-            Condition: fmt.Sprintf(format, _1, col, cutoff, col, cutoff + est_step),
+            Condition: keyRange.condition(columns),
+            Index: index,
         })
+    }
 
-        cutoff += est_step
-        showed_nulls = true
-        counter += 1
+    return chunks
+}
+func columnNames(columns []*inspector.Column) []string {
+    names := make([]string, len(columns))
+    for j, column := range columns {
+        names[j] = column.Name
     }
 
-    return chunks, err
-}
\ No newline at end of file
+    return names
+}
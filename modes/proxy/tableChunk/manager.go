@@ -3,6 +3,9 @@ package tableChunk
 import (
     "sync"
     "math"
+    "time"
+    "context"
+    log "github.com/Sirupsen/logrus"
 )
 
 type Manager struct {
@@ -10,8 +13,22 @@ type Manager struct {
     mutex                     *sync.Mutex
     maxProcessing             int
     maxProcessingForLastTable int
-    currentProcessing         map[string]int // tableName -> countProcessing
+    currentProcessing         map[string]int // table key -> countProcessing
     chunkCh                   chan *Chunk
+    startedAt                 map[*Chunk]time.Time
+    onDone                    func(chunk *Chunk, duration time.Duration)
+    onCut                     func(chunks []*Chunk) error
+    sizing                    *Sizing
+    err                       error
+    waiting                   int // calls of GetNext, which got no chunk, because range was being cut
+}
+
+// Size of chunks cut from key ranges. The first chunks of table have InitialRows,
+// next chunks are sized by throughput of table, so their copy takes about TargetDuration
+type Sizing struct {
+    InitialRows    int64
+    MaxRows        int64
+    TargetDuration time.Duration
 }
 
 func MakeManager(maxProcessing, maxProcessingForLastTable int) *Manager {
@@ -22,53 +39,231 @@ func MakeManager(maxProcessing, maxProcessingForLastTable int) *Manager {
         maxProcessingForLastTable: maxProcessingForLastTable,
         chunkCh: make(chan *Chunk, maxProcessing),
         currentProcessing: make(map[string]int),
+        startedAt: make(map[*Chunk]time.Time),
+        sizing: &Sizing{
+            InitialRows: DEFAULT_CHUNK_SIZE,
+            MaxRows: DEFAULT_CHUNK_SIZE * 10,
+            TargetDuration: 30 * time.Second,
+        },
     }
 }
 
+// SetSizing sets size of chunks cut from key ranges
+func (m *Manager)SetSizing(sizing *Sizing) {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    m.sizing = sizing
+}
+// OnCut sets callback, which is called with new chunk and with rest of range after every cut of range.
+// Error of callback stops giving out chunks
+func (m *Manager)OnCut(f func(chunks []*Chunk) error) {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    m.onCut = f
+}
+// Err returns error of cut of range, after which chunks are not given out anymore
+func (m *Manager)Err() error {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    return m.err
+}
+
+// OnDone sets callback, which is called with duration of processing of every done chunk
+func (m *Manager)OnDone(f func(chunk *Chunk, duration time.Duration)) {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    m.onDone = f
+}
+
 func (m *Manager)AddChunk(chunk *Chunk) {
     m.mutex.Lock()
     defer m.mutex.Unlock()
 
-    chunks, ok := m.chunks[chunk.TableName]
+    chunks, ok := m.chunks[chunk.Key()]
     if !ok {
         chunks = &chunkInfo{
-            tableName: chunk.TableName,
+            tableName: chunk.Key(),
             chunks: make([]*Chunk, 0),
         }
 
-        m.chunks[chunk.TableName] = chunks
+        m.chunks[chunk.Key()] = chunks
     }
 
     chunks.add(chunk)
 }
-func (m *Manager)GetNext() *Chunk {
+// GetNext blocks until chunk may be processed. Returns nil if there is no more chunks or ctx is done
+func (m *Manager)GetNext(ctx context.Context) *Chunk {
     m.recalculateAndSend()
-    return <-m.chunkCh
+
+    select {
+    case chunk := <-m.chunkCh:
+        if chunk != nil {
+            m.mutex.Lock()
+            m.startedAt[chunk] = time.Now()
+            m.mutex.Unlock()
+        }
+
+        return chunk
+    case <-ctx.Done():
+        return nil
+    }
 }
 func (m *Manager)recalculateAndSend() {
     m.mutex.Lock()
     defer m.mutex.Unlock()
 
+    // calls, which found only ranges being cut, are served after cut
+    sent := m.sendNext()
+    for sent && m.waiting > 0 {
+        m.waiting--
+        sent = m.sendNext()
+    }
+}
+// Sends chunk, if it may be processed, or nil, if there is no more chunks. Returns false, if nothing was sent.
+// Range is cut without lock, because KeyBoundary, EXPLAIN and onCut may be slow. Table of range is skipped
+// by other calls while it's cut, and chunk is counted as processing, so limits of processing are kept
+func (m *Manager)sendNext() bool {
     if m.getProcessingCountAll() >= m.maxProcessing {
-        return
+        return false
     }
 
     minChunks := m.getChunksForMinScoreTable()
 
-    if minChunks == nil {
-        m.chunkCh <- nil
+    if minChunks == nil || m.err != nil {
+        if m.err == nil && m.cutting() {
+            m.waiting++
+            return false
+        }
+
+        // nil only signals that all chunks are given out, so it may be skipped if nobody reads channel anymore
+        select {
+        case m.chunkCh <- nil:
+            return true
+        default:
+            return false
+        }
     } else {
         // Если осталась только одна таблица и она сейчас процессится, то
         notProcessedChunks := m.getChunksForNotProcessedTables()
 
         if len(notProcessedChunks) == 1 && m.getProcessingCountTable(minChunks.tableName) > m.maxProcessingForLastTable - 1 {
-            return
+            return false
+        }
+
+        chunk := minChunks.peek()
+        if chunk.Range != nil && chunk.key != nil {
+            cut := m.prepareCut(minChunks, len(notProcessedChunks) == 1)
+
+            m.currentProcessing[chunk.Key()] += 1
+            minChunks.cutting = true
+
+            m.mutex.Unlock()
+            next, err := cut.run()
+            m.mutex.Lock()
+
+            minChunks.cutting = false
+
+            if err != nil {
+                m.currentProcessing[chunk.Key()] -= 1
+                m.err = err
+
+                select {
+                case m.chunkCh <- nil:
+                    return true
+                default:
+                    return false
+                }
+            }
+
+            if next != chunk {
+                minChunks.insert(next)
+            }
+
+            m.chunkCh <- minChunks.getNext()
+            return true
+        }
+
+        m.currentProcessing[chunk.Key()] += 1
+        m.chunkCh <- minChunks.getNext()
+    }
+
+    return true
+}
+// Cut of range, which is prepared under lock and run without it
+type rangeCut struct {
+    chunk    *Chunk
+    size     int64
+    index    int
+    estimate bool // size is halved, if range has not more rows, so another worker doesn't stay idle
+    onCut    func(chunks []*Chunk) error
+}
+
+// Chunk of about target size is cut from key range, ranges of table are not split before.
+// If table is the last one and its range has less rows, than target size, the rest is split in half,
+// so free workers may take it
+func (m *Manager)prepareCut(tableChunks *chunkInfo, lastTable bool) *rangeCut {
+    limit := m.maxProcessing
+    if lastTable && m.maxProcessingForLastTable < limit {
+        limit = m.maxProcessingForLastTable
+    }
+
+    return &rangeCut{
+        chunk: tableChunks.peek(),
+        size: tableChunks.targetRows(m.sizing),
+        index: tableChunks.newIndex(),
+        estimate: lastTable && m.getProcessingCountTable(tableChunks.tableName) + 1 < limit,
+        onCut: m.onCut,
+    }
+}
+// Returns chunk cut from range, or range itself, if it has not more rows
+func (c *rangeCut)run() (*Chunk, error) {
+    chunk := c.chunk
+    size := c.size
+
+    if c.estimate {
+        rows, err := chunk.estimateRows()
+        if err != nil {
+            return nil, err
+        }
+
+        if rows <= size && rows / 2 >= MIN_CHUNK_SIZE {
+            size = rows / 2
         }
+    }
+
+    next, err := chunk.cut(size, c.index)
+    if err != nil {
+        return nil, err
+    }
+
+    saved := []*Chunk{next}
+    if next != chunk {
+        saved = append(saved, chunk)
+    }
+
+    if c.onCut != nil {
+        if err := c.onCut(saved); err != nil {
+            return nil, err
+        }
+    }
+
+    log.Debugf("[chunk] [CHUNK: %v] Cut chunk %v of %v rows: %v", next.Key(), next.Index, size, next.Condition)
 
-        chunk := minChunks.getNext()
-        m.currentProcessing[chunk.TableName] += 1
-        m.chunkCh <- chunk
+    return next, nil
+}
+// Range of some table is being cut
+func (m *Manager)cutting() bool {
+    for _, tableChunks := range m.chunks {
+        if tableChunks.cutting {
+            return true
+        }
     }
+
+    return false
 }
 
 func (m *Manager)getChunksForMinScoreTable() *chunkInfo {
@@ -76,7 +271,7 @@ func (m *Manager)getChunksForMinScoreTable() *chunkInfo {
     minScore := math.MaxInt32
 
     for _, tableChunks := range m.chunks {
-        if tableChunks.noChunks() {
+        if tableChunks.noChunks() || tableChunks.cutting {
             continue
         }
 
@@ -116,11 +311,58 @@ func (m *Manager) GetProcessing() map[string]int {
 
     return result
 }
-func (m *Manager) Done(tableName string) {
+type TableStats struct {
+    Total          int // chunks cut so far, it grows while key ranges are cut
+    Uncut          int // key ranges, which are not cut into chunks yet
+    Done           int
+    Processing     int
+    RowsPerSecond  float64 // throughput of one worker measured by done chunks
+    BytesPerSecond float64
+}
+
+// Stats returns chunks counters for every table added to manager
+func (m *Manager) Stats() map[string]TableStats {
     m.mutex.Lock()
-    m.currentProcessing[tableName] -= 1
+    defer m.mutex.Unlock()
+
+    result := make(map[string]TableStats, len(m.chunks))
+    for tableName, tableChunks := range m.chunks {
+        uncut := tableChunks.uncut()
+
+        result[tableName] = TableStats{
+            Total: len(tableChunks.chunks) - uncut,
+            Uncut: uncut,
+            Done: tableChunks.done,
+            Processing: m.getProcessingCountTable(tableName),
+            RowsPerSecond: tableChunks.rowsPerSecond,
+            BytesPerSecond: tableChunks.bytesPerSecond,
+        }
+    }
+
+    return result
+}
+// Done marks chunk as processed. Copied rows and bytes of chunk are used to size next chunks of table
+func (m *Manager) Done(chunk *Chunk, rows, bytes int64) {
+    m.mutex.Lock()
+    m.currentProcessing[chunk.Key()] -= 1
+
+    startedAt, started := m.startedAt[chunk]
+    delete(m.startedAt, chunk)
+
+    if tableChunks, ok := m.chunks[chunk.Key()]; ok {
+        tableChunks.done += 1
+
+        if started && rows > 0 {
+            tableChunks.measure(rows, bytes, time.Since(startedAt))
+        }
+    }
+    onDone := m.onDone
     m.mutex.Unlock()
 
+    if started && onDone != nil {
+        onDone(chunk, time.Since(startedAt))
+    }
+
     m.recalculateAndSend()
 }
 func (m *Manager) getProcessingCountTable(tableName string) int {
@@ -141,17 +383,84 @@ func (m *Manager) getProcessingCountAll() int {
 }
 
 type chunkInfo struct {
-    tableName string
-    nextIdx   int
-    chunks    []*Chunk
+    tableName      string
+    nextIdx        int
+    done           int
+    chunks         []*Chunk
+    maxIndex       int
+    cutting        bool // range of table is being cut, so chunks of table are not given out
+    rowsPerSecond  float64
+    bytesPerSecond float64
 }
 
 func (c *chunkInfo)add(chunk *Chunk) {
     c.chunks = append(c.chunks, chunk)
+
+    if chunk.Index > c.maxIndex {
+        c.maxIndex = chunk.Index
+    }
+}
+// Inserts chunk before the next chunk, so it's given out first
+func (c *chunkInfo)insert(chunk *Chunk) {
+    c.chunks = append(c.chunks, nil)
+    copy(c.chunks[c.nextIdx + 1:], c.chunks[c.nextIdx:])
+    c.chunks[c.nextIdx] = chunk
+}
+// Index of chunk cut from range
+func (c *chunkInfo)newIndex() int {
+    c.maxIndex++
+    return c.maxIndex
+}
+// Throughput is smoothed, because chunks are copied with different load of servers
+func (c *chunkInfo)measure(rows, bytes int64, duration time.Duration) {
+    seconds := duration.Seconds()
+    if seconds <= 0 {
+        return
+    }
+
+    if c.rowsPerSecond == 0 {
+        c.rowsPerSecond = float64(rows) / seconds
+        c.bytesPerSecond = float64(bytes) / seconds
+        return
+    }
+
+    c.rowsPerSecond = (c.rowsPerSecond + float64(rows) / seconds) / 2
+    c.bytesPerSecond = (c.bytesPerSecond + float64(bytes) / seconds) / 2
+}
+// Rows of next chunk, so it's copied in target duration
+func (c *chunkInfo)targetRows(sizing *Sizing) int64 {
+    rows := sizing.InitialRows
+    if c.rowsPerSecond > 0 {
+        rows = int64(c.rowsPerSecond * sizing.TargetDuration.Seconds())
+    }
+
+    if rows > sizing.MaxRows {
+        rows = sizing.MaxRows
+    }
+    if rows < MIN_CHUNK_SIZE {
+        rows = MIN_CHUNK_SIZE
+    }
+
+    return rows
+}
+// Ranges are not given out before they are cut, the last range becomes the last chunk
+func (c *chunkInfo)uncut() int {
+    count := 0
+    for i, chunk := range c.chunks[c.nextIdx:] {
+        // range being cut is changed without lock
+        if i == 0 && c.cutting || chunk.Range != nil && chunk.key != nil {
+            count++
+        }
+    }
+
+    return count
 }
 func (c *chunkInfo)noChunks() bool {
     return c.nextIdx == len(c.chunks)
 }
+func (c *chunkInfo)peek() *Chunk {
+    return c.chunks[c.nextIdx]
+}
 func (c *chunkInfo)getNext() *Chunk {
     if c.noChunks() {
         return nil
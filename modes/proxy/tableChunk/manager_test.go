@@ -0,0 +1,185 @@
+package tableChunk
+
+import (
+    "context"
+    "fmt"
+    "github.com/LTD-Beget/besync/inspector"
+    "regexp"
+    "sort"
+    "strconv"
+    "sync"
+    "testing"
+    "time"
+)
+
+// Inspector of table with one integer key column. KeyBoundary waits for release, if it's set
+type fakeInspector struct {
+    inspector.Inspector
+    columns []*inspector.Column // index of table, `id` if it's not set
+    keys    []int
+    entered chan struct{}
+    release chan struct{}
+}
+
+var fakeBoundRe = regexp.MustCompile("`\\w+` (>=|>|<) (\\d+)")
+
+func (i *fakeInspector)ChunkColumns(tableName string) ([]*inspector.Column, error) {
+    if i.columns != nil {
+        return i.columns, nil
+    }
+
+    return []*inspector.Column{{Name: "id", IsNumeric: true, ColType: "int"}}, nil
+}
+func (i *fakeInspector)KeyBoundary(tableName string, columns []*inspector.Column, where string, after []string, offset int64) ([]string, error) {
+    if i.release != nil {
+        i.entered <- struct{}{}
+        <-i.release
+    }
+
+    condition := where
+    if after != nil {
+        condition = combineConditions(where, inspector.KeyCondition(columns, after, ">"))
+    }
+
+    keys := i.matching(condition)
+    if offset >= int64(len(keys)) {
+        return nil, nil
+    }
+
+    return []string{strconv.Itoa(keys[offset])}, nil
+}
+func (i *fakeInspector)EstimateCount(tableName, column, where string) (int64, error) {
+    return int64(len(i.matching(where))), nil
+}
+// Keys matching bounds of condition
+func (i *fakeInspector)matching(condition string) []int {
+    keys := make([]int, 0)
+    bounds := fakeBoundRe.FindAllStringSubmatch(condition, -1)
+
+    for _, key := range i.keys {
+        matches := true
+        for _, bound := range bounds {
+            value, _ := strconv.Atoi(bound[2])
+
+            switch bound[1] {
+            case ">=":
+                matches = matches && key >= value
+            case ">":
+                matches = matches && key > value
+            case "<":
+                matches = matches && key < value
+            }
+        }
+
+        if matches {
+            keys = append(keys, key)
+        }
+    }
+
+    return keys
+}
+
+func makeFakeInspector(count int) *fakeInspector {
+    keys := make([]int, count)
+    for j := range keys {
+        keys[j] = j + 1
+    }
+
+    return &fakeInspector{keys: keys}
+}
+
+func TestManagerCutsRangeWithoutLock(t *testing.T) {
+    fake := makeFakeInspector(10500)
+    fake.entered = make(chan struct{})
+    fake.release = make(chan struct{})
+
+    chunk, err := TableRange("t", "", fake)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    m := MakeManager(4, 4)
+    m.SetSizing(&Sizing{InitialRows: MIN_CHUNK_SIZE, MaxRows: MIN_CHUNK_SIZE, TargetDuration: time.Second})
+    m.AddChunk(chunk)
+
+    var mutex sync.Mutex
+    conditions := make([]string, 0)
+
+    var wg sync.WaitGroup
+    for w := 0; w < 4; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+
+            for {
+                chunk := m.GetNext(context.Background())
+                if chunk == nil {
+                    return
+                }
+
+                mutex.Lock()
+                conditions = append(conditions, chunk.Condition)
+                mutex.Unlock()
+
+                m.Done(chunk, MIN_CHUNK_SIZE, 0)
+            }
+        }()
+    }
+
+    <-fake.entered
+
+    // range is being cut, but counters of manager are available
+    stats := make(chan TableStats)
+    go func() {
+        stats <- m.Stats()["t"]
+    }()
+
+    select {
+    case s := <-stats:
+        if s.Uncut != 1 || s.Total != 0 {
+            t.Errorf("Stats during cut: %+v", s)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("Stats is blocked by cut of range")
+    }
+
+    go func() {
+        for {
+            select {
+            case fake.release <- struct{}{}:
+            case <-fake.entered:
+            }
+        }
+    }()
+
+    finished := make(chan struct{})
+    go func() {
+        wg.Wait()
+        close(finished)
+    }()
+
+    select {
+    case <-finished:
+    case <-time.After(10 * time.Second):
+        t.Fatal("Workers didn't get all chunks")
+    }
+
+    if err := m.Err(); err != nil {
+        t.Fatal(err)
+    }
+
+    if s := m.Stats()["t"]; s.Total != 11 || s.Done != 11 || s.Uncut != 0 {
+        t.Errorf("Stats after copy: %+v", s)
+    }
+
+    // every row is in exactly one chunk
+    covered := make([]int, 0)
+    for _, condition := range conditions {
+        covered = append(covered, fake.matching(condition)...)
+    }
+    sort.Ints(covered)
+
+    if fmt.Sprint(covered) != fmt.Sprint(fake.keys) {
+        t.Errorf("Chunks cover %d rows of %d: %v", len(covered), len(fake.keys), conditions)
+    }
+}
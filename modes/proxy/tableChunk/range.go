@@ -0,0 +1,159 @@
+package tableChunk
+
+import (
+    "fmt"
+    "strings"
+    "github.com/LTD-Beget/besync/inspector"
+    log "github.com/Sirupsen/logrus"
+)
+
+// Not split rows of table between Lower (inclusive) and Upper (exclusive) values of key columns.
+// Nil bound is open
+type KeyRange struct {
+    Lower    []string
+    Upper    []string
+    NullRows bool // range includes rows with NULL in key columns
+}
+
+// Index of table, by which ranges are cut
+type tableKey struct {
+    tableName string
+    where     string // condition of copied rows
+    columns   []*inspector.Column
+    inspector inspector.Inspector
+}
+
+// Chunk of all rows matching where, which is cut into chunks while table is copied.
+// Table without suitable index is copied by one chunk
+func TableRange(tableName, where string, i inspector.Inspector) (*Chunk, error) {
+    chunk := &Chunk{
+        TableName: tableName,
+        Range: &KeyRange{NullRows: true},
+    }
+
+    if err := RestoreRange(chunk, where, i); err != nil {
+        return nil, err
+    }
+
+    return chunk, nil
+}
+// Attaches index of table to range saved by interrupted dump. If table has no suitable index anymore,
+// range is copied by one chunk with saved condition
+func RestoreRange(chunk *Chunk, where string, i inspector.Inspector) error {
+    if chunk.Range == nil {
+        return nil
+    }
+
+    columns, err := i.ChunkColumns(chunk.TableName)
+    if err != nil {
+        return err
+    }
+
+    if len(columns) == 0 || !chunk.Range.fits(columns) {
+        log.Debugf("[chunk] [CHUNK: %v] No suitable index, table is copied by one chunk", chunk.TableName)
+        chunk.Range = nil
+        return nil
+    }
+
+    chunk.key = &tableKey{
+        tableName: chunk.TableName,
+        where: where,
+        columns: columns,
+        inspector: i,
+    }
+    chunk.Condition = chunk.Range.condition(columns)
+
+    return nil
+}
+
+// Cuts chunk of about size rows from the beginning of range. Range itself becomes the last chunk,
+// if it has not more rows
+func (c *Chunk)cut(size int64, index int) (*Chunk, error) {
+    keyRange := c.Range
+
+    // boundary is the first row of the next chunk, the first row of range is lower bound itself
+    offset := size
+    if keyRange.Lower != nil {
+        offset--
+    }
+
+    boundary, err := c.key.inspector.KeyBoundary(c.TableName, c.key.columns, c.rangeWhere(), keyRange.Lower, offset)
+    if err != nil {
+        return nil, err
+    }
+
+    if boundary == nil {
+        c.Range = nil
+        return c, nil
+    }
+
+    chunkRange := &KeyRange{
+        Lower: keyRange.Lower,
+        Upper: boundary,
+        NullRows: keyRange.NullRows,
+    }
+
+    keyRange.Lower = boundary
+    keyRange.NullRows = false
+    c.Condition = keyRange.condition(c.key.columns)
+
+    return &Chunk{
+        Database: c.Database,
+        TableName: c.TableName,
+        Condition: chunkRange.condition(c.key.columns),
+        Index: index,
+    }, nil
+}
+// Estimated count of rows of range
+func (c *Chunk)estimateRows() (int64, error) {
+    return c.key.inspector.EstimateCount(c.TableName, "", combineConditions(c.key.where, c.Condition))
+}
+// Condition of KeyBoundary, rows of range after Lower are selected by KeyBoundary itself
+func (c *Chunk)rangeWhere() string {
+    if c.Range.Upper == nil {
+        return c.key.where
+    }
+
+    return combineConditions(c.key.where, inspector.KeyCondition(c.key.columns, c.Range.Upper, "<"))
+}
+
+// Condition of rows of range
+func (r *KeyRange)condition(columns []*inspector.Column) string {
+    conditions := make([]string, 0, 2)
+    if r.Lower != nil {
+        conditions = append(conditions, inspector.KeyCondition(columns, r.Lower, ">="))
+    }
+    if r.Upper != nil {
+        conditions = append(conditions, inspector.KeyCondition(columns, r.Upper, "<"))
+    }
+
+    condition := strings.Join(conditions, " AND ")
+
+    nullCondition := inspector.KeyNullCondition(columns)
+    switch {
+    case nullCondition == "" || r.NullRows && condition == "":
+        return condition
+    case r.NullRows:
+        return fmt.Sprintf("%s OR (%s)", nullCondition, condition)
+    case condition == "":
+        return fmt.Sprintf("NOT (%s)", nullCondition)
+    default:
+        // comparison with NULL may be true for composite keys, so such rows are excluded explicitly
+        return fmt.Sprintf("NOT (%s) AND %s", nullCondition, condition)
+    }
+}
+// Saved bounds must have value of every key column
+func (r *KeyRange)fits(columns []*inspector.Column) bool {
+    return (r.Lower == nil || len(r.Lower) == len(columns)) && (r.Upper == nil || len(r.Upper) == len(columns))
+}
+
+func combineConditions(first, second string) string {
+    if first == "" {
+        return second
+    }
+    if second == "" {
+        return first
+    }
+
+    return fmt.Sprintf("(%s) AND (%s)", first, second)
+}
@@ -0,0 +1,176 @@
+package tableChunk
+
+import (
+    "encoding/json"
+    "github.com/LTD-Beget/besync/inspector"
+    "reflect"
+    "testing"
+)
+
+var (
+    idColumn       = &inspector.Column{Name: "id", IsNumeric: true, ColType: "int"}
+    parentColumn   = &inspector.Column{Name: "parent", IsNumeric: true, ColType: "int", Nullable: true}
+    nameColumn     = &inspector.Column{Name: "name", ColType: "varchar", Collation: "utf8mb4_general_ci"}
+    nullNameColumn = &inspector.Column{Name: "name", ColType: "varchar", Collation: "utf8mb4_general_ci", Nullable: true}
+)
+
+func TestKeyRangeCondition(t *testing.T) {
+    tests := []struct {
+        name     string
+        columns  []*inspector.Column
+        keyRange KeyRange
+        expected string
+    }{
+        {"whole table", []*inspector.Column{idColumn}, KeyRange{NullRows: true}, ""},
+        {"lower", []*inspector.Column{idColumn}, KeyRange{Lower: []string{"10"}}, "`id` >= 10"},
+        {"upper", []*inspector.Column{idColumn}, KeyRange{Upper: []string{"20"}, NullRows: true}, "`id` < 20"},
+        {"both", []*inspector.Column{idColumn}, KeyRange{Lower: []string{"10"}, Upper: []string{"20"}}, "`id` >= 10 AND `id` < 20"},
+
+        {"nullable whole table", []*inspector.Column{parentColumn}, KeyRange{NullRows: true}, ""},
+        {"nullable first", []*inspector.Column{parentColumn}, KeyRange{Upper: []string{"20"}, NullRows: true},
+            "`parent` IS NULL OR (`parent` < 20)"},
+        {"nullable middle", []*inspector.Column{parentColumn}, KeyRange{Lower: []string{"10"}, Upper: []string{"20"}},
+            "NOT (`parent` IS NULL) AND `parent` >= 10 AND `parent` < 20"},
+        {"nullable last", []*inspector.Column{parentColumn}, KeyRange{Lower: []string{"20"}},
+            "NOT (`parent` IS NULL) AND `parent` >= 20"},
+        {"nullable without bounds and nulls", []*inspector.Column{parentColumn}, KeyRange{}, "NOT (`parent` IS NULL)"},
+
+        {"string", []*inspector.Column{nameColumn}, KeyRange{Lower: []string{"O'Brien"}},
+            "`name` >= _utf8mb4'O\\'Brien' COLLATE utf8mb4_general_ci"},
+        {"composite", []*inspector.Column{idColumn, nameColumn}, KeyRange{Lower: []string{"1", "a"}, Upper: []string{"2", "b\\"}},
+            "(`id` > 1 OR (`id` = 1 AND `name` >= _utf8mb4'a' COLLATE utf8mb4_general_ci)) AND " +
+                "(`id` < 2 OR (`id` = 2 AND `name` < _utf8mb4'b\\\\' COLLATE utf8mb4_general_ci))"},
+        {"composite nullable first", []*inspector.Column{idColumn, nullNameColumn}, KeyRange{Upper: []string{"2", ""}, NullRows: true},
+            "`name` IS NULL OR ((`id` < 2 OR (`id` = 2 AND `name` < _utf8mb4'' COLLATE utf8mb4_general_ci)))"},
+        {"composite nullable next", []*inspector.Column{idColumn, nullNameColumn}, KeyRange{Lower: []string{"2", ""}},
+            "NOT (`name` IS NULL) AND (`id` > 2 OR (`id` = 2 AND `name` >= _utf8mb4'' COLLATE utf8mb4_general_ci))"},
+    }
+
+    for _, test := range tests {
+        if result := test.keyRange.condition(test.columns); result != test.expected {
+            t.Errorf("%s: condition = %s, expected %s", test.name, result, test.expected)
+        }
+    }
+}
+
+// Rows with NULL in key are copied only by the first chunk
+func TestMakeKeyChunksNullRows(t *testing.T) {
+    columns := []*inspector.Column{idColumn, nullNameColumn}
+    chunks := makeKeyChunks("t", columns, [][]string{{"10", "a"}, {"20", "b"}})
+
+    expected := []string{
+        "`name` IS NULL OR ((`id` < 10 OR (`id` = 10 AND `name` < _utf8mb4'a' COLLATE utf8mb4_general_ci)))",
+        "NOT (`name` IS NULL) AND (`id` > 10 OR (`id` = 10 AND `name` >= _utf8mb4'a' COLLATE utf8mb4_general_ci)) AND " +
+            "(`id` < 20 OR (`id` = 20 AND `name` < _utf8mb4'b' COLLATE utf8mb4_general_ci))",
+        "NOT (`name` IS NULL) AND (`id` > 20 OR (`id` = 20 AND `name` >= _utf8mb4'b' COLLATE utf8mb4_general_ci))",
+    }
+
+    if len(chunks) != len(expected) {
+        t.Fatalf("%d chunks, expected %d", len(chunks), len(expected))
+    }
+
+    for j, chunk := range chunks {
+        if chunk.Index != j || chunk.Condition != expected[j] {
+            t.Errorf("Chunk %d: %d %s, expected %s", j, chunk.Index, chunk.Condition, expected[j])
+        }
+    }
+}
+
+// Range saved by checkpoint is restored with the same condition
+func TestRestoreRangeRoundTrip(t *testing.T) {
+    tests := []struct {
+        name     string
+        columns  []*inspector.Column
+        keyRange *KeyRange
+    }{
+        {"string key", []*inspector.Column{nameColumn}, &KeyRange{Lower: []string{"it's \\ \"quoted\""}, Upper: []string{"z\x00"}}},
+        {"composite key", []*inspector.Column{idColumn, nullNameColumn}, &KeyRange{Lower: []string{"5", "ü"}, NullRows: false}},
+        {"first range", []*inspector.Column{parentColumn, nameColumn}, &KeyRange{Upper: []string{"7", "x"}, NullRows: true}},
+    }
+
+    for _, test := range tests {
+        fake := &fakeInspector{columns: test.columns}
+
+        chunk := &Chunk{TableName: "t", Range: test.keyRange}
+        if err := RestoreRange(chunk, "", fake); err != nil {
+            t.Fatal(err)
+        }
+
+        saved, err := json.Marshal(chunk.Range)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        restored := &Chunk{TableName: "t", Index: chunk.Index, Range: &KeyRange{}}
+        if err := json.Unmarshal(saved, restored.Range); err != nil {
+            t.Fatal(err)
+        }
+
+        if err := RestoreRange(restored, "", fake); err != nil {
+            t.Fatal(err)
+        }
+
+        if !reflect.DeepEqual(restored.Range, chunk.Range) {
+            t.Errorf("%s: restored range %+v, expected %+v", test.name, restored.Range, chunk.Range)
+        }
+
+        if restored.Condition != chunk.Condition || restored.Condition == "" {
+            t.Errorf("%s: restored condition %s, expected %s", test.name, restored.Condition, chunk.Condition)
+        }
+    }
+}
+
+// Range is copied by one chunk with saved condition, if index of table changed
+func TestRestoreRangeChangedIndex(t *testing.T) {
+    chunk := &Chunk{TableName: "t", Condition: "`id` >= 10", Range: &KeyRange{Lower: []string{"10"}}}
+
+    if err := RestoreRange(chunk, "", &fakeInspector{columns: []*inspector.Column{idColumn, nameColumn}}); err != nil {
+        t.Fatal(err)
+    }
+
+    if chunk.Range != nil || chunk.key != nil || chunk.Condition != "`id` >= 10" {
+        t.Errorf("Range of changed index is not copied by saved condition: %+v", chunk)
+    }
+}
+
+// Chunks are cut from the beginning of range, NULL rows go to the first chunk, the rest of range becomes the last chunk
+func TestChunkCut(t *testing.T) {
+    fake := makeFakeInspector(2500)
+    fake.columns = []*inspector.Column{parentColumn}
+
+    chunk, err := TableRange("t", "", fake)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    expected := []struct {
+        condition string
+        rest      string
+    }{
+        {"`parent` IS NULL OR (`parent` < 1001)", "NOT (`parent` IS NULL) AND `parent` >= 1001"},
+        {"NOT (`parent` IS NULL) AND `parent` >= 1001 AND `parent` < 2001", "NOT (`parent` IS NULL) AND `parent` >= 2001"},
+        {"NOT (`parent` IS NULL) AND `parent` >= 2001", ""},
+    }
+
+    for j, e := range expected {
+        next, err := chunk.cut(1000, j + 1)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if next.Condition != e.condition {
+            t.Errorf("Cut %d: %s, expected %s", j, next.Condition, e.condition)
+        }
+
+        if e.rest == "" {
+            if next != chunk || chunk.Range != nil {
+                t.Errorf("Cut %d: the rest of range must become the last chunk", j)
+            }
+            continue
+        }
+
+        if next == chunk || chunk.Condition != e.rest {
+            t.Errorf("Cut %d: range %s, expected %s", j, chunk.Condition, e.rest)
+        }
+    }
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+    log "github.com/Sirupsen/logrus"
+    "fmt"
+    "strings"
+)
+
+// Filters and limits must refer to dumped tables
+func (s *exporter)checkTableFilters() error {
+    export := s.settings.Export
+
+    if len(export.TableFilters) == 0 && len(export.TableLimits) == 0 {
+        return nil
+    }
+
+    if s.settings.follow() {
+        return fmt.Errorf("TableFilters and TableLimits cannot be used with binlog follow")
+    }
+
+    for tableName, filter := range export.TableFilters {
+        if !inSlice(s.schema.Tables, tableName) {
+            return fmt.Errorf("TableFilters: table '%s' is not dumped", tableName)
+        }
+
+        if strings.TrimSpace(filter) == "" {
+            return fmt.Errorf("TableFilters: filter of table '%s' is blank", tableName)
+        }
+    }
+
+    for tableName, limit := range export.TableLimits {
+        if !inSlice(s.schema.Tables, tableName) {
+            return fmt.Errorf("TableLimits: table '%s' is not dumped", tableName)
+        }
+
+        if limit <= 0 {
+            return fmt.Errorf("TableLimits: limit of table '%s' must be positive", tableName)
+        }
+    }
+
+    return nil
+}
+// Conditions of copied rows are calculated while tables are locked, so they match snapshot of workers
+func (s *exporter)loadTableConditions() error {
+    for _, tableName := range s.schema.Tables {
+        condition := s.settings.Export.TableFilters[tableName]
+
+        if limit := s.settings.Export.TableLimits[tableName]; limit > 0 {
+            limitCondition, err := s.inspector.LimitCondition(tableName, condition, limit)
+            if err != nil {
+                return err
+            }
+
+            condition = combineConditions(condition, limitCondition)
+        }
+
+        if condition != "" {
+            log.Infof("[export] Rows of table %v are filtered by [%s]", tableName, condition)
+            s.schema.TableConditions[tableName] = condition
+        }
+    }
+
+    return nil
+}
+// Condition of copied rows of table, empty if all rows are copied
+func (s *exporter)tableCondition(tableName string) string {
+    return s.schema.TableConditions[tableName]
+}
+
+// Joins non-empty conditions with AND
+func combineConditions(conditions ...string) string {
+    parts := make([]string, 0, len(conditions))
+    for _, condition := range conditions {
+        if condition != "" {
+            parts = append(parts, condition)
+        }
+    }
+
+    if len(parts) == 1 {
+        return parts[0]
+    }
+
+    for i, part := range parts {
+        parts[i] = fmt.Sprintf("(%s)", part)
+    }
+
+    return strings.Join(parts, " AND ")
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+    log "github.com/Sirupsen/logrus"
+    "encoding/json"
+    "fmt"
+    "strings"
+    "time"
+)
+
+const (
+    TASK_LIST_DEFAULT_LIMIT = 50
+    TASK_LIST_MAX_LIMIT     = 1000
+)
+
+// Format of dates in sync_task, they are written with datetime('now','localtime')
+const TASK_TIME_FORMAT = "2006-01-02 15:04:05"
+
+// Filter of task list. Zero values mean no filter
+type TaskFilter struct {
+    Statuses []string
+    Type     string
+    From     time.Time // tasks created at or after this time
+    To       time.Time // tasks created before this time
+    Limit    int
+    Offset   int
+}
+
+type TaskListItem struct {
+    Id              int64
+    Type            string
+    Status          string
+    Running         bool // task is running by this process
+    SourceDb        string
+    TargetDb        string
+    Error           string
+    CreatedAt       time.Time
+    UpdatedAt       time.Time
+    DurationSeconds int64 // till now for running tasks
+}
+
+type TaskList struct {
+    Total  int
+    Limit  int
+    Offset int
+    Tasks  []*TaskListItem
+}
+
+// MakeTaskFilter parses filter given as strings. Statuses are comma separated,
+// times are in RFC3339, "2006-01-02 15:04:05" or "2006-01-02" format (local time)
+func MakeTaskFilter(statuses, taskType, from, to string, limit, offset int) (*TaskFilter, error) {
+    filter := &TaskFilter{
+        Type: taskType,
+        Limit: limit,
+        Offset: offset,
+    }
+
+    for _, status := range strings.Split(statuses, ",") {
+        if status = strings.TrimSpace(status); status != "" {
+            filter.Statuses = append(filter.Statuses, status)
+        }
+    }
+
+    var err error
+    if filter.From, err = parseTaskTime(from); err != nil {
+        return nil, err
+    }
+    if filter.To, err = parseTaskTime(to); err != nil {
+        return nil, err
+    }
+
+    if filter.Limit < 0 || filter.Offset < 0 {
+        return nil, fmt.Errorf("Limit and offset cannot be negative")
+    }
+
+    return filter, nil
+}
+func parseTaskTime(value string) (time.Time, error) {
+    if value == "" {
+        return time.Time{}, nil
+    }
+
+    if t, err := time.Parse(time.RFC3339, value); err == nil {
+        return t, nil
+    }
+
+    for _, layout := range []string{TASK_TIME_FORMAT, "2006-01-02"} {
+        if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+            return t, nil
+        }
+    }
+
+    return time.Time{}, fmt.Errorf("Invalid time '%s'", value)
+}
+
+// ListTasks returns tasks from local database, newest first
+func (m *exportManager)ListTasks(filter *TaskFilter) (*TaskList, error) {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    conditions := make([]string, 0)
+    args := make([]interface{}, 0)
+
+    if len(filter.Statuses) > 0 {
+        conditions = append(conditions, fmt.Sprintf("status IN (%s)", strings.TrimSuffix(strings.Repeat("?,", len(filter.Statuses)), ",")))
+        for _, status := range filter.Statuses {
+            args = append(args, status)
+        }
+    }
+
+    if filter.Type != "" {
+        conditions = append(conditions, "task_type = ?")
+        args = append(args, filter.Type)
+    }
+
+    // dates are stored as local time strings, so they are compared as strings
+    if !filter.From.IsZero() {
+        conditions = append(conditions, "date_create >= ?")
+        args = append(args, filter.From.In(time.Local).Format(TASK_TIME_FORMAT))
+    }
+
+    if !filter.To.IsZero() {
+        conditions = append(conditions, "date_create < ?")
+        args = append(args, filter.To.In(time.Local).Format(TASK_TIME_FORMAT))
+    }
+
+    where := ""
+    if len(conditions) > 0 {
+        where = "WHERE " + strings.Join(conditions, " AND ")
+    }
+
+    limit := filter.Limit
+    if limit <= 0 {
+        limit = TASK_LIST_DEFAULT_LIMIT
+    } else if limit > TASK_LIST_MAX_LIMIT {
+        limit = TASK_LIST_MAX_LIMIT
+    }
+
+    result := &TaskList{
+        Limit: limit,
+        Offset: filter.Offset,
+        Tasks: make([]*TaskListItem, 0),
+    }
+
+    if err := m.db.QueryRow("SELECT COUNT(*) FROM sync_task " + where, args...).Scan(&result.Total); err != nil {
+        return nil, err
+    }
+
+    query := fmt.Sprintf(`SELECT id, task_type, status, settings, error_text,
+     strftime('%%Y-%%m-%%d %%H:%%M:%%S', date_create), strftime('%%Y-%%m-%%d %%H:%%M:%%S', date_update)
+     FROM sync_task %s ORDER BY date_create DESC, id DESC LIMIT ? OFFSET ?`, where)
+
+    rows, err := m.db.Query(query, append(args, limit, filter.Offset)...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        item := &TaskListItem{}
+
+        var dumpedSettings, createdAt, updatedAt string
+        var errorText []byte
+
+        if err := rows.Scan(&item.Id, &item.Type, &item.Status, &dumpedSettings, &errorText, &createdAt, &updatedAt); err != nil {
+            return nil, err
+        }
+
+        item.Error = string(errorText)
+        _, item.Running = m.running[item.Id]
+
+        if item.CreatedAt, err = time.ParseInLocation(TASK_TIME_FORMAT, createdAt, time.Local); err != nil {
+            return nil, err
+        }
+        if item.UpdatedAt, err = time.ParseInLocation(TASK_TIME_FORMAT, updatedAt, time.Local); err != nil {
+            return nil, err
+        }
+
+        finishedAt := item.UpdatedAt
+        if item.Running {
+            finishedAt = time.Now()
+        }
+
+        item.DurationSeconds = int64(finishedAt.Sub(item.CreatedAt).Seconds())
+
+        // broken settings don't hide task from list
+        settings := &Settings{}
+        if err := json.Unmarshal([]byte(dumpedSettings), settings); err != nil {
+            log.Errorf("[export manager] Failed to parse settings of task %v: %v", item.Id, err)
+        }
+
+        if settings.SourceDb != nil {
+            item.SourceDb = settings.SourceDb.Name
+        }
+        if settings.TargetDb != nil {
+            item.TargetDb = settings.TargetDb.Name
+        }
+
+        result.Tasks = append(result.Tasks, item)
+    }
+
+    return result, rows.Err()
+}
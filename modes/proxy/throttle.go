@@ -0,0 +1,371 @@
+package proxy
+
+import (
+    log "github.com/Sirupsen/logrus"
+    "context"
+    "database/sql"
+    "fmt"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Pauses workers while source or replicas of target are overloaded
+type LoadCheckSettings struct {
+    MaxThreadsRunning int         // Threads_running of source
+    MaxReplicationLag int         // seconds, Seconds_Behind_Source (Seconds_Behind_Master) of LagDb
+    LagDb             *DbSettings // replica, which lag is checked. TargetDb by default
+    Interval          int         // seconds between checks, 5 by default
+}
+
+// Settings of replica of load check, which has own password
+func (s *Settings)lagDb() *DbSettings {
+    if s.Export == nil || s.Export.LoadCheck == nil {
+        return nil
+    }
+
+    return s.Export.LoadCheck.LagDb
+}
+func (l *LoadCheckSettings)check() error {
+    if l == nil {
+        return nil
+    }
+
+    if l.MaxThreadsRunning < 0 || l.MaxReplicationLag < 0 || l.Interval < 0 {
+        return fmt.Errorf("LoadCheck: thresholds and Interval cannot be negative")
+    }
+
+    if l.MaxThreadsRunning == 0 && l.MaxReplicationLag == 0 {
+        return fmt.Errorf("LoadCheck: MaxThreadsRunning or MaxReplicationLag must be set")
+    }
+
+    return nil
+}
+func (e *ExportSettings)checkRateLimits() error {
+    if e == nil {
+        return nil
+    }
+
+    for name, limit := range map[string]int64{
+        "MaxRowsPerSecond": e.MaxRowsPerSecond,
+        "MaxBytesPerSecond": e.MaxBytesPerSecond,
+        "MaxWorkerRowsPerSecond": e.MaxWorkerRowsPerSecond,
+        "MaxWorkerBytesPerSecond": e.MaxWorkerBytesPerSecond,
+    } {
+        if limit < 0 {
+            return fmt.Errorf("%s cannot be negative", name)
+        }
+    }
+
+    return e.LoadCheck.check()
+}
+
+// Limits rate of copied amount. Every caller reserves time for its amount and waits until previous reservations pass,
+// so rate doesn't exceed limit on average
+type rateLimiter struct {
+    mutex *sync.Mutex
+    rate  float64 // per second
+    next  time.Time
+}
+
+func makeRateLimiter(rate int64) *rateLimiter {
+    if rate <= 0 {
+        return nil
+    }
+
+    return &rateLimiter{
+        mutex: &sync.Mutex{},
+        rate: float64(rate),
+    }
+}
+// Nil limiter doesn't limit
+func (l *rateLimiter)wait(ctx context.Context, amount int64) error {
+    if l == nil || amount <= 0 {
+        return nil
+    }
+
+    l.mutex.Lock()
+    now := time.Now()
+    if l.next.Before(now) {
+        l.next = now
+    }
+
+    delay := l.next.Sub(now)
+    l.next = l.next.Add(time.Duration(float64(amount) / l.rate * float64(time.Second)))
+    l.mutex.Unlock()
+
+    return sleepContext(ctx, delay)
+}
+func sleepContext(ctx context.Context, delay time.Duration) error {
+    if delay <= 0 {
+        return nil
+    }
+
+    timer := time.NewTimer(delay)
+    defer timer.Stop()
+
+    select {
+    case <-timer.C:
+        return nil
+    case <-ctx.Done():
+        return ErrDumpCancelled
+    }
+}
+
+// Rate limits and load check of task
+type throttle struct {
+    settings *ExportSettings
+    rows     *rateLimiter
+    bytes    *rateLimiter
+    paused   int32 // atomic, 1 while load check finds overload
+    progress *progress
+}
+
+func makeThrottle(settings *ExportSettings, progress *progress) *throttle {
+    return &throttle{
+        settings: settings,
+        rows: makeRateLimiter(settings.MaxRowsPerSecond),
+        bytes: makeRateLimiter(settings.MaxBytesPerSecond),
+        progress: progress,
+    }
+}
+// Throttle of worker has its own limits and shares limits and load check of task
+func (t *throttle)forWorker(ctx context.Context) *workerThrottle {
+    if t == nil {
+        return nil
+    }
+
+    return &workerThrottle{
+        ctx: ctx,
+        task: t,
+        rows: makeRateLimiter(t.settings.MaxWorkerRowsPerSecond),
+        bytes: makeRateLimiter(t.settings.MaxWorkerBytesPerSecond),
+    }
+}
+
+type workerThrottle struct {
+    ctx   context.Context
+    task  *throttle
+    rows  *rateLimiter
+    bytes *rateLimiter
+}
+
+// Waits until rows of batch fit into limits. Nil throttle doesn't limit
+func (w *workerThrottle)waitRate(rows int, size int64) error {
+    if w == nil {
+        return nil
+    }
+
+    for _, limit := range []struct{limiter *rateLimiter; amount int64}{
+        {w.rows, int64(rows)},
+        {w.bytes, size},
+        {w.task.rows, int64(rows)},
+        {w.task.bytes, size},
+    } {
+        if err := limit.limiter.wait(w.ctx, limit.amount); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+// Waits while workers are paused by load check
+func (w *workerThrottle)waitLoad() error {
+    if w == nil {
+        return nil
+    }
+
+    for atomic.LoadInt32(&w.task.paused) == 1 {
+        if err := sleepContext(w.ctx, time.Second); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Checks load until ctx is done. Failed checks are logged and don't pause workers
+func (t *throttle)monitorLoad(ctx context.Context, sourceDb, lagDb *sql.DB) {
+    interval := time.Duration(t.settings.LoadCheck.Interval) * time.Second
+    if interval <= 0 {
+        interval = 5 * time.Second
+    }
+
+    for {
+        reason, err := t.overload(sourceDb, lagDb)
+        if err != nil {
+            // unreachable server must not keep workers paused forever
+            log.Warnf("[throttle] Load check failed: %v", err)
+            reason = ""
+        }
+
+        t.setPaused(reason)
+
+        if sleepContext(ctx, interval) != nil {
+            t.setPaused("")
+            return
+        }
+    }
+}
+func (t *throttle)setPaused(reason string) {
+    var paused int32
+    if reason != "" {
+        paused = 1
+    }
+
+    if atomic.SwapInt32(&t.paused, paused) != paused {
+        if paused == 1 {
+            log.Warnf("[throttle] Workers are paused: %s", reason)
+        } else {
+            log.Infof("[throttle] Workers are resumed")
+        }
+    }
+
+    t.progress.setThrottled(reason)
+}
+// Reason of pause, empty if servers are not overloaded
+func (t *throttle)overload(sourceDb, lagDb *sql.DB) (string, error) {
+    loadCheck := t.settings.LoadCheck
+
+    if loadCheck.MaxThreadsRunning > 0 {
+        var name, value string
+        if err := sourceDb.QueryRow("SHOW GLOBAL STATUS LIKE 'Threads_running'").Scan(&name, &value); err != nil {
+            return "", err
+        }
+
+        threads, err := strconv.Atoi(value)
+        if err != nil {
+            return "", err
+        }
+
+        if threads > loadCheck.MaxThreadsRunning {
+            return fmt.Sprintf("Threads_running of source is %v", threads), nil
+        }
+    }
+
+    if loadCheck.MaxReplicationLag > 0 && lagDb != nil {
+        lag, err := replicationLag(lagDb)
+        if err != nil {
+            return "", err
+        }
+
+        if lag < 0 {
+            return "replication of LagDb is stopped", nil
+        }
+
+        if lag > int64(loadCheck.MaxReplicationLag) {
+            return fmt.Sprintf("replication lag is %v seconds", lag), nil
+        }
+    }
+
+    return "", nil
+}
+// Seconds_Behind_Source of replica, -1 if replication is stopped
+func replicationLag(db *sql.DB) (int64, error) {
+    rows, err := db.Query("SHOW SLAVE STATUS")
+    if err != nil {
+        return 0, err
+    }
+    defer rows.Close()
+
+    columns, err := rows.Columns()
+    if err != nil {
+        return 0, err
+    }
+
+    values := make([]sql.RawBytes, len(columns))
+    scanArgs := make([]interface{}, len(values))
+    for i := range values {
+        scanArgs[i] = &values[i]
+    }
+
+    // server with several replication channels has row for every channel, one stopped channel stops replica
+    lag := int64(-1)
+    channels := 0
+    for rows.Next() {
+        channels++
+
+        if err := rows.Scan(scanArgs...); err != nil {
+            return 0, err
+        }
+
+        for i, column := range columns {
+            if column != "Seconds_Behind_Master" && column != "Seconds_Behind_Source" {
+                continue
+            }
+
+            if values[i] == nil {
+                return -1, nil
+            }
+
+            channelLag, err := strconv.ParseInt(string(values[i]), 10, 64)
+            if err != nil {
+                return 0, err
+            }
+
+            if channelLag > lag {
+                lag = channelLag
+            }
+        }
+    }
+
+    if err := rows.Err(); err != nil {
+        return 0, err
+    }
+
+    if channels == 0 {
+        return 0, fmt.Errorf("LagDb is not replica")
+    }
+
+    return lag, nil
+}
+
+// Starts load check of task. Returned function stops it and closes its connections
+func (s *exporter)startLoadCheck() (func(), error) {
+    loadCheck := s.settings.Export.LoadCheck
+    if loadCheck == nil {
+        return func() {}, nil
+    }
+
+    sourceDb, err := s.newSourceDbConnection()
+    if err != nil {
+        return nil, err
+    }
+
+    var lagDb *sql.DB
+    if loadCheck.MaxReplicationLag > 0 {
+        lagDbSettings := loadCheck.LagDb
+        if lagDbSettings == nil {
+            lagDbSettings = s.settings.TargetDb
+        }
+
+        if lagDbSettings == nil {
+            sourceDb.Close()
+            return nil, fmt.Errorf("LoadCheck: LagDb or TargetDb is required for MaxReplicationLag")
+        }
+
+        if lagDb, err = openDbConnection(lagDbSettings); err != nil {
+            sourceDb.Close()
+            return nil, err
+        }
+    }
+
+    ctx, cancel := context.WithCancel(s.ctx)
+    done := make(chan struct{})
+
+    go func() {
+        defer close(done)
+        s.throttle.monitorLoad(ctx, sourceDb, lagDb)
+    }()
+
+    return func() {
+        cancel()
+        <-done
+
+        sourceDb.Close()
+        if lagDb != nil {
+            lagDb.Close()
+        }
+    }, nil
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+    "context"
+    "database/sql/driver"
+    "github.com/LTD-Beget/besync/internal/fakesql"
+    "testing"
+    "time"
+)
+
+func TestRateLimiterWait(t *testing.T) {
+    var limiter *rateLimiter
+    if err := limiter.wait(context.Background(), 1000); err != nil {
+        t.Errorf("Nil limiter: %v", err)
+    }
+
+    if makeRateLimiter(0) != nil {
+        t.Errorf("Limiter without rate is not nil")
+    }
+
+    // 100 per second: the first amount passes at once, next ones wait for reservations of previous
+    limiter = makeRateLimiter(100)
+    started := time.Now()
+
+    for _, amount := range []int64{10, 0, 10, 10} {
+        if err := limiter.wait(context.Background(), amount); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    if elapsed := time.Since(started); elapsed < 200 * time.Millisecond || elapsed > time.Second {
+        t.Errorf("30 of 100 per second passed in %v, expected 200ms", elapsed)
+    }
+
+    // wait of cancelled task returns without delay
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+
+    if err := limiter.wait(ctx, 100); err != ErrDumpCancelled {
+        t.Errorf("Cancelled wait returns %v, expected %v", err, ErrDumpCancelled)
+    }
+}
+
+func TestReplicationLag(t *testing.T) {
+    columns := []string{"Slave_IO_State", "Seconds_Behind_Master", "Channel_Name"}
+
+    tests := []struct {
+        name    string
+        columns []string
+        rows    [][]driver.Value
+        lag     int64
+        success bool
+    }{
+        {"replica", columns, [][]driver.Value{{"Waiting", []byte("7"), ""}}, 7, true},
+        {"stopped", columns, [][]driver.Value{{"", nil, ""}}, -1, true},
+        {"channels", columns, [][]driver.Value{{"", []byte("3"), "a"}, {"", []byte("12"), "b"}, {"", []byte("0"), "c"}}, 12, true},
+        {"stopped channel", columns, [][]driver.Value{{"", []byte("3"), "a"}, {"", nil, "b"}}, -1, true},
+        {"mysql 8.0.22", []string{"Replica_IO_State", "Seconds_Behind_Source"}, [][]driver.Value{{"", []byte("5")}}, 5, true},
+        {"not replica", columns, [][]driver.Value{}, 0, false},
+        {"bad lag", columns, [][]driver.Value{{"", []byte("x"), ""}}, 0, false},
+    }
+
+    for _, test := range tests {
+        var queries []string
+        db, err := fakesql.Open(fakesql.Recorder(&queries, test.columns, test.rows))
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        lag, err := replicationLag(db)
+        db.Close()
+
+        if test.success && (err != nil || lag != test.lag) {
+            t.Errorf("%s: lag %v, error %v, expected %v", test.name, lag, err, test.lag)
+        }
+        if !test.success && err == nil {
+            t.Errorf("%s: replicationLag must fail", test.name)
+        }
+    }
+}
+
+func TestThrottleOverload(t *testing.T) {
+    source, err := fakesql.Open(fakesql.Recorder(new([]string), []string{"Variable_name", "Value"},
+        [][]driver.Value{{"Threads_running", []byte("30")}}))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer source.Close()
+
+    replica, err := fakesql.Open(fakesql.Recorder(new([]string), []string{"Seconds_Behind_Master"}, [][]driver.Value{{nil}}))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer replica.Close()
+
+    tests := []struct {
+        loadCheck *LoadCheckSettings
+        overload  bool
+    }{
+        {&LoadCheckSettings{MaxThreadsRunning: 50}, false},
+        {&LoadCheckSettings{MaxThreadsRunning: 20}, true},
+        // stopped replication pauses workers
+        {&LoadCheckSettings{MaxThreadsRunning: 50, MaxReplicationLag: 10}, true},
+    }
+
+    for _, test := range tests {
+        th := makeThrottle(&ExportSettings{LoadCheck: test.loadCheck}, nil)
+
+        reason, err := th.overload(source, replica)
+        if err != nil || (reason != "") != test.overload {
+            t.Errorf("%+v: reason %q, error %v, expected overload %v", test.loadCheck, reason, err, test.overload)
+        }
+    }
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+    "crypto/sha1"
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "github.com/go-sql-driver/mysql"
+    "io/ioutil"
+    "net/http"
+)
+
+const (
+    TLS_REQUIRED    = "required"    // connection is encrypted, certificate of server is not verified
+    TLS_VERIFY_FULL = "verify-full" // certificate of server is verified with CAFile (or system CAs) and host name
+)
+
+// TLS options of client connection to mysql server or proxy daemon
+type TLSSettings struct {
+    Mode       string // verify-full (default) or required
+    CAFile     string // CA of server certificate, system CAs are used if empty
+    CertFile   string // client certificate, if server requires it
+    KeyFile    string
+    ServerName string // name in server certificate, host of connection by default
+}
+
+// TLS options of daemon listener
+type ServerTLSSettings struct {
+    CertFile     string
+    KeyFile      string
+    ClientCAFile string // if set, clients must present certificate signed by this CA
+}
+
+// TLS of proxy listeners. Set by Serve, nil if listeners are not encrypted
+var proxyServerTLS *tls.Config
+
+func (t *TLSSettings)clientConfig(host string) (*tls.Config, error) {
+    config := &tls.Config{
+        ServerName: host,
+    }
+
+    if t.ServerName != "" {
+        config.ServerName = t.ServerName
+    }
+
+    switch t.Mode {
+    case "", TLS_VERIFY_FULL:
+    case TLS_REQUIRED:
+        config.InsecureSkipVerify = true
+    default:
+        return nil, fmt.Errorf("[tls] Unknown mode '%s'", t.Mode)
+    }
+
+    if t.CAFile != "" {
+        pool, err := loadCertPool(t.CAFile)
+        if err != nil {
+            return nil, err
+        }
+
+        config.RootCAs = pool
+    }
+
+    if t.CertFile != "" || t.KeyFile != "" {
+        cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+        if err != nil {
+            return nil, fmt.Errorf("[tls] Failed to load client certificate: %v", err)
+        }
+
+        config.Certificates = []tls.Certificate{cert}
+    }
+
+    return config, nil
+}
+// Registers config in mysql driver and returns its name for mysql.Config.TLSConfig.
+// Name depends on options, so connections with the same options share config
+func (t *TLSSettings)registerMysqlConfig(host string) (string, error) {
+    config, err := t.clientConfig(host)
+    if err != nil {
+        return "", err
+    }
+
+    name := fmt.Sprintf("besync-%x", sha1.Sum([]byte(fmt.Sprintf("%s|%+v", host, *t))))
+    if err := mysql.RegisterTLSConfig(name, config); err != nil {
+        return "", err
+    }
+
+    return name, nil
+}
+
+func (t *ServerTLSSettings)serverConfig() (*tls.Config, error) {
+    cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+    if err != nil {
+        return nil, fmt.Errorf("[tls] Failed to load server certificate: %v", err)
+    }
+
+    config := &tls.Config{
+        Certificates: []tls.Certificate{cert},
+    }
+
+    if t.ClientCAFile != "" {
+        pool, err := loadCertPool(t.ClientCAFile)
+        if err != nil {
+            return nil, err
+        }
+
+        config.ClientCAs = pool
+        config.ClientAuth = tls.RequireAndVerifyClientCert
+    }
+
+    return config, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("[tls] Failed to read CA file: %v", err)
+    }
+
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(data) {
+        return nil, fmt.Errorf("[tls] No certificates found in %s", path)
+    }
+
+    return pool, nil
+}
+// Sets TLS options of db connection
+func setMysqlTLS(mysqlConfig *mysql.Config, settings *TLSSettings, host string) error {
+    if settings == nil {
+        return nil
+    }
+
+    name, err := settings.registerMysqlConfig(host)
+    if err != nil {
+        return err
+    }
+
+    mysqlConfig.TLSConfig = name
+
+    return nil
+}
+// Client of proxy daemon api
+func proxyHttpClient(settings *ProxySettings) (string, *http.Client, error) {
+    if settings.TLS == nil {
+        return fmt.Sprintf("http://%s:%v", settings.Host, settings.Port), http.DefaultClient, nil
+    }
+
+    config, err := settings.TLS.clientConfig(settings.Host)
+    if err != nil {
+        return "", nil, err
+    }
+
+    client := &http.Client{
+        Transport: &http.Transport{TLSClientConfig: config},
+    }
+
+    return fmt.Sprintf("https://%s:%v", settings.Host, settings.Port), client, nil
+}
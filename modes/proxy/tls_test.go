@@ -0,0 +1,218 @@
+package proxy
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "io/ioutil"
+    "math/big"
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// Certificate and key written to files of test directory
+type testCert struct {
+    cert     *x509.Certificate
+    key      *ecdsa.PrivateKey
+    certFile string
+    keyFile  string
+}
+
+// Self-signed CA, if parent is nil, otherwise certificate signed by parent
+func makeTestCert(t *testing.T, dir, name string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(time.Now().UnixNano()),
+        Subject: pkix.Name{CommonName: name},
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+        KeyUsage: x509.KeyUsageDigitalSignature,
+    }
+
+    signer, signerKey := template, key
+    if parent == nil {
+        template.IsCA = true
+        template.BasicConstraintsValid = true
+        template.KeyUsage |= x509.KeyUsageCertSign
+    } else {
+        template.DNSNames = []string{name}
+        template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+        signer, signerKey = parent.cert, parent.key
+    }
+
+    der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    cert, err := x509.ParseCertificate(der)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    keyDer, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    result := &testCert{
+        cert: cert,
+        key: key,
+        certFile: filepath.Join(dir, name + ".crt"),
+        keyFile: filepath.Join(dir, name + ".key"),
+    }
+
+    if err := ioutil.WriteFile(result.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+        t.Fatal(err)
+    }
+    if err := ioutil.WriteFile(result.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    return result
+}
+
+// Handshake of client and server configs over loopback connection. Returns error of client or server side
+func testHandshake(client, server *tls.Config) error {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        return err
+    }
+    defer listener.Close()
+
+    serverErr := make(chan error, 1)
+    go func() {
+        c, err := listener.Accept()
+        if err != nil {
+            serverErr <- err
+            return
+        }
+
+        c.SetDeadline(time.Now().Add(5 * time.Second))
+        conn := tls.Server(c, server)
+        serverErr <- conn.Handshake()
+        conn.Close()
+    }()
+
+    c, err := net.Dial("tcp", listener.Addr().String())
+    if err != nil {
+        return err
+    }
+
+    c.SetDeadline(time.Now().Add(5 * time.Second))
+    conn := tls.Client(c, client)
+    err = conn.Handshake()
+    conn.Close()
+
+    if sErr := <-serverErr; err == nil {
+        err = sErr
+    }
+
+    return err
+}
+
+func TestTLSConfigs(t *testing.T) {
+    dir, err := ioutil.TempDir("", "besync-tls")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    ca := makeTestCert(t, dir, "ca", nil, 0)
+    otherCa := makeTestCert(t, dir, "other-ca", nil, 0)
+    server := makeTestCert(t, dir, "proxy.example", ca, x509.ExtKeyUsageServerAuth)
+    client := makeTestCert(t, dir, "exporter", ca, x509.ExtKeyUsageClientAuth)
+    otherClient := makeTestCert(t, dir, "stranger", otherCa, x509.ExtKeyUsageClientAuth)
+
+    tests := []struct {
+        name    string
+        server  *ServerTLSSettings
+        client  *TLSSettings
+        host    string
+        success bool
+    }{
+        {"verified server", &ServerTLSSettings{CertFile: server.certFile, KeyFile: server.keyFile},
+            &TLSSettings{CAFile: ca.certFile}, "proxy.example", true},
+        {"wrong host", &ServerTLSSettings{CertFile: server.certFile, KeyFile: server.keyFile},
+            &TLSSettings{CAFile: ca.certFile}, "other.example", false},
+        {"server name option", &ServerTLSSettings{CertFile: server.certFile, KeyFile: server.keyFile},
+            &TLSSettings{CAFile: ca.certFile, ServerName: "proxy.example"}, "10.0.0.1", true},
+        {"unknown CA", &ServerTLSSettings{CertFile: server.certFile, KeyFile: server.keyFile},
+            &TLSSettings{CAFile: otherCa.certFile}, "proxy.example", false},
+        {"required mode", &ServerTLSSettings{CertFile: server.certFile, KeyFile: server.keyFile},
+            &TLSSettings{Mode: TLS_REQUIRED, CAFile: otherCa.certFile}, "other.example", true},
+        {"client certificate", &ServerTLSSettings{CertFile: server.certFile, KeyFile: server.keyFile, ClientCAFile: ca.certFile},
+            &TLSSettings{CAFile: ca.certFile, CertFile: client.certFile, KeyFile: client.keyFile}, "proxy.example", true},
+        {"no client certificate", &ServerTLSSettings{CertFile: server.certFile, KeyFile: server.keyFile, ClientCAFile: ca.certFile},
+            &TLSSettings{CAFile: ca.certFile}, "proxy.example", false},
+        {"client certificate of unknown CA", &ServerTLSSettings{CertFile: server.certFile, KeyFile: server.keyFile, ClientCAFile: ca.certFile},
+            &TLSSettings{CAFile: ca.certFile, CertFile: otherClient.certFile, KeyFile: otherClient.keyFile}, "proxy.example", false},
+    }
+
+    for _, test := range tests {
+        serverConfig, err := test.server.serverConfig()
+        if err != nil {
+            t.Fatalf("%s: %v", test.name, err)
+        }
+
+        clientConfig, err := test.client.clientConfig(test.host)
+        if err != nil {
+            t.Fatalf("%s: %v", test.name, err)
+        }
+
+        err = testHandshake(clientConfig, serverConfig)
+        if test.success && err != nil {
+            t.Errorf("%s: handshake failed: %v", test.name, err)
+        }
+        if !test.success && err == nil {
+            t.Errorf("%s: handshake must fail", test.name)
+        }
+    }
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+    dir, err := ioutil.TempDir("", "besync-tls")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    ca := makeTestCert(t, dir, "ca", nil, 0)
+    notPem := filepath.Join(dir, "not.pem")
+    if err := ioutil.WriteFile(notPem, []byte("not a certificate"), 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    clients := map[string]*TLSSettings{
+        "unknown mode": {Mode: "prefer"},
+        "missing CA": {CAFile: filepath.Join(dir, "missing.crt")},
+        "CA without certificates": {CAFile: notPem},
+        "certificate without key": {CertFile: ca.certFile},
+    }
+    for name, settings := range clients {
+        if _, err := settings.clientConfig("localhost"); err == nil {
+            t.Errorf("%s: clientConfig must fail", name)
+        }
+    }
+
+    servers := map[string]*ServerTLSSettings{
+        "missing key": {CertFile: ca.certFile, KeyFile: filepath.Join(dir, "missing.key")},
+        "client CA without certificates": {CertFile: ca.certFile, KeyFile: ca.keyFile, ClientCAFile: notPem},
+    }
+    for name, settings := range servers {
+        if _, err := settings.serverConfig(); err == nil {
+            t.Errorf("%s: serverConfig must fail", name)
+        }
+    }
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+    log "github.com/Sirupsen/logrus"
+    "github.com/LTD-Beget/besync/modes/proxy/tableChunk"
+    "fmt"
+    "sync"
+)
+
+// Result of comparing source and target databases
+type VerifyResult struct {
+    Tables        int
+    Chunks        int
+    ChunksDiffer  int
+    Mismatches    []*VerifyMismatch
+}
+
+// Chunk with different row count or checksum
+type VerifyMismatch struct {
+    Table          string
+    Chunk          string
+    SourceRows     int64
+    TargetRows     int64
+    SourceChecksum string
+    TargetChecksum string
+}
+
+// Compares every chunk of dumped tables on source and target. Chunks are calculated again,
+// so verification doesn't depend on checkpoints of dump
+func (s *exporter)verifyTables() error {
+    if s.settings.Export.NoData {
+        log.Infof("[verify] NoData = true; Skipping verification")
+        return nil
+    }
+
+    s.progress.setPhase(PHASE_VERIFY)
+
+    var algorithm string
+    if s.settings.Verify != nil {
+        algorithm = s.settings.Verify.Algorithm
+    }
+
+    result := &VerifyResult{
+        Mismatches: make([]*VerifyMismatch, 0),
+    }
+    resultMutex := &sync.Mutex{}
+
+    var wg sync.WaitGroup = sync.WaitGroup{}
+
+tables:
+    for _, database := range s.databaseExporters() {
+        for _, tableName := range database.schema.Tables {
+            if s.isCancelled() {
+                break tables
+            }
+
+            tableKey := database.objectKey(tableName)
+
+            columns, ok := database.schema.TableColumns[tableName]
+            if !ok {
+                var err error
+                if columns, err = database.inspector.ColumnTypes(tableName); err != nil {
+                    s.fail(wrapExportError(PHASE_VERIFY, tableKey, "", err))
+                    break tables
+                }
+
+                database.schema.TableColumns[tableName] = columns
+            }
+
+            chunks, err := tableChunk.CalculateChunksForTable(tableName, database.tableCondition(tableName), s.settings.Export.TableChunkSize, database.inspector)
+            if err != nil {
+                s.fail(wrapExportError(PHASE_VERIFY, tableKey, "", err))
+                break tables
+            }
+
+            result.Tables++
+            result.Chunks += len(chunks)
+
+            for _, chunk := range chunks {
+                chunk.Database = database.database
+                wg.Add(1)
+
+                s.workPool.SendWorkAsync(&jobVerifyChunk{
+                    jobDatabase: database.jobDatabase(),
+                    tableName: chunk.TableName,
+                    condition: chunk.Condition,
+                    filter: database.tableCondition(tableName),
+                    columnInfo: database.verifiedColumns(tableName, columns),
+                    algorithm: algorithm,
+                }, func(chunk *tableChunk.Chunk) func(result interface{}, err error) {
+                    return func(jobResult interface{}, err error) {
+                        defer wg.Done()
+
+                        if err := jobError(jobResult, err); err == ErrDumpCancelled {
+                            return
+                        } else if err != nil {
+                            s.fail(wrapExportError(PHASE_VERIFY, chunk.Key(), chunk.Condition, err))
+                            return
+                        }
+
+                        checksum := jobResult.(*chunkChecksum)
+                        if checksum.equal() {
+                            return
+                        }
+
+                        log.Warnf("[verify][%s] Chunk [%s] differs: source %v rows (%s), target %v rows (%s)",
+                            chunk.Key(), chunk.Condition, checksum.sourceRows, checksum.sourceSum, checksum.targetRows, checksum.targetSum)
+
+                        resultMutex.Lock()
+                        defer resultMutex.Unlock()
+
+                        result.ChunksDiffer++
+                        result.Mismatches = append(result.Mismatches, &VerifyMismatch{
+                            Table: chunk.Key(),
+                            Chunk: chunk.Condition,
+                            SourceRows: checksum.sourceRows,
+                            TargetRows: checksum.targetRows,
+                            SourceChecksum: checksum.sourceSum,
+                            TargetChecksum: checksum.targetSum,
+                        })
+                    }
+                }(chunk))
+            }
+        }
+    }
+
+    log.Debugf("[verify] Waiting for chunks verification")
+    wg.Wait()
+
+    if s.isCancelled() {
+        return nil
+    }
+
+    s.verifyResult = result
+
+    if result.ChunksDiffer > 0 {
+        return wrapExportError(PHASE_VERIFY, "", "", fmt.Errorf("Verification failed: %v of %v chunks differ", result.ChunksDiffer, result.Chunks))
+    }
+
+    log.Infof("[verify] All %v chunks of %v tables are equal", result.Chunks, result.Tables)
+
+    return nil
+}
+// VerifyResult returns result of finished verification or nil if verification wasn't done
+func (s *exporter)VerifyResult() *VerifyResult {
+    return s.verifyResult
+}
@@ -9,46 +9,152 @@ import (
     "strconv"
     "strings"
     "github.com/hashicorp/go-version"
+    "context"
+    "io"
+    "github.com/LTD-Beget/besync/modes/proxy/tableChunk"
 )
 
+// Database of job. Worker switches its connections to it before job
+type jobDatabase struct {
+    sourceDb string   // empty if task copies single database, which connections already use
+    targetDb string
+    rename   *renamer // target names of objects of database
+}
+type databaseJob interface {
+    database() *jobDatabase
+}
+
+type jobCreateDatabase struct {
+    name      string // name on target
+    charset   string
+    collation string
+}
+type jobDropDatabase struct {
+    name string
+}
+// Moves tables of shadow databases into target databases
+type jobSwapTables struct {
+    databases []shadowSwap
+}
+type shadowSwap struct {
+    shadow string
+    target string
+}
+// Drops views, triggers and routines of shadow database and tables created for views
+type jobDropObjects struct {
+    jobDatabase
+    views []string
+}
 type jobCreateTable struct {
+    jobDatabase
     tableName     string
     withDropTable bool
+    ifNotExists   bool // existing table is kept
+    truncate      bool // delete rows of existing table
 }
 type jobCreateViewTable struct {
+    jobDatabase
     viewName     string
     withDropView bool
     columnInfo   map[string]*inspector.Column
 }
 type jobCreateView struct {
+    jobDatabase
     viewName string
 }
 type jobExportTable struct {
+    jobDatabase
     tableName   string
     condition   string
+    filter      string // condition of copied rows of table
+    masking     *tableMasking
     columnInfo  map[string]*inspector.Column
     rowsPerStmt int
+    chunkIndex  int
+    progress    *progress
+    onConflict  string
+    cleanup     bool // delete rows of chunk from target before export
 }
 type jobCreateTrigger struct {
+    jobDatabase
     triggerName     string
     withDropTrigger bool
 }
 type jobCreateProcedure struct {
+    jobDatabase
     procName string
     withDropProcedure bool
 }
+type jobCreateFunction struct {
+    jobDatabase
+    funcName         string
+    withDropFunction bool
+}
+type jobCreateEvent struct {
+    jobDatabase
+    eventName     string
+    withDropEvent bool
+}
+type jobVerifyChunk struct {
+    jobDatabase
+    tableName  string
+    condition  string
+    filter     string
+    columnInfo map[string]*inspector.Column
+    algorithm  string
+}
+
+// Executes statements of dump file or given statements. INSERTs are loaded with batch insert
+type jobImportStatements struct {
+    path        string
+    statements  func() (string, error) // used if path is empty
+    rowsPerStmt int
+    progress    *progress
+}
+
+func (d *jobDatabase)database() *jobDatabase {
+    return d
+}
+// Key of table in progress
+func (d *jobDatabase)tableKey(tableName string) string {
+    return tableChunk.TableKey(d.sourceDb, tableName)
+}
+
+// Result of jobExportTable
+type chunkCopied struct {
+    rows  int64
+    bytes int64
+}
+
+// Result of jobVerifyChunk
+type chunkChecksum struct {
+    sourceRows int64
+    targetRows int64
+    sourceSum  string
+    targetSum  string
+}
+
+func (c *chunkChecksum)equal() bool {
+    return c.sourceRows == c.targetRows && c.sourceSum == c.targetSum
+}
 
 type worker struct {
     inspector          inspector.Inspector
     sourceDb           *sql.DB
     targetDb           *sql.DB
+    output             *dumpOutput // set instead of targetDb if dump is written to file
     targetMysqlVersion *version.Version
     sourceMysqlVersion *version.Version
     withTransaction    bool
     maxAllowedPacket   int64
+    ctx                context.Context
+    rename             *renamer // target names of objects of current job
+    sourceDatabase     string   // databases selected by USE
+    targetDatabase     string
+    throttle           *workerThrottle // rate limits and load check of copied rows
 }
 
-func MakeWorker(sourceDb *sql.DB, sourceMysqlVersion *version.Version, withTransaction bool, targetDbSettings *DbSettings) (*worker, error) {
+func MakeWorker(ctx context.Context, sourceDb *sql.DB, sourceMysqlVersion *version.Version, withTransaction bool, targetDbSettings *DbSettings) (w *worker, err error) {
     mysqlConfig := &mysql.Config{
         User: targetDbSettings.User,
         Passwd: targetDbSettings.Password,
@@ -64,31 +170,29 @@ func MakeWorker(sourceDb *sql.DB, sourceMysqlVersion *version.Version, withTrans
         },
     }
 
+    if err := setMysqlTLS(mysqlConfig, targetDbSettings.TLS, targetDbSettings.Host); err != nil {
+        return nil, err
+    }
+
     targetDb, err := sql.Open("mysql", mysqlConfig.FormatDSN())
     if err != nil {
         return nil, err
     }
 
-    // starting transaction
-    if withTransaction {
-        transactionSupportVersion, err := version.NewVersion("4.0")
+    // database of connection may be switched by USE, so worker keeps single connection
+    targetDb.SetMaxOpenConns(1)
+
+    defer func() {
         if err != nil {
-            return nil, err
+            targetDb.Close()
         }
+    }()
 
-        if sourceMysqlVersion.LessThan(transactionSupportVersion) {
-            log.Infof("[worker] Cannot start transaction, because source mysql version lower than 4 (current version is %s)", sourceMysqlVersion)
-        } else {
-            if _, err := sourceDb.Exec("SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ"); err != nil {
-                return nil, err
-            }
-
-            if _, err := sourceDb.Exec("START TRANSACTION /*!40100 WITH CONSISTENT SNAPSHOT */"); err != nil {
-                return nil, err
-            }
+    // import workers don't read source
+    if sourceDb != nil {
+        if err := startSourceTransaction(sourceDb, sourceMysqlVersion, withTransaction); err != nil {
+            return nil, err
         }
-    } else {
-        log.Infof("[worker] We do not start transaction because settings")
     }
 
     // get max allowed packet
@@ -108,13 +212,14 @@ func MakeWorker(sourceDb *sql.DB, sourceMysqlVersion *version.Version, withTrans
     }
 
     inspector := inspector.MakeMysqlInspector(sourceDb, sourceMysqlVersion)
-    w := &worker{
+    w = &worker{
         inspector: inspector,
         sourceDb: sourceDb,
         targetDb: targetDb,
         sourceMysqlVersion: sourceMysqlVersion,
         withTransaction: withTransaction,
         maxAllowedPacket: int64(maxAllowedPacket * .9),
+        ctx: ctx,
     }
 
     // determine target mysql version
@@ -132,21 +237,93 @@ func MakeWorker(sourceDb *sql.DB, sourceMysqlVersion *version.Version, withTrans
 
     return w, nil
 }
+// MakeFileWorker makes worker, which writes dump to file instead of target database
+func MakeFileWorker(ctx context.Context, sourceDb *sql.DB, sourceMysqlVersion *version.Version, withTransaction bool, output *dumpOutput) (*worker, error) {
+    if err := startSourceTransaction(sourceDb, sourceMysqlVersion, withTransaction); err != nil {
+        return nil, err
+    }
+
+    return &worker{
+        inspector: inspector.MakeMysqlInspector(sourceDb, sourceMysqlVersion),
+        sourceDb: sourceDb,
+        output: output,
+        // dump is restored to the same mysql version in most cases
+        targetMysqlVersion: sourceMysqlVersion,
+        sourceMysqlVersion: sourceMysqlVersion,
+        withTransaction: withTransaction,
+        maxAllowedPacket: FILE_MAX_STATEMENT_SIZE,
+        ctx: ctx,
+    }, nil
+}
+func startSourceTransaction(sourceDb *sql.DB, sourceMysqlVersion *version.Version, withTransaction bool) error {
+    if !withTransaction {
+        log.Infof("[worker] We do not start transaction because settings")
+        return nil
+    }
+
+    transactionSupportVersion, err := version.NewVersion("4.0")
+    if err != nil {
+        return err
+    }
+
+    if sourceMysqlVersion.LessThan(transactionSupportVersion) {
+        log.Infof("[worker] Cannot start transaction, because source mysql version lower than 4 (current version is %s)", sourceMysqlVersion)
+        return nil
+    }
+
+    if _, err := sourceDb.Exec("SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ"); err != nil {
+        return err
+    }
+
+    if _, err := sourceDb.Exec("START TRANSACTION /*!40100 WITH CONSISTENT SNAPSHOT */"); err != nil {
+        return err
+    }
+
+    return nil
+}
 // Use this call to block further jobs if necessary
 func (w *worker) TunnyReady() bool {
     return true
 }
 // This is where the work actually happens
-func (w *worker) TunnyJob(job interface{}) interface{} {
+func (w *worker) TunnyJob(job interface{}) (result interface{}) {
     log.Debugf("[worker] Got work %+v", job)
 
+    metrics.jobStarted()
+    defer metrics.jobFinished()
+
+    // panic in worker goroutine cannot be recovered by exporter, so it's converted to job error
+    defer func() {
+        if r := recover(); r != nil {
+            log.Errorf("[worker] Job %+v panic: %v", job, r)
+            result = fmt.Errorf("[worker] Job panic: %v", r)
+        }
+    }()
+
+    if dbJob, ok := job.(databaseJob); ok {
+        if err := w.useDatabase(dbJob.database()); err != nil {
+            return err
+        }
+    }
+
     var err error
 
     switch job.(type) {
+    case *jobCreateDatabase:
+        err = w.createDatabase(job.(*jobCreateDatabase))
+    case *jobDropDatabase:
+        err = w.dropDatabase(job.(*jobDropDatabase))
+    case *jobSwapTables:
+        err = w.swapTables(job.(*jobSwapTables))
+    case *jobDropObjects:
+        err = w.dropObjects(job.(*jobDropObjects))
     case *jobCreateTable:
         err = w.createTable(job.(*jobCreateTable))
     case *jobExportTable:
-        err = w.exportTable(job.(*jobExportTable))
+        var copied *chunkCopied
+        if copied, err = w.exportTable(job.(*jobExportTable)); err == nil {
+            return copied
+        }
     case *jobCreateViewTable:
         err = w.createViewTable(job.(*jobCreateViewTable))
     case *jobCreateView:
@@ -155,65 +332,170 @@ func (w *worker) TunnyJob(job interface{}) interface{} {
         err = w.createTrigger(job.(*jobCreateTrigger))
     case *jobCreateProcedure:
         err = w.createProcedure(job.(*jobCreateProcedure))
+    case *jobCreateFunction:
+        err = w.createFunction(job.(*jobCreateFunction))
+    case *jobCreateEvent:
+        err = w.createEvent(job.(*jobCreateEvent))
+    case *jobImportStatements:
+        err = w.importStatements(job.(*jobImportStatements))
+    case *jobVerifyChunk:
+        var checksum *chunkChecksum
+        if checksum, err = w.verifyChunk(job.(*jobVerifyChunk)); err == nil {
+            return checksum
+        }
     default:
         err = fmt.Errorf("Unknown job %+b given", job)
     }
 
     return err
 }
-func (w *worker)TunnyInitialize() {}
+func (w *worker)TunnyInitialize() {
+    metrics.workerStarted()
+}
 func (w *worker)TunnyTerminate() {
+    defer metrics.workerStopped()
+    defer w.closeConnections()
+
     if !w.withTransaction {
         log.Debug("[worker] We don't need commit transaction because settings")
+        return
     }
 
-    log.Debugf("[worker] Committing transaction")
-    if _, err := w.sourceDb.Exec("COMMIT"); err != nil {
+    // source transaction is read only, so rollback after cancel just releases snapshot faster
+    finishSql := "COMMIT"
+    if w.isCancelled() {
+        finishSql = "ROLLBACK"
+    }
+
+    log.Debugf("[worker] Finishing transaction with %s", finishSql)
+    if _, err := w.sourceDb.Exec(finishSql); err != nil {
         log.Errorf("[woker] %v", err)
     }
 }
+func (w *worker)closeConnections() {
+    if w.sourceDb != nil {
+        if err := w.sourceDb.Close(); err != nil {
+            log.Errorf("[worker] Failed to close source connection: %v", err)
+        }
+    }
+
+    if w.targetDb == nil {
+        return
+    }
+
+    if err := w.targetDb.Close(); err != nil {
+        log.Errorf("[worker] Failed to close target connection: %v", err)
+    }
+}
+// Executes query on target database or writes it to section of dump
+func (w *worker)execTarget(section, query string) error {
+    if w.output != nil {
+        return w.output.Section(section).WriteStatement(query)
+    }
+
+    _, err := w.targetDb.Exec(query)
+    return err
+}
+// Same as execTarget, but for triggers and procedures, which need DELIMITER in dump file
+func (w *worker)execTargetRoutine(query string) error {
+    if w.output != nil {
+        return w.output.Section(SECTION_OBJECTS).WriteRoutine(query)
+    }
+
+    _, err := w.targetDb.Exec(query)
+    return err
+}
+func (w *worker)isCancelled() bool {
+    return w.ctx.Err() != nil
+}
+// Switches connections to databases of job. Databases of multi-database task are selected by USE,
+// connections of such task have no default database, so lost USE fails queries instead of using wrong database
+func (w *worker)useDatabase(database *jobDatabase) error {
+    w.rename = database.rename
+
+    if database.sourceDb != "" && database.sourceDb != w.sourceDatabase && w.sourceDb != nil {
+        if _, err := w.sourceDb.Exec(fmt.Sprintf("USE %s", quoteIdentifier(database.sourceDb))); err != nil {
+            return err
+        }
+
+        w.sourceDatabase = database.sourceDb
+    }
+
+    if database.targetDb != "" && database.targetDb != w.targetDatabase && w.targetDb != nil {
+        if _, err := w.targetDb.Exec(fmt.Sprintf("USE %s", quoteIdentifier(database.targetDb))); err != nil {
+            return err
+        }
+
+        w.targetDatabase = database.targetDb
+    }
+
+    return nil
+}
+func (w *worker)createDatabase(job *jobCreateDatabase) error {
+    query := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s /*!40100 DEFAULT CHARACTER SET %s COLLATE %s */",
+        quoteIdentifier(job.name), job.charset, job.collation)
+
+    log.Infof("[worker] CREATE DATABASE: [%s]", query)
+
+    return w.execTarget(SECTION_SCHEMA, query)
+}
 func (w *worker) createTable(job *jobCreateTable) error {
     createTableQuery, err := w.inspector.ShowCreateTable(job.tableName)
     if err != nil {
         return err
     }
 
+    createTableQuery = w.rename.createTable(job.tableName, createTableQuery)
+    targetTable := w.rename.table(job.tableName)
+
     if job.withDropTable {
-        _, err = w.targetDb.Exec(w.inspector.DropTableQuery(job.tableName))
-        if err != nil {
+        if err := w.execTarget(SECTION_SCHEMA, w.inspector.DropTableQuery(targetTable)); err != nil {
             return err
         }
     }
 
+    if job.ifNotExists && strings.HasPrefix(createTableQuery, "CREATE TABLE ") {
+        createTableQuery = "CREATE TABLE IF NOT EXISTS " + strings.TrimPrefix(createTableQuery, "CREATE TABLE ")
+    }
+
     log.Infof("[worker] CREATE TABLE: [%s]", createTableQuery)
 
-    _, err = w.targetDb.Exec(createTableQuery)
-    if err != nil {
+    if err := w.execTarget(SECTION_SCHEMA, createTableQuery); err != nil {
         return err
     }
 
+    if job.truncate {
+        log.Infof("[worker] Truncating table %s", targetTable)
+
+        if err := w.execTarget(SECTION_SCHEMA, w.inspector.TruncateTableQuery(targetTable)); err != nil {
+            return err
+        }
+    }
+
     return nil
 }
 // In this job we'r creating tables instead of views and saving name of views
 // In job createView we should drop view-table and create real view
 func (w *worker) createViewTable(job *jobCreateViewTable) error {
+    viewName := w.rename.table(job.viewName)
+
     if job.withDropView {
-        if err := w.dropView(job.viewName); err != nil {
+        if err := w.dropView(viewName); err != nil {
             return err
         }
     }
 
-    log.Debugf("[worker] Creating view %v as table to resolve dependencies & saving view name", job.viewName)
-    createTableSql := w.inspector.MakeCreateTableQuery(job.viewName, job.columnInfo)
+    log.Debugf("[worker] Creating view %v as table to resolve dependencies & saving view name", viewName)
+    createTableSql := w.inspector.MakeCreateTableQuery(viewName, job.columnInfo)
 
-    if _, err := w.targetDb.Exec(createTableSql); err != nil {
+    if err := w.execTarget(SECTION_OBJECTS, createTableSql); err != nil {
         return err
     }
 
     return nil
 }
 func (w *worker) createView(job *jobCreateView) error {
-    if err := w.dropView(job.viewName); err != nil {
+    if err := w.dropView(w.rename.table(job.viewName)); err != nil {
         return err
     }
 
@@ -221,8 +503,9 @@ func (w *worker) createView(job *jobCreateView) error {
     if err != nil {
         return err
     }
+    createViewSql = w.rename.definition(createViewSql)
 
-    if _, err := w.targetDb.Exec(createViewSql); err != nil {
+    if err := w.execTarget(SECTION_OBJECTS, createViewSql); err != nil {
         return err
     }
 
@@ -235,14 +518,15 @@ func (w *worker)createTrigger(job *jobCreateTrigger) error {
     if err != nil {
         return err
     }
+    createTriggerQuery = w.rename.definition(createTriggerQuery)
 
     if job.withDropTrigger {
-        if _, err := w.targetDb.Exec(w.inspector.DropTriggerQuery(job.triggerName)); err != nil {
+        if err := w.execTarget(SECTION_OBJECTS, w.inspector.DropTriggerQuery(job.triggerName)); err != nil {
             return err
         }
     }
 
-    if _, err = w.targetDb.Exec(createTriggerQuery); err != nil {
+    if err := w.execTargetRoutine(createTriggerQuery); err != nil {
         return err
     }
 
@@ -261,7 +545,7 @@ func (w *worker)createProcedure(job *jobCreateProcedure) error {
     if job.withDropProcedure {
         log.Debugf("[worker] Drop procedure `%s`", job.procName)
 
-        if _, err := w.targetDb.Exec(w.inspector.DropProcedureQuery(job.procName)); err != nil {
+        if err := w.execTarget(SECTION_OBJECTS, w.inspector.DropProcedureQuery(job.procName)); err != nil {
             return err
         }
     }
@@ -270,8 +554,9 @@ func (w *worker)createProcedure(job *jobCreateProcedure) error {
     if err != nil {
         return err
     }
+    createProcSql = w.rename.definition(createProcSql)
 
-    if _, err := w.targetDb.Exec(createProcSql); err != nil {
+    if err := w.execTargetRoutine(createProcSql); err != nil {
         return err
     }
 
@@ -279,32 +564,139 @@ func (w *worker)createProcedure(job *jobCreateProcedure) error {
 
     return nil
 }
+func (w *worker)createFunction(job *jobCreateFunction) error {
+    functionSupportVersion, _ := version.NewVersion("5.0")
+    if w.targetMysqlVersion.LessThan(functionSupportVersion) {
+        log.Warnf("[worker] Target mysql version %v is lower than 5. Stored Functions is not supported. Skipping function '%s'", w.targetMysqlVersion, job.funcName)
+        return nil
+    }
+
+    if job.withDropFunction {
+        log.Debugf("[worker] Drop function `%s`", job.funcName)
+
+        if err := w.execTarget(SECTION_OBJECTS, w.inspector.DropFunctionQuery(job.funcName)); err != nil {
+            return err
+        }
+    }
+
+    createFuncSql, err := w.inspector.ShowCreateFunction(job.funcName)
+    if err != nil {
+        return err
+    }
+    createFuncSql = w.rename.definition(createFuncSql)
+
+    if err := w.execTargetRoutine(createFuncSql); err != nil {
+        return err
+    }
+
+    log.Infof("[worker] Processed function: %s", job.funcName)
+
+    return nil
+}
+// Event keeps its status, so enabled event is run by scheduler of target
+func (w *worker)createEvent(job *jobCreateEvent) error {
+    eventSupportVersion, _ := version.NewVersion("5.1.6")
+    if w.targetMysqlVersion.LessThan(eventSupportVersion) {
+        log.Warnf("[worker] Target mysql version %v is lower than 5.1.6. Events is not supported. Skipping event '%s'", w.targetMysqlVersion, job.eventName)
+        return nil
+    }
+
+    if job.withDropEvent {
+        log.Debugf("[worker] Drop event `%s`", job.eventName)
+
+        if err := w.execTarget(SECTION_OBJECTS, w.inspector.DropEventQuery(job.eventName)); err != nil {
+            return err
+        }
+    }
+
+    createEventSql, err := w.inspector.ShowCreateEvent(job.eventName)
+    if err != nil {
+        return err
+    }
+    createEventSql = w.rename.definition(createEventSql)
+
+    if err := w.execTargetRoutine(createEventSql); err != nil {
+        return err
+    }
+
+    log.Infof("[worker] Processed event: %s", job.eventName)
+
+    return nil
+}
 func (w *worker)dropView(viewName string) error {
-    if _, err := w.targetDb.Exec(w.inspector.DropTableQuery(viewName)); err != nil {
+    if err := w.execTarget(SECTION_OBJECTS, w.inspector.DropTableQuery(viewName)); err != nil {
         return err
     }
 
     viewSupportVersion, _ := version.NewVersion("5.0")
     if w.targetMysqlVersion.LessThan(viewSupportVersion) {
-        log.Warnf("[worker] Target mysql version %v is lower than 5. Views is not supported. Skipping procedure '%s'")
+        log.Warnf("[worker] Target mysql version %v is lower than 5. Views is not supported. Skipping view '%s'", w.targetMysqlVersion, viewName)
         return nil
     }
 
-    if _, err := w.targetDb.Exec(w.inspector.DropViewQuery(viewName)); err != nil {
+    if err := w.execTarget(SECTION_OBJECTS, w.inspector.DropViewQuery(viewName)); err != nil {
         return err
     }
 
     return nil
 }
-func (w *worker) exportTable(job *jobExportTable) error {
-    batchInsert := MakeBatchInsert(job.rowsPerStmt, job.tableName, job.columnInfo, w.targetDb, w.maxAllowedPacket)
+func (w *worker) exportTable(job *jobExportTable) (copied *chunkCopied, err error) {
+    targetTable := w.rename.table(job.tableName)
+    targetColumns := w.rename.columnInfo(job.tableName, job.columnInfo)
+
+    var batchInsert *batchInsert
+    if w.output != nil {
+        dataFile, fileErr := w.output.DataFile(job.tableName, job.chunkIndex)
+        if fileErr != nil {
+            return nil, fileErr
+        }
+
+        defer func() {
+            if releaseErr := w.output.ReleaseDataFile(job.tableName, dataFile); releaseErr != nil && err == nil {
+                err = releaseErr
+            }
+        }()
+
+        batchInsert = MakeFileBatchInsert(job.rowsPerStmt, targetTable, targetColumns, dataFile, w.maxAllowedPacket)
+    } else {
+        batchInsert = MakeBatchInsert(job.rowsPerStmt, targetTable, targetColumns, w.targetDb, w.maxAllowedPacket)
+    }
+    batchInsert.Throttle(w.throttle)
+
+    // unique keys are not updated, rows are found by them
+    var keyColumns []string
+    if job.onConflict == ON_CONFLICT_UPDATE {
+        if keyColumns, err = w.inspector.UniqueColumns(job.tableName); err != nil {
+            return nil, err
+        }
+
+        for i, column := range keyColumns {
+            keyColumns[i] = w.rename.column(job.tableName, column)
+        }
+    }
+    batchInsert.OnConflict(job.onConflict, keyColumns)
+    if job.progress != nil {
+        batchInsert.OnFlush(func(rows int, size int64) {
+            job.progress.addRows(job.tableKey(job.tableName), rows, size)
+        })
+    }
 
     selectStmt := w.getColumnStmt(job.columnInfo, true)
+    copied = &chunkCopied{}
 
     // Execute the query
     var whereCond string
-    if job.condition != "" {
-        whereCond = fmt.Sprintf(" WHERE %s", job.condition)
+    if condition := combineConditions(job.condition, job.filter); condition != "" {
+        whereCond = fmt.Sprintf(" WHERE %s", condition)
+    }
+
+    if job.cleanup {
+        deleteSql := fmt.Sprintf("DELETE FROM `%v`%s", targetTable, w.rename.condition(job.tableName, job.columnInfo, whereCond))
+        log.Infof("[worker] Deleting rows of interrupted chunk: [%s]", deleteSql)
+
+        if _, err := w.targetDb.Exec(deleteSql); err != nil {
+            return nil, err
+        }
     }
 
     query := fmt.Sprintf("SELECT %v FROM `%v`%s", selectStmt, job.tableName, whereCond)
@@ -312,13 +704,15 @@ func (w *worker) exportTable(job *jobExportTable) error {
 
     rows, err := w.sourceDb.Query(query)
     if err != nil {
-        return err
+        return nil, err
     }
+    // source db has one connection, it must be released on any error, so TunnyTerminate can finish transaction
+    defer rows.Close()
 
     // Get column names
     columns, err := rows.Columns()
     if err != nil {
-        return err
+        return nil, err
     }
 
     // Make a slice for the values
@@ -334,11 +728,19 @@ func (w *worker) exportTable(job *jobExportTable) error {
 
     // Fetch rows
     for rows.Next() {
+        if w.isCancelled() {
+            return nil, ErrDumpCancelled
+        }
+
+        if err := w.throttle.waitLoad(); err != nil {
+            return nil, err
+        }
+
         // get RawBytes from data
         err = rows.Scan(scanArgs...)
 
         if err != nil {
-            return err
+            return nil, err
         }
 
         var size int64
@@ -354,25 +756,215 @@ func (w *worker) exportTable(job *jobExportTable) error {
             }
         }
 
+        if job.masking != nil {
+            job.masking.apply(rowValues)
+            size = rowSize(rowValues)
+        }
+
         // insert
         if err := batchInsert.Insert(rowValues, size); err != nil {
-            return err
+            return nil, err
         }
+
+        copied.rows++
+        copied.bytes += size
     }
 
     if err = rows.Err(); err != nil {
-        return err
+        return nil, err
     }
 
     if err := batchInsert.Flush(); err != nil {
-        return err
+        return nil, err
     }
 
     if err := batchInsert.Close(); err != nil {
-        return err
+        return nil, err
     }
 
-    return nil
+    return copied, nil
+}
+func rowSize(rowValues []interface{}) int64 {
+    var size int64
+    for _, value := range rowValues {
+        if data, ok := value.([]byte); ok {
+            size += int64(len(data))
+        }
+    }
+
+    return size
+}
+// Calculates checksum of chunk on source and target at the same time
+func (w *worker)verifyChunk(job *jobVerifyChunk) (*chunkChecksum, error) {
+    if w.isCancelled() {
+        return nil, ErrDumpCancelled
+    }
+
+    condition := combineConditions(job.condition, job.filter)
+
+    query, err := w.inspector.ChecksumQuery(job.tableName, job.columnInfo, condition, job.algorithm)
+    if err != nil {
+        return nil, err
+    }
+
+    targetQuery, err := w.inspector.ChecksumQuery(w.rename.table(job.tableName), w.rename.columnInfo(job.tableName, job.columnInfo),
+        w.rename.condition(job.tableName, job.columnInfo, condition), job.algorithm)
+    if err != nil {
+        return nil, err
+    }
+
+    log.Debugf("[worker] Verify chunk with query: [%s]", query)
+
+    checksum := &chunkChecksum{}
+
+    var targetErr error
+    targetDone := make(chan struct{})
+
+    go func() {
+        defer close(targetDone)
+        targetErr = w.targetDb.QueryRow(targetQuery).Scan(&checksum.targetRows, &checksum.targetSum)
+    }()
+
+    sourceErr := w.sourceDb.QueryRow(query).Scan(&checksum.sourceRows, &checksum.sourceSum)
+
+    <-targetDone
+
+    if sourceErr != nil {
+        return nil, sourceErr
+    }
+
+    if targetErr != nil {
+        return nil, targetErr
+    }
+
+    return checksum, nil
+}
+func (w *worker)importStatements(job *jobImportStatements) (err error) {
+    next := job.statements
+
+    if job.path != "" {
+        script, openErr := openSqlScript(job.path)
+        if openErr != nil {
+            return openErr
+        }
+        defer script.Close()
+
+        next = makeSqlScanner(script).Next
+    }
+
+    // rows of sequential INSERTs into the same columns are joined
+    var batchInsert *batchInsert
+    var batchKey string
+
+    closeBatch := func() error {
+        if batchInsert == nil {
+            return nil
+        }
+
+        defer func() {
+            batchInsert = nil
+        }()
+
+        if err := batchInsert.Flush(); err != nil {
+            batchInsert.Close()
+            return err
+        }
+
+        return batchInsert.Close()
+    }
+
+    defer func() {
+        if closeErr := closeBatch(); closeErr != nil && err == nil {
+            err = closeErr
+        }
+    }()
+
+    for {
+        if w.isCancelled() {
+            return ErrDumpCancelled
+        }
+
+        query, err := next()
+        if err == io.EOF {
+            return nil
+        } else if err != nil {
+            return err
+        }
+
+        if isLockStatement(query) {
+            log.Debugf("[worker] Skipping [%s]", query)
+            continue
+        }
+
+        if !isInsertStatement(query) {
+            if err := closeBatch(); err != nil {
+                return err
+            }
+
+            if _, err := w.targetDb.Exec(query); err != nil {
+                return err
+            }
+
+            continue
+        }
+
+        stmt, err := parseInsert(query)
+        if err != nil {
+            return err
+        }
+
+        // columns of ON DUPLICATE KEY UPDATE are not known to batch insert
+        if stmt.update != "" {
+            if err := closeBatch(); err != nil {
+                return err
+            }
+
+            if _, err := w.targetDb.Exec(query); err != nil {
+                return err
+            }
+
+            if job.progress != nil {
+                var size int64
+                for _, rowSize := range stmt.sizes {
+                    size += rowSize
+                }
+
+                job.progress.addRows(stmt.table, len(stmt.rows), size)
+            }
+
+            continue
+        }
+
+        key := fmt.Sprintf("%s %s(%s)", stmt.onConflict, stmt.table, strings.Join(stmt.columns, ","))
+
+        if batchInsert == nil || batchKey != key {
+            if err := closeBatch(); err != nil {
+                return err
+            }
+
+            columnInfo := make(map[string]*inspector.Column, len(stmt.columns))
+            for i, name := range stmt.columns {
+                columnInfo[name] = &inspector.Column{Name: name, Index: i}
+            }
+
+            batchInsert = MakeBatchInsert(job.rowsPerStmt, stmt.table, columnInfo, w.targetDb, w.maxAllowedPacket)
+            batchInsert.OnConflict(stmt.onConflict, nil)
+            batchKey = key
+
+            if job.progress != nil {
+                tableName := stmt.table
+                batchInsert.OnFlush(func(rows int, size int64) {
+                    job.progress.addRows(tableName, rows, size)
+                })
+            }
+        }
+
+        for i, row := range stmt.rows {
+            if err := batchInsert.Insert(row, stmt.sizes[i]); err != nil {
+                return err
+            }
+        }
+    }
 }
 func (w *worker)getColumnStmt(columns map[string]*inspector.Column, hexBlob bool) string {
     sortedColumns := inspector.SortColumnsByIndex(columns)